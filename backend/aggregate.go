@@ -0,0 +1,661 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var ErrShardedAggregate = errors.New("only count, sum, min, max and mean of a field can be aggregated across backends unless grouped by * or all shard tags")
+
+var (
+	aliasRegexp = regexp.MustCompile(`(?is)^(.*?)\s+as\s+("(?:[^"\\]|\\.)*"|[^\s"]+)$`)
+	callRegexp  = regexp.MustCompile(`(?is)^(\w+)\s*\((.*)\)$`)
+)
+
+// shardedAggregate is an aggregation of the select statement combined from the results of backends,
+// mean is combined by the sum and count queried in the backends.
+type shardedAggregate struct {
+	fn      string
+	column  string
+	columns []string
+}
+
+// shardedQuery is the select statement rewritten for the measurements sharded by tags, which is queried in all backends
+// of a circle, the limit, offset and fill of the aggregations are applied after merging.
+type shardedQuery struct {
+	query  string
+	aggs   []*shardedAggregate
+	desc   bool
+	limit  int
+	offset int
+	fill   string
+}
+
+// clauseToken is a word or a parenthesized group of the select statement outside the quotes and regexes, with its position.
+type clauseToken struct {
+	text       string
+	start, end int
+}
+
+// queryEdit replaces the text of the statement between start and end.
+type queryEdit struct {
+	start, end int
+	text       string
+}
+
+// newShardedQuery rewrites the select statement q for the measurements sharded by the tags. The aggregations are rewritten
+// to be combined unless the statement is grouped by * or all the tags, since each series is stored in one backend then.
+// The backends are queried with fill(null) for the aggregations, and fill(previous) or fill(number) is applied after merging.
+func newShardedQuery(q string, tags []string) (*shardedQuery, error) {
+	q = strings.TrimRight(strings.TrimSpace(q), "; ")
+	start := findFromClause(q)
+	if start < 0 || len(q) < 6 || !strings.EqualFold(q[:6], "select") {
+		return nil, ErrIllegalQL
+	}
+	tokens, err := scanClauseTokens(q, start)
+	if err != nil {
+		return nil, err
+	}
+	sq := &shardedQuery{}
+	var edits []queryEdit
+	var dims string
+	var fill *clauseToken
+	for i, token := range tokens {
+		switch strings.ToLower(token.text) {
+		case "group":
+			if clauseWordAt(tokens, i+1, "by") {
+				dims = q[tokens[i+1].end:groupByEnd(q, tokens, i+2)]
+			}
+		case "order":
+			sq.desc = clauseWordAt(tokens, i+1, "by") && clauseWordAt(tokens, i+2, "time") && clauseWordAt(tokens, i+3, "desc")
+		case "fill":
+			if i+1 < len(tokens) && tokens[i+1].text[0] == '(' {
+				fill = &tokens[i+1]
+			}
+		case "limit":
+			if i+1 < len(tokens) {
+				sq.limit, _ = strconv.Atoi(tokens[i+1].text)
+			}
+		case "offset":
+			if i+1 < len(tokens) {
+				sq.offset, _ = strconv.Atoi(tokens[i+1].text)
+				// the offset is removed with the spaces before it
+				edits = append(edits, queryEdit{start: len(strings.TrimRightFunc(q[:token.start], unicode.IsSpace)), end: tokens[i+1].end})
+			}
+		}
+	}
+	if sq.limit > 0 && sq.offset > 0 {
+		for i, token := range tokens {
+			if strings.EqualFold(token.text, "limit") && i+1 < len(tokens) {
+				edits = append(edits, queryEdit{start: tokens[i+1].start, end: tokens[i+1].end, text: strconv.Itoa(sq.limit + sq.offset)})
+			}
+		}
+	}
+
+	fields, err := splitFields(q[len("select") : start-len("from")])
+	if err != nil {
+		return nil, err
+	}
+	if !groupsByTags(dims, tags) {
+		sq.aggs, fields, err = rewriteAggregates(fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sq.aggs != nil && fill != nil {
+		// the filled values of the backends can't be combined
+		switch arg := strings.ToLower(strings.TrimSpace(fill.text[1 : len(fill.text)-1])); arg {
+		case "null", "none":
+		case "previous":
+			sq.fill = arg
+		case "linear":
+			return nil, ErrShardedAggregate
+		default:
+			if _, err = strconv.ParseFloat(arg, 64); err != nil {
+				return nil, ErrShardedAggregate
+			}
+			sq.fill = arg
+		}
+		if sq.fill != "" {
+			edits = append(edits, queryEdit{start: fill.start, end: fill.end, text: "(null)"})
+		}
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, edit := range edits {
+		q = q[:edit.start] + edit.text + q[edit.end:]
+	}
+	sq.query = "select " + strings.Join(fields, ", ") + " from" + q[start:]
+	return sq, nil
+}
+
+// scanClauseTokens returns the words and parenthesized groups of q from position start,
+// the quoted identifiers, strings and regexes are skipped.
+func scanClauseTokens(q string, start int) (tokens []clauseToken, err error) {
+	data := []byte(q)
+	for i := start; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '"' || c == '\'' || c == '/' && isRegexStart(data, i):
+			if i, err = findEndWithQuoteOrRegex(data, i); err != nil {
+				return nil, err
+			}
+		case c == '(':
+			end, err := findEndWithParen(data, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, clauseToken{text: q[i:end], start: i, end: end})
+			i = end
+		case isIdentChar(c):
+			end := i + 1
+			for end < len(data) && isIdentChar(data[end]) {
+				end++
+			}
+			tokens = append(tokens, clauseToken{text: q[i:end], start: i, end: end})
+			i = end
+		default:
+			i++
+		}
+	}
+	return
+}
+
+// findEndWithParen returns the end of the parenthesized group starting at position start of data.
+func findEndWithParen(data []byte, start int) (int, error) {
+	depth := 0
+	for i := start; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '"' || c == '\'' || c == '/' && isRegexStart(data, i):
+			end, err := findEndWithQuoteOrRegex(data, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end - 1
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, ErrUnclosed
+}
+
+func clauseWordAt(tokens []clauseToken, i int, word string) bool {
+	return i < len(tokens) && strings.EqualFold(tokens[i].text, word)
+}
+
+// groupByEnd returns the end of the dimensions of group by, which are followed by the other clauses from tokens[i].
+func groupByEnd(q string, tokens []clauseToken, i int) int {
+	for ; i < len(tokens); i++ {
+		switch strings.ToLower(tokens[i].text) {
+		case "fill", "order", "limit", "offset", "slimit", "soffset", "tz":
+			return tokens[i].start
+		}
+	}
+	return len(q)
+}
+
+// splitFields splits the fields of select by the commas outside the quotes and parentheses.
+func splitFields(s string) (fields []string, err error) {
+	data := []byte(s)
+	depth, start := 0, 0
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '"', '\'':
+			end, _, err := FindEndWithQuote(data, i, data[i])
+			if err != nil {
+				return nil, err
+			}
+			i = end - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				fields = append(fields, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	fields = append(fields, strings.TrimSpace(s[start:]))
+	for _, field := range fields {
+		if field == "" {
+			return nil, ErrIllegalQL
+		}
+	}
+	return fields, nil
+}
+
+// groupsByTags returns whether the dimensions of group by contain * or all the tags.
+func groupsByTags(dims string, tags []string) bool {
+	if strings.TrimSpace(dims) == "" {
+		return false
+	}
+	fields, err := splitFields(dims)
+	if err != nil {
+		return false
+	}
+	set := util.NewSet()
+	for _, dim := range fields {
+		if len(dim) >= 2 && dim[0] == '"' && dim[len(dim)-1] == '"' {
+			dim = util.UnescapeIdentifier(dim[1 : len(dim)-1])
+		}
+		if dim == "*" {
+			return true
+		}
+		set.Add(dim)
+	}
+	for _, tag := range tags {
+		if !set[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// rewriteAggregates rewrites the aggregations of fields with the internal aliases, and names the columns like influxdb.
+// It returns nil if there are no aggregations.
+func rewriteAggregates(fields []string) ([]*shardedAggregate, []string, error) {
+	var aggs []*shardedAggregate
+	var rewritten []string
+	aliases := make([]string, len(fields))
+	for i, field := range fields {
+		expr := field
+		if m := aliasRegexp.FindStringSubmatch(field); m != nil {
+			expr, aliases[i] = strings.TrimSpace(m[1]), m[2]
+			if aliases[i][0] == '"' {
+				aliases[i] = util.UnescapeIdentifier(aliases[i][1 : len(aliases[i])-1])
+			}
+		}
+		m := callRegexp.FindStringSubmatch(expr)
+		if m == nil {
+			if aggs != nil {
+				return nil, nil, ErrShardedAggregate
+			}
+			continue
+		}
+		fn, arg := strings.ToLower(m[1]), strings.TrimSpace(m[2])
+		switch fn {
+		case "count", "sum", "min", "max", "mean":
+		default:
+			return nil, nil, ErrShardedAggregate
+		}
+		if arg == "" || arg == "*" || arg[0] == '/' || strings.Contains(arg, "(") {
+			return nil, nil, ErrShardedAggregate
+		}
+		if i > 0 && aggs == nil {
+			return nil, nil, ErrShardedAggregate
+		}
+		agg := &shardedAggregate{fn: fn}
+		if fn == "mean" {
+			agg.columns = []string{fmt.Sprintf("_%d_sum", i), fmt.Sprintf("_%d_count", i)}
+			rewritten = append(rewritten, fmt.Sprintf("sum(%s) as \"%s\"", arg, agg.columns[0]), fmt.Sprintf("count(%s) as \"%s\"", arg, agg.columns[1]))
+		} else {
+			agg.columns = []string{fmt.Sprintf("_%d_%s", i, fn)}
+			rewritten = append(rewritten, fmt.Sprintf("%s(%s) as \"%s\"", fn, arg, agg.columns[0]))
+		}
+		aggs = append(aggs, agg)
+	}
+	if aggs == nil {
+		return nil, fields, nil
+	}
+
+	// the aliases are resolved first, then the conflicts of function names are resolved by suffixes
+	names := make(map[string]int)
+	for _, alias := range aliases {
+		if alias != "" {
+			names[alias] = 1
+		}
+	}
+	for i, agg := range aggs {
+		if aliases[i] != "" {
+			agg.column = aliases[i]
+			continue
+		}
+		count, conflict := names[agg.fn]
+		if !conflict {
+			names[agg.fn] = 1
+			agg.column = agg.fn
+			continue
+		}
+		for {
+			name := fmt.Sprintf("%s_%d", agg.fn, count)
+			if _, conflict = names[name]; !conflict {
+				names[agg.fn] = count + 1
+				names[name] = 1
+				agg.column = name
+				break
+			}
+			count++
+		}
+	}
+	return aggs, rewritten, nil
+}
+
+type mergedSeries struct {
+	row    *models.Row
+	parts  int
+	times  map[string]int
+	accums [][]*accumulator
+}
+
+// merge merges the series of the same name and tags from the results of backends, the aggregations are combined by time,
+// and the values are sorted by time if they are from multiple backends.
+func (sq *shardedQuery) merge(bodies [][]byte) (*Response, error) {
+	var keys []string
+	merged := make(map[string]*mergedSeries)
+	result := &Result{}
+	for _, b := range bodies {
+		rsp, err := ResponseFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if rsp.Err != "" {
+			return rsp, nil
+		}
+		if len(rsp.Results) == 0 {
+			continue
+		}
+		if rsp.Results[0].Err != "" {
+			return rsp, nil
+		}
+		result.Messages = append(result.Messages, rsp.Results[0].Messages...)
+		result.Partial = result.Partial || rsp.Results[0].Partial
+		for _, serie := range rsp.Results[0].Series {
+			key := serie.Name + "\x00" + string(models.NewTags(serie.Tags).HashKey())
+			ms, ok := merged[key]
+			if !ok {
+				ms = &mergedSeries{row: &models.Row{Name: serie.Name, Tags: serie.Tags}, times: make(map[string]int)}
+				merged[key] = ms
+				keys = append(keys, key)
+			}
+			ms.parts++
+			if sq.aggs != nil {
+				if err = sq.accumulate(ms, serie); err != nil {
+					return nil, err
+				}
+			} else {
+				appendValues(ms.row, serie)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		ms := merged[key]
+		if sq.aggs != nil {
+			ms.row.Columns = []string{"time"}
+			for _, agg := range sq.aggs {
+				ms.row.Columns = append(ms.row.Columns, agg.column)
+			}
+			for i, accums := range ms.accums {
+				for j, acc := range accums {
+					ms.row.Values[i][j+1] = acc.value()
+				}
+			}
+		}
+		if ms.parts > 1 && len(ms.row.Values) > 1 && len(ms.row.Columns) > 0 && ms.row.Columns[0] == "time" {
+			sort.SliceStable(ms.row.Values, func(i, j int) bool {
+				if sq.desc {
+					return timeOf(ms.row.Values[i][0]) > timeOf(ms.row.Values[j][0])
+				}
+				return timeOf(ms.row.Values[i][0]) < timeOf(ms.row.Values[j][0])
+			})
+		}
+		if sq.aggs != nil && sq.fill != "" {
+			sq.fillValues(ms.row.Values)
+		}
+		if sq.offset > 0 || sq.limit > 0 {
+			if sq.offset >= len(ms.row.Values) {
+				ms.row.Values = nil
+			} else {
+				ms.row.Values = ms.row.Values[sq.offset:]
+			}
+			if sq.limit > 0 && sq.limit < len(ms.row.Values) {
+				ms.row.Values = ms.row.Values[:sq.limit]
+			}
+		}
+		result.Series = append(result.Series, ms.row)
+	}
+	sort.SliceStable(result.Series, func(i, j int) bool {
+		si, sj := result.Series[i], result.Series[j]
+		return si.Name < sj.Name || si.Name == sj.Name && string(models.NewTags(si.Tags).HashKey()) < string(models.NewTags(sj.Tags).HashKey())
+	})
+	return &Response{Results: []*Result{result}}, nil
+}
+
+// fillValues fills the null aggregations of the values sorted by time, since the backends are queried with fill(null).
+func (sq *shardedQuery) fillValues(values [][]interface{}) {
+	for j := 1; j <= len(sq.aggs); j++ {
+		var prev interface{}
+		for n := range values {
+			i := n
+			if sq.desc {
+				i = len(values) - 1 - n
+			}
+			switch {
+			case values[i][j] != nil:
+				prev = values[i][j]
+			case sq.fill == "previous":
+				values[i][j] = prev
+			default:
+				values[i][j] = json.Number(sq.fill)
+			}
+		}
+	}
+}
+
+func (sq *shardedQuery) accumulate(ms *mergedSeries, serie *models.Row) error {
+	index := make(map[string]int, len(serie.Columns))
+	for i, col := range serie.Columns {
+		index[col] = i
+	}
+	for _, agg := range sq.aggs {
+		for _, col := range agg.columns {
+			if _, ok := index[col]; !ok {
+				return fmt.Errorf("column %s not found in the result of backend", col)
+			}
+		}
+	}
+	for _, value := range serie.Values {
+		tk := fmt.Sprint(value[0])
+		i, ok := ms.times[tk]
+		if !ok {
+			i = len(ms.row.Values)
+			ms.times[tk] = i
+			ms.row.Values = append(ms.row.Values, make([]interface{}, len(sq.aggs)+1))
+			ms.row.Values[i][0] = value[0]
+			accums := make([]*accumulator, len(sq.aggs))
+			for j, agg := range sq.aggs {
+				accums[j] = &accumulator{fn: agg.fn}
+			}
+			ms.accums = append(ms.accums, accums)
+		}
+		for j, agg := range sq.aggs {
+			acc := ms.accums[i][j]
+			if agg.fn == "mean" {
+				acc.addSum(value[index[agg.columns[0]]])
+				acc.addCount(value[index[agg.columns[1]]])
+				continue
+			}
+			v := value[index[agg.columns[0]]]
+			switch agg.fn {
+			case "count":
+				acc.addCount(v)
+			case "sum":
+				acc.addSum(v)
+			case "min", "max":
+				acc.addExtreme(v)
+			}
+		}
+	}
+	return nil
+}
+
+// appendValues appends the values of serie to row, the columns of row are extended if they are different.
+func appendValues(row *models.Row, serie *models.Row) {
+	if row.Columns == nil {
+		row.Columns = serie.Columns
+		row.Values = append(row.Values, serie.Values...)
+		return
+	}
+	if equalColumns(row.Columns, serie.Columns) {
+		row.Values = append(row.Values, serie.Values...)
+		return
+	}
+	columns := util.NewSetFromSlice(row.Columns[1:])
+	for _, col := range serie.Columns[1:] {
+		columns.Add(col)
+	}
+	union := make([]string, 0, len(columns)+1)
+	for col := range columns {
+		union = append(union, col)
+	}
+	sort.Strings(union)
+	union = append([]string{row.Columns[0]}, union...)
+	row.Values = remapValues(row.Columns, union, row.Values)
+	row.Values = append(row.Values, remapValues(serie.Columns, union, serie.Values)...)
+	row.Columns = union
+}
+
+func equalColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func remapValues(columns, union []string, values [][]interface{}) [][]interface{} {
+	index := make(map[string]int, len(union))
+	for i, col := range union {
+		index[col] = i
+	}
+	remapped := make([][]interface{}, len(values))
+	for i, value := range values {
+		remapped[i] = make([]interface{}, len(union))
+		for j, col := range columns {
+			if j < len(value) {
+				remapped[i][index[col]] = value[j]
+			}
+		}
+	}
+	return remapped
+}
+
+// timeOf returns the time of value in epoch or RFC3339 format, for sorting only.
+func timeOf(v interface{}) int64 {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return int64(f)
+	case string:
+		if ts, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return ts.UnixNano()
+		}
+	}
+	return 0
+}
+
+type accumulator struct {
+	fn      string
+	count   int64
+	isum    int64
+	fsum    float64
+	isFloat bool
+	hasSum  bool
+	hasCnt  bool
+	extreme interface{}
+	ext     float64
+}
+
+func (acc *accumulator) addCount(v interface{}) {
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			acc.count += i
+			acc.hasCnt = true
+		}
+	}
+}
+
+func (acc *accumulator) addSum(v interface{}) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return
+	}
+	acc.hasSum = true
+	if i, err := n.Int64(); err == nil && !acc.isFloat {
+		acc.isum += i
+		return
+	}
+	if !acc.isFloat {
+		acc.isFloat = true
+		acc.fsum = float64(acc.isum)
+	}
+	f, _ := n.Float64()
+	acc.fsum += f
+}
+
+func (acc *accumulator) addExtreme(v interface{}) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return
+	}
+	if acc.extreme == nil || acc.fn == "min" && f < acc.ext || acc.fn == "max" && f > acc.ext {
+		acc.extreme, acc.ext = n, f
+	}
+}
+
+func (acc *accumulator) value() interface{} {
+	switch acc.fn {
+	case "count":
+		if acc.hasCnt {
+			return acc.count
+		}
+	case "sum":
+		if acc.hasSum && acc.isFloat {
+			return acc.fsum
+		} else if acc.hasSum {
+			return acc.isum
+		}
+	case "min", "max":
+		return acc.extreme
+	case "mean":
+		if acc.count > 0 {
+			if acc.isFloat {
+				return acc.fsum / float64(acc.count)
+			}
+			return float64(acc.isum) / float64(acc.count)
+		}
+	}
+	return nil
+}
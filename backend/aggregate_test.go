@@ -0,0 +1,208 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestNewShardedQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		q     string
+		query string
+		aggs  []string
+	}{
+		{
+			name:  "raw",
+			q:     "select value from cpu where time > now() - 1h order by time desc limit 10 offset 5",
+			query: "select value from cpu where time > now() - 1h order by time desc limit 15",
+		},
+		{
+			name:  "aggregations",
+			q:     "SELECT count(value), sum(value), min(value), max(value), mean(value) FROM cpu WHERE time > now() - 1h GROUP BY time(1m) fill(none);",
+			query: `select count(value) as "_0_count", sum(value) as "_1_sum", min(value) as "_2_min", max(value) as "_3_max", sum(value) as "_4_sum", count(value) as "_4_count" from cpu WHERE time > now() - 1h GROUP BY time(1m) fill(none)`,
+			aggs:  []string{"count", "sum", "min", "max", "mean"},
+		},
+		{
+			name:  "aliases and conflicts",
+			q:     `select mean(value) as "avg", max(a), max(b), max(c) as max_1 from cpu group by time(1m), region`,
+			query: `select sum(value) as "_0_sum", count(value) as "_0_count", max(a) as "_1_max", max(b) as "_2_max", max(c) as "_3_max" from cpu group by time(1m), region`,
+			aggs:  []string{"avg", "max", "max_2", "max_1"},
+		},
+		{
+			name:  "group by shard tag",
+			q:     `select percentile(value, 95) from cpu group by time(1m), "host"`,
+			query: `select percentile(value, 95) from cpu group by time(1m), "host"`,
+		},
+		{
+			name:  "group by all",
+			q:     `select last(value) from cpu group by *`,
+			query: `select last(value) from cpu group by *`,
+		},
+		{
+			name:  "clauses in string and regex",
+			q:     `select value from cpu where msg = 'x limit 5 offset 1 order by time desc' and host =~ /group by host/ limit 2 offset 1`,
+			query: `select value from cpu where msg = 'x limit 5 offset 1 order by time desc' and host =~ /group by host/ limit 3`,
+		},
+		{
+			name:  "group by in regex",
+			q:     `select count(value) from cpu where host =~ /group by host/ group by time(1m) limit 5`,
+			query: `select count(value) as "_0_count" from cpu where host =~ /group by host/ group by time(1m) limit 5`,
+			aggs:  []string{"count"},
+		},
+		{
+			name:  "fill number",
+			q:     "select max(value), mean(value) from cpu where time > now() - 1h group by time(1m) fill(0) tz('UTC')",
+			query: `select max(value) as "_0_max", sum(value) as "_1_sum", count(value) as "_1_count" from cpu where time > now() - 1h group by time(1m) fill(null) tz('UTC')`,
+			aggs:  []string{"max", "mean"},
+		},
+		{
+			name:  "fill previous",
+			q:     "select sum(value) from cpu group by time(1m) FILL(previous)",
+			query: `select sum(value) as "_0_sum" from cpu group by time(1m) FILL(null)`,
+			aggs:  []string{"sum"},
+		},
+		{
+			name:  "fill none",
+			q:     "select sum(value) from cpu group by time(1m) fill(none)",
+			query: `select sum(value) as "_0_sum" from cpu group by time(1m) fill(none)`,
+			aggs:  []string{"sum"},
+		},
+		{
+			name:  "fill by shard tag",
+			q:     "select max(value) from cpu group by time(1m), host fill(0)",
+			query: "select max(value) from cpu group by time(1m), host fill(0)",
+		},
+	}
+	for _, tt := range tests {
+		sq, err := newShardedQuery(tt.q, []string{"host"})
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		var aggs []string
+		for _, agg := range sq.aggs {
+			aggs = append(aggs, agg.column)
+		}
+		if sq.query != tt.query || len(aggs) != len(tt.aggs) {
+			t.Errorf("%v: got %s, %v, want %s, %v", tt.name, sq.query, aggs, tt.query, tt.aggs)
+			continue
+		}
+		for i := range aggs {
+			if aggs[i] != tt.aggs[i] {
+				t.Errorf("%v: got %v, want %v", tt.name, aggs, tt.aggs)
+				break
+			}
+		}
+	}
+}
+
+func TestNewShardedQueryError(t *testing.T) {
+	tests := []struct {
+		name string
+		q    string
+	}{
+		{name: "unsupported function", q: "select percentile(value, 95) from cpu group by time(1m)"},
+		{name: "mixed fields", q: "select count(value), value from cpu"},
+		{name: "wildcard", q: "select count(*) from cpu"},
+		{name: "nested", q: "select sum(abs(value)) from cpu"},
+		{name: "group by other tag", q: "select last(value) from cpu group by region"},
+		{name: "no from", q: "select 1"},
+		{name: "fill linear", q: "select mean(value) from cpu group by time(1m) fill(linear)"},
+		{name: "fill string", q: "select mean(value) from cpu group by time(1m) fill('x')"},
+	}
+	for _, tt := range tests {
+		if _, err := newShardedQuery(tt.q, []string{"host"}); err == nil {
+			t.Errorf("%v: got nil error", tt.name)
+		}
+	}
+}
+
+func TestShardedQueryMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		q      string
+		bodies []string
+		want   string
+	}{
+		{
+			name: "aggregations",
+			q:    "select count(value), sum(value), min(value), max(value), mean(value) from cpu group by time(1m)",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","_0_count","_1_sum","_2_min","_3_max","_4_sum","_4_count"],"values":[[0,2,3,1,2,3,2],[60,1,5,5,5,5,1]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","_0_count","_1_sum","_2_min","_3_max","_4_sum","_4_count"],"values":[[0,1,1.5,1.5,1.5,1.5,1],[120,null,null,null,null,null,null]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count","sum","min","max","mean"],"values":[[0,3,4.5,1,2,1.5],[60,1,5,5,5,5],[120,null,null,null,null,null]]}]}]}`,
+		},
+		{
+			name: "raw",
+			q:    "select * from cpu order by time desc limit 2 offset 1",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","host","value"],"values":[[4,"a",4],[1,"a",1]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","host","load"],"values":[[3,"b",3],[2,"b",2]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","host","load","value"],"values":[[3,"b",3,null],[2,"b",2,null]]}]}]}`,
+		},
+		{
+			name: "series",
+			q:    "select count(value) from cpu group by region",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"region":"west"},"columns":["time","_0_count"],"values":[[0,1]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"region":"east"},"columns":["time","_0_count"],"values":[[0,2]]},{"name":"cpu","tags":{"region":"west"},"columns":["time","_0_count"],"values":[[0,3]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"region":"east"},"columns":["time","count"],"values":[[0,2]]},{"name":"cpu","tags":{"region":"west"},"columns":["time","count"],"values":[[0,4]]}]}]}`,
+		},
+		{
+			name: "fill number",
+			q:    "select count(value), sum(value), max(value), mean(value) from cpu group by time(1m) fill(0)",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","_0_count","_1_sum","_2_max","_3_sum","_3_count"],"values":[[0,1,-3,-3,-3,1],[60,null,null,null,null,null],[120,null,null,null,null,null]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","_0_count","_1_sum","_2_max","_3_sum","_3_count"],"values":[[0,null,null,null,null,null],[60,1,-1,-1,-1,1],[120,null,null,null,null,null]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count","sum","max","mean"],"values":[[0,1,-3,-3,-3],[60,1,-1,-1,-1],[120,0,0,0,0]]}]}]}`,
+		},
+		{
+			name: "fill previous",
+			q:    "select max(value) from cpu group by time(1m) order by time desc fill(previous)",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","_0_max"],"values":[[180,null],[120,null],[60,2],[0,null]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","_0_max"],"values":[[180,null],[120,1],[60,null],[0,null]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","max"],"values":[[180,1],[120,1],[60,2],[0,null]]}]}]}`,
+		},
+		{
+			name: "error",
+			q:    "select value from cpu",
+			bodies: []string{
+				`{"results":[{"statement_id":0}]}`,
+				`{"results":[{"statement_id":0,"error":"database not found: db"}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"error":"database not found: db"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		sq, err := newShardedQuery(tt.q, []string{"host"})
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		bodies := make([][]byte, len(tt.bodies))
+		for i, body := range tt.bodies {
+			bodies[i] = []byte(body)
+		}
+		rsp, err := sq.merge(bodies)
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		if got := strings.TrimSpace(string(util.MarshalJSON(rsp, false))); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
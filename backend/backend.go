@@ -6,9 +6,12 @@ package backend
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/url"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,45 +21,91 @@ import (
 )
 
 type CacheBuffer struct {
-	Buffer  *bytes.Buffer
-	Counter int
+	Buffer   *bytes.Buffer
+	Counter  int
+	Segments map[int64]int
+	acks     map[*circleAck]int
+	reserved int
+	mms      map[string]struct{}
+}
+
+type bufferPoint struct {
+	*LinePoint
+	segment int64
+	ack     *circleAck
 }
 
 type Backend struct {
 	*HttpBackend
-	fb   *FileBackend
-	pool *ants.Pool
-
+	fb     *FileBackend
+	wal    *WAL
+	dl     *DeadLetter
+	pool   *ants.Pool
+	budget *MemoryBudget
+	schema *SchemaCache
+	cache  *QueryCache
+
+	lock            sync.RWMutex
 	running         atomic.Value
-	flushSize       int
-	flushTime       int
-	rewriteInterval int
-	rewriteThreads  int
+	flushSize       atomic.Int32
+	flushTime       atomic.Int32
+	rewriteInterval atomic.Int32
+	rewriteThreads  atomic.Int32
+	writeTimeout    time.Duration
 	rewriteTicker   *time.Ticker
-	chWrite         chan *LinePoint
+	chWrite         chan bufferPoint
 	chTimer         <-chan time.Time
 	buffers         map[string]map[string]*CacheBuffer
 	wg              sync.WaitGroup
+	rewriteWg       sync.WaitGroup
+	closing         chan struct{}
+	done            chan struct{}
+	flushed         atomic.Int64
+	spilled         atomic.Int64
+	dropped         atomic.Int64
+	buffered        atomic.Int64
 }
 
-func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (ib *Backend) {
+func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig, budget *MemoryBudget, schema *SchemaCache, cache *QueryCache) (ib *Backend) {
 	ib = &Backend{
-		HttpBackend:     NewHttpBackend(cfg, pxcfg),
-		flushSize:       pxcfg.FlushSize,
-		flushTime:       pxcfg.FlushTime,
-		rewriteInterval: pxcfg.RewriteInterval,
-		rewriteThreads:  pxcfg.RewriteThreads,
-		rewriteTicker:   time.NewTicker(time.Duration(pxcfg.RewriteInterval) * time.Second),
-		chWrite:         make(chan *LinePoint, 16),
-		buffers:         make(map[string]map[string]*CacheBuffer),
+		HttpBackend:   NewHttpBackend(cfg, pxcfg),
+		budget:        budget,
+		schema:        schema,
+		cache:         cache,
+		writeTimeout:  time.Duration(pxcfg.WriteTimeout) * time.Second,
+		rewriteTicker: time.NewTicker(time.Duration(pxcfg.RewriteInterval) * time.Second),
+		chWrite:       make(chan bufferPoint, 16),
+		buffers:       make(map[string]map[string]*CacheBuffer),
+		closing:       make(chan struct{}),
+		done:          make(chan struct{}),
 	}
 	ib.running.Store(true)
+	ib.setFlushConfig(pxcfg)
 
 	var err error
 	ib.fb, err = NewFileBackend(cfg.Name, pxcfg.DataDir)
 	if err != nil {
 		panic(err)
 	}
+	if pxcfg.WALEnabled {
+		ib.wal, err = NewWAL(cfg.Name, pxcfg.DataDir, pxcfg.WALFsync, pxcfg.WALFsyncTime)
+		if err != nil {
+			panic(err)
+		}
+		n, err := ib.wal.Replay(ib.fb)
+		if err != nil {
+			panic(err)
+		}
+		if n > 0 {
+			log.Printf("wal replay: %d points of backend %s written to file", n, cfg.Name)
+		}
+	}
+	if pxcfg.DeadLetterEnabled {
+		ib.dl, err = NewDeadLetter(cfg.Name, pxcfg.DataDir)
+		if err != nil {
+			panic(err)
+		}
+	}
 	ib.pool, err = ants.NewPool(pxcfg.ConnPoolSize)
 	if err != nil {
 		panic(err)
@@ -70,30 +119,36 @@ func NewSimpleBackend(cfg *BackendConfig) *Backend {
 	return &Backend{HttpBackend: NewSimpleHttpBackend(cfg)}
 }
 
+func (ib *Backend) setFlushConfig(pxcfg *ProxyConfig) {
+	ib.flushSize.Store(int32(pxcfg.FlushSize))
+	ib.flushTime.Store(int32(pxcfg.FlushTime))
+	ib.rewriteInterval.Store(int32(pxcfg.RewriteInterval))
+	ib.rewriteThreads.Store(int32(pxcfg.RewriteThreads))
+}
+
+// Reload applies the flush and rewrite settings of pxcfg, buffered points are kept.
+func (ib *Backend) Reload(pxcfg *ProxyConfig) {
+	if int(ib.rewriteInterval.Load()) != pxcfg.RewriteInterval {
+		ib.rewriteTicker.Reset(time.Duration(pxcfg.RewriteInterval) * time.Second)
+	}
+	ib.setFlushConfig(pxcfg)
+}
+
 func (ib *Backend) worker() {
-	for ib.IsRunning() {
+	defer close(ib.done)
+	for {
 		select {
 		case p, ok := <-ib.chWrite:
 			if !ok {
-				// closed
+				// closed, the points left in channel have been buffered
 				ib.Flush()
-				ib.wg.Wait()
-				ib.HttpBackend.Close()
-				ib.fb.Close()
-				ib.pool.Release()
+				ib.release()
 				return
 			}
-			ib.WriteBuffer(p)
+			ib.writeBuffer(p)
 
 		case <-ib.chTimer:
 			ib.Flush()
-			if !ib.IsRunning() {
-				ib.wg.Wait()
-				ib.HttpBackend.Close()
-				ib.fb.Close()
-				ib.pool.Release()
-				return
-			}
 
 		case <-ib.rewriteTicker.C:
 			ib.RewriteIdle()
@@ -101,15 +156,77 @@ func (ib *Backend) worker() {
 	}
 }
 
+func (ib *Backend) release() {
+	ib.wg.Wait()
+	ib.rewriteWg.Wait()
+	ib.HttpBackend.Close()
+	ib.fb.Close()
+	if ib.wal != nil {
+		ib.wal.Close()
+	}
+	if ib.dl != nil {
+		ib.dl.Close()
+	}
+	ib.pool.Release()
+}
+
 func (ib *Backend) WritePoint(point *LinePoint) (err error) {
+	return ib.writePoint(point, nil)
+}
+
+// writePoint writes point to buffer, ack will be notified once the point is written to backend or file.
+func (ib *Backend) writePoint(point *LinePoint, ack *circleAck) (err error) {
+	ib.lock.RLock()
+	defer ib.lock.RUnlock()
 	if !ib.IsRunning() {
 		return io.ErrClosedPipe
 	}
-	ib.chWrite <- point
-	return
+	n := len(point.Line)
+	if !ib.budget.Acquire(n) {
+		return ErrBufferFull
+	}
+	var segment int64
+	if ib.wal != nil {
+		// the point is acknowledged only after it's appended to wal
+		segment, err = ib.wal.Write(point)
+		if err != nil {
+			ib.budget.Release(n)
+			return
+		}
+	}
+	ib.buffered.Add(int64(n))
+	bp := bufferPoint{point, segment, ack}
+	select {
+	case ib.chWrite <- bp:
+		return
+	default:
+	}
+	if !ib.budget.IsReject() {
+		ib.chWrite <- bp
+		return
+	}
+	// the worker is busy, wait at most write timeout before rejecting the point
+	timer := time.NewTimer(ib.writeTimeout)
+	defer timer.Stop()
+	select {
+	case ib.chWrite <- bp:
+		return
+	case <-timer.C:
+		ib.budget.Release(n)
+		ib.buffered.Add(-int64(n))
+		// the rejected point may be replayed from wal after crash, which is harmless since it has a timestamp
+		ib.releaseWAL(map[int64]int{segment: 1})
+		return ErrBackendBusy
+	}
 }
 
 func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
+	ib.budget.Acquire(len(point.Line))
+	ib.buffered.Add(int64(len(point.Line)))
+	return ib.writeBuffer(bufferPoint{LinePoint: point})
+}
+
+func (ib *Backend) writeBuffer(point bufferPoint) (err error) {
 	db, rp, line := point.Db, point.Rp, point.Line
 	// it's thread-safe since ib.buffers is only used (read-write) in ib.worker() goroutine
 	if _, ok := ib.buffers[db]; !ok {
@@ -120,9 +237,28 @@ func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
 	}
 	cb := ib.buffers[db][rp]
 	cb.Counter++
+	cb.reserved += len(line)
 	if cb.Buffer == nil {
 		cb.Buffer = &bytes.Buffer{}
 	}
+	if point.segment > 0 {
+		if cb.Segments == nil {
+			cb.Segments = make(map[int64]int)
+		}
+		cb.Segments[point.segment]++
+	}
+	if point.ack != nil {
+		if cb.acks == nil {
+			cb.acks = make(map[*circleAck]int)
+		}
+		cb.acks[point.ack]++
+	}
+	if mm, err := ScanKey(line); err == nil {
+		if cb.mms == nil {
+			cb.mms = make(map[string]struct{})
+		}
+		cb.mms[mm] = struct{}{}
+	}
 	n, err := cb.Buffer.Write(line)
 	if err != nil {
 		log.Printf("buffer write error: %s", err)
@@ -142,61 +278,182 @@ func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
 	}
 
 	switch {
-	case cb.Counter >= ib.flushSize:
+	case ib.budget.Exceeded() && !ib.budget.IsReject():
+		ib.spillBuffers()
+	case cb.Counter >= int(ib.flushSize.Load()):
 		ib.FlushBuffer(db, rp)
 	case ib.chTimer == nil:
-		ib.chTimer = time.After(time.Duration(ib.flushTime) * time.Second)
+		ib.chTimer = time.After(time.Duration(ib.flushTime.Load()) * time.Second)
 	}
 	return
 }
 
+// spillBuffers writes the largest buffers to file to free memory until the usage of budget is under the low-water mark.
+func (ib *Backend) spillBuffers() {
+	type buffer struct {
+		db, rp string
+		size   int
+	}
+	var buffers []buffer
+	for db := range ib.buffers {
+		for rp, cb := range ib.buffers[db] {
+			if cb.reserved > 0 {
+				buffers = append(buffers, buffer{db, rp, cb.reserved})
+			}
+		}
+	}
+	sort.Slice(buffers, func(i, j int) bool { return buffers[i].size > buffers[j].size })
+	for _, b := range buffers {
+		if ib.budget.UnderLowWater() {
+			return
+		}
+		ib.flushBuffer(b.db, b.rp, true)
+	}
+}
+
 func (ib *Backend) FlushBuffer(db, rp string) {
+	ib.flushBuffer(db, rp, false)
+}
+
+// flushBuffer writes the buffer of db and rp to backend, or to file directly in the worker goroutine if spill is true.
+func (ib *Backend) flushBuffer(db, rp string, spill bool) {
 	cb := ib.buffers[db][rp]
 	if cb.Buffer == nil {
 		return
 	}
 	p := cb.Buffer.Bytes()
+	n := int64(cb.Counter)
+	segments, acks, reserved, mms := cb.Segments, cb.acks, cb.reserved, cb.mms
 	cb.Buffer = nil
 	cb.Counter = 0
+	cb.Segments = nil
+	cb.acks = nil
+	cb.reserved = 0
+	cb.mms = nil
+	ib.budget.Release(reserved)
+	ib.buffered.Add(-int64(reserved))
 	if len(p) == 0 {
 		return
 	}
 
 	ib.wg.Add(1)
-	ib.pool.Submit(func() {
+	task := func() {
 		defer ib.wg.Done()
 		var buf bytes.Buffer
 		err := Compress(&buf, p)
 		if err != nil {
 			log.Print("compress buffer error: ", err)
+			ib.dropped.Add(n)
+			notifyAcks(acks, err)
 			return
 		}
 
-		p = buf.Bytes()
-
-		if ib.IsActive() {
-			err = ib.WriteCompressed(db, rp, p)
-			switch err {
-			case nil:
+		var ackErr error
+		if !spill && ib.IsActive() {
+			err = ib.WriteCompressed(db, rp, buf.Bytes())
+			switch {
+			case err == nil:
+				ib.recordSchema(db, p)
+				ib.invalidateCache(db, mms)
+				ib.flushed.Add(n)
+				ib.releaseWAL(segments)
+				notifyAcks(acks, nil)
 				return
-			case ErrBadRequest:
+			case ib.dl != nil && isRejected(err):
+				written, dead, remains, _ := ib.isolate(db, rp, SplitLines(p), err)
+				if written > 0 {
+					ib.invalidateCache(db, mms)
+				}
+				ib.flushed.Add(int64(written))
+				ib.dropped.Add(int64(dead))
+				if dead > 0 {
+					ackErr = fmt.Errorf("backend %s: %d points dead lettered: %s", ib.Name, dead, err)
+				}
+				if len(remains) == 0 {
+					ib.releaseWAL(segments)
+					notifyAcks(acks, ackErr)
+					return
+				}
+				// the remaining lines not written due to other errors are written to file
+				p, n = bytes.Join(remains, []byte{'\n'}), int64(len(remains))
+				buf.Reset()
+				if err = Compress(&buf, p); err != nil {
+					log.Print("compress buffer error: ", err)
+					ib.dropped.Add(n)
+					notifyAcks(acks, err)
+					return
+				}
+			case errors.Is(err, ErrBadRequest):
 				log.Printf("bad request, drop all data")
+				ib.dropped.Add(n)
+				ib.releaseWAL(segments)
+				notifyAcks(acks, fmt.Errorf("backend %s: %s", ib.Name, err))
 				return
-			case ErrNotFound:
+			case errors.Is(err, ErrNotFound):
 				log.Printf("bad backend, drop all data")
+				ib.dropped.Add(n)
+				ib.releaseWAL(segments)
+				notifyAcks(acks, fmt.Errorf("backend %s: %s", ib.Name, err))
 				return
 			default:
-				log.Printf("write http error, url: %s, db: %s, rp: %s, plen: %d", ib.Url, db, rp, len(p))
+				log.Printf("write http error, url: %s, db: %s, rp: %s, plen: %d", ib.Url, db, rp, buf.Len())
 			}
 		}
 
-		b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), []byte(url.QueryEscape(rp)), p}, []byte{' '})
+		b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), []byte(url.QueryEscape(rp)), buf.Bytes()}, []byte{' '})
 		err = ib.fb.Write(b)
 		if err != nil {
-			log.Printf("write db and data to file error: %s, db: %s, rp: %s, plen: %d", err, db, rp, len(p))
+			// the data is kept in wal if enabled, and will be replayed on next startup
+			log.Printf("write db and data to file error: %s, db: %s, rp: %s, plen: %d", err, db, rp, buf.Len())
+			ib.dropped.Add(n)
+			notifyAcks(acks, fmt.Errorf("backend %s: %s", ib.Name, err))
 			return
 		}
-	})
+		ib.spilled.Add(n)
+		ib.releaseWAL(segments)
+		notifyAcks(acks, ackErr)
+	}
+	if spill {
+		task()
+	} else {
+		ib.pool.Submit(task)
+	}
+}
+
+// recordSchema records the field types of the flushed lines p of database db into the schema cache,
+// so that the types are known only once the backend has accepted them.
+func (ib *Backend) recordSchema(db string, p []byte) {
+	if ib.schema == nil || !ib.schema.Enabled() {
+		return
+	}
+	ib.schema.RecordLines(db, p)
+}
+
+// invalidateCache invalidates the query cache of measurements mms of database db once their points are flushed,
+// since the queries between routing and flushing may have cached the responses without the points.
+func (ib *Backend) invalidateCache(db string, mms map[string]struct{}) {
+	if ib.cache == nil {
+		return
+	}
+	for mm := range mms {
+		ib.cache.Invalidate(db, mm)
+	}
+}
+
+func (ib *Backend) releaseWAL(segments map[int64]int) {
+	if ib.wal != nil && len(segments) > 0 {
+		ib.wal.Release(segments)
+	}
+}
+
+func notifyAcks(acks map[*circleAck]int, err error) {
+	for ack, n := range acks {
+		if err != nil {
+			ack.fail(err)
+		} else {
+			ack.written(n)
+		}
+	}
 }
 
 func (ib *Backend) Flush() {
@@ -213,30 +470,40 @@ func (ib *Backend) Flush() {
 func (ib *Backend) RewriteIdle() {
 	if !ib.IsRewriting() && ib.fb.IsData() {
 		ib.SetRewriting(true)
+		ib.rewriteWg.Add(1)
 		go ib.RewriteLoop()
 	}
 }
 
 func (ib *Backend) RewriteLoop() {
+	defer ib.rewriteWg.Done()
 	defer ib.SetRewriting(false)
 	for ib.fb.IsData() {
 		if !ib.IsRunning() {
 			return
 		}
 		if !ib.IsActive() {
-			time.Sleep(time.Duration(ib.rewriteInterval) * time.Second)
+			ib.sleep(time.Duration(ib.rewriteInterval.Load()) * time.Second)
 			continue
 		}
 		err := ib.Rewrite()
 		if err != nil {
-			time.Sleep(time.Duration(ib.rewriteInterval) * time.Second)
+			ib.sleep(time.Duration(ib.rewriteInterval.Load()) * time.Second)
 			continue
 		}
 	}
 }
 
+// sleep pauses for duration d, or returns immediately once the backend is closing.
+func (ib *Backend) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ib.closing:
+	}
+}
+
 func (ib *Backend) Rewrite() (err error) {
-	blocks, err := ib.fb.ReadN(ib.rewriteThreads)
+	blocks, err := ib.fb.ReadN(int(ib.rewriteThreads.Load()))
 	if err != nil {
 		log.Print("rewrite read file error: ", err)
 		return
@@ -286,12 +553,28 @@ func (ib *Backend) rewrite(b []byte) (err error) {
 	}
 	err = ib.WriteCompressed(db, rp, p[2])
 
-	switch err {
-	case nil:
-	case ErrBadRequest:
+	switch {
+	case err == nil:
+		// the measurements of the block are unknown without decompression
+		if ib.cache != nil {
+			ib.cache.InvalidateDB(db)
+		}
+	case ib.dl != nil && isRejected(err):
+		lines, derr := Decompress(p[2])
+		if derr != nil {
+			log.Print("rewrite decompress error: ", derr)
+			return nil
+		}
+		// the whole block will be rewritten again if some lines are not written due to other errors, the written lines are idempotent
+		var written int
+		written, _, _, err = ib.isolate(db, rp, SplitLines(lines), err)
+		if written > 0 && ib.cache != nil {
+			ib.cache.InvalidateDB(db)
+		}
+	case errors.Is(err, ErrBadRequest):
 		log.Printf("bad request, drop all data")
 		err = nil
-	case ErrNotFound:
+	case errors.Is(err, ErrNotFound):
 		log.Printf("bad backend, drop all data")
 		err = nil
 	default:
@@ -304,11 +587,37 @@ func (ib *Backend) IsRunning() (b bool) {
 	return ib.running.Load().(bool)
 }
 
+// Close stops accepting points and flushes the buffers in background, use Done to wait for the flush.
+// The flush statistics are reset so that Stats only counts the points flushed since close.
 func (ib *Backend) Close() {
+	ib.lock.Lock()
+	defer ib.lock.Unlock()
+	if !ib.IsRunning() {
+		return
+	}
+	ib.flushed.Store(0)
+	ib.spilled.Store(0)
+	ib.dropped.Store(0)
 	ib.running.Store(false)
+	close(ib.closing)
 	close(ib.chWrite)
 }
 
+// Done returns a channel that's closed when the buffers have been flushed and the backend is released.
+func (ib *Backend) Done() <-chan struct{} {
+	return ib.done
+}
+
+// Stats returns the number of points written to backend, spilled to file and dropped.
+func (ib *Backend) Stats() (flushed, spilled, dropped int64) {
+	return ib.flushed.Load(), ib.spilled.Load(), ib.dropped.Load()
+}
+
+// Buffered returns the bytes of the points buffered in memory.
+func (ib *Backend) Buffered() int64 {
+	return ib.buffered.Load()
+}
+
 func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 	health := struct {
 		Name      string      `json:"name"`
@@ -319,6 +628,7 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 		WriteOnly bool        `json:"write_only"`
 		Healthy   bool        `json:"healthy,omitempty"`
 		Stats     interface{} `json:"stats,omitempty"`
+		Buffer    interface{} `json:"buffer,omitempty"`
 	}{
 		Name:      ib.Name,
 		Url:       ib.Url,
@@ -340,9 +650,7 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 			inplace, incorrect := 0, 0
 			mms := ib.GetMeasurements(db)
 			for _, mm := range mms {
-				key := ic.getKeyFn(db, mm)
-				nb := ic.GetBackend(key)
-				if nb.Url == ib.Url {
+				if ic.isInplace(ib, db, mm) {
 					inplace++
 				} else {
 					incorrect++
@@ -368,5 +676,12 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 	})
 	health.Healthy = healthy
 	health.Stats = stats
+	flushed, spilled, dropped := ib.Stats()
+	health.Buffer = map[string]int64{
+		"bytes":   ib.Buffered(),
+		"flushed": flushed,
+		"spilled": spilled,
+		"dropped": dropped,
+	}
 	return health
 }
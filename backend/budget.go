@@ -0,0 +1,102 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+const (
+	BufferPolicySpill  = "spill"
+	BufferPolicyReject = "reject"
+)
+
+// BufferLowWaterRatio is the ratio of the limit, which the usage is reduced under by spilling once the limit is exceeded,
+// so that the buffers are not spilled again on every point around the limit.
+const BufferLowWaterRatio = 0.8
+
+var (
+	ErrInvalidBufferPolicy = errors.New("invalid buffer_policy, require spill or reject")
+	ErrBufferFull          = errors.New("buffer memory limit exceeded")
+	ErrBackendBusy         = errors.New("backend busy")
+)
+
+// MemoryBudget limits the memory of the points buffered by all the backends of a proxy.
+// The points are counted from being accepted by a backend until their buffer is flushed.
+type MemoryBudget struct {
+	limit  atomic.Int64
+	usage  atomic.Int64
+	reject atomic.Bool
+}
+
+func NewMemoryBudget(limit int, policy string) *MemoryBudget {
+	mb := &MemoryBudget{}
+	mb.Set(limit, policy)
+	return mb
+}
+
+// Set changes the limit in bytes and the policy, no limit if limit <= 0.
+func (mb *MemoryBudget) Set(limit int, policy string) {
+	mb.limit.Store(int64(limit))
+	mb.reject.Store(policy == BufferPolicyReject)
+}
+
+// Acquire counts n bytes into usage, it fails only if the policy is reject and the limit would be exceeded.
+func (mb *MemoryBudget) Acquire(n int) bool {
+	if mb == nil {
+		return true
+	}
+	usage := mb.usage.Add(int64(n))
+	if mb.IsReject() {
+		if limit := mb.limit.Load(); limit > 0 && usage > limit {
+			mb.usage.Add(-int64(n))
+			return false
+		}
+	}
+	return true
+}
+
+func (mb *MemoryBudget) Release(n int) {
+	if mb != nil {
+		mb.usage.Add(-int64(n))
+	}
+}
+
+// Exceeded returns true if the usage is over the limit.
+func (mb *MemoryBudget) Exceeded() bool {
+	if mb == nil {
+		return false
+	}
+	limit := mb.limit.Load()
+	return limit > 0 && mb.usage.Load() > limit
+}
+
+// UnderLowWater returns true if the usage is under the low-water mark of the limit, or there is no limit.
+func (mb *MemoryBudget) UnderLowWater() bool {
+	if mb == nil {
+		return true
+	}
+	limit := mb.limit.Load()
+	return limit <= 0 || mb.usage.Load() <= int64(float64(limit)*BufferLowWaterRatio)
+}
+
+func (mb *MemoryBudget) IsReject() bool {
+	return mb != nil && mb.reject.Load()
+}
+
+func (mb *MemoryBudget) Usage() int64 {
+	if mb == nil {
+		return 0
+	}
+	return mb.usage.Load()
+}
+
+func (mb *MemoryBudget) Limit() int64 {
+	if mb == nil {
+		return 0
+	}
+	return mb.limit.Load()
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		acquire  []int
+		want     []bool
+		exceeded bool
+	}{
+		{
+			name:     "spill",
+			policy:   BufferPolicySpill,
+			acquire:  []int{60, 60},
+			want:     []bool{true, true},
+			exceeded: true,
+		},
+		{
+			name:     "reject",
+			policy:   BufferPolicyReject,
+			acquire:  []int{60, 60, 40},
+			want:     []bool{true, false, true},
+			exceeded: false,
+		},
+	}
+	for _, tt := range tests {
+		mb := NewMemoryBudget(100, tt.policy)
+		for i, n := range tt.acquire {
+			if got := mb.Acquire(n); got != tt.want[i] {
+				t.Errorf("%v: acquire %d got %v, want %v", tt.name, n, got, tt.want[i])
+			}
+		}
+		if mb.Exceeded() != tt.exceeded {
+			t.Errorf("%v: got exceeded %v, want %v", tt.name, mb.Exceeded(), tt.exceeded)
+		}
+		for i, n := range tt.acquire {
+			if tt.want[i] {
+				mb.Release(n)
+			}
+		}
+		if mb.Usage() != 0 {
+			t.Errorf("%v: got usage %d, want 0", tt.name, mb.Usage())
+		}
+	}
+}
+
+func TestProxyBufferPolicy(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	ip := newTestProxy(t, ok)
+	ip.budget.Set(16, BufferPolicyReject)
+	err := ip.WriteStream(strings.NewReader("cpu,host=server01 value=1\ncpu,host=server02 value=2\n"), "db1", "", "ns", ConsistencyAny)
+	if !errors.Is(err, ErrBufferFull) || !strings.HasPrefix(err.Error(), "line 1: ") {
+		t.Errorf("reject: got %v, want buffer full error", err)
+	}
+
+	ip.budget.Set(16, BufferPolicySpill)
+	err = ip.Write([]byte("cpu,host=server01 value=1\n"), "db1", "", "ns")
+	if err != nil {
+		t.Errorf("spill: got %v, want nil", err)
+	}
+	be := ip.Circles[0].Backends()[0]
+	for i := 0; i < 100; i++ {
+		if _, spilled, _ := be.Stats(); spilled > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if flushed, spilled, _ := be.Stats(); flushed != 0 || spilled != 1 {
+		t.Errorf("spill: got %d flushed, %d spilled, want 0, 1", flushed, spilled)
+	}
+	if ip.budget.Usage() != 0 || be.Buffered() != 0 {
+		t.Errorf("spill: got usage %d, buffered %d, want 0", ip.budget.Usage(), be.Buffered())
+	}
+}
+
+func TestProxySpillLargestBuffers(t *testing.T) {
+	ip := newTestProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	be := ip.Circles[0].Backends()[0]
+	be.flushTime.Store(60)
+	line := "cpu,host=server01 value=1 1\n"
+	n := len(line) - 1
+	// the first 4 points are under the limit, and the 5th exceeds it
+	ip.budget.Set(4*n+n/2, BufferPolicySpill)
+	err := ip.Write([]byte(strings.Repeat(line, 3)), "db1", "", "ns")
+	if err == nil {
+		err = ip.Write([]byte(line), "db2", "", "ns")
+	}
+	if err != nil {
+		t.Fatalf("got write error %v", err)
+	}
+	for len(be.chWrite) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// only the largest buffer of db1 is spilled, which is enough to be under the low-water mark
+	if err = ip.Write([]byte(line), "db2", "", "ns"); err != nil {
+		t.Fatalf("got write error %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, spilled, _ := be.Stats(); spilled > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for spill")
+		}
+	}
+	if _, spilled, _ := be.Stats(); spilled != 3 {
+		t.Errorf("got %d spilled, want 3", spilled)
+	}
+	if usage := ip.budget.Usage(); usage != int64(2*n) {
+		t.Errorf("got usage %d, want %d of db2 buffered", usage, 2*n)
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheEntryOverhead is the approximate memory of an entry besides its key and body.
+const cacheEntryOverhead = 256
+
+type cacheEntry struct {
+	key    string
+	db     string
+	mm     string
+	header http.Header
+	body   []byte
+	expire time.Time
+}
+
+func (ce *cacheEntry) size() int {
+	return len(ce.key) + len(ce.body) + cacheEntryOverhead
+}
+
+// cacheFill is a query in flight to fill the cache, which is marked stale if its measurement is written meanwhile.
+type cacheFill struct {
+	db    string
+	mm    string
+	stale bool
+}
+
+type cacheNode struct {
+	keys  map[string]struct{}
+	fills map[*cacheFill]struct{}
+}
+
+// QueryCache is an in-process lru cache of the responses of select statements, the entries expire after ttl
+// and are invalidated when new points are written to their databases and measurements.
+type QueryCache struct {
+	lock      sync.RWMutex
+	maxSize   int
+	ttl       time.Duration
+	bucket    time.Duration
+	size      int
+	lru       *list.List
+	entries   map[string]*list.Element
+	nodes     map[string]map[string]*cacheNode
+	hits      int64
+	misses    int64
+	evictions int64
+	enabled   atomic.Bool
+	descs     map[string]*prometheus.Desc
+}
+
+func NewQueryCache(size, ttl, bucket int) *QueryCache {
+	qc := &QueryCache{
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		nodes:   make(map[string]map[string]*cacheNode),
+		descs: map[string]*prometheus.Desc{
+			"hits":      prometheus.NewDesc("influx_proxy_query_cache_hits_total", "Number of queries responded from query cache.", nil, nil),
+			"misses":    prometheus.NewDesc("influx_proxy_query_cache_misses_total", "Number of cacheable queries not found in query cache.", nil, nil),
+			"evictions": prometheus.NewDesc("influx_proxy_query_cache_evictions_total", "Number of entries evicted from query cache by memory limit.", nil, nil),
+			"entries":   prometheus.NewDesc("influx_proxy_query_cache_entries", "Number of entries in query cache.", nil, nil),
+			"bytes":     prometheus.NewDesc("influx_proxy_query_cache_bytes", "Approximate memory in bytes of query cache.", nil, nil),
+		},
+	}
+	qc.Set(size, ttl, bucket)
+	return qc
+}
+
+// Set updates the memory limit in bytes, ttl and bucket of now() in seconds, the cache is disabled if size is 0.
+func (qc *QueryCache) Set(size, ttl, bucket int) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	qc.maxSize = size
+	qc.ttl = time.Duration(ttl) * time.Second
+	qc.bucket = time.Duration(bucket) * time.Second
+	qc.enabled.Store(size > 0)
+	qc.evict()
+}
+
+func (qc *QueryCache) Enabled() bool {
+	return qc.enabled.Load()
+}
+
+// Key returns the cache key of the select statement q of database db and measurement mm,
+// the parameters affecting the response body are also included.
+func (qc *QueryCache) Key(req *http.Request, db, mm, q string) string {
+	var b strings.Builder
+	for _, s := range []string{db, req.FormValue("rp"), mm, req.FormValue("epoch"), req.FormValue("pretty"), req.FormValue("params"), strings.Join(req.Header.Values("Accept-Encoding"), ",")} {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+	b.WriteString(NormalizeQuery(q))
+	return b.String()
+}
+
+// Align replaces now() in the statement q with the current time truncated to the bucket,
+// so that the statements with relative time windows in the same bucket have the same key and response.
+func (qc *QueryCache) Align(q string) string {
+	qc.lock.RLock()
+	bucket := qc.bucket
+	qc.lock.RUnlock()
+	if bucket <= 0 {
+		return q
+	}
+	return ReplaceNow(q, time.Now().UTC().Truncate(bucket))
+}
+
+// Get returns the header and body of the entry by key if not expired.
+func (qc *QueryCache) Get(key string) (http.Header, []byte, bool) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	if elem, ok := qc.entries[key]; ok {
+		ce := elem.Value.(*cacheEntry)
+		if time.Now().Before(ce.expire) {
+			qc.lru.MoveToFront(elem)
+			qc.hits++
+			return ce.header, ce.body, true
+		}
+		qc.remove(elem)
+	}
+	qc.misses++
+	return nil, nil, false
+}
+
+// Begin registers a query in flight to fill the cache of database db and measurement mm, End must be called after.
+func (qc *QueryCache) Begin(db, mm string) *cacheFill {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	fill := &cacheFill{db: db, mm: mm}
+	qc.node(db, mm).fills[fill] = struct{}{}
+	return fill
+}
+
+func (qc *QueryCache) End(fill *cacheFill) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	if node, ok := qc.nodes[fill.db][fill.mm]; ok {
+		delete(node.fills, fill)
+		qc.prune(fill.db, fill.mm, node)
+	}
+}
+
+// Put adds the entry filled by the query unless its measurement has been written during the query,
+// or the entry is larger than MaxEntrySize.
+func (qc *QueryCache) Put(fill *cacheFill, key string, header http.Header, body []byte) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	ce := &cacheEntry{key: key, db: fill.db, mm: fill.mm, header: header, body: body, expire: time.Now().Add(qc.ttl)}
+	if fill.stale || qc.maxSize <= 0 || ce.size() > qc.maxEntrySize() {
+		return
+	}
+	if elem, ok := qc.entries[key]; ok {
+		qc.remove(elem)
+	}
+	qc.entries[key] = qc.lru.PushFront(ce)
+	qc.node(ce.db, ce.mm).keys[key] = struct{}{}
+	qc.size += ce.size()
+	qc.evict()
+}
+
+// MaxEntrySize returns the max size in bytes of a response to be cached, which is 1/8 of the memory limit.
+func (qc *QueryCache) MaxEntrySize() int {
+	qc.lock.RLock()
+	defer qc.lock.RUnlock()
+	return qc.maxEntrySize()
+}
+
+func (qc *QueryCache) maxEntrySize() int {
+	return qc.maxSize / 8
+}
+
+// Invalidate removes the entries of database db and measurement mm, and marks the queries in flight stale.
+func (qc *QueryCache) Invalidate(db, mm string) {
+	if !qc.Enabled() {
+		return
+	}
+	qc.lock.RLock()
+	_, ok := qc.nodes[db][mm]
+	qc.lock.RUnlock()
+	if !ok {
+		return
+	}
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	if node, ok := qc.nodes[db][mm]; ok {
+		qc.invalidate(db, mm, node)
+	}
+}
+
+// InvalidateDB removes the entries of all measurements of database db, and marks the queries in flight stale.
+func (qc *QueryCache) InvalidateDB(db string) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	for mm, node := range qc.nodes[db] {
+		qc.invalidate(db, mm, node)
+	}
+}
+
+func (qc *QueryCache) invalidate(db, mm string, node *cacheNode) {
+	for key := range node.keys {
+		qc.remove(qc.entries[key])
+	}
+	for fill := range node.fills {
+		fill.stale = true
+	}
+}
+
+func (qc *QueryCache) node(db, mm string) *cacheNode {
+	if _, ok := qc.nodes[db]; !ok {
+		qc.nodes[db] = make(map[string]*cacheNode)
+	}
+	node, ok := qc.nodes[db][mm]
+	if !ok {
+		node = &cacheNode{keys: make(map[string]struct{}), fills: make(map[*cacheFill]struct{})}
+		qc.nodes[db][mm] = node
+	}
+	return node
+}
+
+func (qc *QueryCache) prune(db, mm string, node *cacheNode) {
+	if len(node.keys) == 0 && len(node.fills) == 0 {
+		delete(qc.nodes[db], mm)
+		if len(qc.nodes[db]) == 0 {
+			delete(qc.nodes, db)
+		}
+	}
+}
+
+func (qc *QueryCache) remove(elem *list.Element) {
+	ce := qc.lru.Remove(elem).(*cacheEntry)
+	delete(qc.entries, ce.key)
+	qc.size -= ce.size()
+	if node, ok := qc.nodes[ce.db][ce.mm]; ok {
+		delete(node.keys, ce.key)
+		qc.prune(ce.db, ce.mm, node)
+	}
+}
+
+func (qc *QueryCache) evict() {
+	for qc.size > qc.maxSize && qc.lru.Len() > 0 {
+		qc.remove(qc.lru.Back())
+		qc.evictions++
+	}
+}
+
+func (qc *QueryCache) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range qc.descs {
+		ch <- desc
+	}
+}
+
+func (qc *QueryCache) Collect(ch chan<- prometheus.Metric) {
+	qc.lock.RLock()
+	defer qc.lock.RUnlock()
+	ch <- prometheus.MustNewConstMetric(qc.descs["hits"], prometheus.CounterValue, float64(qc.hits))
+	ch <- prometheus.MustNewConstMetric(qc.descs["misses"], prometheus.CounterValue, float64(qc.misses))
+	ch <- prometheus.MustNewConstMetric(qc.descs["evictions"], prometheus.CounterValue, float64(qc.evictions))
+	ch <- prometheus.MustNewConstMetric(qc.descs["entries"], prometheus.GaugeValue, float64(qc.lru.Len()))
+	ch <- prometheus.MustNewConstMetric(qc.descs["bytes"], prometheus.GaugeValue, float64(qc.size))
+}
+
+// cacheWriter tees the response written to the client for the cache, until the size exceeds the limit.
+type cacheWriter struct {
+	http.ResponseWriter
+	limit  int
+	status int
+	buf    bytes.Buffer
+	over   bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.over {
+		if cw.buf.Len()+len(p) > cw.limit {
+			cw.over = true
+			cw.buf = bytes.Buffer{}
+		} else {
+			cw.buf.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *cacheWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// cacheHeader returns the headers of response to be cached, which describe the body.
+func cacheHeader(h http.Header) http.Header {
+	header := http.Header{}
+	for _, k := range []string{"Content-Type", "Content-Encoding"} {
+		if v := h.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	return header
+}
+
+// NormalizeQuery collapses the whitespaces outside the quotes and regexes of statement q, and trims the semicolons.
+func NormalizeQuery(q string) string {
+	data := []byte(strings.TrimRight(strings.TrimSpace(q), "; \t\r\n"))
+	var b strings.Builder
+	b.Grow(len(data))
+	space := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if isSpace(c) {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		if c == '"' || c == '\'' || c == '/' && isRegexStart(data, i) {
+			end, err := findEndWithQuoteOrRegex(data, i)
+			if err != nil {
+				b.Write(data[i:])
+				break
+			}
+			b.Write(data[i:end])
+			i = end - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// ReplaceNow replaces now() outside the quotes and regexes of statement q with the time literal of t.
+func ReplaceNow(q string, t time.Time) string {
+	data := []byte(q)
+	literal := "'" + t.Format(time.RFC3339Nano) + "'"
+	var b strings.Builder
+	b.Grow(len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c == '"' || c == '\'' || c == '/' && isRegexStart(data, i) {
+			end, err := findEndWithQuoteOrRegex(data, i)
+			if err != nil {
+				b.Write(data[i:])
+				break
+			}
+			b.Write(data[i:end])
+			i = end - 1
+			continue
+		}
+		if n := scanNow(data, i); n > 0 {
+			b.WriteString(literal)
+			i += n - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// scanNow returns the length of now() at position i of data, or 0 if not found.
+func scanNow(data []byte, i int) int {
+	if i+3 > len(data) || !strings.EqualFold(string(data[i:i+3]), "now") || i > 0 && isIdentChar(data[i-1]) {
+		return 0
+	}
+	j := i + 3
+	for j < len(data) && isSpace(data[j]) {
+		j++
+	}
+	if j >= len(data) || data[j] != '(' {
+		return 0
+	}
+	for j++; j < len(data) && isSpace(data[j]); j++ {
+	}
+	if j >= len(data) || data[j] != ')' {
+		return 0
+	}
+	return j + 1 - i
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
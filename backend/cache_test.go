@@ -0,0 +1,141 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		q    string
+		want string
+	}{
+		{
+			name: "spaces",
+			q:    "  select  value\n\tfrom cpu   where time > now() - 1h ;  ",
+			want: "select value from cpu where time > now() - 1h",
+		},
+		{
+			name: "quotes",
+			q:    `select "a  b" from cpu where host = 'x   y'`,
+			want: `select "a  b" from cpu where host = 'x   y'`,
+		},
+		{
+			name: "regex",
+			q:    "select value from cpu where host =~  /a  b/ and value > 1 / 2",
+			want: "select value from cpu where host =~ /a  b/ and value > 1 / 2",
+		},
+	}
+	for _, tt := range tests {
+		if got := NormalizeQuery(tt.q); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReplaceNow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC)
+	tests := []struct {
+		name string
+		q    string
+		want string
+	}{
+		{
+			name: "now",
+			q:    "select value from cpu where time > NOW() - 1h and time < now ( )",
+			want: "select value from cpu where time > '2020-01-01T00:00:10Z' - 1h and time < '2020-01-01T00:00:10Z'",
+		},
+		{
+			name: "quotes",
+			q:    `select "now()" from cpu where host = 'now()' or host =~ /now()/`,
+			want: `select "now()" from cpu where host = 'now()' or host =~ /now()/`,
+		},
+		{
+			name: "identifier",
+			q:    "select know() from cpu where time > now",
+			want: "select know() from cpu where time > now",
+		},
+	}
+	for _, tt := range tests {
+		if got := ReplaceNow(tt.q, now); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQueryCacheKey(t *testing.T) {
+	qc := NewQueryCache(8*1024, 60, 10)
+	q := "select value from cpu where host = $host"
+	req := NewQueryRequest("GET", "db1", q, "")
+	req.Form.Set("params", `{"host":"a"}`)
+	key := qc.Key(req, "db1", "cpu", q)
+	req.Form.Set("params", `{"host":"b"}`)
+	if got := qc.Key(req, "db1", "cpu", q); got == key {
+		t.Errorf("got the same key %q with different params", got)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	qc := NewQueryCache(8*1024, 60, 10)
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	body := []byte(strings.Repeat("x", 100))
+
+	fill := qc.Begin("db1", "cpu")
+	qc.Put(fill, "cpu1", header, body)
+	qc.End(fill)
+	if _, got, ok := qc.Get("cpu1"); !ok || string(got) != string(body) {
+		t.Errorf("got %s, %v, want hit", got, ok)
+	}
+
+	// the in-flight fill is marked stale by write
+	fill = qc.Begin("db1", "cpu")
+	qc.Invalidate("db1", "cpu")
+	qc.Put(fill, "cpu2", header, body)
+	qc.End(fill)
+	if _, _, ok := qc.Get("cpu1"); ok {
+		t.Errorf("got hit of cpu1, want invalidated")
+	}
+	if _, _, ok := qc.Get("cpu2"); ok {
+		t.Errorf("got hit of cpu2, want stale")
+	}
+
+	// the entry larger than 1/8 of limit is not cached
+	fill = qc.Begin("db1", "mem")
+	qc.Put(fill, "large", header, make([]byte, 1024))
+	qc.End(fill)
+	if _, _, ok := qc.Get("large"); ok {
+		t.Errorf("got hit of large entry, want not cached")
+	}
+
+	// the least recently used entries are evicted
+	for i := 0; i < 30; i++ {
+		fill = qc.Begin("db2", "mem")
+		qc.Put(fill, strings.Repeat("k", i+1), nil, body)
+		qc.End(fill)
+		if i == 0 {
+			qc.Get("k")
+		}
+	}
+	if qc.size > qc.maxSize || qc.evictions == 0 {
+		t.Errorf("got size %d, evictions %d, want size <= %d and evictions", qc.size, qc.evictions, qc.maxSize)
+	}
+	if _, _, ok := qc.Get("kk"); ok {
+		t.Errorf("got hit of kk, want evicted")
+	}
+
+	qc.InvalidateDB("db2")
+	qc.Set(8*1024, 0, 10)
+	fill = qc.Begin("db1", "cpu")
+	qc.Put(fill, "expired", nil, body)
+	qc.End(fill)
+	if _, _, ok := qc.Get("expired"); ok || qc.lru.Len() != 0 || len(qc.nodes) != 0 {
+		t.Errorf("got %v, %d entries, %d nodes, want expired and empty", ok, qc.lru.Len(), len(qc.nodes))
+	}
+}
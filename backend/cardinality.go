@@ -0,0 +1,219 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	CardinalityPolicyReject = "reject"
+	CardinalityPolicyDrop   = "drop"
+)
+
+var ErrInvalidCardinalityPolicy = errors.New("invalid cardinality_policy, require reject or drop")
+
+// CardinalityLimitError is returned when a new series exceeds the cardinality limit of database or measurement.
+type CardinalityLimitError struct {
+	Db          string
+	Measurement string
+	Limit       int
+}
+
+func (e *CardinalityLimitError) Error() string {
+	if e.Measurement != "" {
+		return fmt.Sprintf("max series per measurement limit exceeded: database \"%s\" measurement \"%s\" (%d)", e.Db, e.Measurement, e.Limit)
+	}
+	return fmt.Sprintf("max series per database limit exceeded: database \"%s\" (%d)", e.Db, e.Limit)
+}
+
+type dbCardinality struct {
+	series       int
+	rejected     atomic.Int64
+	dropped      atomic.Int64
+	measurements map[string]map[uint64]struct{}
+}
+
+// CardinalityLimiter tracks the distinct series written per database and measurement since startup,
+// the hashes of series keys are kept exactly so that the memory is bounded by the limits.
+type CardinalityLimiter struct {
+	lock     sync.RWMutex
+	dbLimit  int
+	mmLimit  int
+	drop     bool
+	dbs      map[string]*dbCardinality
+	descs    map[string]*prometheus.Desc
+	disabled bool
+}
+
+func NewCardinalityLimiter(dbLimit, mmLimit int, policy string) *CardinalityLimiter {
+	cl := &CardinalityLimiter{
+		dbs: make(map[string]*dbCardinality),
+		descs: map[string]*prometheus.Desc{
+			"database":    prometheus.NewDesc("influx_proxy_cardinality_database_series", "Number of distinct series written to database since startup.", []string{"database"}, nil),
+			"measurement": prometheus.NewDesc("influx_proxy_cardinality_measurement_series", "Number of distinct series written to measurement since startup.", []string{"database", "measurement"}, nil),
+			"rejected":    prometheus.NewDesc("influx_proxy_cardinality_rejected_total", "Number of lines rejected by cardinality limit.", []string{"database"}, nil),
+			"dropped":     prometheus.NewDesc("influx_proxy_cardinality_dropped_total", "Number of lines dropped by cardinality limit.", []string{"database"}, nil),
+		},
+	}
+	cl.Set(dbLimit, mmLimit, policy)
+	return cl
+}
+
+// Set changes the limits and the policy, no limit if limit <= 0, and tracking is disabled if neither limit is set.
+func (cl *CardinalityLimiter) Set(dbLimit, mmLimit int, policy string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.dbLimit, cl.mmLimit = dbLimit, mmLimit
+	cl.drop = policy == CardinalityPolicyDrop
+	cl.disabled = dbLimit <= 0 && mmLimit <= 0
+	if cl.disabled {
+		cl.dbs = make(map[string]*dbCardinality)
+	}
+}
+
+// Check returns CardinalityLimitError if the series of line is new and exceeds the limits, the dropped is true
+// instead of an error if the policy is drop. The series is not recorded until Record is called once written,
+// so the limits may be exceeded slightly by the new series written concurrently.
+func (cl *CardinalityLimiter) Check(db, mm string, line []byte) (dropped bool, err error) {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	if cl.disabled {
+		return false, nil
+	}
+	dc, ok := cl.dbs[db]
+	if !ok {
+		return false, nil
+	}
+	series := dc.measurements[mm]
+	if _, ok := series[seriesHash(line)]; ok {
+		return false, nil
+	}
+	if cl.dbLimit > 0 && dc.series >= cl.dbLimit {
+		err = &CardinalityLimitError{Db: db, Limit: cl.dbLimit}
+	} else if cl.mmLimit > 0 && len(series) >= cl.mmLimit {
+		err = &CardinalityLimitError{Db: db, Measurement: mm, Limit: cl.mmLimit}
+	}
+	if err != nil {
+		if cl.drop {
+			dc.dropped.Add(1)
+			return true, nil
+		}
+		dc.rejected.Add(1)
+		return false, err
+	}
+	return false, nil
+}
+
+// Record records the series of line which has been written.
+func (cl *CardinalityLimiter) Record(db, mm string, line []byte) {
+	cl.lock.RLock()
+	if cl.disabled {
+		cl.lock.RUnlock()
+		return
+	}
+	hash := seriesHash(line)
+	if dc, ok := cl.dbs[db]; ok {
+		if _, ok := dc.measurements[mm][hash]; ok {
+			cl.lock.RUnlock()
+			return
+		}
+	}
+	cl.lock.RUnlock()
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	dc, ok := cl.dbs[db]
+	if !ok {
+		dc = &dbCardinality{measurements: make(map[string]map[uint64]struct{})}
+		cl.dbs[db] = dc
+	}
+	series, ok := dc.measurements[mm]
+	if !ok {
+		series = make(map[uint64]struct{})
+		dc.measurements[mm] = series
+	}
+	if _, ok := series[hash]; !ok {
+		series[hash] = struct{}{}
+		dc.series++
+	}
+}
+
+// Stats returns the cardinality of database db, or all databases if db is empty.
+func (cl *CardinalityLimiter) Stats(db string) map[string]interface{} {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	policy := CardinalityPolicyReject
+	if cl.drop {
+		policy = CardinalityPolicyDrop
+	}
+	dbs := make(map[string]interface{})
+	for name, dc := range cl.dbs {
+		if db != "" && name != db {
+			continue
+		}
+		mms := make(map[string]int, len(dc.measurements))
+		for mm, series := range dc.measurements {
+			mms[mm] = len(series)
+		}
+		dbs[name] = map[string]interface{}{
+			"series":       dc.series,
+			"rejected":     dc.rejected.Load(),
+			"dropped":      dc.dropped.Load(),
+			"measurements": mms,
+		}
+	}
+	return map[string]interface{}{
+		"database_limit":    cl.dbLimit,
+		"measurement_limit": cl.mmLimit,
+		"policy":            policy,
+		"databases":         dbs,
+	}
+}
+
+func (cl *CardinalityLimiter) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range cl.descs {
+		ch <- desc
+	}
+}
+
+func (cl *CardinalityLimiter) Collect(ch chan<- prometheus.Metric) {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	for db, dc := range cl.dbs {
+		ch <- prometheus.MustNewConstMetric(cl.descs["database"], prometheus.GaugeValue, float64(dc.series), db)
+		ch <- prometheus.MustNewConstMetric(cl.descs["rejected"], prometheus.CounterValue, float64(dc.rejected.Load()), db)
+		ch <- prometheus.MustNewConstMetric(cl.descs["dropped"], prometheus.CounterValue, float64(dc.dropped.Load()), db)
+		for mm, series := range dc.measurements {
+			ch <- prometheus.MustNewConstMetric(cl.descs["measurement"], prometheus.GaugeValue, float64(len(series)), db, mm)
+		}
+	}
+}
+
+// seriesHash returns the hash of the series key of line, the tags are sorted so that the order of tags doesn't matter.
+func seriesHash(line []byte) uint64 {
+	key := line
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+		} else if line[i] == ' ' {
+			key = line[:i]
+			break
+		}
+	}
+	name, tags := models.ParseKeyBytes(key)
+	sort.Sort(tags)
+	h := fnv.New64a()
+	h.Write(models.MakeKey(name, tags))
+	return h.Sum64()
+}
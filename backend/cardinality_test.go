@@ -0,0 +1,138 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestCardinalityLimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbLimit int
+		mmLimit int
+		policy  string
+		lines   []string
+		errs    []string
+		dropped []bool
+		mms     map[string]int
+	}{
+		{
+			name:    "disabled",
+			policy:  CardinalityPolicyReject,
+			lines:   []string{"cpu,host=a value=1", "cpu,host=b value=1"},
+			errs:    []string{"", ""},
+			dropped: []bool{false, false},
+		},
+		{
+			name:    "measurement limit",
+			mmLimit: 2,
+			policy:  CardinalityPolicyReject,
+			lines:   []string{"cpu,host=a,region=x value=1", "cpu,region=x,host=a value=2 1596819659", "cpu,host=b value=1", "cpu,host=c value=1", "mem,host=c value=1"},
+			errs:    []string{"", "", "", "max series per measurement limit exceeded: database \"db1\" measurement \"cpu\" (2)", ""},
+			dropped: []bool{false, false, false, false, false},
+		},
+		{
+			name:    "database limit",
+			dbLimit: 2,
+			policy:  CardinalityPolicyReject,
+			lines:   []string{"cpu,host=a value=1", "mem,host=a value=1", "disk,host=a value=1", "cpu,host=a value=2"},
+			errs:    []string{"", "", "max series per database limit exceeded: database \"db1\" (2)", ""},
+			dropped: []bool{false, false, false, false},
+			mms:     map[string]int{"cpu": 1, "mem": 1},
+		},
+		{
+			name:    "drop",
+			dbLimit: 1,
+			policy:  CardinalityPolicyDrop,
+			lines:   []string{"cpu,host=a value=1", "cpu,host=b value=1"},
+			errs:    []string{"", ""},
+			dropped: []bool{false, true},
+		},
+	}
+	for _, tt := range tests {
+		cl := NewCardinalityLimiter(tt.dbLimit, tt.mmLimit, tt.policy)
+		for i, line := range tt.lines {
+			mm, _ := ScanKey([]byte(line))
+			dropped, err := cl.Check("db1", mm, []byte(line))
+			if (err == nil && tt.errs[i] != "") || (err != nil && err.Error() != tt.errs[i]) || dropped != tt.dropped[i] {
+				t.Errorf("%v: line %d: got %v, %v, want %v, %q", tt.name, i+1, dropped, err, tt.dropped[i], tt.errs[i])
+			}
+			if err == nil && !dropped {
+				cl.Record("db1", mm, []byte(line))
+			}
+		}
+		if tt.mms != nil {
+			stats := cl.Stats("db1")["databases"].(map[string]interface{})["db1"].(map[string]interface{})
+			if mms := stats["measurements"].(map[string]int); !reflect.DeepEqual(mms, tt.mms) {
+				t.Errorf("%v: got measurements %v, want %v", tt.name, mms, tt.mms)
+			}
+		}
+	}
+}
+
+func TestProxyCardinalityLimit(t *testing.T) {
+	ip := newTestProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ip.Cardinality().Set(0, 1, CardinalityPolicyReject)
+	err := ip.Write([]byte("cpu,host=a value=1\ncpu,host=b value=1\ncpu,host=a value=2\n"), "db1", "", "ns")
+	var perr *PartialWriteError
+	if !errors.As(err, &perr) || perr.Dropped != 1 || perr.Errors[0].Line != 2 {
+		t.Fatalf("got %v, want partial write error of line 2", err)
+	}
+	stats := ip.Cardinality().Stats("db1")["databases"].(map[string]interface{})["db1"].(map[string]interface{})
+	if stats["series"] != 1 || stats["rejected"] != int64(1) {
+		t.Errorf("got stats %v, want 1 series and 1 rejected", stats)
+	}
+	if !strings.Contains(err.Error(), "max series per measurement limit exceeded") {
+		t.Errorf("got %v, want limit exceeded", err)
+	}
+}
+
+func TestProxyWritePointsCardinalityLimit(t *testing.T) {
+	ip := newTestProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ip.Cardinality().Set(0, 1, CardinalityPolicyReject)
+	points, err := models.ParsePointsString("cpu,host=a value=1\ncpu,host=b value=1\ncpu,host=a value=2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cerr *CardinalityLimitError
+	if err = ip.WritePoints(points, "db1", ""); !errors.As(err, &cerr) {
+		t.Fatalf("got %v, want cardinality limit error", err)
+	}
+	stats := ip.Cardinality().Stats("db1")["databases"].(map[string]interface{})["db1"].(map[string]interface{})
+	if stats["series"] != 1 || stats["rejected"] != int64(1) {
+		t.Errorf("got stats %v, want 1 series and 1 rejected", stats)
+	}
+}
+
+func TestProxyCardinalityBufferFull(t *testing.T) {
+	ip := newTestProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ip.Cardinality().Set(0, 1, CardinalityPolicyReject)
+	ip.budget.Set(16, BufferPolicyReject)
+	if err := ip.WriteRow([]byte("cpu,host=a value=1"), "db1", "", "ns"); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("got %v, want buffer full error", err)
+	}
+	// the series not written doesn't consume the quota
+	ip.budget.Set(0, BufferPolicyReject)
+	if err := ip.WriteRow([]byte("cpu,host=b value=1"), "db1", "", "ns"); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	stats := ip.Cardinality().Stats("db1")["databases"].(map[string]interface{})["db1"].(map[string]interface{})
+	if stats["series"] != 1 || stats["rejected"] != int64(0) {
+		t.Errorf("got stats %v, want 1 series and 0 rejected", stats)
+	}
+}
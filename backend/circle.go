@@ -9,32 +9,91 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/influxdata/influxdb1-client/models"
 	"stathat.com/c/consistent"
 )
 
 type Circle struct {
 	CircleId     int //nolint:all
 	Name         string
-	Backends     []*Backend
-	getKeyFn     func(string, string) string
+	backends     []*Backend
+	sTpl         *shardTpl
+	hashKey      string
+	budget       *MemoryBudget
+	schema       *SchemaCache
+	cache        *QueryCache
+	lock         sync.RWMutex
 	router       *consistent.Consistent
 	routerCache  sync.Map
 	mapToBackend map[string]*Backend
 }
 
-func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int) (ic *Circle) { //nolint:all
+func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int, budget *MemoryBudget, schema *SchemaCache, cache *QueryCache) (ic *Circle) { //nolint:all
 	ic = &Circle{
-		CircleId:     circleId,
-		Name:         cfg.Name,
-		Backends:     make([]*Backend, len(cfg.Backends)),
-		router:       consistent.New(),
-		mapToBackend: make(map[string]*Backend),
+		CircleId: circleId,
+		Name:     cfg.Name,
+		backends: make([]*Backend, len(cfg.Backends)),
+		hashKey:  pxcfg.HashKey,
+		budget:   budget,
+		schema:   schema,
+		cache:    cache,
 	}
+	for idx, bkcfg := range cfg.Backends {
+		ic.backends[idx] = NewBackend(bkcfg, pxcfg, budget, schema, cache)
+	}
+	ic.buildRouter()
+	return
+}
+
+func (ic *Circle) buildRouter() {
+	ic.router = consistent.New()
 	ic.router.NumberOfReplicas = 256
+	ic.mapToBackend = make(map[string]*Backend)
+	for idx, be := range ic.backends {
+		ic.addRouter(be, idx, ic.hashKey)
+	}
+}
+
+// Backends returns the backends of the circle. The slice is replaced rather than modified on reload,
+// so it's safe to be iterated without lock.
+func (ic *Circle) Backends() []*Backend {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.backends
+}
+
+// Reload makes the backends of the circle match cfg, then rebuilds the router and clears the router cache.
+// Existing backends are kept along with their buffers, the removed backends are returned and should be closed
+// once the writes routed to them are done.
+func (ic *Circle) Reload(cfg *CircleConfig, pxcfg *ProxyConfig) (added []*Backend, removed []*Backend) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	olds := make(map[string]*Backend, len(ic.backends))
+	for _, be := range ic.backends {
+		olds[be.Name] = be
+	}
+	backends := make([]*Backend, len(cfg.Backends))
 	for idx, bkcfg := range cfg.Backends {
-		ic.Backends[idx] = NewBackend(bkcfg, pxcfg)
-		ic.addRouter(ic.Backends[idx], idx, pxcfg.HashKey)
+		if be, ok := olds[bkcfg.Name]; ok {
+			be.Reload(pxcfg)
+			backends[idx] = be
+			delete(olds, bkcfg.Name)
+		} else {
+			backends[idx] = NewBackend(bkcfg, pxcfg, ic.budget, ic.schema, ic.cache)
+			added = append(added, backends[idx])
+		}
+	}
+	for _, be := range ic.backends {
+		if _, ok := olds[be.Name]; ok {
+			removed = append(removed, be)
+		}
 	}
+	ic.backends = backends
+	ic.buildRouter()
+	ic.routerCache.Range(func(key, _ interface{}) bool {
+		ic.routerCache.Delete(key)
+		return true
+	})
 	return
 }
 
@@ -63,6 +122,8 @@ func (ic *Circle) addRouter(be *Backend, idx int, hashKey string) {
 }
 
 func (ic *Circle) GetBackend(key string) *Backend {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
 	if be, ok := ic.routerCache.Load(key); ok {
 		return be.(*Backend)
 	}
@@ -72,10 +133,26 @@ func (ic *Circle) GetBackend(key string) *Backend {
 	return be
 }
 
+// isInplace returns whether the measurement mm of database db in backend ib is routed to ib,
+// all the series of the measurement are checked if the measurement is sharded by tags.
+func (ic *Circle) isInplace(ib *Backend, db, mm string) bool {
+	if !ic.sTpl.HasTags() {
+		return ic.GetBackend(ic.sTpl.GetKey(db, mm)).Url == ib.Url
+	}
+	for _, series := range ib.GetSeries(db, mm) {
+		key := ic.sTpl.GetKeyWithTags(db, mm, models.ParseTags([]byte(series)))
+		if ic.GetBackend(key).Url != ib.Url {
+			return false
+		}
+	}
+	return true
+}
+
 func (ic *Circle) GetHealth(stats bool) interface{} {
 	var wg sync.WaitGroup
-	backends := make([]interface{}, len(ic.Backends))
-	for i, be := range ic.Backends {
+	bes := ic.Backends()
+	backends := make([]interface{}, len(bes))
+	for i, be := range bes {
 		wg.Add(1)
 		go func(i int, be *Backend) {
 			defer wg.Done()
@@ -97,7 +174,7 @@ func (ic *Circle) GetHealth(stats bool) interface{} {
 }
 
 func (ic *Circle) IsActive() bool {
-	for _, be := range ic.Backends {
+	for _, be := range ic.Backends() {
 		if !be.IsActive() {
 			return false
 		}
@@ -106,7 +183,7 @@ func (ic *Circle) IsActive() bool {
 }
 
 func (ic *Circle) IsWriteOnly() bool {
-	for _, be := range ic.Backends {
+	for _, be := range ic.Backends() {
 		if be.IsWriteOnly() {
 			return true
 		}
@@ -114,14 +191,23 @@ func (ic *Circle) IsWriteOnly() bool {
 	return false
 }
 
+func (ic *Circle) IsRewriting() bool {
+	for _, be := range ic.Backends() {
+		if be.IsRewriting() {
+			return true
+		}
+	}
+	return false
+}
+
 func (ic *Circle) SetTransferIn(b bool) {
-	for _, be := range ic.Backends {
+	for _, be := range ic.Backends() {
 		be.SetTransferIn(b)
 	}
 }
 
 func (ic *Circle) Close() {
-	for _, be := range ic.Backends {
+	for _, be := range ic.Backends() {
 		be.Close()
 	}
 }
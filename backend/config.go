@@ -6,7 +6,9 @@ package backend
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"reflect"
 	"strings"
 
 	"github.com/chengshiwen/influx-proxy/backend/tls"
@@ -22,14 +24,15 @@ var (
 )
 
 var (
-	HashKeyIdx    = "idx"
-	HashKeyExi    = "exi"
-	HashKeyName   = "name"
-	HashKeyURL    = "url"
-	HashKeyVarIdx = "%idx"
-	ShardKeyVarDb = "%db"
-	ShardKeyVarMm = "%mm"
-	ShardKeyDbMm  = "%db,%mm"
+	HashKeyIdx     = "idx"
+	HashKeyExi     = "exi"
+	HashKeyName    = "name"
+	HashKeyURL     = "url"
+	HashKeyVarIdx  = "%idx"
+	ShardKeyVarDb  = "%db"
+	ShardKeyVarMm  = "%mm"
+	ShardKeyVarTag = "%tag"
+	ShardKeyDbMm   = "%db,%mm"
 )
 
 var (
@@ -38,16 +41,27 @@ var (
 	ErrEmptyBackendName      = errors.New("backend name cannot be empty")
 	ErrDuplicatedBackendName = errors.New("backend name duplicated")
 	ErrInvalidHashKey        = errors.New("invalid hash_key, require idx, exi, name, url or template containing %idx")
-	ErrInvalidShardKey       = errors.New("invalid shard_key, require template containing %db or %mm")
+	ErrInvalidShardKey       = errors.New("invalid shard_key, require template containing %db or %mm, and optional %tag(name)")
+	ErrEmptyConfigFile       = errors.New("config file is empty, proxy was not loaded from file")
+	ErrReloadCircles         = errors.New("circles cannot be added, removed or renamed on reload")
+	ErrEmptyUDPBindAddr      = errors.New("udp bind_addr cannot be empty")
+	ErrEmptyUDPDatabase      = errors.New("udp database cannot be empty")
+	ErrEmptyGraphiteBindAddr = errors.New("graphite bind_addr cannot be empty")
+	ErrEmptyGraphiteDatabase = errors.New("graphite database cannot be empty")
+	ErrInvalidGraphiteProto  = errors.New("invalid graphite protocol, require tcp, udp or pickle")
+	ErrEmptyOpenTSDBDatabase = errors.New("opentsdb database cannot be empty")
+	ErrInvalidMetricVersion  = errors.New("invalid prom_write metric_version, require 1 or 2")
+	ErrDuplicatedPromWriteDB = errors.New("prom_write database duplicated")
 )
 
 type BackendConfig struct { //nolint:all
-	Name        string `mapstructure:"name"`
-	Url         string `mapstructure:"url"` //nolint:all
-	Username    string `mapstructure:"username"`
-	Password    string `mapstructure:"password"`
-	AuthEncrypt bool   `mapstructure:"auth_encrypt"`
-	WriteOnly   bool   `mapstructure:"write_only"`
+	Name           string `mapstructure:"name"`
+	Url            string `mapstructure:"url"` //nolint:all
+	Username       string `mapstructure:"username"`
+	Password       string `mapstructure:"password"`
+	AuthEncrypt    bool   `mapstructure:"auth_encrypt"`
+	WriteOnly      bool   `mapstructure:"write_only"`
+	NativePromRead bool   `mapstructure:"native_prom_read"`
 }
 
 type CircleConfig struct {
@@ -55,51 +69,127 @@ type CircleConfig struct {
 	Backends []*BackendConfig `mapstructure:"backends"`
 }
 
+type UDPConfig struct {
+	BindAddr        string `mapstructure:"bind_addr"`
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+	Precision       string `mapstructure:"precision"`
+	ReadBuffer      int    `mapstructure:"read_buffer"`
+	BatchSize       int    `mapstructure:"batch_size"`
+	BatchPending    int    `mapstructure:"batch_pending"`
+	BatchTimeout    int    `mapstructure:"batch_timeout"`
+}
+
+type GraphiteConfig struct {
+	BindAddr        string   `mapstructure:"bind_addr"`
+	Protocol        string   `mapstructure:"protocol"`
+	Database        string   `mapstructure:"database"`
+	RetentionPolicy string   `mapstructure:"retention_policy"`
+	Separator       string   `mapstructure:"separator"`
+	Templates       []string `mapstructure:"templates"`
+	ReadBuffer      int      `mapstructure:"read_buffer"`
+}
+
+type OpenTSDBConfig struct {
+	BindAddr        string `mapstructure:"bind_addr"`
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+}
+
+type OTLPConfig struct {
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+}
+
+type PromWriteConfig struct {
+	Database      string `mapstructure:"database"`
+	MetricVersion int    `mapstructure:"metric_version"`
+	KeepStale     bool   `mapstructure:"keep_stale"`
+	Metadata      bool   `mapstructure:"metadata"`
+}
+
 type ProxyConfig struct {
-	Circles         []*CircleConfig `mapstructure:"circles"`
-	ListenAddr      string          `mapstructure:"listen_addr"`
-	DBList          []string        `mapstructure:"db_list"`
-	DataDir         string          `mapstructure:"data_dir"`
-	TLogDir         string          `mapstructure:"tlog_dir"`
-	HashKey         string          `mapstructure:"hash_key"`
-	ShardKey        string          `mapstructure:"shard_key"`
-	FlushSize       int             `mapstructure:"flush_size"`
-	FlushTime       int             `mapstructure:"flush_time"`
-	CheckInterval   int             `mapstructure:"check_interval"`
-	RewriteInterval int             `mapstructure:"rewrite_interval"`
-	RewriteThreads  int             `mapstructure:"rewrite_threads"`
-	ConnPoolSize    int             `mapstructure:"conn_pool_size"`
-	WriteTimeout    int             `mapstructure:"write_timeout"`
-	IdleTimeout     int             `mapstructure:"idle_timeout"`
-	Username        string          `mapstructure:"username"`
-	Password        string          `mapstructure:"password"`
-	AuthEncrypt     bool            `mapstructure:"auth_encrypt"`
-	PingAuthEnabled bool            `mapstructure:"ping_auth_enabled"`
-	WriteTracing    bool            `mapstructure:"write_tracing"`
-	QueryTracing    bool            `mapstructure:"query_tracing"`
-	PprofEnabled    bool            `mapstructure:"pprof_enabled"`
-	HTTPSEnabled    bool            `mapstructure:"https_enabled"`
-	HTTPSCert       string          `mapstructure:"https_cert"`
-	HTTPSKey        string          `mapstructure:"https_key"`
-	TLS             *tls.Config     `mapstructure:"tls"`
+	Circles            []*CircleConfig    `mapstructure:"circles"`
+	ListenAddr         string             `mapstructure:"listen_addr"`
+	UDP                []*UDPConfig       `mapstructure:"udp"`
+	Graphite           []*GraphiteConfig  `mapstructure:"graphite"`
+	OpenTSDB           *OpenTSDBConfig    `mapstructure:"opentsdb"`
+	OTLP               *OTLPConfig        `mapstructure:"otlp"`
+	PromWrite          []*PromWriteConfig `mapstructure:"prom_write"`
+	NativePromRead     bool               `mapstructure:"native_prom_read"`
+	DBList             []string           `mapstructure:"db_list"`
+	DataDir            string             `mapstructure:"data_dir"`
+	TLogDir            string             `mapstructure:"tlog_dir"`
+	HashKey            string             `mapstructure:"hash_key"`
+	ShardKey           string             `mapstructure:"shard_key"`
+	FlushSize          int                `mapstructure:"flush_size"`
+	FlushTime          int                `mapstructure:"flush_time"`
+	CheckInterval      int                `mapstructure:"check_interval"`
+	RewriteInterval    int                `mapstructure:"rewrite_interval"`
+	RewriteThreads     int                `mapstructure:"rewrite_threads"`
+	ConnPoolSize       int                `mapstructure:"conn_pool_size"`
+	WriteTimeout       int                `mapstructure:"write_timeout"`
+	IdleTimeout        int                `mapstructure:"idle_timeout"`
+	ShutdownTimeout    int                `mapstructure:"shutdown_timeout"`
+	ConsistencyTimeout int                `mapstructure:"consistency_timeout"`
+	MaxBodySize        int                `mapstructure:"max_body_size"`
+	MaxDecompressSize  int                `mapstructure:"max_decompress_size"`
+	MaxLineSize        int                `mapstructure:"max_line_size"`
+	BufferMemoryLimit  int                `mapstructure:"buffer_memory_limit"`
+	BufferPolicy       string             `mapstructure:"buffer_policy"`
+	SchemaCacheEnabled bool               `mapstructure:"schema_cache_enabled"`
+	CardinalityDBLimit int                `mapstructure:"cardinality_db_limit"`
+	CardinalityMmLimit int                `mapstructure:"cardinality_measurement_limit"`
+	CardinalityPolicy  string             `mapstructure:"cardinality_policy"`
+	QueryCacheSize     int                `mapstructure:"query_cache_size"`
+	QueryCacheTTL      int                `mapstructure:"query_cache_ttl"`
+	QueryCacheBucket   int                `mapstructure:"query_cache_now_bucket"`
+	WALEnabled         bool               `mapstructure:"wal_enabled"`
+	WALFsync           string             `mapstructure:"wal_fsync"`
+	WALFsyncTime       int                `mapstructure:"wal_fsync_time"`
+	DeadLetterEnabled  bool               `mapstructure:"dead_letter_enabled"`
+	Username           string             `mapstructure:"username"`
+	Password           string             `mapstructure:"password"`
+	AuthEncrypt        bool               `mapstructure:"auth_encrypt"`
+	PingAuthEnabled    bool               `mapstructure:"ping_auth_enabled"`
+	WriteTracing       bool               `mapstructure:"write_tracing"`
+	QueryTracing       bool               `mapstructure:"query_tracing"`
+	PprofEnabled       bool               `mapstructure:"pprof_enabled"`
+	HTTPSEnabled       bool               `mapstructure:"https_enabled"`
+	HTTPSCert          string             `mapstructure:"https_cert"`
+	HTTPSKey           string             `mapstructure:"https_key"`
+	TLS                *tls.Config        `mapstructure:"tls"`
+
+	file string
 }
 
 func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
-	viper.SetConfigFile(cfgfile)
-	err = viper.ReadInConfig()
+	// a private viper per load, since the global one is not safe to be read again concurrently on reload
+	v := viper.New()
+	v.SetConfigFile(cfgfile)
+	err = v.ReadInConfig()
 	if err != nil {
 		return
 	}
 	cfg = &ProxyConfig{}
-	err = viper.Unmarshal(cfg)
+	err = v.Unmarshal(cfg)
 	if err != nil {
 		return
 	}
+	cfg.file = cfgfile
 	cfg.setDefault()
 	err = cfg.checkConfig()
 	return
 }
 
+// Reload reads the config file which cfg was loaded from again.
+func (cfg *ProxyConfig) Reload() (*ProxyConfig, error) {
+	if cfg.file == "" {
+		return nil, ErrEmptyConfigFile
+	}
+	return NewFileConfig(cfg.file)
+}
+
 func (cfg *ProxyConfig) setDefault() {
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = ":7076"
@@ -140,6 +230,60 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.IdleTimeout <= 0 {
 		cfg.IdleTimeout = 10
 	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 30
+	}
+	if cfg.ConsistencyTimeout <= 0 {
+		cfg.ConsistencyTimeout = 10
+	}
+	if cfg.MaxLineSize <= 0 {
+		cfg.MaxLineSize = 1048576
+	}
+	if cfg.BufferPolicy == "" {
+		cfg.BufferPolicy = BufferPolicySpill
+	}
+	for _, udp := range cfg.UDP {
+		if udp.Precision == "" {
+			udp.Precision = "ns"
+		}
+		if udp.BatchSize <= 0 {
+			udp.BatchSize = 5000
+		}
+		if udp.BatchPending <= 0 {
+			udp.BatchPending = 1000
+		}
+		if udp.BatchTimeout <= 0 {
+			udp.BatchTimeout = 1
+		}
+	}
+	for _, graphite := range cfg.Graphite {
+		if graphite.Protocol == "" {
+			graphite.Protocol = "tcp"
+		}
+		if graphite.Separator == "" {
+			graphite.Separator = "."
+		}
+	}
+	for _, pw := range cfg.PromWrite {
+		if pw.MetricVersion == 0 {
+			pw.MetricVersion = 1
+		}
+	}
+	if cfg.CardinalityPolicy == "" {
+		cfg.CardinalityPolicy = CardinalityPolicyReject
+	}
+	if cfg.QueryCacheTTL <= 0 {
+		cfg.QueryCacheTTL = 60
+	}
+	if cfg.QueryCacheBucket <= 0 {
+		cfg.QueryCacheBucket = 10
+	}
+	if cfg.WALFsync == "" {
+		cfg.WALFsync = WALFsyncInterval
+	}
+	if cfg.WALFsyncTime <= 0 {
+		cfg.WALFsyncTime = 1
+	}
 }
 
 func (cfg *ProxyConfig) checkConfig() (err error) {
@@ -167,6 +311,47 @@ func (cfg *ProxyConfig) checkConfig() (err error) {
 	if !strings.Contains(cfg.ShardKey, ShardKeyVarDb) && !strings.Contains(cfg.ShardKey, ShardKeyVarMm) {
 		return ErrInvalidShardKey
 	}
+	if cfg.BufferPolicy != BufferPolicySpill && cfg.BufferPolicy != BufferPolicyReject {
+		return ErrInvalidBufferPolicy
+	}
+	for _, udp := range cfg.UDP {
+		if udp.BindAddr == "" {
+			return ErrEmptyUDPBindAddr
+		}
+		if udp.Database == "" {
+			return ErrEmptyUDPDatabase
+		}
+	}
+	for _, graphite := range cfg.Graphite {
+		if graphite.BindAddr == "" {
+			return ErrEmptyGraphiteBindAddr
+		}
+		if graphite.Database == "" {
+			return ErrEmptyGraphiteDatabase
+		}
+		if graphite.Protocol != "tcp" && graphite.Protocol != "udp" && graphite.Protocol != "pickle" {
+			return ErrInvalidGraphiteProto
+		}
+	}
+	if cfg.OpenTSDB != nil && cfg.OpenTSDB.BindAddr != "" && cfg.OpenTSDB.Database == "" {
+		return ErrEmptyOpenTSDBDatabase
+	}
+	dbs := util.NewSet()
+	for _, pw := range cfg.PromWrite {
+		if pw.MetricVersion != 1 && pw.MetricVersion != 2 {
+			return ErrInvalidMetricVersion
+		}
+		if dbs[pw.Database] {
+			return ErrDuplicatedPromWriteDB
+		}
+		dbs.Add(pw.Database)
+	}
+	if cfg.CardinalityPolicy != CardinalityPolicyReject && cfg.CardinalityPolicy != CardinalityPolicyDrop {
+		return ErrInvalidCardinalityPolicy
+	}
+	if cfg.WALFsync != WALFsyncAlways && cfg.WALFsync != WALFsyncInterval && cfg.WALFsync != WALFsyncNone {
+		return ErrInvalidWALFsync
+	}
 	if cfg.TLS != nil {
 		if err := cfg.TLS.Validate(); err != nil {
 			return err
@@ -175,6 +360,80 @@ func (cfg *ProxyConfig) checkConfig() (err error) {
 	return
 }
 
+// CheckReload reports an error if ncfg contains changes which cannot be applied to a running proxy.
+// Database list, auth, tracing, flush, rewrite, shutdown and consistency settings, and backends of the existing circles are reloadable.
+func (cfg *ProxyConfig) CheckReload(ncfg *ProxyConfig) error {
+	if len(cfg.Circles) != len(ncfg.Circles) {
+		return ErrReloadCircles
+	}
+	for idx, circle := range cfg.Circles {
+		if circle.Name != ncfg.Circles[idx].Name {
+			return ErrReloadCircles
+		}
+	}
+	bkcfgs := make(map[string]*BackendConfig)
+	for _, circle := range cfg.Circles {
+		for _, bkcfg := range circle.Backends {
+			bkcfgs[bkcfg.Name] = bkcfg
+		}
+	}
+	for idx, circle := range ncfg.Circles {
+		for _, bkcfg := range circle.Backends {
+			obkcfg, ok := bkcfgs[bkcfg.Name]
+			if !ok {
+				continue
+			}
+			if *obkcfg != *bkcfg {
+				return fmt.Errorf("backend %s changed, remove it and add a backend with a new name instead", bkcfg.Name)
+			}
+			if !cfg.containsBackend(idx, bkcfg.Name) {
+				return fmt.Errorf("backend %s cannot be moved to another circle", bkcfg.Name)
+			}
+		}
+	}
+	restarts := []struct {
+		name    string
+		changed bool
+	}{
+		{"listen_addr", cfg.ListenAddr != ncfg.ListenAddr},
+		{"udp", !reflect.DeepEqual(cfg.UDP, ncfg.UDP)},
+		{"graphite", !reflect.DeepEqual(cfg.Graphite, ncfg.Graphite)},
+		{"opentsdb", !reflect.DeepEqual(cfg.OpenTSDB, ncfg.OpenTSDB)},
+		{"data_dir", cfg.DataDir != ncfg.DataDir},
+		{"tlog_dir", cfg.TLogDir != ncfg.TLogDir},
+		{"hash_key", cfg.HashKey != ncfg.HashKey},
+		{"shard_key", cfg.ShardKey != ncfg.ShardKey},
+		{"check_interval", cfg.CheckInterval != ncfg.CheckInterval},
+		{"conn_pool_size", cfg.ConnPoolSize != ncfg.ConnPoolSize},
+		{"write_timeout", cfg.WriteTimeout != ncfg.WriteTimeout},
+		{"idle_timeout", cfg.IdleTimeout != ncfg.IdleTimeout},
+		{"wal_enabled", cfg.WALEnabled != ncfg.WALEnabled},
+		{"wal_fsync", cfg.WALFsync != ncfg.WALFsync},
+		{"wal_fsync_time", cfg.WALFsyncTime != ncfg.WALFsyncTime},
+		{"dead_letter_enabled", cfg.DeadLetterEnabled != ncfg.DeadLetterEnabled},
+		{"pprof_enabled", cfg.PprofEnabled != ncfg.PprofEnabled},
+		{"https_enabled", cfg.HTTPSEnabled != ncfg.HTTPSEnabled},
+		{"https_cert", cfg.HTTPSCert != ncfg.HTTPSCert},
+		{"https_key", cfg.HTTPSKey != ncfg.HTTPSKey},
+		{"tls", !reflect.DeepEqual(cfg.TLS, ncfg.TLS)},
+	}
+	for _, r := range restarts {
+		if r.changed {
+			return fmt.Errorf("%s cannot be changed on reload, restart is required", r.name)
+		}
+	}
+	return nil
+}
+
+func (cfg *ProxyConfig) containsBackend(circleId int, name string) bool { //nolint:all
+	for _, bkcfg := range cfg.Circles[circleId].Backends {
+		if bkcfg.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (cfg *ProxyConfig) PrintSummary() {
 	log.Printf("%d circles loaded from file", len(cfg.Circles))
 	for id, circle := range cfg.Circles {
@@ -186,6 +445,30 @@ func (cfg *ProxyConfig) PrintSummary() {
 		log.Printf("db list: %v", cfg.DBList)
 	}
 	log.Printf("auth: %t, encrypt: %t", cfg.Username != "" || cfg.Password != "", cfg.AuthEncrypt)
+	if cfg.WALEnabled {
+		log.Printf("wal: enabled, fsync: %s", cfg.WALFsync)
+	}
+	if cfg.DeadLetterEnabled {
+		log.Printf("dead letter: enabled")
+	}
+	for _, udp := range cfg.UDP {
+		log.Printf("udp: listen on %s, db: %s, rp: %s, precision: %s", udp.BindAddr, udp.Database, udp.RetentionPolicy, udp.Precision)
+	}
+	for _, graphite := range cfg.Graphite {
+		log.Printf("graphite: listen on %s/%s, db: %s, rp: %s, templates: %d", graphite.BindAddr, graphite.Protocol, graphite.Database, graphite.RetentionPolicy, len(graphite.Templates))
+	}
+	if cfg.OpenTSDB != nil && cfg.OpenTSDB.Database != "" {
+		log.Printf("opentsdb: listen on %s, db: %s, rp: %s", cfg.OpenTSDB.BindAddr, cfg.OpenTSDB.Database, cfg.OpenTSDB.RetentionPolicy)
+	}
+	if cfg.OTLP != nil && cfg.OTLP.Database != "" {
+		log.Printf("otlp: db: %s, rp: %s", cfg.OTLP.Database, cfg.OTLP.RetentionPolicy)
+	}
+	if cfg.NativePromRead {
+		log.Printf("native prom read: enabled")
+	}
+	for _, pw := range cfg.PromWrite {
+		log.Printf("prom write: db: %s, metric version: %d, keep stale: %t, metadata: %t", pw.Database, pw.MetricVersion, pw.KeepStale, pw.Metadata)
+	}
 }
 
 func (cfg *ProxyConfig) String() string {
@@ -0,0 +1,122 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "testing"
+
+func newTestConfig() *ProxyConfig {
+	cfg := &ProxyConfig{
+		Circles: []*CircleConfig{
+			{
+				Name: "circle-1",
+				Backends: []*BackendConfig{
+					{Name: "influxdb-1-1", Url: "http://127.0.0.1:8086"},
+					{Name: "influxdb-1-2", Url: "http://127.0.0.1:8087"},
+				},
+			},
+			{
+				Name: "circle-2",
+				Backends: []*BackendConfig{
+					{Name: "influxdb-2-1", Url: "http://127.0.0.1:8088"},
+					{Name: "influxdb-2-2", Url: "http://127.0.0.1:8089"},
+				},
+			},
+		},
+	}
+	cfg.setDefault()
+	return cfg
+}
+
+func TestCheckReload(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *ProxyConfig)
+		valid  bool
+	}{
+		{
+			name:   "unchanged",
+			modify: func(cfg *ProxyConfig) {},
+			valid:  true,
+		},
+		{
+			name: "reloadable",
+			modify: func(cfg *ProxyConfig) {
+				cfg.DBList = []string{"db1", "db2"}
+				cfg.Username = "admin"
+				cfg.Password = "secret"
+				cfg.FlushSize = 5000
+				cfg.FlushTime = 3
+				cfg.RewriteInterval = 30
+				cfg.WriteTracing = true
+			},
+			valid: true,
+		},
+		{
+			name: "add backend",
+			modify: func(cfg *ProxyConfig) {
+				cfg.Circles[0].Backends = append(cfg.Circles[0].Backends, &BackendConfig{Name: "influxdb-1-3", Url: "http://127.0.0.1:8090"})
+			},
+			valid: true,
+		},
+		{
+			name: "remove backend",
+			modify: func(cfg *ProxyConfig) {
+				cfg.Circles[1].Backends = cfg.Circles[1].Backends[:1]
+			},
+			valid: true,
+		},
+		{
+			name: "change backend url",
+			modify: func(cfg *ProxyConfig) {
+				cfg.Circles[0].Backends[0].Url = "http://127.0.0.1:9086"
+			},
+			valid: false,
+		},
+		{
+			name: "move backend",
+			modify: func(cfg *ProxyConfig) {
+				be := cfg.Circles[0].Backends[1]
+				cfg.Circles[0].Backends = cfg.Circles[0].Backends[:1]
+				cfg.Circles[1].Backends = append(cfg.Circles[1].Backends, be)
+			},
+			valid: false,
+		},
+		{
+			name: "add circle",
+			modify: func(cfg *ProxyConfig) {
+				cfg.Circles = append(cfg.Circles, &CircleConfig{Name: "circle-3", Backends: []*BackendConfig{{Name: "influxdb-3-1"}}})
+			},
+			valid: false,
+		},
+		{
+			name: "rename circle",
+			modify: func(cfg *ProxyConfig) {
+				cfg.Circles[1].Name = "circle-3"
+			},
+			valid: false,
+		},
+		{
+			name: "change shard key",
+			modify: func(cfg *ProxyConfig) {
+				cfg.ShardKey = "%db"
+			},
+			valid: false,
+		},
+		{
+			name: "change listen addr",
+			modify: func(cfg *ProxyConfig) {
+				cfg.ListenAddr = ":7077"
+			},
+			valid: false,
+		},
+	}
+	for _, tt := range tests {
+		cfg, ncfg := newTestConfig(), newTestConfig()
+		tt.modify(ncfg)
+		if err := cfg.CheckReload(ncfg); (err == nil) != tt.valid {
+			t.Errorf("%v: got %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
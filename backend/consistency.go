@@ -0,0 +1,203 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ConsistencyLevel int
+
+const (
+	ConsistencyAny ConsistencyLevel = iota
+	ConsistencyOne
+	ConsistencyQuorum
+	ConsistencyAll
+)
+
+func ParseConsistencyLevel(level string) (ConsistencyLevel, error) {
+	switch strings.ToLower(level) {
+	case "", "any":
+		return ConsistencyAny, nil
+	case "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	}
+	return ConsistencyAny, fmt.Errorf("invalid consistency %q (use any, one, quorum or all)", level)
+}
+
+func (cl ConsistencyLevel) String() string {
+	switch cl {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	}
+	return "any"
+}
+
+// Required returns the number of circles required to be written for the level.
+func (cl ConsistencyLevel) Required(circles int) int {
+	switch cl {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyQuorum:
+		return circles/2 + 1
+	case ConsistencyAll:
+		return circles
+	}
+	return 0
+}
+
+// ConsistencyError is returned when the consistency level of a write is not met.
+type ConsistencyError struct {
+	Level    ConsistencyLevel
+	Required int
+	Written  int
+	Total    int
+	Timeout  bool
+	Errors   []string
+}
+
+func (e *ConsistencyError) Error() string {
+	var b strings.Builder
+	if e.Timeout {
+		b.WriteString("timeout: ")
+	} else {
+		b.WriteString("write failed: ")
+	}
+	fmt.Fprintf(&b, "consistency level %s not met, %d of %d circles written, %d required", e.Level, e.Written, e.Total, e.Required)
+	if len(e.Errors) > 0 {
+		fmt.Fprintf(&b, ": %s", strings.Join(e.Errors, "; "))
+	}
+	return b.String()
+}
+
+// WriteAck tracks the points of a write until they are written to backend or file in the required number of circles.
+type WriteAck struct {
+	lock     sync.Mutex
+	level    ConsistencyLevel
+	required int
+	circles  []*circleAck
+	sealed   bool
+	finished bool
+	done     chan struct{}
+	err      error
+}
+
+type circleAck struct {
+	wa      *WriteAck
+	id      int
+	pending int
+	err     error
+}
+
+func NewWriteAck(level ConsistencyLevel, circles int) *WriteAck {
+	wa := &WriteAck{
+		level:    level,
+		required: level.Required(circles),
+		circles:  make([]*circleAck, circles),
+		done:     make(chan struct{}),
+	}
+	for i := range wa.circles {
+		wa.circles[i] = &circleAck{wa: wa, id: i}
+	}
+	return wa
+}
+
+// circle returns the tracker of circle id, and counts a pending point of the circle.
+func (wa *WriteAck) circle(id int) *circleAck {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	ca := wa.circles[id]
+	ca.pending++
+	return ca
+}
+
+// Seal marks that all points of the write have been routed.
+func (wa *WriteAck) Seal() {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	wa.sealed = true
+	wa.check()
+}
+
+// Wait waits until the consistency level is met, failed or timed out.
+func (wa *WriteAck) Wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-wa.done:
+		return wa.err
+	case <-timer.C:
+		wa.lock.Lock()
+		defer wa.lock.Unlock()
+		if !wa.finished {
+			wa.finish(true)
+		}
+		return wa.err
+	}
+}
+
+func (wa *WriteAck) check() {
+	if !wa.sealed || wa.finished {
+		return
+	}
+	// once the level can't be met, wait for the other circles as well to report the exact number of written circles
+	written, failed := wa.count()
+	if written >= wa.required || (len(wa.circles)-failed < wa.required && written+failed == len(wa.circles)) {
+		wa.finish(false)
+	}
+}
+
+func (wa *WriteAck) count() (written, failed int) {
+	for _, ca := range wa.circles {
+		if ca.err != nil {
+			failed++
+		} else if ca.pending == 0 {
+			written++
+		}
+	}
+	return
+}
+
+func (wa *WriteAck) finish(timeout bool) {
+	wa.finished = true
+	written, _ := wa.count()
+	if written < wa.required {
+		cerr := &ConsistencyError{Level: wa.level, Required: wa.required, Written: written, Total: len(wa.circles), Timeout: timeout}
+		for _, ca := range wa.circles {
+			if ca.err != nil {
+				cerr.Errors = append(cerr.Errors, fmt.Sprintf("circle %d: %s", ca.id, ca.err))
+			}
+		}
+		wa.err = cerr
+	}
+	close(wa.done)
+}
+
+func (ca *circleAck) written(n int) {
+	ca.wa.lock.Lock()
+	defer ca.wa.lock.Unlock()
+	ca.pending -= n
+	ca.wa.check()
+}
+
+func (ca *circleAck) fail(err error) {
+	ca.wa.lock.Lock()
+	defer ca.wa.lock.Unlock()
+	if ca.err == nil {
+		ca.err = err
+	}
+	ca.wa.check()
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrDeadLetterDisabled = errors.New("dead letter disabled, require dead_letter_enabled")
+
+// DeadLetterRecord is a line rejected by backend, it's stored as a json line in dead letter file.
+type DeadLetterRecord struct {
+	Time  time.Time `json:"time"`
+	Db    string    `json:"db"`
+	Rp    string    `json:"rp"`
+	Error string    `json:"error"`
+	Line  string    `json:"line"`
+}
+
+// DeadLetter stores the lines rejected by a backend in <data_dir>/<backend name>.dlq.
+type DeadLetter struct {
+	lock     sync.Mutex
+	filename string
+	file     *os.File
+	entries  int
+}
+
+func NewDeadLetter(filename string, datadir string) (dl *DeadLetter, err error) {
+	dl = &DeadLetter{filename: filepath.Join(datadir, filename+".dlq")}
+	dl.file, err = os.OpenFile(dl.filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("open dead letter error: %s %s", dl.filename, err)
+		return
+	}
+	r := bufio.NewReader(dl.file)
+	for {
+		_, err = r.ReadSlice('\n')
+		if err == nil {
+			dl.entries++
+		} else if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func (dl *DeadLetter) Write(db, rp string, line []byte, msg string) error {
+	b, err := json.Marshal(&DeadLetterRecord{Time: time.Now(), Db: db, Rp: rp, Error: msg, Line: string(line)})
+	if err != nil {
+		return err
+	}
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	_, err = dl.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	dl.entries++
+	return nil
+}
+
+// Stats returns the number of records and the size in bytes of dead letter file.
+func (dl *DeadLetter) Stats() (entries int, size int64) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	if fi, err := dl.file.Stat(); err == nil {
+		size = fi.Size()
+	}
+	return dl.entries, size
+}
+
+// Download copies the records of dead letter file to w.
+func (dl *DeadLetter) Download(w io.Writer) error {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	_, err := io.Copy(w, io.NewSectionReader(dl.file, 0, 1<<62))
+	return err
+}
+
+func (dl *DeadLetter) Purge() error {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	return dl.truncate()
+}
+
+// take reads all the records and truncates dead letter file.
+func (dl *DeadLetter) take() (records []*DeadLetterRecord, err error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	r := bufio.NewReader(io.NewSectionReader(dl.file, 0, 1<<62))
+	for {
+		b, rerr := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(b)) > 0 {
+			record := &DeadLetterRecord{}
+			if err = json.Unmarshal(b, record); err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return nil, rerr
+		}
+	}
+	return records, dl.truncate()
+}
+
+func (dl *DeadLetter) truncate() error {
+	err := dl.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	dl.entries = 0
+	return nil
+}
+
+func (dl *DeadLetter) Close() error {
+	return dl.file.Close()
+}
+
+// isRejected returns true if err means the lines are rejected by backend and will not succeed by retrying.
+func isRejected(err error) bool {
+	return errors.Is(err, ErrBadRequest) || errors.Is(err, ErrNotFound)
+}
+
+// isolate writes the lines rejected by backend with err in halves recursively to isolate the bad lines, which are written to dead letter file.
+// The lines not written due to other errors are returned as remains along with the error.
+func (ib *Backend) isolate(db, rp string, lines [][]byte, err error) (written, dead int, remains [][]byte, rerr error) {
+	// database or retention policy not found is not caused by any single line
+	if len(lines) <= 1 || errors.Is(err, ErrNotFound) {
+		for _, line := range lines {
+			if derr := ib.dl.Write(db, rp, line, err.Error()); derr != nil {
+				log.Printf("write dead letter error: %s, backend: %s, db: %s, rp: %s, line: %s", derr, ib.Name, db, rp, line)
+			}
+		}
+		log.Printf("dead letter %d lines, backend: %s, db: %s, rp: %s, error: %s", len(lines), ib.Name, db, rp, err)
+		return 0, len(lines), nil, nil
+	}
+	mid := len(lines) / 2
+	for _, half := range [][][]byte{lines[:mid], lines[mid:]} {
+		if rerr != nil {
+			remains = append(remains, half...)
+			continue
+		}
+		herr := ib.Write(db, rp, bytes.Join(half, []byte{'\n'}))
+		switch {
+		case herr == nil:
+			written += len(half)
+		case isRejected(herr):
+			w, d, r, e := ib.isolate(db, rp, half, herr)
+			written, dead, remains, rerr = written+w, dead+d, append(remains, r...), e
+		default:
+			remains, rerr = append(remains, half...), herr
+		}
+	}
+	return
+}
+
+// ReplayDeadLetter writes the dead lettered lines to backend again. The lines rejected again are dead lettered with the new error,
+// and the lines not written due to other errors are put back to dead letter file with the original error.
+func (ib *Backend) ReplayDeadLetter() (written, dead int, err error) {
+	if ib.dl == nil {
+		return 0, 0, ErrDeadLetterDisabled
+	}
+	if !ib.IsActive() {
+		return 0, 0, ErrBackendsUnavailable
+	}
+	records, err := ib.dl.take()
+	if err != nil {
+		return
+	}
+	type group struct {
+		db, rp  string
+		lines   [][]byte
+		records map[string]*DeadLetterRecord
+	}
+	var keys []string
+	groups := make(map[string]*group)
+	for _, record := range records {
+		key := record.Db + " " + record.Rp
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			groups[key] = &group{db: record.Db, rp: record.Rp, records: make(map[string]*DeadLetterRecord)}
+		}
+		groups[key].lines = append(groups[key].lines, []byte(record.Line))
+		groups[key].records[record.Line] = record
+	}
+	for _, key := range keys {
+		g := groups[key]
+		remains := g.lines
+		if err == nil {
+			werr := ib.Write(g.db, g.rp, bytes.Join(g.lines, []byte{'\n'}))
+			switch {
+			case werr == nil:
+				written, remains = written+len(g.lines), nil
+			case isRejected(werr):
+				var w, d int
+				w, d, remains, err = ib.isolate(g.db, g.rp, g.lines, werr)
+				written, dead = written+w, dead+d
+			default:
+				err = werr
+			}
+		}
+		for _, line := range remains {
+			record := g.records[string(line)]
+			if derr := ib.dl.Write(record.Db, record.Rp, line, record.Error); derr != nil {
+				log.Printf("write dead letter error: %s, backend: %s, db: %s, rp: %s, line: %s", derr, ib.Name, record.Db, record.Rp, line)
+			}
+		}
+	}
+	return
+}
+
+func (ib *Backend) DeadLetter() *DeadLetter {
+	return ib.dl
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeadLetter(t *testing.T) {
+	var reject atomic.Bool
+	reject.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			r, _ := gzip.NewReader(req.Body)
+			p, _ := io.ReadAll(r)
+			if reject.Load() && bytes.Contains(p, []byte("bad")) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"partial write: field type conflict dropped=1"}`))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := &ProxyConfig{DataDir: t.TempDir(), DeadLetterEnabled: true}
+	cfg.setDefault()
+	be := NewBackend(&BackendConfig{Name: "influxdb-1", Url: server.URL}, cfg, nil, nil, nil)
+	for i := 0; i < 100 && !be.IsActive(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lines := []string{"cpu value=1", "cpu value=2", "cpu value=\"bad\"", "cpu value=4", "cpu value=5", "cpu value=\"bad\"", "cpu value=7"}
+	for _, line := range lines {
+		be.WritePoint(&LinePoint{"db1", "", []byte(line)})
+	}
+	be.Close()
+	<-be.Done()
+	if flushed, spilled, dropped := be.Stats(); flushed != 5 || spilled != 0 || dropped != 2 {
+		t.Errorf("flush: got %d flushed, %d spilled, %d dropped, want 5, 0, 2", flushed, spilled, dropped)
+	}
+
+	dl, err := NewDeadLetter("influxdb-1", cfg.DataDir)
+	if err != nil {
+		t.Fatalf("open dead letter error: %v", err)
+	}
+	defer dl.Close()
+	if entries, _ := dl.Stats(); entries != 2 {
+		t.Errorf("dead letter: got %d entries, want 2", entries)
+	}
+	var buf bytes.Buffer
+	dl.Download(&buf)
+	if !bytes.Contains(buf.Bytes(), []byte(`"error":"bad request: partial write: field type conflict dropped=1"`)) {
+		t.Errorf("dead letter: got %s, want error message", buf.Bytes())
+	}
+
+	be = NewBackend(&BackendConfig{Name: "influxdb-1", Url: server.URL}, cfg, nil, nil, nil)
+	defer be.Close()
+	for i := 0; i < 100 && !be.IsActive(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	written, dead, err := be.ReplayDeadLetter()
+	if written != 0 || dead != 2 || err != nil {
+		t.Errorf("replay: got %d written, %d dead, error %v, want 0, 2, nil", written, dead, err)
+	}
+	reject.Store(false)
+	written, dead, err = be.ReplayDeadLetter()
+	if written != 2 || dead != 0 || err != nil {
+		t.Errorf("replay: got %d written, %d dead, error %v, want 2, 0, nil", written, dead, err)
+	}
+	if entries, size := be.DeadLetter().Stats(); entries != 0 || size != 0 {
+		t.Errorf("replay: got %d entries, %d bytes, want 0", entries, size)
+	}
+}
+
+func TestWriteNotFound(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		notFound bool
+	}{
+		{
+			name:     "database not found",
+			status:   http.StatusNotFound,
+			body:     `{"error":"database not found: \"db1\""}`,
+			notFound: true,
+		},
+		{
+			name:     "retention policy not found",
+			status:   http.StatusBadRequest,
+			body:     `{"error":"retention policy not found: rp1"}`,
+			notFound: true,
+		},
+		{
+			name:   "line containing not found",
+			status: http.StatusBadRequest,
+			body:   `{"error":"partial write: field type conflict: input field \"value\" on measurement \"not found\" is type float, already exists as type string dropped=1"}`,
+		},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		cfg := &ProxyConfig{}
+		cfg.setDefault()
+		hb := NewHttpBackend(&BackendConfig{Name: "influxdb-1", Url: server.URL}, cfg)
+		err := hb.Write("db1", "rp1", []byte("cpu value=1"))
+		if errors.Is(err, ErrNotFound) != tt.notFound || !isRejected(err) {
+			t.Errorf("%v: got %v, want not found %v", tt.name, err, tt.notFound)
+		}
+		hb.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const deleteMeasurementKey = "_measurement"
+
+var (
+	ErrDeleteTimeRange   = errors.New("delete requires start and stop, and start must not be after stop")
+	ErrDeleteMeasurement = errors.New("delete predicate must contain _measurement with =")
+)
+
+// DeleteRequest is the request body of the delete api of influxdb 2.x.
+type DeleteRequest struct {
+	Start     time.Time `json:"start"`
+	Stop      time.Time `json:"stop"`
+	Predicate string    `json:"predicate"`
+}
+
+type deleteTerm struct {
+	key   string
+	op    string
+	value string
+}
+
+// DeleteToInfluxQL converts the delete request to the delete statement of influxql and returns its measurement,
+// the predicate is made of the comparisons like key="value" or key!="value" joined by AND,
+// and must contain the comparison _measurement="value".
+func DeleteToInfluxQL(dr *DeleteRequest) (mm string, q string, err error) {
+	if dr.Start.IsZero() || dr.Stop.IsZero() || dr.Start.After(dr.Stop) {
+		return "", "", ErrDeleteTimeRange
+	}
+	terms, err := parseDeletePredicate(dr.Predicate)
+	if err != nil {
+		return "", "", err
+	}
+	var sb strings.Builder
+	for _, term := range terms {
+		if term.key == deleteMeasurementKey {
+			if term.op != "=" || mm != "" && mm != term.value {
+				return "", "", ErrDeleteMeasurement
+			}
+			mm = term.value
+			continue
+		}
+		sb.WriteString(fmt.Sprintf(" and \"%s\" %s '%s'", util.EscapeIdentifier(term.key), term.op, util.EscapeString(term.value)))
+	}
+	if mm == "" {
+		return "", "", ErrDeleteMeasurement
+	}
+	q = fmt.Sprintf("delete from \"%s\" where time >= '%s' and time <= '%s'%s", util.EscapeIdentifier(mm),
+		dr.Start.UTC().Format(time.RFC3339Nano), dr.Stop.UTC().Format(time.RFC3339Nano), sb.String())
+	return mm, q, nil
+}
+
+func parseDeletePredicate(predicate string) ([]*deleteTerm, error) {
+	var terms []*deleteTerm
+	s := strings.TrimSpace(predicate)
+	for s != "" {
+		if len(terms) > 0 {
+			if len(s) < 4 || !strings.EqualFold(s[:3], "and") || s[3] != ' ' && s[3] != '\t' {
+				return nil, fmt.Errorf("invalid delete predicate, expect AND: %s", s)
+			}
+			s = strings.TrimSpace(s[3:])
+		}
+		term := &deleteTerm{}
+		if s != "" && s[0] == '"' {
+			key, rest, err := cutDeleteString(s)
+			if err != nil {
+				return nil, err
+			}
+			term.key, s = key, rest
+		} else {
+			i := strings.IndexAny(s, "=! \t")
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid delete predicate, expect key: %s", s)
+			}
+			term.key, s = s[:i], s[i:]
+		}
+		s = strings.TrimSpace(s)
+		switch {
+		case strings.HasPrefix(s, "!="):
+			term.op, s = "!=", s[2:]
+		case strings.HasPrefix(s, "="):
+			term.op, s = "=", s[1:]
+		default:
+			return nil, fmt.Errorf("invalid delete predicate, expect = or !=: %s", s)
+		}
+		s = strings.TrimSpace(s)
+		if s == "" || s[0] != '"' {
+			return nil, fmt.Errorf("invalid delete predicate, expect double quoted value: %s", s)
+		}
+		value, rest, err := cutDeleteString(s)
+		if err != nil {
+			return nil, err
+		}
+		term.value, s = value, strings.TrimSpace(rest)
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// cutDeleteString cuts the double quoted string at the beginning of s, and returns the unquoted string and the rest.
+func cutDeleteString(s string) (string, string, error) {
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+			sb.WriteByte(s[i])
+		case '"':
+			return sb.String(), s[i+1:], nil
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return "", "", fmt.Errorf("invalid delete predicate, unterminated string: %s", s)
+}
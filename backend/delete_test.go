@@ -0,0 +1,77 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteToInfluxQL(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	stop := time.Date(2020, 1, 2, 0, 0, 0, 500, time.UTC)
+	tests := []struct {
+		name      string
+		predicate string
+		mm        string
+		want      string
+	}{
+		{
+			name:      "measurement",
+			predicate: `_measurement="cpu"`,
+			mm:        "cpu",
+			want:      `delete from "cpu" where time >= '2020-01-01T00:00:00Z' and time <= '2020-01-02T00:00:00.0000005Z'`,
+		},
+		{
+			name:      "tags",
+			predicate: ` host = "server01" AND _measurement="cpu" and "region"!="us \"west\"" `,
+			mm:        "cpu",
+			want:      `delete from "cpu" where time >= '2020-01-01T00:00:00Z' and time <= '2020-01-02T00:00:00.0000005Z' and "host" = 'server01' and "region" != 'us "west"'`,
+		},
+		{
+			name:      "escape",
+			predicate: `_measurement="c\"p'u" AND tag="it's"`,
+			mm:        `c"p'u`,
+			want:      `delete from "c\"p'u" where time >= '2020-01-01T00:00:00Z' and time <= '2020-01-02T00:00:00.0000005Z' and "tag" = 'it\'s'`,
+		},
+	}
+	for _, tt := range tests {
+		mm, q, err := DeleteToInfluxQL(&DeleteRequest{Start: start, Stop: stop, Predicate: tt.predicate})
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		if mm != tt.mm || q != tt.want {
+			t.Errorf("%v: got %s, %s, want %s, %s", tt.name, mm, q, tt.mm, tt.want)
+		}
+	}
+}
+
+func TestDeleteToInfluxQLError(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	stop := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		start     time.Time
+		stop      time.Time
+		predicate string
+	}{
+		{name: "no start", stop: stop, predicate: `_measurement="cpu"`},
+		{name: "start after stop", start: stop, stop: start, predicate: `_measurement="cpu"`},
+		{name: "no measurement", start: start, stop: stop, predicate: `host="a"`},
+		{name: "empty predicate", start: start, stop: stop, predicate: ``},
+		{name: "measurement not equal", start: start, stop: stop, predicate: `_measurement!="cpu"`},
+		{name: "multiple measurements", start: start, stop: stop, predicate: `_measurement="cpu" AND _measurement="mem"`},
+		{name: "or", start: start, stop: stop, predicate: `_measurement="cpu" OR host="a"`},
+		{name: "unquoted value", start: start, stop: stop, predicate: `_measurement=cpu`},
+		{name: "unterminated value", start: start, stop: stop, predicate: `_measurement="cpu`},
+		{name: "regex", start: start, stop: stop, predicate: `_measurement="cpu" AND host=~"a"`},
+	}
+	for _, tt := range tests {
+		if _, _, err := DeleteToInfluxQL(&DeleteRequest{Start: tt.start, Stop: tt.stop, Predicate: tt.predicate}); err == nil {
+			t.Errorf("%v: got nil error", tt.name)
+		}
+	}
+}
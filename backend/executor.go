@@ -12,9 +12,12 @@ import (
 	"math/rand"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
 )
@@ -25,9 +28,17 @@ var (
 	ErrBackendsUnavailable = errors.New("backends unavailable")
 	ErrGetMeasurement      = errors.New("can't get measurement")
 	ErrGetBackends         = errors.New("can't get backends")
+	ErrFluxShardedByTags   = errors.New("flux query is not supported when shard_key contains %tag(name)")
 )
 
 func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) (body []byte, err error) {
+	// fall back to another backend only if nothing has been streamed to the client.
+	var sw *StreamWriter
+	if w != nil {
+		sw = NewStreamWriter(w)
+		w = sw
+	}
+
 	// pass non-active, rewriting or write-only.
 	perms := rand.Perm(len(ip.Circles))
 	for _, p := range perms {
@@ -36,7 +47,7 @@ func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn f
 			continue
 		}
 		body, err = fn(be, req, w)
-		if err == nil {
+		if err == nil || sw != nil && sw.Written() {
 			return
 		}
 	}
@@ -48,7 +59,7 @@ func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn f
 			continue
 		}
 		body, err = fn(be, req, w)
-		if err == nil {
+		if err == nil || sw != nil && sw.Written() {
 			return
 		}
 	}
@@ -59,19 +70,238 @@ func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn f
 	return nil, ErrBackendsUnavailable
 }
 
-func ReadProm(w http.ResponseWriter, req *http.Request, ip *Proxy, db, mm string) (err error) {
-	// all circles -> backend by key(db,mm) -> select or show
+func ReadProm(req *http.Request, ip *Proxy, db, mm string, q *remote.Query) (qr *remote.QueryResult, err error) {
+	// all circles -> backend by key(db,mm) -> prometheus read, or select if native read enabled
+	native := ip.Config().NativePromRead
+	if ip.IsShardedByTags() {
+		return readPromSharded(req, ip, db, mm, q, native)
+	}
 	key := ip.GetKey(db, mm)
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
-		err = be.ReadProm(req, w)
+		qr, err = readProm(be, req, db, mm, q, native)
 		return nil, err
 	}
+	_, err = query(nil, req, ip, key, fn)
+	return
+}
+
+func readProm(be *Backend, req *http.Request, db, mm string, q *remote.Query, native bool) (*remote.QueryResult, error) {
+	if native || be.nativePromRead {
+		return be.ReadPromNative(db, req.FormValue("rp"), mm, q)
+	}
+	return be.ReadProm(req, q)
+}
+
+// readPromSharded reads the time series of measurement mm sharded by tags from all backends of a circle,
+// another circle is read if any backend fails.
+func readPromSharded(req *http.Request, ip *Proxy, db, mm string, q *remote.Query, native bool) (qr *remote.QueryResult, err error) {
+	// one circle -> all backends -> prometheus read, or select if native read enabled
+	for _, circle := range shardedCircles(ip) {
+		backends := circle.Backends()
+		results := make([]*remote.QueryResult, len(backends))
+		errs := make([]error, len(backends))
+		var wg sync.WaitGroup
+		for i, be := range backends {
+			wg.Add(1)
+			go func(i int, be *Backend) {
+				defer wg.Done()
+				if !be.IsActive() {
+					errs[i] = ErrBackendsUnavailable
+					return
+				}
+				results[i], errs[i] = readProm(be, req, db, mm, q, native)
+			}(i, be)
+		}
+		wg.Wait()
+		qr, err = &remote.QueryResult{}, nil
+		for i := range backends {
+			if errs[i] != nil {
+				qr, err = nil, errs[i]
+				break
+			}
+			// each series is stored in one backend
+			qr.Timeseries = append(qr.Timeseries, results[i].Timeseries...)
+		}
+		if err == nil {
+			return
+		}
+	}
+	if err != nil {
+		return
+	}
+	return nil, ErrBackendsUnavailable
+}
+
+// ReadPromStream streams the prometheus read response of measurement mm from backend to w as is,
+// the response is translated from influxql for the backend with native prometheus read.
+func ReadPromStream(w http.ResponseWriter, req *http.Request, ip *Proxy, db, mm string, q *remote.Query) (err error) {
+	// all circles -> backend by key(db,mm) -> prometheus read
+	if ip.IsShardedByTags() {
+		qr, err := readPromSharded(req, ip, db, mm, q, false)
+		if err != nil {
+			return err
+		}
+		return WritePromReadResponse(w, &remote.ReadResponse{Results: []*remote.QueryResult{qr}})
+	}
+	key := ip.GetKey(db, mm)
+	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		if be.nativePromRead {
+			qr, err := be.ReadPromNative(db, req.FormValue("rp"), mm, q)
+			if err != nil {
+				return nil, err
+			}
+			return nil, WritePromReadResponse(w, &remote.ReadResponse{Results: []*remote.QueryResult{qr}})
+		}
+		return nil, be.ReadPromStream(req, q, w)
+	}
 	_, err = query(w, req, ip, key, fn)
 	return
 }
 
+// QueryProm queries the time series of measurement mm matching the prometheus query by influxql through QueryFromQL,
+// only the last sample of each time series is queried if last is true.
+func QueryProm(ip *Proxy, db, rp, mm string, q *remote.Query, last bool) (*remote.QueryResult, error) {
+	// all circles -> backend by key(db,mm) -> select
+	var ql string
+	var err error
+	if last {
+		ql, err = PromSeriesToInfluxQL(rp, mm, q)
+	} else {
+		ql, err = PromQueryToInfluxQL(rp, mm, q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokens, _, _ := CheckQuery(ql)
+	req := NewQueryRequest("GET", db, ql, "ms")
+	// leave the decompression of response to transport since QueryFromQL doesn't decompress
+	req.Header.Del("Accept-Encoding")
+	body, err := QueryFromQL(nil, req, ip, tokens, db)
+	if err != nil {
+		return nil, err
+	}
+	return PromQueryResultFromResponseBytes(body)
+}
+
+// ShowMeasurements returns the measurements of db matching regex in all backends, or all measurements if regex is empty.
+func ShowMeasurements(ip *Proxy, db, regex string) ([]string, error) {
+	// all circles -> all backends -> show measurements
+	q := "show measurements"
+	if regex != "" {
+		q += " with measurement =~ /" + util.EscapeRegex(regex) + "/"
+	}
+	rsp, err := showInParallel(ip, db, q, reduceByValues)
+	if err != nil {
+		return nil, err
+	}
+	var measurements []string
+	for _, s := range rsp.Results[0].Series {
+		for _, v := range s.Values {
+			measurements = append(measurements, v[0].(string))
+		}
+	}
+	sort.Strings(measurements)
+	return measurements, nil
+}
+
+// ShowTagKeys returns the distinct tag keys of all measurements of db in all backends.
+func ShowTagKeys(ip *Proxy, db string) ([]string, error) {
+	// all circles -> all backends -> show tag keys
+	rsp, err := showInParallel(ip, db, "show tag keys", reduceBySeries)
+	if err != nil {
+		return nil, err
+	}
+	set := util.NewSet()
+	for _, s := range rsp.Results[0].Series {
+		for _, v := range s.Values {
+			set.Add(v[0].(string))
+		}
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// RetentionPolicy is the retention policy of a database.
+type RetentionPolicy struct {
+	Database           string
+	Name               string
+	Duration           time.Duration
+	ShardGroupDuration time.Duration
+	Default            bool
+}
+
+// ShowRetentionPolicies returns the retention policies of all databases except _internal in all backends.
+func ShowRetentionPolicies(ip *Proxy) ([]*RetentionPolicy, error) {
+	// all circles -> all backends -> show databases, show retention policies
+	rsp, err := showInParallel(ip, "", "show databases", reduceByValues)
+	if err != nil {
+		return nil, err
+	}
+	var rps []*RetentionPolicy
+	for _, s := range rsp.Results[0].Series {
+		for _, v := range s.Values {
+			db := v[0].(string)
+			if db == "_internal" {
+				continue
+			}
+			rprsp, err := showInParallel(ip, db, "show retention policies", func(bodies [][]byte, _ bool, _, _ int) (*Response, error) {
+				return attachByValues(bodies)
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, rs := range rprsp.Results[0].Series {
+				for _, rv := range rs.Values {
+					rp := &RetentionPolicy{Database: db}
+					for i, col := range rs.Columns {
+						switch col {
+						case "name":
+							rp.Name, _ = rv[i].(string)
+						case "duration":
+							d, _ := rv[i].(string)
+							rp.Duration, _ = time.ParseDuration(d)
+						case "shardGroupDuration":
+							d, _ := rv[i].(string)
+							rp.ShardGroupDuration, _ = time.ParseDuration(d)
+						case "default":
+							rp.Default, _ = rv[i].(bool)
+						}
+					}
+					rps = append(rps, rp)
+				}
+			}
+		}
+	}
+	sort.SliceStable(rps, func(i, j int) bool {
+		return rps[i].Database < rps[j].Database || rps[i].Database == rps[j].Database && rps[i].Name < rps[j].Name
+	})
+	return rps, nil
+}
+
+func showInParallel(ip *Proxy, db, q string, reduce func([][]byte, bool, int, int) (*Response, error)) (*Response, error) {
+	bodies, inactive, err := QueryInParallel(ip.GetAllBackends(), NewQueryRequest("GET", db, q, ""), nil, true)
+	if err != nil {
+		return nil, err
+	}
+	if inactive > 0 {
+		log.Printf("query: %s, inactive: %d/%d backends unavailable", q, inactive, inactive+len(bodies))
+		if len(bodies) == 0 {
+			return nil, ErrBackendsUnavailable
+		}
+	}
+	return reduce(bodies, false, 0, 0)
+}
+
 func QueryFlux(w http.ResponseWriter, req *http.Request, ip *Proxy, bucket, measurement string) (err error) {
 	// all circles -> backend by key(bucket,measurement) -> query flux
+	if ip.IsShardedByTags() {
+		// the flux tables of the backends can't be merged
+		return ErrFluxShardedByTags
+	}
 	key := ip.GetKey(bucket, measurement)
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
 		err = be.QueryFlux(req, w)
@@ -82,13 +312,80 @@ func QueryFlux(w http.ResponseWriter, req *http.Request, ip *Proxy, bucket, meas
 }
 
 func QueryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
+	if ip.cache.Enabled() && strings.ToLower(tokens[0]) == "select" && req.FormValue("chunked") != "true" {
+		sources, _, _, err := ParseSourcesFromInfluxQL(req.FormValue("q"))
+		if err == nil && len(sources) == 1 && sources[0].Regex == "" {
+			return queryCache(w, req, ip, tokens, db, sources[0].Measurement)
+		}
+	}
+	return queryFromQL(w, req, ip, tokens, db)
+}
+
+// queryCache queries the select statement of measurement mm through the query cache, the now() of the statement
+// is aligned to the bucket so that the same statements refreshed in a bucket hit the cache.
+func queryCache(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db, mm string) (body []byte, err error) {
+	qc := ip.cache
+	creq := CloneQueryRequest(req)
+	creq.Form.Set("q", qc.Align(req.FormValue("q")))
+	key := qc.Key(creq, db, mm, creq.FormValue("q"))
+	if !strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+		if header, body, ok := qc.Get(key); ok {
+			if w != nil {
+				CopyHeader(w.Header(), header)
+			}
+			return body, nil
+		}
+	}
+
+	fill := qc.Begin(db, mm)
+	defer qc.End(fill)
+	var cw *cacheWriter
+	if w != nil {
+		cw = &cacheWriter{ResponseWriter: w, limit: qc.MaxEntrySize()}
+		w = cw
+	}
+	body, err = queryFromQL(w, creq, ip, tokens, db)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		var header http.Header
+		if w != nil {
+			header = cacheHeader(w.Header())
+		}
+		qc.Put(fill, key, header, body)
+	} else if cw != nil && cw.status == http.StatusOK && !cw.over {
+		// the response has been streamed to the client
+		qc.Put(fill, key, cacheHeader(w.Header()), cw.buf.Bytes())
+	}
+	return
+}
+
+func queryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
 	// all circles -> backend by key(db,mm) -> select or show
+	if ip.IsShardedByTags() {
+		if strings.ToLower(tokens[0]) == "select" {
+			return QueryShardedQL(w, req, ip)
+		}
+		return QueryShowQL(w, req, ip, tokens)
+	}
+	if strings.ToLower(tokens[0]) == "select" {
+		q := req.FormValue("q")
+		sources, start, end, err := ParseSourcesFromInfluxQL(q)
+		if err == nil && (len(sources) > 1 || len(sources) == 1 && sources[0].Regex != "") {
+			return querySources(w, req, ip, db, q, sources, start, end)
+		}
+	}
 	mm, err := GetMeasurementFromTokens(tokens)
 	if err != nil {
 		return nil, ErrGetMeasurement
 	}
 	key := ip.GetKey(db, mm)
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		if w != nil {
+			// stream the response to the client, including the chunked response
+			return nil, be.QueryStream(req, w)
+		}
 		qr := be.Query(req, w, false)
 		return qr.Body, qr.Err
 	}
@@ -96,10 +393,169 @@ func QueryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	return
 }
 
+// shardedCircles returns the circles to query the measurements sharded by tags in turn, the circles with all backends
+// active and none rewriting or write-only come first, then the ones with all backends active.
+func shardedCircles(ip *Proxy) []*Circle {
+	var circles, busy []*Circle
+	for _, p := range rand.Perm(len(ip.Circles)) {
+		ic := ip.Circles[p]
+		if !ic.IsActive() {
+			continue
+		}
+		if ic.IsRewriting() || ic.IsWriteOnly() {
+			busy = append(busy, ic)
+		} else {
+			circles = append(circles, ic)
+		}
+	}
+	return append(circles, busy...)
+}
+
+// QueryShardedQL queries the select statement in all backends of a circle since the measurements are sharded by tags,
+// then merges the series and combines the aggregations.
+func QueryShardedQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
+	// one circle -> all backends -> select
+	sq, err := newShardedQuery(req.FormValue("q"), ip.sTpl.tags)
+	if err != nil {
+		return nil, err
+	}
+	creq := CloneQueryRequest(req)
+	creq.Form.Set("q", sq.query)
+	// remove support of query parameter `chunked`
+	creq.Form.Del("chunked")
+
+	// fall back to another circle if any backend fails or becomes inactive, since its series would be missing.
+	for _, circle := range shardedCircles(ip) {
+		var bodies [][]byte
+		var inactive int
+		bodies, inactive, err = QueryInParallel(circle.Backends(), creq, nil, true)
+		if err == nil && inactive > 0 {
+			log.Printf("query: %s, inactive: %d/%d backends of circle %d unavailable", sq.query, inactive, inactive+len(bodies), circle.CircleId)
+			err = ErrBackendsUnavailable
+		}
+		if err != nil {
+			continue
+		}
+		var rsp *Response
+		rsp, err = sq.merge(bodies)
+		if err != nil {
+			return
+		}
+		return marshalResponse(w, req, rsp)
+	}
+	if err != nil {
+		return
+	}
+	return nil, ErrBackendsUnavailable
+}
+
+// querySources queries the select statement q from multiple measurements or regexes of measurements, the regexes are resolved
+// by show measurements in all backends, then the statement is rewritten with the measurements owned by each key
+// and queried in the backends by key, and the series are merged.
+func querySources(w http.ResponseWriter, req *http.Request, ip *Proxy, db, q string, sources []*Source, start, end int) (body []byte, err error) {
+	// all circles -> all backends -> show measurements; all circles -> backend by key(db,mm) -> select
+	var keys []string
+	groups := make(map[string][]string)
+	exists := make(map[string]bool)
+	for _, src := range sources {
+		sdb := db
+		if src.Database != "" {
+			sdb = src.Database
+			if ip.IsForbiddenDB(sdb) {
+				return nil, fmt.Errorf("database forbidden: %s", sdb)
+			}
+		}
+		measurements := []string{src.Measurement}
+		if src.Regex != "" {
+			measurements, err = ShowMeasurements(ip, sdb, src.Regex)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, mm := range measurements {
+			clause := (&Source{Database: src.Database, RetentionPolicy: src.RetentionPolicy, Measurement: mm}).String()
+			if exists[clause] {
+				continue
+			}
+			exists[clause] = true
+			key := ip.GetKey(sdb, mm)
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], clause)
+		}
+	}
+
+	bodies := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		qr := be.Query(req, nil, true)
+		return qr.Body, qr.Err
+	}
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		creq := CloneQueryRequest(req)
+		creq.Form.Set("q", q[:start]+" "+strings.Join(groups[key], ", ")+q[end:])
+		// remove support of query parameter `chunked`
+		creq.Form.Del("chunked")
+		wg.Add(1)
+		go func(i int, key string, creq *http.Request) {
+			defer wg.Done()
+			bodies[i], errs[i] = query(nil, creq, ip, key, fn)
+		}(i, key, creq)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rsp, err := mergeBySeries(bodies)
+	if err != nil {
+		return
+	}
+	return marshalResponse(w, req, rsp)
+}
+
+// marshalResponse marshals the response assembled by proxy, which is compressed if the client accepts gzip.
+func marshalResponse(w http.ResponseWriter, req *http.Request, rsp *Response) (body []byte, err error) {
+	body = marshalChunks(req, rsp)
+	if w != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			var buf bytes.Buffer
+			err = Compress(&buf, body)
+			if err != nil {
+				return
+			}
+			body = buf.Bytes()
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Del("Content-Length")
+	}
+	return
+}
+
+// marshalChunks marshals the response, which is split into chunks like influxdb if the query parameter chunked is true.
+func marshalChunks(req *http.Request, rsp *Response) []byte {
+	pretty := req.FormValue("pretty") == "true"
+	if req.FormValue("chunked") != "true" {
+		return util.MarshalJSON(rsp, pretty)
+	}
+	size, _ := strconv.Atoi(req.FormValue("chunk_size"))
+	var buf bytes.Buffer
+	for _, chunk := range ChunkResponse(rsp, size) {
+		buf.Write(util.MarshalJSON(chunk, pretty))
+	}
+	return buf.Bytes()
+}
+
 func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
 	// all circles -> all backends -> show
-	// remove support of query parameter `chunked`
-	req.Form.Del("chunked")
+	// the chunked response is assembled after merging
+	creq := CloneQueryRequest(req)
+	creq.Form.Del("chunked")
 	backends := ip.GetAllBackends()
 	stmt2 := GetHeadStmtFromTokens(tokens, 2)
 	stmt3 := GetHeadStmtFromTokens(tokens, 3)
@@ -107,14 +563,14 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if (stmt2 == "show measurements" || stmt2 == "show series" || stmt3 == "show field keys" || stmt3 == "show tag keys" || stmt3 == "show tag values") && CheckLimitOrOffsetClause(tokens) {
 		limitOffsetExists = true
 		limit, offset = getLimitOffsetFromTokens(tokens)
-		req.Form.Set("q", removeLimitOffsetClause(req.FormValue("q")))
+		creq.Form.Set("q", removeLimitOffsetClause(creq.FormValue("q")))
 	}
-	bodies, inactive, err := QueryInParallel(backends, req, w, true)
+	bodies, inactive, err := QueryInParallel(backends, creq, w, true)
 	if err != nil {
 		return
 	}
 	if inactive > 0 {
-		log.Printf("query: %s, inactive: %d/%d backends unavailable", req.FormValue("q"), inactive, inactive+len(bodies))
+		log.Printf("query: %s, inactive: %d/%d backends unavailable", creq.FormValue("q"), inactive, inactive+len(bodies))
 		if len(bodies) == 0 {
 			return nil, ErrBackendsUnavailable
 		}
@@ -136,8 +592,10 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if rsp == nil {
 		rsp = ResponseFromSeries(nil)
 	}
-	pretty := req.URL.Query().Get("pretty") == "true"
-	body = util.MarshalJSON(rsp, pretty)
+	body = marshalChunks(req, rsp)
+	if w == nil {
+		return
+	}
 	if w.Header().Get("Content-Encoding") == "gzip" {
 		var buf bytes.Buffer
 		err = Compress(&buf, body)
@@ -158,7 +616,18 @@ func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, to
 	}
 	key := ip.GetKey(db, mm)
 	backends := ip.GetBackends(key)
-	return QueryBackends(backends, req, w)
+	if ip.IsShardedByTags() {
+		// the measurement is sharded to all backends by tags
+		backends = ip.GetAllBackends()
+	}
+	body, err = QueryBackends(backends, req, w)
+	// the data may be deleted in some backends even if failed
+	ip.cache.Invalidate(db, mm)
+	if err == nil {
+		// the field types may be changed after deleting data
+		ip.schema.Remove(db, mm)
+	}
+	return
 }
 
 func QueryAlterQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
@@ -257,13 +726,25 @@ func reduceByValues(bodies [][]byte, limitOffsetExists bool, limit, offset int)
 func reduceBySeries(bodies [][]byte, limitOffsetExists bool, limit, offset int) (rsp *Response, err error) {
 	var series models.Rows
 	seriesMap := make(map[string]*models.Row)
+	valuesMap := make(map[string]map[string]bool)
 	for _, b := range bodies {
 		_series, err := SeriesFromResponseBytes(b)
 		if err != nil {
 			return nil, err
 		}
 		for _, serie := range _series {
-			seriesMap[serie.Name] = serie
+			// the values of the same series are unioned since the measurement may be sharded to multiple backends by tags
+			if _, ok := seriesMap[serie.Name]; !ok {
+				seriesMap[serie.Name] = &models.Row{Name: serie.Name, Columns: serie.Columns}
+				valuesMap[serie.Name] = make(map[string]bool)
+			}
+			for _, value := range serie.Values {
+				key := fmt.Sprint(value...)
+				if !valuesMap[serie.Name][key] {
+					seriesMap[serie.Name].Values = append(seriesMap[serie.Name].Values, value)
+					valuesMap[serie.Name][key] = true
+				}
+			}
 		}
 	}
 	for _, serie := range seriesMap {
@@ -285,6 +766,41 @@ func reduceBySeries(bodies [][]byte, limitOffsetExists bool, limit, offset int)
 	return ResponseFromSeries(series), nil
 }
 
+// mergeBySeries merges the series of the first results, the series are sorted by name and tags like influxdb,
+// and the response with error is returned as is.
+func mergeBySeries(bodies [][]byte) (rsp *Response, err error) {
+	merged := &Result{}
+	for _, b := range bodies {
+		_rsp, err := ResponseFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if _rsp.Err != "" {
+			return _rsp, nil
+		}
+		if len(_rsp.Results) == 0 {
+			continue
+		}
+		if _rsp.Results[0].Err != "" {
+			return _rsp, nil
+		}
+		merged.Series = append(merged.Series, _rsp.Results[0].Series...)
+		merged.Messages = append(merged.Messages, _rsp.Results[0].Messages...)
+		merged.Partial = merged.Partial || _rsp.Results[0].Partial
+	}
+	if len(merged.Series) > 1 {
+		tagsKeys := make(map[*models.Row]string, len(merged.Series))
+		for _, serie := range merged.Series {
+			tagsKeys[serie] = string(models.NewTags(serie.Tags).HashKey())
+		}
+		sort.SliceStable(merged.Series, func(i, j int) bool {
+			si, sj := merged.Series[i], merged.Series[j]
+			return si.Name < sj.Name || si.Name == sj.Name && tagsKeys[si] < tagsKeys[sj]
+		})
+	}
+	return &Response{Results: []*Result{merged}}, nil
+}
+
 func attachByValues(bodies [][]byte) (rsp *Response, err error) {
 	var series models.Rows
 	valuesMap := make(map[string]bool)
@@ -332,7 +848,14 @@ func concatByResults(bodies [][]byte) (rsp *Response, err error) {
 func sortLimitOffset(source [][]interface{}, limitOffsetExists bool, limit, offset int) (target [][]interface{}, err error) {
 	if len(source) > 1 {
 		sort.SliceStable(source, func(i, j int) bool {
-			return strings.Compare(source[i][0].(string), source[j][0].(string)) < 0
+			for k := 0; k < len(source[i]) && k < len(source[j]); k++ {
+				si, _ := source[i][k].(string)
+				sj, _ := source[j][k].(string)
+				if c := strings.Compare(si, sj); c != 0 {
+					return c < 0
+				}
+			}
+			return false
 		})
 	}
 	if limitOffsetExists {
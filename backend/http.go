@@ -7,7 +7,9 @@ package backend
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -20,7 +22,10 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
 	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 )
 
 var (
@@ -31,6 +36,26 @@ var (
 	ErrUnknown      = errors.New("unknown error")
 )
 
+// ResponseError is returned by write with the error of status code and the error message responded by backend.
+type ResponseError struct {
+	Err        error
+	StatusCode int
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Err, e.Message)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports the retention policy not found as ErrNotFound besides Err, since it's responded with status 400 by influxdb.
+func (e *ResponseError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusBadRequest && strings.HasPrefix(e.Message, "retention policy not found")
+}
+
 const (
 	HeaderQueryOrigin = "Query-Origin"
 	QueryParallel     = "Parallel"
@@ -44,19 +69,22 @@ type QueryResult struct {
 }
 
 type HttpBackend struct { //nolint:all
-	client      *http.Client
-	transport   *http.Transport
-	Name        string
-	Url         string //nolint:all
-	username    string
-	password    string
-	authEncrypt bool
-	interval    int
-	running     atomic.Value
-	active      atomic.Value
-	rewriting   atomic.Value
-	transferIn  atomic.Value
-	writeOnly   bool
+	client         *http.Client
+	transport      *http.Transport
+	ctx            context.Context
+	cancel         context.CancelFunc
+	Name           string
+	Url            string //nolint:all
+	username       string
+	password       string
+	authEncrypt    bool
+	interval       int
+	running        atomic.Value
+	active         atomic.Value
+	rewriting      atomic.Value
+	transferIn     atomic.Value
+	writeOnly      bool
+	nativePromRead bool
 }
 
 func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend) { //nolint:all
@@ -69,14 +97,16 @@ func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend) {
 
 func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend) { //nolint:all
 	hb = &HttpBackend{
-		transport:   NewTransport(strings.HasPrefix(cfg.Url, "https")),
-		Name:        cfg.Name,
-		Url:         cfg.Url,
-		username:    cfg.Username,
-		password:    cfg.Password,
-		authEncrypt: cfg.AuthEncrypt,
-		writeOnly:   cfg.WriteOnly,
-	}
+		transport:      NewTransport(strings.HasPrefix(cfg.Url, "https")),
+		Name:           cfg.Name,
+		Url:            cfg.Url,
+		username:       cfg.Username,
+		password:       cfg.Password,
+		authEncrypt:    cfg.AuthEncrypt,
+		writeOnly:      cfg.WriteOnly,
+		nativePromRead: cfg.NativePromRead,
+	}
+	hb.ctx, hb.cancel = context.WithCancel(context.Background())
 	hb.running.Store(true)
 	hb.active.Store(true)
 	hb.rewriting.Store(false)
@@ -136,6 +166,15 @@ func Compress(buf *bytes.Buffer, p []byte) (err error) {
 	return
 }
 
+func Decompress(p []byte) ([]byte, error) {
+	zip, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer zip.Close()
+	return io.ReadAll(zip)
+}
+
 func CopyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -226,7 +265,7 @@ func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed b
 	q := url.Values{}
 	q.Set("db", db)
 	q.Set("rp", rp)
-	req, err := http.NewRequest("POST", hb.Url+"/write?"+q.Encode(), stream)
+	req, err := http.NewRequestWithContext(hb.ctx, "POST", hb.Url+"/write?"+q.Encode(), stream)
 	if err != nil {
 		log.Print("new request error: ", err)
 		return
@@ -273,43 +312,119 @@ func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed b
 	if bytes.Contains(respbuf, []byte("retention policy not found")) {
 		err = ErrBadRequest
 	}
-	return
+	var rerr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(respbuf, &rerr) != nil || rerr.Error == "" {
+		rerr.Error = string(bytes.TrimSpace(respbuf))
+	}
+	return &ResponseError{Err: err, StatusCode: resp.StatusCode, Message: rerr.Error}
 }
 
-func (hb *HttpBackend) ReadProm(req *http.Request, w http.ResponseWriter) (err error) {
-	if len(req.Form) == 0 {
-		req.Form = url.Values{}
-	}
-	req.Form.Del("u")
-	req.Form.Del("p")
-	if hb.username != "" || hb.password != "" {
-		hb.SetBasicAuth(req)
+// ReadProm sends a remote read request of the query to backend and returns the query result.
+func (hb *HttpBackend) ReadProm(req *http.Request, query *remote.Query) (qr *remote.QueryResult, err error) {
+	resp, err := hb.readProm(req, query)
+	if err != nil {
+		return
 	}
+	defer resp.Body.Close()
 
-	req.URL, err = url.Parse(hb.Url + "/api/v1/prom/read?" + req.Form.Encode())
+	p, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Print("internal url parse error: ", err)
+		log.Printf("prometheus read body error: %s", err)
+		return
+	}
+	p, err = snappy.Decode(nil, p)
+	if err != nil {
+		return
+	}
+	var rsp remote.ReadResponse
+	if err = proto.Unmarshal(p, &rsp); err != nil {
 		return
 	}
+	if len(rsp.Results) != 1 {
+		return nil, fmt.Errorf("prometheus read results: %d, expect 1", len(rsp.Results))
+	}
+	return rsp.Results[0], nil
+}
 
-	resp, err := hb.transport.RoundTrip(req)
+// ReadPromStream sends a remote read request of the query to backend and streams the response to w as is.
+func (hb *HttpBackend) ReadPromStream(req *http.Request, query *remote.Query, w http.ResponseWriter) (err error) {
+	resp, err := hb.readProm(req, query)
 	if err != nil {
-		log.Printf("prometheus read error: %s", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	CopyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if err = StreamBody(w, resp.Body); err != nil {
+		log.Printf("prometheus stream body error: %s", err)
+	}
+	return
+}
 
-	p, err := io.ReadAll(resp.Body)
+// WritePromReadResponse writes the remote read response in snappy compressed protobuf.
+func WritePromReadResponse(w http.ResponseWriter, rsp *remote.ReadResponse) error {
+	data, err := proto.Marshal(rsp)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	_, err = w.Write(snappy.Encode(nil, data))
+	return err
+}
+
+// readProm sends a remote read request of the query to backend and returns the response of status code 200.
+func (hb *HttpBackend) readProm(req *http.Request, query *remote.Query) (resp *http.Response, err error) {
+	form := url.Values{}
+	for k, v := range req.Form {
+		if k != "u" && k != "p" {
+			form[k] = v
+		}
+	}
+	data, err := proto.Marshal(&remote.ReadRequest{Queries: []*remote.Query{query}})
 	if err != nil {
-		log.Printf("prometheus read body error: %s", err)
 		return
 	}
 
-	w.WriteHeader(resp.StatusCode)
-	_, err = w.Write(p)
-	return
+	preq, err := http.NewRequestWithContext(req.Context(), "POST", hb.Url+"/api/v1/prom/read?"+form.Encode(), bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		log.Print("new request error: ", err)
+		return
+	}
+	preq.Header.Set("Content-Type", "application/x-protobuf")
+	preq.Header.Set("Content-Encoding", "snappy")
+	preq.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+	if hb.username != "" || hb.password != "" {
+		hb.SetBasicAuth(preq)
+	}
+
+	resp, err = hb.transport.RoundTrip(preq)
+	if err != nil {
+		log.Printf("prometheus read error: %s", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		p, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("prometheus read status code: %d, error: %s", resp.StatusCode, bytes.TrimSpace(p))
+	}
+	return resp, nil
+}
+
+// ReadPromNative translates the remote read query into influxql and queries with epoch ms, for the backend without /api/v1/prom/read.
+func (hb *HttpBackend) ReadPromNative(db, rp, mm string, query *remote.Query) (*remote.QueryResult, error) {
+	q, err := PromQueryToInfluxQL(rp, mm, query)
+	if err != nil {
+		return nil, err
+	}
+	qr := hb.Query(NewQueryRequest("GET", db, q, "ms"), nil, true)
+	if qr.Err != nil {
+		return nil, qr.Err
+	}
+	return PromQueryResultFromResponseBytes(qr.Body)
 }
 
 func (hb *HttpBackend) QueryFlux(req *http.Request, w http.ResponseWriter) (err error) {
@@ -331,19 +446,14 @@ func (hb *HttpBackend) QueryFlux(req *http.Request, w http.ResponseWriter) (err
 	defer resp.Body.Close()
 
 	CopyHeader(w.Header(), resp.Header)
-
-	p, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("flux read body error: %s", err)
-		return
-	}
 	w.WriteHeader(resp.StatusCode)
-	_, err = w.Write(p)
+	if err = StreamBody(w, resp.Body); err != nil {
+		log.Printf("flux stream body error: %s", err)
+	}
 	return
 }
 
-func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
-	qr = &QueryResult{}
+func (hb *HttpBackend) prepareQuery(req *http.Request) (err error) {
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
@@ -354,9 +464,50 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 		hb.SetBasicAuth(req)
 	}
 
-	req.URL, qr.Err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
-	if qr.Err != nil {
-		log.Print("internal url parse error: ", qr.Err)
+	req.URL, err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
+	if err != nil {
+		log.Print("internal url parse error: ", err)
+	}
+	return
+}
+
+// QueryStream queries and streams the response to w with flushing, including the chunked response of `chunked=true`.
+// The response with status code >= 400 is returned as error without being written, so that another backend can be queried.
+func (hb *HttpBackend) QueryStream(req *http.Request, w http.ResponseWriter) (err error) {
+	if err = hb.prepareQuery(req); err != nil {
+		return
+	}
+
+	q := strings.TrimSpace(req.FormValue("q"))
+	resp, err := hb.transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("query error: %s, the query is %s", err, q)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var p []byte
+		if p, err = io.ReadAll(resp.Body); err == nil && resp.Header.Get("Content-Encoding") == "gzip" {
+			p, err = Decompress(p)
+		}
+		if err != nil {
+			log.Printf("read body error: %s, the query is %s", err, q)
+			return
+		}
+		return queryError(resp.StatusCode, p)
+	}
+	CopyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if err = StreamBody(w, resp.Body); err != nil {
+		log.Printf("stream body error: %s, the query is %s", err, q)
+	}
+	return
+}
+
+func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
+	qr = &QueryResult{}
+	if qr.Err = hb.prepareQuery(req); qr.Err != nil {
 		return
 	}
 
@@ -392,14 +543,22 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 		return
 	}
 	if resp.StatusCode >= 400 {
-		rsp, _ := ResponseFromResponseBytes(qr.Body)
-		qr.Err = errors.New(rsp.Err)
+		qr.Err = queryError(resp.StatusCode, qr.Body)
 	}
 	qr.Header = resp.Header
 	qr.Status = resp.StatusCode
 	return
 }
 
+// queryError returns the error responded by backend with status code >= 400,
+// or the status code and body if the body is not a json error.
+func queryError(status int, body []byte) error {
+	if rsp, err := ResponseFromResponseBytes(body); err == nil && rsp.Err != "" {
+		return errors.New(rsp.Err)
+	}
+	return fmt.Errorf("query status code: %d, error: %s", status, bytes.TrimSpace(body))
+}
+
 func (hb *HttpBackend) QueryChunk(method, db, q, epoch string, chunk int) (cr *ChunkedResponse, err error) {
 	req := NewQueryRequest(method, db, q, epoch)
 	if hb.username != "" || hb.password != "" {
@@ -463,25 +622,41 @@ func (hb *HttpBackend) GetMeasurements(db string) []string {
 	return hb.GetSeriesValues(db, "show measurements")
 }
 
+func (hb *HttpBackend) GetSeries(db, mm string) []string {
+	return hb.GetSeriesValues(db, fmt.Sprintf("show series from \"%s\"", util.EscapeIdentifier(mm)))
+}
+
 func (hb *HttpBackend) GetTagKeys(db, rp, mm string) []string {
 	return hb.GetSeriesValues(db, fmt.Sprintf("show tag keys from \"%s\".\"%s\"", util.EscapeIdentifier(rp), util.EscapeIdentifier(mm)))
 }
 
 func (hb *HttpBackend) GetFieldKeys(db, rp, mm string) map[string][]string {
+	fieldKeys, _ := hb.FieldKeys(db, rp, mm)
+	return fieldKeys
+}
+
+// FieldKeys returns the types of field keys of measurement mm, or the error if the query fails.
+func (hb *HttpBackend) FieldKeys(db, rp, mm string) (map[string][]string, error) {
 	fieldKeys := make(map[string][]string)
 	q := fmt.Sprintf("show field keys from \"%s\".\"%s\"", util.EscapeIdentifier(rp), util.EscapeIdentifier(mm))
+	if rp == "" {
+		q = fmt.Sprintf("show field keys from \"%s\"", util.EscapeIdentifier(mm))
+	}
 	qr := hb.Query(NewQueryRequest("GET", db, q, ""), nil, true)
 	if qr.Err != nil {
-		return fieldKeys
+		return fieldKeys, qr.Err
+	}
+	series, err := SeriesFromResponseBytes(qr.Body)
+	if err != nil {
+		return fieldKeys, err
 	}
-	series, _ := SeriesFromResponseBytes(qr.Body)
 	for _, s := range series {
 		for _, v := range s.Values {
 			fk := v[0].(string)
 			fieldKeys[fk] = append(fieldKeys[fk], v[1].(string))
 		}
 	}
-	return fieldKeys
+	return fieldKeys, nil
 }
 
 func (hb *HttpBackend) DropMeasurement(db, mm string) ([]byte, error) {
@@ -490,7 +665,13 @@ func (hb *HttpBackend) DropMeasurement(db, mm string) ([]byte, error) {
 	return qr.Body, qr.Err
 }
 
+// CancelWrite aborts the in-flight and later writes, the data will be written to file instead.
+func (hb *HttpBackend) CancelWrite() {
+	hb.cancel()
+}
+
 func (hb *HttpBackend) Close() {
 	hb.running.Store(false)
+	hb.cancel()
 	hb.transport.CloseIdleConnections()
 }
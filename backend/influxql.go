@@ -8,6 +8,7 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
@@ -39,6 +40,7 @@ var (
 	ErrUnmatchedQuote = errors.New("unmatched quote")
 	ErrUnclosed       = errors.New("unclosed parenthesis")
 	ErrIllegalQL      = errors.New("illegal InfluxQL")
+	ErrNotExecuted    = errors.New("not executed")
 )
 
 func FindEndWithQuote(data []byte, start int, endchar byte) (end int, unquoted []byte, err error) {
@@ -52,7 +54,7 @@ func FindEndWithQuote(data []byte, start int, endchar byte) (end int, unquoted [
 			return
 		case '\\':
 			switch {
-			case len(data) == end:
+			case len(data) == end+1:
 				err = ErrUnmatchedQuote
 				return
 			case data[end+1] == endchar || data[end+1] == '\\':
@@ -70,6 +72,69 @@ func FindEndWithQuote(data []byte, start int, endchar byte) (end int, unquoted [
 	return
 }
 
+// SplitStatements splits the query q into the statements by the semicolons outside the quotes, and drops the empty statements.
+// The query is not split if its quotes are invalid, which is left to the backend to report.
+func SplitStatements(q string) (stmts []string) {
+	data := []byte(q)
+	start := 0
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '"', '\'', '/':
+			if data[i] == '/' && !isRegexStart(data, i) {
+				continue
+			}
+			end, err := findEndWithQuoteOrRegex(data, i)
+			if err != nil {
+				return []string{strings.TrimSpace(q)}
+			}
+			i = end - 1
+		case ';':
+			if stmt := strings.TrimSpace(q[start:i]); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			start = i + 1
+		}
+	}
+	if stmt := strings.TrimSpace(q[start:]); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return
+}
+
+// isRegexStart returns whether the slash at position i of data starts a regex, which follows =~, !~, from,
+// or a comma in the measurement list, while the other slashes are divisions.
+func isRegexStart(data []byte, i int) bool {
+	j := i - 1
+	for j >= 0 && isSpace(data[j]) {
+		j--
+	}
+	if j < 0 {
+		return false
+	}
+	if data[j] == ',' || j >= 1 && data[j] == '~' && (data[j-1] == '=' || data[j-1] == '!') {
+		return true
+	}
+	return j >= 3 && strings.EqualFold(string(data[j-3:j+1]), "from") && (j == 3 || !isIdentChar(data[j-4]))
+}
+
+// findEndWithQuoteOrRegex returns the end of the quoted identifier, string or regex starting at position start of data,
+// any character can be escaped by backslash in regex.
+func findEndWithQuoteOrRegex(data []byte, start int) (int, error) {
+	if data[start] != '/' {
+		end, _, err := FindEndWithQuote(data, start, data[start])
+		return end, err
+	}
+	for end := start + 1; end < len(data); end++ {
+		switch data[end] {
+		case '/':
+			return end + 1, nil
+		case '\\':
+			end++
+		}
+	}
+	return 0, ErrUnmatchedQuote
+}
+
 func SkipWhitespace(buf []byte, i int) int {
 	for i < len(buf) {
 		if buf[i] != ' ' && buf[i] != '\t' && buf[i] != 0 {
@@ -472,3 +537,172 @@ func removeLimitOffsetClause(q string) (np string) {
 	}
 	return strings.TrimSpace(q[:lpos])
 }
+
+// Source is a source of the from clause, which is a measurement or a regex of measurements, with optional database and retention policy.
+type Source struct {
+	Database        string
+	RetentionPolicy string
+	Measurement     string
+	Regex           string
+}
+
+func (s *Source) String() string {
+	var sb strings.Builder
+	if s.Database != "" {
+		sb.WriteString(fmt.Sprintf("\"%s\".", util.EscapeIdentifier(s.Database)))
+		if s.RetentionPolicy != "" {
+			sb.WriteString(fmt.Sprintf("\"%s\"", util.EscapeIdentifier(s.RetentionPolicy)))
+		}
+		sb.WriteByte('.')
+	} else if s.RetentionPolicy != "" {
+		sb.WriteString(fmt.Sprintf("\"%s\".", util.EscapeIdentifier(s.RetentionPolicy)))
+	}
+	if s.Regex != "" {
+		sb.WriteString(fmt.Sprintf("/%s/", util.EscapeRegex(s.Regex)))
+	} else {
+		sb.WriteString(fmt.Sprintf("\"%s\"", util.EscapeIdentifier(s.Measurement)))
+	}
+	return sb.String()
+}
+
+// ParseSourcesFromInfluxQL parses the sources of the from clause in the select statement q, and returns the sources
+// with the start and end offsets of the clause in q, the sources are nil if the from clause is a subquery.
+func ParseSourcesFromInfluxQL(q string) (sources []*Source, start int, end int, err error) {
+	start = findFromClause(q)
+	if start < 0 {
+		return nil, 0, 0, ErrIllegalQL
+	}
+	i := skipSpace(q, start)
+	if i < len(q) && q[i] == '(' {
+		return nil, 0, 0, nil
+	}
+	for {
+		src := &Source{}
+		var parts []string
+		for {
+			i = skipSpace(q, i)
+			if i >= len(q) {
+				return nil, 0, 0, ErrIllegalQL
+			}
+			var part string
+			if q[i] == '/' {
+				if src.Regex, i, err = scanRegex(q, i); err != nil {
+					return nil, 0, 0, err
+				}
+				break
+			} else if q[i] == '"' || q[i] == '\'' {
+				if part, i, err = scanQuotedIdentifier(q, i); err != nil {
+					return nil, 0, 0, err
+				}
+			} else if q[i] != '.' {
+				j := i
+				for ; j < len(q) && !strings.ContainsRune(" \t\r\n.,;()\"'", rune(q[j])); j++ { //revive:disable-line:empty-block
+				}
+				if j == i {
+					return nil, 0, 0, ErrIllegalQL
+				}
+				part, i = q[i:j], j
+			}
+			parts = append(parts, part)
+			if i >= len(q) || q[i] != '.' {
+				break
+			}
+			i++
+		}
+		switch {
+		case src.Regex != "" && len(parts) == 3 || src.Regex == "" && len(parts) == 4:
+			return nil, 0, 0, ErrIllegalQL
+		case src.Regex != "":
+			parts = append(parts, "")
+		}
+		switch len(parts) {
+		case 1:
+			src.Measurement = parts[0]
+		case 2:
+			src.RetentionPolicy, src.Measurement = parts[0], parts[1]
+		case 3:
+			src.Database, src.RetentionPolicy, src.Measurement = parts[0], parts[1], parts[2]
+		}
+		if src.Regex == "" && src.Measurement == "" {
+			return nil, 0, 0, ErrIllegalQL
+		}
+		sources = append(sources, src)
+		end = i
+		i = skipSpace(q, i)
+		if i >= len(q) || q[i] != ',' {
+			break
+		}
+		i++
+	}
+	return sources, start, end, nil
+}
+
+// findFromClause returns the offset after the first from keyword outside the quotes and parentheses, or -1 if not found.
+func findFromClause(q string) int {
+	depth := 0
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; c {
+		case '"', '\'':
+			end, _, err := FindEndWithQuote([]byte(q), i, c)
+			if err != nil {
+				return -1
+			}
+			i = end - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case 'f', 'F':
+			if depth == 0 && i+4 < len(q) && strings.EqualFold(q[i:i+4], "from") && isSpace(q[i+4]) && (i == 0 || isSpace(q[i-1])) {
+				return i + 4
+			}
+		}
+	}
+	return -1
+}
+
+func scanQuotedIdentifier(q string, i int) (string, int, error) {
+	end, unquoted, err := FindEndWithQuote([]byte(q), i, q[i])
+	if err != nil {
+		return "", 0, err
+	}
+	return string(unquoted[1 : len(unquoted)-1]), end, nil
+}
+
+func scanRegex(q string, i int) (string, int, error) {
+	var sb strings.Builder
+	for j := i + 1; j < len(q); j++ {
+		switch q[j] {
+		case '\\':
+			if j+1 < len(q) && q[j+1] == '/' {
+				j++
+			} else {
+				sb.WriteByte(q[j])
+				j++
+				if j == len(q) {
+					return "", 0, ErrUnmatchedQuote
+				}
+			}
+			sb.WriteByte(q[j])
+		case '/':
+			if sb.Len() == 0 {
+				return "", 0, ErrIllegalQL
+			}
+			return sb.String(), j + 1, nil
+		default:
+			sb.WriteByte(q[j])
+		}
+	}
+	return "", 0, ErrUnmatchedQuote
+}
+
+func skipSpace(q string, i int) int {
+	for i < len(q) && isSpace(q[i]) {
+		i++
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -4,7 +4,10 @@
 
 package backend
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 // ALTER RETENTION POLICY "1h.cpu" ON "mydb" DEFAULT
 // ALTER RETENTION POLICY "policy1" ON "somedb" DURATION 1h REPLICATION 4
@@ -753,3 +756,127 @@ func TestLimitOffsetClause(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSourcesFromInfluxQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		q       string
+		sources []*Source
+		clause  string
+	}{
+		{
+			name:    "single",
+			q:       `select * from cpu where time > now() - 1h`,
+			sources: []*Source{{Measurement: "cpu"}},
+			clause:  ` cpu`,
+		},
+		{
+			name:    "multiple",
+			q:       `SELECT mean("value") FROM cpu,"m e,m" , autogen."disk.io" GROUP BY time(1m)`,
+			sources: []*Source{{Measurement: "cpu"}, {Measurement: "m e,m"}, {RetentionPolicy: "autogen", Measurement: "disk.io"}},
+			clause:  ` cpu,"m e,m" , autogen."disk.io"`,
+		},
+		{
+			name:    "regex",
+			q:       `select * from db../^disk\/\d+$/, "d.b"."rp".cpu limit 1`,
+			sources: []*Source{{Database: "db", Regex: `^disk/\d+$`}, {Database: "d.b", RetentionPolicy: "rp", Measurement: "cpu"}},
+			clause:  ` db../^disk\/\d+$/, "d.b"."rp".cpu`,
+		},
+		{
+			name:    "quoted from in fields",
+			q:       `select "from", 'from' from 'cpu'`,
+			sources: []*Source{{Measurement: "cpu"}},
+			clause:  ` 'cpu'`,
+		},
+		{
+			name:   "subquery",
+			q:      `select max(v) from (select * from cpu, mem)`,
+			clause: ``,
+		},
+	}
+	for _, tt := range tests {
+		sources, start, end, err := ParseSourcesFromInfluxQL(tt.q)
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(sources, tt.sources) {
+			t.Errorf("%v: got sources %+v, want %+v", tt.name, sources, tt.sources)
+		}
+		if clause := tt.q[start:end]; clause != tt.clause {
+			t.Errorf("%v: got clause %q, want %q", tt.name, clause, tt.clause)
+		}
+	}
+
+	for _, q := range []string{`select * from`, `select * from cpu,`, `select * from /cpu`, `select * from //`, `select * from a.b.c.d`} {
+		if _, _, _, err := ParseSourcesFromInfluxQL(q); err == nil {
+			t.Errorf("%q: got nil error", q)
+		}
+	}
+}
+
+func TestSourceString(t *testing.T) {
+	tests := []struct {
+		have *Source
+		want string
+	}{
+		{have: &Source{Measurement: `c"pu`}, want: `"c\"pu"`},
+		{have: &Source{RetentionPolicy: "rp", Measurement: "cpu"}, want: `"rp"."cpu"`},
+		{have: &Source{Database: "db", Measurement: "cpu"}, want: `"db".."cpu"`},
+		{have: &Source{Database: "db", RetentionPolicy: "rp", Regex: "^a/b"}, want: `"db"."rp"./^a\/b/`},
+	}
+	for _, tt := range tests {
+		if got := tt.have.String(); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		q    string
+		want []string
+	}{
+		{
+			name: "single",
+			q:    `select * from cpu;`,
+			want: []string{`select * from cpu`},
+		},
+		{
+			name: "multiple",
+			q:    ` show databases ;; select * from "c;pu" where host = 'a;b' and "x\";" = 'it\'s;' ; `,
+			want: []string{`show databases`, `select * from "c;pu" where host = 'a;b' and "x\";" = 'it\'s;'`},
+		},
+		{
+			name: "unmatched quote",
+			q:    `select * from cpu where host = 'a; select 1`,
+			want: []string{`select * from cpu where host = 'a; select 1`},
+		},
+		{
+			name: "trailing backslash",
+			q:    `select * from cpu where host = 'a\`,
+			want: []string{`select * from cpu where host = 'a\`},
+		},
+		{
+			name: "regex",
+			q:    `select * from cpu where host =~ /a;b/ and path !~ /\/x;\d/; select * from /c;pu/, /m\/;em/;show measurements with measurement =~/d;isk/`,
+			want: []string{`select * from cpu where host =~ /a;b/ and path !~ /\/x;\d/`, `select * from /c;pu/, /m\/;em/`, `show measurements with measurement =~/d;isk/`},
+		},
+		{
+			name: "division",
+			q:    `select used / total from mem; select 1 / 2 from "FROM"`,
+			want: []string{`select used / total from mem`, `select 1 / 2 from "FROM"`},
+		},
+		{
+			name: "unmatched regex",
+			q:    `select * from cpu where host =~ /a; select 1`,
+			want: []string{`select * from cpu where host =~ /a; select 1`},
+		},
+	}
+	for _, tt := range tests {
+		if got := SplitStatements(tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
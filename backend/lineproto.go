@@ -5,8 +5,10 @@
 package backend
 
 import (
+	"bufio"
 	"bytes"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +22,49 @@ type LinePoint struct {
 	Line []byte
 }
 
+// NewLineScanner returns a scanner reading line protocol from r, lines longer than maxLineSize cause bufio.ErrTooLong, no limit if maxLineSize <= 0.
+func NewLineScanner(r io.Reader, maxLineSize int) *bufio.Scanner {
+	if maxLineSize <= 0 {
+		maxLineSize = math.MaxInt32
+	}
+	scanner := bufio.NewScanner(r)
+	size := bufio.MaxScanTokenSize
+	if maxLineSize < size {
+		size = maxLineSize
+	}
+	// one more byte after the newline is required by ScanLines
+	scanner.Buffer(make([]byte, 0, size+2), maxLineSize+2)
+	scanner.Split(ScanLines)
+	return scanner
+}
+
+// SplitLines splits p into non-empty lines of line protocol.
+func SplitLines(p []byte) (lines [][]byte) {
+	scanner := NewLineScanner(bytes.NewReader(p), len(p))
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(line) > 0 {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	return
+}
+
+// ScanLines is a split function for bufio.Scanner based on ScanLine, newlines inside quoted field values are kept in the line.
+func ScanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	i, line := ScanLine(data, 0)
+	// the byte after the newline must be available to handle escaped characters the same way as the whole buffer
+	if i+1 < len(data) || (atEOF && i < len(data)) {
+		return i + 1, line, nil
+	}
+	if atEOF {
+		return len(data), line, nil
+	}
+	return 0, nil, nil
+}
+
 func ScanKey(pointbuf []byte) (key string, err error) {
 	buflen := len(pointbuf)
 	var b strings.Builder
@@ -40,6 +85,19 @@ func ScanKey(pointbuf []byte) (key string, err error) {
 	return "", io.EOF
 }
 
+// ScanTags returns the tags of the series key, which ends at the first unescaped space.
+func ScanTags(pointbuf []byte) models.Tags {
+	for i := 0; i < len(pointbuf); i++ {
+		switch pointbuf[i] {
+		case '\\':
+			i++
+		case ' ':
+			return models.ParseTags(pointbuf[:i])
+		}
+	}
+	return models.ParseTags(pointbuf)
+}
+
 func ScanTime(buf []byte) (int, bool) {
 	i := len(buf) - 1
 	for ; i >= 0; i-- {
@@ -10,6 +10,7 @@ import (
 	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestScanKey(t *testing.T) {
@@ -374,3 +375,58 @@ func BenchmarkRapidCheck(b *testing.B) {
 		RapidCheck(line)
 	}
 }
+
+func TestScanLines(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			name: "lines",
+			data: "cpu value=1\nmem value=2\n",
+			want: []string{"cpu value=1", "mem value=2"},
+		},
+		{
+			name: "no trailing newline",
+			data: "cpu value=1\n\nmem value=2",
+			want: []string{"cpu value=1", "", "mem value=2"},
+		},
+		{
+			name: "quoted newline",
+			data: "cpu value=\"a\nb\"\nmem value=2\n",
+			want: []string{"cpu value=\"a\nb\"", "mem value=2"},
+		},
+		{
+			name: "escaped newline",
+			data: "cpu,host=a\\\nb value=1\nmem value=2",
+			want: []string{"cpu,host=a\\\nb value=1", "mem value=2"},
+		},
+	}
+	for _, tt := range tests {
+		for _, r := range []io.Reader{strings.NewReader(tt.data), iotest.OneByteReader(strings.NewReader(tt.data))} {
+			scanner := NewLineScanner(r, 1024)
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Errorf("%v: error %v", tt.name, err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) || len(got) != len(tt.want) {
+				t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestScanLinesTooLong(t *testing.T) {
+	scanner := NewLineScanner(strings.NewReader("cpu value=1\n"+strings.Repeat("a", 100)+"\n"), 64)
+	n := 0
+	for scanner.Scan() {
+		n++
+	}
+	if n != 1 || scanner.Err() == nil {
+		t.Errorf("got %d lines and error %v, want 1 line and error", n, scanner.Err())
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+const (
+	// promNameTag is the label name of prometheus metric name
+	promNameTag = "__name__"
+	// promValueField is the field prometheus values are written to
+	promValueField = "value"
+)
+
+// PromQueryToInfluxQL translates the time range and label matchers of the prometheus query on measurement mm into influxql,
+// the matchers of __name__ are ignored since the measurement is resolved already.
+func PromQueryToInfluxQL(rp, mm string, q *remote.Query) (string, error) {
+	return promQueryToInfluxQL(fmt.Sprintf("\"%s\"", promValueField), rp, mm, q)
+}
+
+// PromSeriesToInfluxQL is like PromQueryToInfluxQL but selects only the last sample of each time series.
+func PromSeriesToInfluxQL(rp, mm string, q *remote.Query) (string, error) {
+	return promQueryToInfluxQL(fmt.Sprintf("last(\"%s\")", promValueField), rp, mm, q)
+}
+
+func promQueryToInfluxQL(field, rp, mm string, q *remote.Query) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("select %s from ", field))
+	if rp != "" {
+		sb.WriteString(fmt.Sprintf("\"%s\".", util.EscapeIdentifier(rp)))
+	}
+	sb.WriteString(fmt.Sprintf("\"%s\" where time >= %dms and time <= %dms", util.EscapeIdentifier(mm), q.StartTimestampMs, q.EndTimestampMs))
+	for _, m := range q.Matchers {
+		if m.Name == promNameTag {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf(" and \"%s\" ", util.EscapeIdentifier(m.Name)))
+		switch m.Type {
+		case remote.MatchType_EQUAL:
+			sb.WriteString(fmt.Sprintf("= '%s'", util.EscapeString(m.Value)))
+		case remote.MatchType_NOT_EQUAL:
+			sb.WriteString(fmt.Sprintf("!= '%s'", util.EscapeString(m.Value)))
+		case remote.MatchType_REGEX_MATCH:
+			sb.WriteString(fmt.Sprintf("=~ /^(?:%s)$/", util.EscapeRegex(m.Value)))
+		case remote.MatchType_REGEX_NO_MATCH:
+			sb.WriteString(fmt.Sprintf("!~ /^(?:%s)$/", util.EscapeRegex(m.Value)))
+		default:
+			return "", fmt.Errorf("unknown match type %v", m.Type)
+		}
+	}
+	sb.WriteString(" group by *")
+	return sb.String(), nil
+}
+
+// PromQueryResultFromResponseBytes builds the time series of prometheus from the response body queried with epoch ms.
+func PromQueryResultFromResponseBytes(body []byte) (*remote.QueryResult, error) {
+	rsp, err := ResponseFromResponseBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Err != "" {
+		return nil, errors.New(rsp.Err)
+	}
+	var series models.Rows
+	if len(rsp.Results) > 0 {
+		if rsp.Results[0].Err != "" {
+			return nil, errors.New(rsp.Results[0].Err)
+		}
+		series = rsp.Results[0].Series
+	}
+	return PromQueryResultFromSeries(series)
+}
+
+// PromQueryResultFromSeries builds the time series of prometheus from the series queried with epoch ms,
+// the tags are the labels and the measurement is the metric name if there is no __name__ tag.
+func PromQueryResultFromSeries(series models.Rows) (*remote.QueryResult, error) {
+	qr := &remote.QueryResult{}
+	for _, s := range series {
+		ts := &remote.TimeSeries{}
+		if _, ok := s.Tags[promNameTag]; !ok {
+			ts.Labels = append(ts.Labels, &remote.LabelPair{Name: promNameTag, Value: s.Name})
+		}
+		for k, v := range s.Tags {
+			if v != "" {
+				ts.Labels = append(ts.Labels, &remote.LabelPair{Name: k, Value: v})
+			}
+		}
+		sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+
+		for _, v := range s.Values {
+			if len(v) < 2 || v[1] == nil {
+				continue
+			}
+			tn, ok := v[0].(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("invalid time: %v", v[0])
+			}
+			t, err := tn.Int64()
+			if err != nil {
+				return nil, err
+			}
+			vn, ok := v[1].(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("invalid value: %v", v[1])
+			}
+			value, err := vn.Float64()
+			if err != nil {
+				return nil, err
+			}
+			ts.Samples = append(ts.Samples, &remote.Sample{Value: value, TimestampMs: t})
+		}
+		if len(ts.Samples) > 0 {
+			qr.Timeseries = append(qr.Timeseries, ts)
+		}
+	}
+	return qr, nil
+}
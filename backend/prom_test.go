@@ -0,0 +1,108 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+)
+
+func TestPromQueryToInfluxQL(t *testing.T) {
+	tests := []struct {
+		name string
+		rp   string
+		mm   string
+		have []*remote.LabelMatcher
+		want string
+	}{
+		{
+			name: "test1",
+			mm:   "up",
+			have: []*remote.LabelMatcher{{Type: remote.MatchType_EQUAL, Name: "__name__", Value: "up"}},
+			want: `select "value" from "up" where time >= 1000ms and time <= 2000ms group by *`,
+		},
+		{
+			name: "test2",
+			rp:   "autogen",
+			mm:   "http_requests_total",
+			have: []*remote.LabelMatcher{
+				{Type: remote.MatchType_REGEX_MATCH, Name: "__name__", Value: "http_.*"},
+				{Type: remote.MatchType_EQUAL, Name: "job", Value: "node"},
+				{Type: remote.MatchType_NOT_EQUAL, Name: "code", Value: "500"},
+				{Type: remote.MatchType_REGEX_MATCH, Name: "path", Value: "/api/.+"},
+				{Type: remote.MatchType_REGEX_NO_MATCH, Name: "instance", Value: "localhost:.*"},
+			},
+			want: `select "value" from "autogen"."http_requests_total" where time >= 1000ms and time <= 2000ms and "job" = 'node' and "code" != '500' and "path" =~ /^(?:\/api\/.+)$/ and "instance" !~ /^(?:localhost:.*)$/ group by *`,
+		},
+		{
+			name: "test3",
+			mm:   `cpu"usage`,
+			have: []*remote.LabelMatcher{{Type: remote.MatchType_EQUAL, Name: "host", Value: `it's`}},
+			want: `select "value" from "cpu\"usage" where time >= 1000ms and time <= 2000ms and "host" = 'it\'s' group by *`,
+		},
+		{
+			name: "test4",
+			mm:   "http_requests_total",
+			have: []*remote.LabelMatcher{
+				{Type: remote.MatchType_REGEX_MATCH, Name: "path", Value: `\/api/v1\\/.*`},
+			},
+			want: `select "value" from "http_requests_total" where time >= 1000ms and time <= 2000ms and "path" =~ /^(?:\/api\/v1\\\/.*)$/ group by *`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := PromQueryToInfluxQL(tt.rp, tt.mm, &remote.Query{StartTimestampMs: 1000, EndTimestampMs: 2000, Matchers: tt.have})
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPromQueryResultFromSeries(t *testing.T) {
+	body := []byte(`{"results":[{"statement_id":0,"series":[` +
+		`{"name":"up","tags":{"__name__":"up","instance":"a","job":""},"columns":["time","value"],"values":[[1000,1],[2000,null]]},` +
+		`{"name":"up","tags":{"instance":"b"},"columns":["time","value"],"values":[[1000,0.5]]},` +
+		`{"name":"up","tags":{"instance":"c"},"columns":["time","value"],"values":[[1000,null]]}]}]}`)
+	series, err := SeriesFromResponseBytes(body)
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	got, err := PromQueryResultFromSeries(series)
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	want := &remote.QueryResult{Timeseries: []*remote.TimeSeries{
+		{
+			Labels:  []*remote.LabelPair{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "a"}},
+			Samples: []*remote.Sample{{Value: 1, TimestampMs: 1000}},
+		},
+		{
+			Labels:  []*remote.LabelPair{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "b"}},
+			Samples: []*remote.Sample{{Value: 0.5, TimestampMs: 1000}},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPromSeriesToInfluxQL(t *testing.T) {
+	q := &remote.Query{StartTimestampMs: 1000, EndTimestampMs: 2000, Matchers: []*remote.LabelMatcher{
+		{Type: remote.MatchType_EQUAL, Name: "__name__", Value: "up"},
+		{Type: remote.MatchType_EQUAL, Name: "job", Value: "node"},
+	}}
+	got, err := PromSeriesToInfluxQL("", "up", q)
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	want := `select last("value") from "up" where time >= 1000ms and time <= 2000ms and "job" = 'node' group by *`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
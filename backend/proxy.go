@@ -5,7 +5,12 @@
 package backend
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
@@ -13,14 +18,22 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
 )
 
 type Proxy struct {
 	Circles []*Circle
+	cfg     *ProxyConfig
+	lock    sync.RWMutex
+	routing sync.RWMutex
 	dbSet   util.Set
 	sTpl    *shardTpl
+	budget  *MemoryBudget
+	schema  *SchemaCache
+	card    *CardinalityLimiter
+	cache   *QueryCache
 }
 
 func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
@@ -31,15 +44,18 @@ func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
 	}
 	ip = &Proxy{
 		Circles: make([]*Circle, len(cfg.Circles)),
-		dbSet:   util.NewSet(),
+		cfg:     cfg,
+		dbSet:   util.NewSetFromSlice(cfg.DBList),
 		sTpl:    newShardTpl(cfg.ShardKey),
+		budget:  NewMemoryBudget(cfg.BufferMemoryLimit, cfg.BufferPolicy),
+		schema:  NewSchemaCache(),
+		card:    NewCardinalityLimiter(cfg.CardinalityDBLimit, cfg.CardinalityMmLimit, cfg.CardinalityPolicy),
+		cache:   NewQueryCache(cfg.QueryCacheSize, cfg.QueryCacheTTL, cfg.QueryCacheBucket),
 	}
+	ip.schema.Set(cfg.SchemaCacheEnabled)
 	for idx, circfg := range cfg.Circles {
-		ip.Circles[idx] = NewCircle(circfg, cfg, idx)
-		ip.Circles[idx].getKeyFn = ip.GetKey
-	}
-	for _, db := range cfg.DBList {
-		ip.dbSet.Add(db)
+		ip.Circles[idx] = NewCircle(circfg, cfg, idx, ip.budget, ip.schema, ip.cache)
+		ip.Circles[idx].sTpl = ip.sTpl
 	}
 	rand.New(rand.NewSource(time.Now().UnixNano()))
 	return
@@ -49,6 +65,17 @@ func (ip *Proxy) GetKey(db, mm string) string {
 	return ip.sTpl.GetKey(db, mm)
 }
 
+// GetKeyWithTags returns the shard key of the point with tags, the tags are ignored if the shard key doesn't contain %tag(name).
+func (ip *Proxy) GetKeyWithTags(db, mm string, tags models.Tags) string {
+	return ip.sTpl.GetKeyWithTags(db, mm, tags)
+}
+
+// IsShardedByTags returns whether the shard key contains %tag(name), which shards the points of a measurement
+// to different backends by the tag values.
+func (ip *Proxy) IsShardedByTags() bool {
+	return ip.sTpl.HasTags()
+}
+
 func (ip *Proxy) GetBackends(key string) []*Backend {
 	backends := make([]*Backend, len(ip.Circles))
 	for i, circle := range ip.Circles {
@@ -60,11 +87,11 @@ func (ip *Proxy) GetBackends(key string) []*Backend {
 func (ip *Proxy) GetAllBackends() []*Backend {
 	capacity := 0
 	for _, circle := range ip.Circles {
-		capacity += len(circle.Backends)
+		capacity += len(circle.Backends())
 	}
 	backends := make([]*Backend, 0, capacity)
 	for _, circle := range ip.Circles {
-		backends = append(backends, circle.Backends...)
+		backends = append(backends, circle.Backends()...)
 	}
 	return backends
 }
@@ -83,10 +110,83 @@ func (ip *Proxy) GetHealth(stats bool) []interface{} {
 	return health
 }
 
+// Cardinality returns the limiter of series cardinality, which is also a prometheus collector.
+func (ip *Proxy) Cardinality() *CardinalityLimiter {
+	return ip.card
+}
+
+// QueryCache returns the cache of query responses, which is also a prometheus collector.
+func (ip *Proxy) QueryCache() *QueryCache {
+	return ip.cache
+}
+
+// BufferStats returns the memory usage and limit in bytes of the points buffered by all backends.
+func (ip *Proxy) BufferStats() map[string]interface{} {
+	return map[string]interface{}{
+		"bytes":    ip.budget.Usage(),
+		"limit":    ip.budget.Limit(),
+		"exceeded": ip.budget.Exceeded(),
+		"policy":   ip.Config().BufferPolicy,
+	}
+}
+
 func (ip *Proxy) IsForbiddenDB(db string) bool {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
 	return len(ip.dbSet) > 0 && !ip.dbSet[db]
 }
 
+func (ip *Proxy) Config() *ProxyConfig {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+	return ip.cfg
+}
+
+// Reload applies cfg to the running proxy in place, or returns an error without any change
+// if cfg contains changes which cannot be applied safely.
+func (ip *Proxy) Reload(cfg *ProxyConfig) error {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+	err := ip.cfg.CheckReload(cfg)
+	if err != nil {
+		return err
+	}
+	for idx, circfg := range cfg.Circles {
+		circle := ip.Circles[idx]
+		added, removed := circle.Reload(circfg, cfg)
+		for _, be := range added {
+			log.Printf("circle %d: backend %s(%s) added", idx, be.Name, be.Url)
+		}
+		for _, be := range removed {
+			if be.fb.IsData() {
+				log.Printf("circle %d: backend %s(%s) removed, backlog data is left in %s", idx, be.Name, be.Url, cfg.DataDir)
+			} else {
+				log.Printf("circle %d: backend %s(%s) removed", idx, be.Name, be.Url)
+			}
+		}
+		if len(removed) > 0 {
+			go ip.closeRemoved(removed)
+		}
+	}
+	ip.dbSet = util.NewSetFromSlice(cfg.DBList)
+	ip.budget.Set(cfg.BufferMemoryLimit, cfg.BufferPolicy)
+	ip.schema.Set(cfg.SchemaCacheEnabled)
+	ip.card.Set(cfg.CardinalityDBLimit, cfg.CardinalityMmLimit, cfg.CardinalityPolicy)
+	ip.cache.Set(cfg.QueryCacheSize, cfg.QueryCacheTTL, cfg.QueryCacheBucket)
+	ip.cfg = cfg
+	return nil
+}
+
+// closeRemoved closes the removed backends after the writes which have been routed to them are buffered,
+// the buffers are flushed on close.
+func (ip *Proxy) closeRemoved(backends []*Backend) {
+	ip.routing.Lock()
+	ip.routing.Unlock() //nolint:staticcheck
+	for _, be := range backends {
+		be.Close()
+	}
+}
+
 func (ip *Proxy) QueryFlux(w http.ResponseWriter, req *http.Request, qr *QueryRequest) (err error) {
 	var bucket, measurement string
 	if qr.Query != "" {
@@ -114,6 +214,57 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 		return nil, ErrEmptyQuery
 	}
 
+	stmts := SplitStatements(q)
+	if len(stmts) > 1 {
+		return ip.queryStatements(w, req, stmts)
+	}
+	return ip.queryStatement(w, req, q)
+}
+
+// queryStatements queries the statements one by one like influxdb, the statements after the first failed one are not executed.
+func (ip *Proxy) queryStatements(w http.ResponseWriter, req *http.Request, stmts []string) (body []byte, err error) {
+	for _, stmt := range stmts {
+		if _, check, _ := CheckQuery(stmt); !check {
+			return nil, ErrIllegalQL
+		}
+	}
+	rsp := &Response{Results: make([]*Result, 0, len(stmts))}
+	failed := false
+	for i, stmt := range stmts {
+		if failed {
+			rsp.Results = append(rsp.Results, &Result{StatementID: i, Err: ErrNotExecuted.Error()})
+			continue
+		}
+		sreq := CloneQueryRequest(req)
+		sreq.Form.Set("q", stmt)
+		// remove support of query parameter `chunked`
+		sreq.Form.Del("chunked")
+		// leave the decompression of response to transport since the results are assembled
+		sreq.Header.Del("Accept-Encoding")
+		result := &Result{StatementID: i}
+		sbody, err := ip.queryStatement(nil, sreq, stmt)
+		if err == nil {
+			var srsp *Response
+			srsp, err = ResponseFromResponseBytes(sbody)
+			if err == nil && srsp.Err != "" {
+				err = errors.New(srsp.Err)
+			} else if err == nil && len(srsp.Results) > 0 {
+				result = srsp.Results[0]
+				result.StatementID = i
+			}
+		}
+		if err != nil {
+			result.Err = err.Error()
+		}
+		if result.Err != "" {
+			failed = true
+		}
+		rsp.Results = append(rsp.Results, result)
+	}
+	return marshalResponse(w, req, rsp)
+}
+
+func (ip *Proxy) queryStatement(w http.ResponseWriter, req *http.Request, q string) (body []byte, err error) {
 	tokens, check, from := CheckQuery(q)
 	if !check {
 		return nil, ErrIllegalQL
@@ -143,20 +294,74 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 	} else if CheckDeleteOrDropMeasurementFromTokens(tokens) {
 		return QueryDeleteOrDropQL(w, req, ip, tokens, db)
 	} else if alterDb || CheckRetentionPolicyFromTokens(tokens) {
-		return QueryAlterQL(w, req, ip)
+		body, err = QueryAlterQL(w, req, ip)
+		ip.cache.InvalidateDB(db)
+		if err == nil {
+			ip.schema.Remove(db, "")
+		}
+		return
 	}
 	return nil, ErrIllegalQL
 }
 
+// Exec executes the statement q of db which returns no series, like create, alter, drop and delete,
+// and returns the error of the statement if any.
+func (ip *Proxy) Exec(db, q string) error {
+	req := NewQueryRequest("POST", db, q, "")
+	// leave the decompression of response to transport since the body is not decompressed
+	req.Header.Del("Accept-Encoding")
+	body, err := ip.Query(nil, req)
+	if err != nil {
+		return err
+	}
+	rsp, err := ResponseFromResponseBytes(body)
+	if err != nil {
+		return err
+	}
+	if rsp.Err != "" {
+		return errors.New(rsp.Err)
+	}
+	for _, r := range rsp.Results {
+		if r.Err != "" {
+			return errors.New(r.Err)
+		}
+	}
+	return nil
+}
+
 func (ip *Proxy) Write(p []byte, db, rp, precision string) (err error) {
+	return ip.write(NewLineScanner(bytes.NewReader(p), len(p)), db, rp, precision, nil)
+}
+
+// WriteStream writes line protocol read from r, the lines are routed as they are scanned so that the whole body is never held in memory.
+// It waits until the points are written to backend or file in the number of circles required by level.
+// The consistency error takes precedence over the partial write error, while the error aborting the stream takes precedence over both.
+func (ip *Proxy) WriteStream(r io.Reader, db, rp, precision string, level ConsistencyLevel) error {
+	scanner := NewLineScanner(r, ip.Config().MaxLineSize)
+	if level == ConsistencyAny {
+		return ip.write(scanner, db, rp, precision, nil)
+	}
+	ack := NewWriteAck(level, len(ip.Circles))
+	err := ip.write(scanner, db, rp, precision, ack)
+	ack.Seal()
+	var perr *PartialWriteError
+	if err != nil && !errors.As(err, &perr) {
+		return err
+	}
+	if cerr := ack.Wait(time.Duration(ip.Config().ConsistencyTimeout) * time.Second); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (ip *Proxy) write(scanner *bufio.Scanner, db, rp, precision string, ack *WriteAck) (err error) {
 	var (
-		pos   int
 		block []byte
+		perr  PartialWriteError
 	)
-	for pos < len(p) {
-		pos, block = ScanLine(p, pos)
-		pos++
-
+	lineno, written := 1, 0
+	for ; scanner.Scan(); lineno += 1 + bytes.Count(block, []byte{'\n'}) {
+		block = scanner.Bytes()
 		if len(block) == 0 {
 			continue
 		}
@@ -164,70 +369,194 @@ func (ip *Proxy) Write(p []byte, db, rp, precision string) (err error) {
 		if start >= len(block) || block[start] == '#' {
 			continue
 		}
-		if block[len(block)-1] == '\n' {
-			block = block[:len(block)-1]
-		}
 
 		line := make([]byte, len(block[start:]))
 		copy(line, block[start:])
-		ip.WriteRow(line, db, rp, precision)
+		if err := ip.writeRow(line, db, rp, precision, ack); err != nil {
+			if errors.Is(err, ErrBufferFull) || errors.Is(err, ErrBackendBusy) {
+				// stop writing the rest lines and let the client retry later
+				return &WriteAbortError{Line: lineno, Written: written, Err: err}
+			}
+			perr.Add(lineno, err)
+			continue
+		}
+		written++
+	}
+	if err = scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = ErrLineTooLong
+		}
+		return &WriteAbortError{Line: lineno, Written: written, Err: err}
+	}
+	if perr.Dropped > 0 {
+		return &perr
 	}
 	return
 }
 
-func (ip *Proxy) WriteRow(line []byte, db, rp, precision string) {
+func (ip *Proxy) WriteRow(line []byte, db, rp, precision string) error {
+	return ip.writeRow(line, db, rp, precision, nil)
+}
+
+func (ip *Proxy) writeRow(line []byte, db, rp, precision string, ack *WriteAck) error {
 	nanoLine := AppendNano(line, precision)
 	mm, err := ScanKey(nanoLine)
 	if err != nil {
 		log.Printf("scan key error: %s", err)
-		return
+		return fmt.Errorf("unable to parse '%s': missing fields", line)
 	}
 	if !RapidCheck(nanoLine[len(mm):]) {
 		log.Printf("invalid format, db: %s, rp: %s, precision: %s, line: %s", db, rp, precision, string(line))
-		return
+		return fmt.Errorf("unable to parse '%s': invalid format", line)
 	}
 
 	key := ip.GetKey(db, mm)
+	if ip.sTpl.HasTags() {
+		key = ip.GetKeyWithTags(db, mm, ScanTags(nanoLine))
+	}
+	// hold the routing lock until the point is buffered, so that the backend is not closed by reload meanwhile
+	ip.routing.RLock()
+	defer ip.routing.RUnlock()
 	backends := ip.GetBackends(key)
 	if len(backends) == 0 {
 		log.Printf("write data error: can't get backends, db: %s, mm: %s", db, mm)
-		return
+		return ErrGetBackends
+	}
+
+	var pt models.Point
+	if ip.schema.Enabled() {
+		pts, err := models.ParsePoints(nanoLine)
+		if err != nil {
+			return err
+		}
+		if len(pts) != 1 {
+			return fmt.Errorf("unable to parse '%s': invalid format", line)
+		}
+		pt = pts[0]
+	}
+	dropped, err := ip.check(db, rp, mm, nanoLine, pt, backends)
+	if err != nil || dropped {
+		return err
 	}
 
+	ip.cache.Invalidate(db, mm)
+	var werr error
+	written := false
 	point := &LinePoint{db, rp, nanoLine}
-	for _, be := range backends {
-		err = be.WritePoint(point)
+	for i, be := range backends {
+		var ca *circleAck
+		if ack != nil {
+			ca = ack.circle(i)
+		}
+		err = be.writePoint(point, ca)
 		if err != nil {
+			if ca != nil {
+				ca.fail(fmt.Errorf("backend %s: %s", be.Name, err))
+			}
 			log.Printf("write data to buffer error: %s, url: %s, db: %s, rp: %s, precision: %s, line: %s", err, be.Url, db, rp, precision, string(line))
+			werr = fmt.Errorf("write to backend %s failed: %w", be.Name, err)
+		} else {
+			written = true
 		}
 	}
+	if written {
+		ip.card.Record(db, mm, nanoLine)
+	}
+	return werr
 }
 
 func (ip *Proxy) WritePoints(points []models.Point, db, rp string) error {
 	var err error
+	schemaEnabled := ip.schema.Enabled()
 	for _, pt := range points {
 		mm := string(pt.Name())
 		key := ip.GetKey(db, mm)
+		if ip.sTpl.HasTags() {
+			key = ip.GetKeyWithTags(db, mm, pt.Tags())
+		}
+		ip.routing.RLock()
 		backends := ip.GetBackends(key)
 		if len(backends) == 0 {
+			ip.routing.RUnlock()
 			log.Printf("write point error: can't get backends, db: %s, mm: %s", db, mm)
 			err = ErrEmptyBackends
 			continue
 		}
 
-		point := &LinePoint{db, rp, []byte(pt.String())}
+		line := []byte(pt.String())
+		var spt models.Point
+		if schemaEnabled {
+			spt = pt
+		}
+		dropped, cerr := ip.check(db, rp, mm, line, spt, backends)
+		if cerr != nil || dropped {
+			ip.routing.RUnlock()
+			if cerr != nil {
+				err = cerr
+			}
+			continue
+		}
+
+		ip.cache.Invalidate(db, mm)
+		point := &LinePoint{db, rp, line}
+		written := false
 		for _, be := range backends {
-			err = be.WritePoint(point)
-			if err != nil {
-				log.Printf("write point to buffer error: %s, url: %s, db: %s, rp: %s, point: %s", err, be.Url, db, rp, pt.String())
+			if werr := be.WritePoint(point); werr != nil {
+				log.Printf("write point to buffer error: %s, url: %s, db: %s, rp: %s, point: %s", werr, be.Url, db, rp, pt.String())
+				err = werr
+			} else {
+				written = true
 			}
 		}
+		ip.routing.RUnlock()
+		if written {
+			ip.card.Record(db, mm, line)
+		}
 	}
 	return err
 }
 
-func (ip *Proxy) ReadProm(w http.ResponseWriter, req *http.Request, db, metric string) (err error) {
-	return ReadProm(w, req, ip, db, metric)
+// check checks the point against the schema cache if pt is not nil, and the cardinality limits,
+// the series should be recorded by ip.card.Record once written. The dropped is true instead of an error if the point is dropped by the cardinality policy.
+func (ip *Proxy) check(db, rp, mm string, line []byte, pt models.Point, backends []*Backend) (dropped bool, err error) {
+	if pt != nil {
+		err = ip.schema.Check(db, pt, func() (map[string][]string, error) {
+			for _, be := range backends {
+				if be.IsActive() {
+					return be.FieldKeys(db, rp, mm)
+				}
+			}
+			return nil, ErrBackendsUnavailable
+		})
+		if err != nil {
+			return
+		}
+	}
+	return ip.card.Check(db, mm, line)
+}
+
+func (ip *Proxy) ReadProm(req *http.Request, db, metric string, q *remote.Query) (*remote.QueryResult, error) {
+	return ReadProm(req, ip, db, metric, q)
+}
+
+func (ip *Proxy) ReadPromStream(w http.ResponseWriter, req *http.Request, db, metric string, q *remote.Query) error {
+	return ReadPromStream(w, req, ip, db, metric, q)
+}
+
+func (ip *Proxy) QueryProm(db, rp, metric string, q *remote.Query, last bool) (*remote.QueryResult, error) {
+	return QueryProm(ip, db, rp, metric, q, last)
+}
+
+func (ip *Proxy) ShowMeasurements(db, regex string) ([]string, error) {
+	return ShowMeasurements(ip, db, regex)
+}
+
+func (ip *Proxy) ShowTagKeys(db string) ([]string, error) {
+	return ShowTagKeys(ip, db)
+}
+
+func (ip *Proxy) ShowRetentionPolicies() ([]*RetentionPolicy, error) {
+	return ShowRetentionPolicies(ip)
 }
 
 func (ip *Proxy) Close() {
@@ -235,3 +564,27 @@ func (ip *Proxy) Close() {
 		c.Close()
 	}
 }
+
+// Shutdown closes all circles and waits for the buffers of all backends to be flushed.
+// Once ctx is done, the remaining writes are canceled and the data is written to file instead.
+func (ip *Proxy) Shutdown(ctx context.Context) {
+	ip.Close()
+	backends := ip.GetAllBackends()
+	for _, be := range backends {
+		select {
+		case <-be.Done():
+		case <-ctx.Done():
+			be.CancelWrite()
+			<-be.Done()
+		}
+	}
+	var flushedTotal, spilledTotal, droppedTotal int64
+	for _, be := range backends {
+		flushed, spilled, dropped := be.Stats()
+		log.Printf("backend %s(%s) shutdown: %d points flushed, %d points spilled to file, %d points dropped", be.Name, be.Url, flushed, spilled, dropped)
+		flushedTotal += flushed
+		spilledTotal += spilled
+		droppedTotal += dropped
+	}
+	log.Printf("proxy shutdown: %d points flushed, %d points spilled to file, %d points dropped", flushedTotal, spilledTotal, droppedTotal)
+}
@@ -0,0 +1,669 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+// newTestProxy creates a proxy with one circle for each handler, each circle has one backend served by the handler
+func newTestProxy(t *testing.T, handlers ...http.HandlerFunc) *Proxy {
+	cfg := &ProxyConfig{DataDir: t.TempDir()}
+	for i, handler := range handlers {
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		cfg.Circles = append(cfg.Circles, &CircleConfig{
+			Name:     fmt.Sprintf("circle-%d", i+1),
+			Backends: []*BackendConfig{{Name: fmt.Sprintf("influxdb-%d-1", i+1), Url: server.URL}},
+		})
+	}
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	t.Cleanup(func() { ip.Shutdown(context.Background()) })
+	return ip
+}
+
+func TestProxyPartialWrite(t *testing.T) {
+	ip := newTestProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tests := []struct {
+		name    string
+		data    string
+		lines   []int
+		dropped int
+	}{
+		{
+			name: "valid",
+			data: "cpu,host=server01 value=1\n# comment\n\ncpu,host=server02 value=2 1596819659\n",
+		},
+		{
+			name:    "invalid",
+			data:    "cpu,host=server01 value=1\ncpu\ncpu,host=server02 value=2\nmem 1596819659\n",
+			lines:   []int{2, 4},
+			dropped: 2,
+		},
+		{
+			name:    "quoted newline",
+			data:    "cpu value=\"multiple\nlines\"\nmem\n",
+			lines:   []int{3},
+			dropped: 1,
+		},
+	}
+	for _, tt := range tests {
+		err := ip.Write([]byte(tt.data), "db1", "", "s")
+		if tt.dropped == 0 {
+			if err != nil {
+				t.Errorf("%v: got %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		var perr *PartialWriteError
+		if !errors.As(err, &perr) {
+			t.Errorf("%v: got %v, want partial write error", tt.name, err)
+			continue
+		}
+		if perr.Dropped != tt.dropped || len(perr.Errors) != len(tt.lines) {
+			t.Errorf("%v: got %d dropped, %d errors, want %d, %d", tt.name, perr.Dropped, len(perr.Errors), tt.dropped, len(tt.lines))
+			continue
+		}
+		for i, le := range perr.Errors {
+			if le.Line != tt.lines[i] {
+				t.Errorf("%v: got line %d, want %d", tt.name, le.Line, tt.lines[i])
+			}
+		}
+	}
+}
+
+func TestProxyReload(t *testing.T) {
+	var written atomic.Int64
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			written.Add(1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	servers := make([]*httptest.Server, 3)
+	for i := range servers {
+		servers[i] = httptest.NewServer(http.HandlerFunc(handler))
+		t.Cleanup(servers[i].Close)
+	}
+	dir := t.TempDir()
+	newConfig := func(servers ...*httptest.Server) *ProxyConfig {
+		cfg := &ProxyConfig{DataDir: dir, Circles: []*CircleConfig{{Name: "circle-1"}}}
+		for i, server := range servers {
+			cfg.Circles[0].Backends = append(cfg.Circles[0].Backends, &BackendConfig{Name: fmt.Sprintf("influxdb-1-%d", i+1), Url: server.URL})
+		}
+		cfg.setDefault()
+		return cfg
+	}
+	ip := NewProxy(newConfig(servers...))
+	t.Cleanup(func() { ip.Shutdown(context.Background()) })
+	olds := ip.Circles[0].Backends()
+
+	done := make(chan struct{})
+	var errs atomic.Int64
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if err := ip.WriteRow([]byte(fmt.Sprintf("cpu,host=server%d value=1", i)), "db1", "", "ns"); err != nil {
+				errs.Add(1)
+			}
+		}
+	}()
+	if err := ip.Reload(newConfig(servers[:1]...)); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	<-done
+
+	backends := ip.Circles[0].Backends()
+	if len(backends) != 1 || backends[0] != olds[0] {
+		t.Errorf("got %d backends, want the first backend kept", len(backends))
+	}
+	if errs.Load() > 0 {
+		t.Errorf("got %d write errors, want 0", errs.Load())
+	}
+	for _, be := range olds[1:] {
+		<-be.Done()
+	}
+}
+
+func TestProxyWriteStream(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	bad := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	ip := newTestProxy(t, ok, bad)
+	tests := []struct {
+		level ConsistencyLevel
+		valid bool
+	}{
+		{ConsistencyAny, true},
+		{ConsistencyOne, true},
+		{ConsistencyQuorum, false},
+		{ConsistencyAll, false},
+	}
+	for _, tt := range tests {
+		err := ip.WriteStream(strings.NewReader("cpu,host=server01 value=1\n"), "db1", "", "ns", tt.level)
+		if tt.valid {
+			if err != nil {
+				t.Errorf("%v: got %v, want nil", tt.level, err)
+			}
+			continue
+		}
+		var cerr *ConsistencyError
+		if !errors.As(err, &cerr) || cerr.Timeout || cerr.Written != 1 {
+			t.Errorf("%v: got %v, want consistency error", tt.level, err)
+		}
+	}
+
+	ip.Config().MaxLineSize = 16
+	err := ip.WriteStream(strings.NewReader("cpu value=1\ncpu,host=server01 value=1\n"), "db1", "", "ns", ConsistencyAll)
+	if !errors.Is(err, ErrLineTooLong) || err.Error() != "line 2: line too long, 1 lines before have been written" {
+		t.Errorf("got %v, want line too long", err)
+	}
+}
+
+func TestProxyQueryStream(t *testing.T) {
+	chunks := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1]],"partial":true}],"partial":true}]}` + "\n" +
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[2,2]]}]}]}` + "\n"
+	var hits atomic.Int32
+	ip := newTestProxy(t,
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/query" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			hits.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"internal error"}`))
+		},
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/query" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			hits.Add(1)
+			if req.FormValue("chunked") != "true" || req.FormValue("chunk_size") != "1" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"not chunked"}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			for _, chunk := range strings.SplitAfter(chunks, "\n") {
+				w.Write([]byte(chunk))
+				w.(http.Flusher).Flush()
+			}
+		},
+	)
+	for i := 0; i < 4; i++ {
+		req := NewQueryRequest("GET", "db1", "select value from cpu", "")
+		req.Form.Set("chunked", "true")
+		req.Form.Set("chunk_size", "1")
+		rec := httptest.NewRecorder()
+		sw := NewStreamWriter(rec)
+		body, err := ip.Query(sw, req)
+		if err != nil || body != nil || !sw.Written() {
+			t.Fatalf("got %s, %v, %v, want nil, nil, true", body, err, sw.Written())
+		}
+		if rec.Body.String() != chunks || !rec.Flushed {
+			t.Errorf("got %s, flushed %v, want %s", rec.Body.String(), rec.Flushed, chunks)
+		}
+	}
+	if n := hits.Load(); n < 4 || n > 8 {
+		t.Errorf("got %d queries, want 4 to 8", n)
+	}
+}
+
+func TestProxyQueryStreamInterrupted(t *testing.T) {
+	var hits atomic.Int32
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		hits.Add(1)
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte(`{"results":[`))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	ip := newTestProxy(t, handler, handler)
+	rec := httptest.NewRecorder()
+	sw := NewStreamWriter(rec)
+	_, err := ip.Query(sw, NewQueryRequest("GET", "db1", "select value from cpu", ""))
+	if err == nil || !sw.Written() || rec.Body.String() != `{"results":[` {
+		t.Errorf("got %v, %v, %s, want error, true, partial body", err, sw.Written(), rec.Body.String())
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("got %d queries, want 1 without fallback", n)
+	}
+}
+
+func TestProxyQueryStreamError(t *testing.T) {
+	ip := newTestProxy(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("upstream unavailable\n"))
+	})
+	rec := httptest.NewRecorder()
+	sw := NewStreamWriter(rec)
+	_, err := ip.Query(sw, NewQueryRequest("GET", "db1", "select value from cpu", ""))
+	want := "query status code: 502, error: upstream unavailable"
+	if err == nil || err.Error() != want || sw.Written() {
+		t.Errorf("got %v, %v, want %s, false", err, sw.Written(), want)
+	}
+}
+
+func TestProxyQueryStatements(t *testing.T) {
+	ip := newTestProxy(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch q := req.FormValue("q"); {
+		case strings.Contains(q, "bad"):
+			w.Write([]byte(`{"results":[{"statement_id":0,"error":"measurement bad not allowed"}]}`))
+		case strings.Contains(q, "fail"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"error parsing query"}`))
+		default:
+			mm := q[strings.LastIndex(q, " ")+1:]
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"%s","columns":["time","value"],"values":[[0,1]]}]}]}`, mm)
+		}
+	})
+	tests := []struct {
+		name string
+		q    string
+		want string
+	}{
+		{
+			name: "statement ids",
+			q:    "select value from cpu; select value from mem",
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[0,1]]}]},` +
+				`{"statement_id":1,"series":[{"name":"mem","columns":["time","value"],"values":[[0,1]]}]}]}`,
+		},
+		{
+			name: "statement error",
+			q:    "select value from cpu; select value from bad; select value from mem",
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[0,1]]}]},` +
+				`{"statement_id":1,"error":"measurement bad not allowed"},{"statement_id":2,"error":"not executed"}]}`,
+		},
+		{
+			name: "query error",
+			q:    "select value from fail; select value from cpu",
+			want: `{"results":[{"statement_id":0,"error":"error parsing query"},{"statement_id":1,"error":"not executed"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		body, err := ip.Query(nil, NewQueryRequest("GET", "db1", tt.q, ""))
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		if got := strings.TrimSpace(string(body)); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProxyQueryCache(t *testing.T) {
+	var hits atomic.Int32
+	var last atomic.Value
+	ip := newTestProxy(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		hits.Add(1)
+		last.Store(req.FormValue("q"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[0,%d]]}]}]}`+"\n", hits.Load())
+	})
+	ip.QueryCache().Set(1<<20, 60, 3600)
+
+	query := func(q string, noCache bool) string {
+		req := NewQueryRequest("GET", "db1", q, "")
+		if noCache {
+			req.Header.Set("Cache-Control", "no-cache")
+		}
+		rec := httptest.NewRecorder()
+		sw := NewStreamWriter(rec)
+		body, err := ip.Query(sw, req)
+		if err != nil {
+			t.Fatalf("got error %s", err)
+		}
+		if !sw.Written() {
+			rec.Write(body)
+		}
+		return rec.Body.String()
+	}
+	tests := []struct {
+		name    string
+		q       string
+		write   bool
+		noCache bool
+		hits    int32
+	}{
+		{name: "miss", q: "select value from cpu where time > now() - 1h", hits: 1},
+		{name: "hit", q: "select  value from cpu where time > now() - 1h;", hits: 1},
+		{name: "another measurement", q: "select value from mem where time > now() - 1h", hits: 2},
+		{name: "invalidated by write", q: "select value from cpu where time > now() - 1h", write: true, hits: 3},
+		{name: "hit after write", q: "select value from cpu where time > now() - 1h", hits: 3},
+		{name: "no cache", q: "select value from cpu where time > now() - 1h", noCache: true, hits: 4},
+		{name: "hit after no cache", q: "select value from cpu where time > now() - 1h", hits: 4},
+	}
+	var prev string
+	for _, tt := range tests {
+		if tt.write {
+			if err := ip.WriteRow([]byte("cpu value=1"), "db1", "", "ns"); err != nil {
+				t.Fatalf("%v: got write error %s", tt.name, err)
+			}
+		}
+		body := query(tt.q, tt.noCache)
+		if n := hits.Load(); n != tt.hits {
+			t.Errorf("%v: got %d backend queries, want %d", tt.name, n, tt.hits)
+		}
+		if !strings.Contains(body, fmt.Sprintf(`[0,%d]`, tt.hits)) {
+			t.Errorf("%v: got %s, want value %d", tt.name, body, tt.hits)
+		}
+		if tt.name == "hit" && body != prev {
+			t.Errorf("%v: got %s, want %s", tt.name, body, prev)
+		}
+		prev = body
+	}
+	if q := last.Load().(string); strings.Contains(q, "now()") {
+		t.Errorf("got %s, want now() aligned", q)
+	}
+}
+
+func TestProxyQueryCacheFlush(t *testing.T) {
+	var hits atomic.Int32
+	ip := newTestProxy(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/query":
+			hits.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[0,%d]]}]}]}`+"\n", hits.Load())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	ip.QueryCache().Set(1<<20, 60, 3600)
+
+	query := func() {
+		if _, err := ip.Query(nil, NewQueryRequest("GET", "db1", "select value from cpu", "")); err != nil {
+			t.Fatalf("got error %s", err)
+		}
+	}
+	if err := ip.WriteRow([]byte("cpu value=1"), "db1", "", "ns"); err != nil {
+		t.Fatalf("got write error %s", err)
+	}
+	// the response may be cached before the buffered point is flushed
+	query()
+	query()
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("got %d backend queries before flush, want 1", n)
+	}
+	be := ip.Circles[0].Backends()[0]
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if flushed, _, _ := be.Stats(); flushed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for flush")
+		}
+	}
+	query()
+	if n := hits.Load(); n != 2 {
+		t.Errorf("got %d backend queries after flush, want 2", n)
+	}
+}
+
+func TestProxyShardedByTags(t *testing.T) {
+	handler := func(host string, fail bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/query" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"internal error"}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"%s"},"columns":["time","value"],"values":[[1000,1]]}]}]}`, host)
+		}
+	}
+	// the second backend of the first circle fails, so that the second circle is queried
+	cfg := &ProxyConfig{DataDir: t.TempDir(), ShardKey: "%db,%mm,%tag(host)", NativePromRead: true}
+	for i, handlers := range [][]http.HandlerFunc{{handler("a", false), handler("b", true)}, {handler("a", false), handler("b", false)}} {
+		circfg := &CircleConfig{Name: fmt.Sprintf("circle-%d", i+1)}
+		for j, handler := range handlers {
+			server := httptest.NewServer(handler)
+			t.Cleanup(server.Close)
+			circfg.Backends = append(circfg.Backends, &BackendConfig{Name: fmt.Sprintf("influxdb-%d-%d", i+1, j+1), Url: server.URL})
+		}
+		cfg.Circles = append(cfg.Circles, circfg)
+	}
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	t.Cleanup(func() { ip.Shutdown(context.Background()) })
+
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1000,1]]},` +
+		`{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1000,1]]}]}]}`
+	for i := 0; i < 4; i++ {
+		body, err := ip.Query(nil, NewQueryRequest("GET", "db1", "select value from cpu group by *", ""))
+		if got := strings.TrimSpace(string(body)); err != nil || got != want {
+			t.Errorf("got %s, %v, want %s", got, err, want)
+		}
+		qr, err := ip.ReadProm(NewQueryRequest("GET", "db1", "", ""), "db1", "cpu", &remote.Query{StartTimestampMs: 0, EndTimestampMs: 2000})
+		if err != nil || len(qr.Timeseries) != 2 {
+			t.Errorf("got %v, %v, want 2 time series", qr, err)
+		}
+	}
+	if err := QueryFlux(nil, NewQueryRequest("POST", "db1", "", ""), ip, "db1", "cpu"); err != ErrFluxShardedByTags {
+		t.Errorf("got %v, want %s", err, ErrFluxShardedByTags)
+	}
+}
+
+func TestProxyShutdown(t *testing.T) {
+	var lines atomic.Int32
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		timeout time.Duration
+		flushed int64
+		spilled int64
+	}{
+		{
+			name: "working",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/write" {
+					r, _ := gzip.NewReader(req.Body)
+					p, _ := io.ReadAll(r)
+					lines.Add(int32(len(SplitLines(p))))
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+			timeout: 5 * time.Second,
+			flushed: 3,
+		},
+		{
+			name: "stuck",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/write" {
+					// the write is canceled once the shutdown deadline is exceeded, which is noticed after the body is read
+					io.Copy(io.Discard, req.Body)
+					<-req.Context().Done()
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+			timeout: 200 * time.Millisecond,
+			spilled: 3,
+		},
+	}
+	for _, tt := range tests {
+		lines.Store(0)
+		ip := newTestProxy(t, tt.handler)
+		be := ip.Circles[0].Backends()[0]
+		for i := 0; i < 100 && !be.IsActive(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// the points are still buffered when the proxy is shut down
+		be.flushTime.Store(60)
+		if err := ip.Write([]byte("cpu value=1 1\ncpu value=2 2\nmem value=3 3\n"), "db1", "", "ns"); err != nil {
+			t.Fatalf("%v: got write error %v", tt.name, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+		ip.Shutdown(ctx)
+		cancel()
+
+		if flushed, spilled, dropped := be.Stats(); flushed != tt.flushed || spilled != tt.spilled || dropped != 0 {
+			t.Errorf("%v: got %d flushed, %d spilled, %d dropped, want %d, %d, 0", tt.name, flushed, spilled, dropped, tt.flushed, tt.spilled)
+		}
+		if n := lines.Load(); int64(n) != tt.flushed {
+			t.Errorf("%v: got %d lines written to backend, want %d", tt.name, n, tt.flushed)
+		}
+		fb, err := NewFileBackend(be.Name, ip.Config().DataDir)
+		if err != nil {
+			t.Fatalf("%v: open file error: %v", tt.name, err)
+		}
+		var spilled int64
+		for fb.IsData() {
+			b, err := fb.Read()
+			if err != nil || len(b) == 0 {
+				break
+			}
+			p := bytes.SplitN(b, []byte{' '}, 3)
+			data, err := Decompress(p[2])
+			if err != nil {
+				t.Fatalf("%v: decompress error: %v", tt.name, err)
+			}
+			spilled += int64(len(SplitLines(data)))
+		}
+		fb.Close()
+		if spilled != tt.spilled {
+			t.Errorf("%v: got %d lines in file, want %d", tt.name, spilled, tt.spilled)
+		}
+	}
+}
+
+func TestProxyQuerySources(t *testing.T) {
+	measurements := []string{"cpu", "mem", "disk_free", "disk_used"}
+	// owned maps the url of backend to the measurements routed to it, which is filled once the proxy is created
+	owned := make(map[string][]string)
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		q := req.FormValue("q")
+		url := "http://" + req.Host
+		var series []string
+		if strings.HasPrefix(q, "show measurements") {
+			var values []string
+			for _, mm := range owned[url] {
+				if strings.HasPrefix(mm, "disk") {
+					values = append(values, fmt.Sprintf(`["%s"]`, mm))
+				}
+			}
+			if len(values) > 0 {
+				series = append(series, fmt.Sprintf(`{"name":"measurements","columns":["name"],"values":[%s]}`, strings.Join(values, ",")))
+			}
+		} else {
+			for _, mm := range measurements {
+				if !strings.Contains(q, `"`+mm+`"`) {
+					continue
+				}
+				if !util.NewSetFromSlice(owned[url])[mm] {
+					t.Errorf("got %s queried in backend %s not owning it", mm, url)
+				}
+				series = append(series, fmt.Sprintf(`{"name":"%s","columns":["time","value"],"values":[[1000,1]]}`, mm))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[%s]}]}`, strings.Join(series, ","))
+	}
+	cfg := &ProxyConfig{DataDir: t.TempDir()}
+	circfg := &CircleConfig{Name: "circle-1"}
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(http.HandlerFunc(handler))
+		t.Cleanup(server.Close)
+		circfg.Backends = append(circfg.Backends, &BackendConfig{Name: fmt.Sprintf("influxdb-1-%d", i+1), Url: server.URL})
+	}
+	cfg.Circles = append(cfg.Circles, circfg)
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	t.Cleanup(func() { ip.Shutdown(context.Background()) })
+	for _, mm := range measurements {
+		be := ip.Circles[0].GetBackend(ip.GetKey("db1", mm))
+		owned[be.Url] = append(owned[be.Url], mm)
+	}
+	if len(owned) != 2 {
+		t.Fatalf("got measurements owned by %d backends, want 2", len(owned))
+	}
+
+	series := func(mms ...string) string {
+		var rows []string
+		for _, mm := range mms {
+			rows = append(rows, fmt.Sprintf(`{"name":"%s","columns":["time","value"],"values":[[1000,1]]}`, mm))
+		}
+		return fmt.Sprintf(`{"results":[{"statement_id":0,"series":[%s]}]}`, strings.Join(rows, ","))
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "measurements",
+			query: "select value from mem, cpu",
+			want:  series("cpu", "mem"),
+		},
+		{
+			name:  "regex",
+			query: "select value from /^disk/",
+			want:  series("disk_free", "disk_used"),
+		},
+		{
+			name:  "measurements and regex",
+			query: "select value from disk_used, /^disk/, cpu where time > 0",
+			want:  series("cpu", "disk_free", "disk_used"),
+		},
+	}
+	for _, tt := range tests {
+		body, err := ip.Query(nil, NewQueryRequest("GET", "db1", tt.query, ""))
+		if got := strings.TrimSpace(string(body)); err != nil || got != tt.want {
+			t.Errorf("%v: got %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var fieldTypeNames = map[models.FieldType]string{
+	models.Integer:  "integer",
+	models.Float:    "float",
+	models.Boolean:  "boolean",
+	models.String:   "string",
+	models.Unsigned: "unsigned",
+}
+
+// FieldTypeConflictError is returned when the type of a field differs from the type already written.
+type FieldTypeConflictError struct {
+	Measurement string
+	Field       string
+	Type        string
+	ExistType   string
+}
+
+// Error returns the message compatible with influxdb.
+func (e *FieldTypeConflictError) Error() string {
+	return fmt.Sprintf("field type conflict: input field \"%s\" on measurement \"%s\" is type %s, already exists as type %s", e.Field, e.Measurement, e.Type, e.ExistType)
+}
+
+const (
+	schemaUnseeded = iota
+	schemaSeeding
+	schemaSeeded
+)
+
+// SchemaSeedRetryInterval is the interval to retry the failed seed of field types.
+var SchemaSeedRetryInterval = 10 * time.Second
+
+type measurementSchema struct {
+	lock    sync.RWMutex
+	state   int
+	retryAt time.Time
+	fields  map[string]string
+}
+
+// SchemaCache records the field types of measurements per database to detect field type conflicts before writing to backends.
+type SchemaCache struct {
+	lock    sync.RWMutex
+	enabled atomic.Bool
+	schemas map[string]map[string]*measurementSchema
+}
+
+func NewSchemaCache() *SchemaCache {
+	return &SchemaCache{schemas: make(map[string]map[string]*measurementSchema)}
+}
+
+// Set enables or disables the cache, the cached field types are removed once changed.
+func (sc *SchemaCache) Set(enabled bool) {
+	if sc.enabled.Swap(enabled) != enabled {
+		sc.Reset()
+	}
+}
+
+func (sc *SchemaCache) Enabled() bool {
+	return sc.enabled.Load()
+}
+
+func (sc *SchemaCache) get(db, mm string) *measurementSchema {
+	sc.lock.RLock()
+	ms, ok := sc.schemas[db][mm]
+	sc.lock.RUnlock()
+	if ok {
+		return ms
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if _, ok := sc.schemas[db]; !ok {
+		sc.schemas[db] = make(map[string]*measurementSchema)
+	}
+	if ms, ok = sc.schemas[db][mm]; !ok {
+		ms = &measurementSchema{fields: make(map[string]string)}
+		sc.schemas[db][mm] = ms
+	}
+	return ms
+}
+
+// Check returns FieldTypeConflictError if the type of any field of point differs from the cached type.
+// The field types of the measurement are seeded in background by seed on first check, which returns the types
+// of field keys, and the failed seed is retried after SchemaSeedRetryInterval. The point is checked against
+// the field types recorded from the flushed points before seeded.
+func (sc *SchemaCache) Check(db string, point models.Point, seed func() (map[string][]string, error)) error {
+	mm := string(point.Name())
+	ms := sc.get(db, mm)
+	ms.lock.RLock()
+	unseeded := ms.state == schemaUnseeded && !time.Now().Before(ms.retryAt)
+	ms.lock.RUnlock()
+	if unseeded {
+		ms.lock.Lock()
+		if ms.state == schemaUnseeded && !time.Now().Before(ms.retryAt) {
+			ms.state = schemaSeeding
+			go ms.seed(db, mm, seed)
+		}
+		ms.lock.Unlock()
+	}
+
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	iter := point.FieldIterator()
+	for iter.Next() {
+		field := string(iter.FieldKey())
+		if typ, ok := ms.fields[field]; ok && typ != fieldTypeNames[iter.Type()] {
+			return &FieldTypeConflictError{Measurement: mm, Field: field, Type: fieldTypeNames[iter.Type()], ExistType: typ}
+		}
+	}
+	return nil
+}
+
+func (ms *measurementSchema) seed(db, mm string, seed func() (map[string][]string, error)) {
+	fieldKeys, err := seed()
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if err != nil {
+		log.Printf("seed schema error: %s, db: %s, mm: %s", err, db, mm)
+		ms.state, ms.retryAt = schemaUnseeded, time.Now().Add(SchemaSeedRetryInterval)
+		return
+	}
+	for fk, types := range fieldKeys {
+		// the type is unknown if the field has different types in different shards
+		if len(types) == 1 {
+			ms.fields[fk] = types[0]
+		}
+	}
+	ms.state = schemaSeeded
+}
+
+// Record caches the field types of point which has been written to backend.
+func (sc *SchemaCache) Record(db string, point models.Point) {
+	ms := sc.get(db, string(point.Name()))
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	iter := point.FieldIterator()
+	for iter.Next() {
+		field := string(iter.FieldKey())
+		if _, ok := ms.fields[field]; !ok {
+			ms.fields[field] = fieldTypeNames[iter.Type()]
+		}
+	}
+}
+
+// RecordLines caches the field types of the points in lines which have been written to backend.
+func (sc *SchemaCache) RecordLines(db string, lines []byte) {
+	pts, err := models.ParsePoints(lines)
+	if err != nil {
+		log.Printf("record schema error: %s, db: %s", err, db)
+	}
+	for _, pt := range pts {
+		sc.Record(db, pt)
+	}
+}
+
+// Remove removes the cached field types of measurement mm in database db, or all measurements of db if mm is empty.
+func (sc *SchemaCache) Remove(db, mm string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if mm == "" {
+		delete(sc.schemas, db)
+	} else {
+		delete(sc.schemas[db], mm)
+	}
+}
+
+// Reset removes all the cached field types.
+func (sc *SchemaCache) Reset() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.schemas = make(map[string]map[string]*measurementSchema)
+}
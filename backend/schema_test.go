@@ -0,0 +1,148 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+// waitSeeded waits until the seed of measurement mm of database db is done, either seeded or failed.
+func waitSeeded(t *testing.T, sc *SchemaCache, db, mm string) {
+	ms := sc.get(db, mm)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		ms.lock.RLock()
+		state := ms.state
+		ms.lock.RUnlock()
+		if state != schemaSeeding {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for seed")
+		}
+	}
+}
+
+func TestSchemaCache(t *testing.T) {
+	sc := NewSchemaCache()
+	seed := func() (map[string][]string, error) {
+		return map[string][]string{"value": {"integer"}, "mixed": {"float", "string"}}, nil
+	}
+	pts, _ := models.ParsePoints([]byte("cpu value=1.5"))
+	if err := sc.Check("db1", pts[0], seed); err != nil {
+		t.Errorf("seeding: got %v, want nil", err)
+	}
+	waitSeeded(t, sc, "db1", "cpu")
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "seeded",
+			line: "cpu value=1i",
+		},
+		{
+			name: "seeded conflict",
+			line: "cpu value=1.5",
+			want: "field type conflict: input field \"value\" on measurement \"cpu\" is type float, already exists as type integer",
+		},
+		{
+			name: "different types in shards",
+			line: "cpu running=true,mixed=\"ok\"",
+		},
+		{
+			name: "recorded conflict",
+			line: "cpu running=\"yes\"",
+			want: "field type conflict: input field \"running\" on measurement \"cpu\" is type string, already exists as type boolean",
+		},
+		{
+			name: "other measurement",
+			line: "mem running=\"yes\"",
+		},
+	}
+	for _, tt := range tests {
+		pts, err := models.ParsePoints([]byte(tt.line))
+		if err != nil {
+			t.Fatalf("%v: parse error: %v", tt.name, err)
+		}
+		err = sc.Check("db1", pts[0], seed)
+		if err == nil {
+			sc.Record("db1", pts[0])
+		}
+		if (err == nil && tt.want != "") || (err != nil && err.Error() != tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	sc.Remove("db1", "cpu")
+	nop := func() (map[string][]string, error) { return nil, nil }
+	if err := sc.Check("db1", pts[0], nop); err != nil {
+		t.Errorf("removed: got %v, want nil", err)
+	}
+}
+
+func TestSchemaCacheSeedRetry(t *testing.T) {
+	interval := SchemaSeedRetryInterval
+	SchemaSeedRetryInterval = 50 * time.Millisecond
+	defer func() { SchemaSeedRetryInterval = interval }()
+
+	sc := NewSchemaCache()
+	var calls atomic.Int32
+	seed := func() (map[string][]string, error) {
+		if calls.Add(1) == 1 {
+			return nil, ErrBackendsUnavailable
+		}
+		return map[string][]string{"value": {"integer"}}, nil
+	}
+	pts, _ := models.ParsePoints([]byte("cpu value=1.5"))
+	if err := sc.Check("db1", pts[0], seed); err != nil {
+		t.Errorf("failed seed: got %v, want nil", err)
+	}
+	waitSeeded(t, sc, "db1", "cpu")
+	if err := sc.Check("db1", pts[0], seed); err != nil || calls.Load() != 1 {
+		t.Errorf("before retry: got %v and %d seeds, want nil and 1 seed", err, calls.Load())
+	}
+	time.Sleep(SchemaSeedRetryInterval)
+	sc.Check("db1", pts[0], seed)
+	waitSeeded(t, sc, "db1", "cpu")
+	var cerr *FieldTypeConflictError
+	if err := sc.Check("db1", pts[0], seed); !errors.As(err, &cerr) || calls.Load() != 2 {
+		t.Errorf("after retry: got %v and %d seeds, want field type conflict error and 2 seeds", err, calls.Load())
+	}
+}
+
+func TestProxySchemaCache(t *testing.T) {
+	ip := newTestProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ip.schema.Set(true)
+	if err := ip.Write([]byte("cpu value=1i\ncpu value=2i\n"), "db1", "", "ns"); err != nil {
+		t.Fatalf("got write error %v", err)
+	}
+	// the field types are recorded once the points are flushed
+	be := ip.Circles[0].Backends()[0]
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if flushed, _, _ := be.Stats(); flushed == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for flush")
+		}
+	}
+	err := ip.Write([]byte("cpu value=3i\ncpu value=1.5\n"), "db1", "", "ns")
+	var perr *PartialWriteError
+	if !errors.As(err, &perr) || perr.Dropped != 1 || perr.Errors[0].Line != 2 {
+		t.Fatalf("got %v, want partial write error of line 2", err)
+	}
+	var cerr *FieldTypeConflictError
+	if !errors.As(perr.Errors[0].Err, &cerr) || cerr.Field != "value" || cerr.Type != "float" || cerr.ExistType != "integer" {
+		t.Errorf("got %v, want field type conflict error", perr.Errors[0].Err)
+	}
+}
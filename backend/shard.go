@@ -4,30 +4,40 @@
 
 package backend
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
 
 type shardTpl struct {
-	tpl   string
-	parts []string
-	dbCnt int
-	mmCnt int
+	tpl      string
+	parts    []string
+	dbCnt    int
+	mmCnt    int
+	tags     []string
+	tagParts map[int]string // index of part -> tag name
 }
 
 func newShardTpl(tpl string) *shardTpl {
-	st := &shardTpl{tpl: tpl}
+	st := &shardTpl{tpl: tpl, tagParts: make(map[int]string)}
 	for i := 0; i < len(tpl); {
 		for j := i; j < len(tpl); {
-			if j <= len(tpl)-3 && (tpl[j:j+3] == ShardKeyVarDb || tpl[j:j+3] == ShardKeyVarMm) {
+			if v := scanShardKeyVar(tpl[j:]); v != "" {
 				if j > i {
 					st.parts = append(st.parts, tpl[i:j])
 				}
-				st.parts = append(st.parts, tpl[j:j+3])
-				if tpl[j:j+3] == ShardKeyVarDb {
+				st.parts = append(st.parts, v)
+				if v == ShardKeyVarDb {
 					st.dbCnt++
-				} else if tpl[j:j+3] == ShardKeyVarMm {
+				} else if v == ShardKeyVarMm {
 					st.mmCnt++
+				} else {
+					tag := v[len(ShardKeyVarTag)+1 : len(v)-1]
+					st.tags = append(st.tags, tag)
+					st.tagParts[len(st.parts)-1] = tag
 				}
-				i, j = j+3, j+3
+				i, j = j+len(v), j+len(v)
 				continue
 			}
 			j++
@@ -41,14 +51,42 @@ func newShardTpl(tpl string) *shardTpl {
 	return st
 }
 
+// scanShardKeyVar returns the variable %db, %mm or %tag(name) at the beginning of s, or empty if not found.
+func scanShardKeyVar(s string) string {
+	if strings.HasPrefix(s, ShardKeyVarDb) {
+		return ShardKeyVarDb
+	} else if strings.HasPrefix(s, ShardKeyVarMm) {
+		return ShardKeyVarMm
+	} else if strings.HasPrefix(s, ShardKeyVarTag+"(") {
+		start := len(ShardKeyVarTag) + 1
+		end := strings.IndexByte(s, ')')
+		if end > start && !strings.ContainsAny(s[start:end], "%(") {
+			return s[:end+1]
+		}
+	}
+	return ""
+}
+
+// HasTags returns whether the template contains %tag(name), which shards the points of a measurement by the tag values.
+func (st *shardTpl) HasTags() bool {
+	return len(st.tags) > 0
+}
+
 func (st *shardTpl) GetKey(db, mm string) string {
+	return st.GetKeyWithTags(db, mm, nil)
+}
+
+// GetKeyWithTags renders the key with the tags of point, the missing tag is rendered as empty.
+func (st *shardTpl) GetKeyWithTags(db, mm string, tags models.Tags) string {
 	var b strings.Builder
 	b.Grow(len(st.tpl) + (len(db)-len(ShardKeyVarDb))*st.dbCnt + (len(mm)-len(ShardKeyVarMm))*st.mmCnt)
-	for _, part := range st.parts {
+	for i, part := range st.parts {
 		if part == ShardKeyVarDb {
 			b.WriteString(db)
 		} else if part == ShardKeyVarMm {
 			b.WriteString(mm)
+		} else if tag, ok := st.tagParts[i]; ok {
+			b.Write(tags.Get([]byte(tag)))
 		} else {
 			b.WriteString(part)
 		}
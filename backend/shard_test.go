@@ -134,6 +134,58 @@ func TestShardTpl(t *testing.T) {
 	}
 }
 
+func TestShardTplWithTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		tpl    string
+		line   string
+		parts  []string
+		tags   []string
+		render string
+	}{
+		{
+			name:   "tag",
+			tpl:    "%db,%mm,%tag(host)",
+			line:   "cpu,host=server01,region=east value=1",
+			parts:  []string{"%db", ",", "%mm", ",", "%tag(host)"},
+			tags:   []string{"host"},
+			render: "database,cpu,server01",
+		},
+		{
+			name:   "tags",
+			tpl:    "%mm-%tag(region)%tag(host)-key",
+			line:   "cpu,host=server01,region=east value=1",
+			parts:  []string{"%mm", "-", "%tag(region)", "%tag(host)", "-key"},
+			tags:   []string{"region", "host"},
+			render: "cpu-eastserver01-key",
+		},
+		{
+			name:   "missing tag",
+			tpl:    "%db,%mm,%tag(host)",
+			line:   "cpu,region=east value=1",
+			parts:  []string{"%db", ",", "%mm", ",", "%tag(host)"},
+			tags:   []string{"host"},
+			render: "database,cpu,",
+		},
+		{
+			name:   "not tag",
+			tpl:    "%db,%mm,%tag()%tag(host",
+			line:   "cpu,host=server01 value=1",
+			parts:  []string{"%db", ",", "%mm", ",%tag()%tag(host"},
+			render: "database,cpu,%tag()%tag(host",
+		},
+	}
+	for _, tt := range tests {
+		st := newShardTpl(tt.tpl)
+		if !slices.Equal(st.parts, tt.parts) || !slices.Equal(st.tags, tt.tags) || st.HasTags() != (len(tt.tags) > 0) {
+			t.Errorf("%v: got %+v, %+v, want %+v, %+v", tt.name, st.parts, st.tags, tt.parts, tt.tags)
+		}
+		if render := st.GetKeyWithTags("database", "cpu", ScanTags([]byte(tt.line))); render != tt.render {
+			t.Errorf("%v: got %s, want %s", tt.name, render, tt.render)
+		}
+	}
+}
+
 func BenchmarkGetKeyByPlus(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
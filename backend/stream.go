@@ -0,0 +1,114 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+const DefaultChunkSize = 10000
+
+// StreamWriter is the http.ResponseWriter recording whether the response has been written to the client,
+// the query can not fall back to another backend or respond an error once any bytes are written.
+type StreamWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+// NewStreamWriter wraps w, or returns w itself if it is a StreamWriter already.
+func NewStreamWriter(w http.ResponseWriter) *StreamWriter {
+	if sw, ok := w.(*StreamWriter); ok {
+		return sw
+	}
+	return &StreamWriter{ResponseWriter: w}
+}
+
+func (sw *StreamWriter) WriteHeader(code int) {
+	sw.written = true
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	sw.written = true
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *StreamWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		sw.written = true
+		flusher.Flush()
+	}
+}
+
+// Written returns whether the status code or any bytes of the response have been written.
+func (sw *StreamWriter) Written() bool {
+	return sw.written
+}
+
+func (sw *StreamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// StreamBody copies the body to w and flushes after each read, so that the chunked response is sent in time.
+func StreamBody(w http.ResponseWriter, body io.Reader) (err error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			if _, err = w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// ChunkResponse splits the response into chunks like the chunked response of influxdb, each chunk contains
+// at most size values of a series, and the series and result are marked partial if continued in the next chunk.
+func ChunkResponse(rsp *Response, size int) []*Response {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	if rsp.Err != "" {
+		return []*Response{rsp}
+	}
+	var chunks []*Response
+	for _, result := range rsp.Results {
+		if result.Err != "" || len(result.Series) == 0 {
+			chunks = append(chunks, &Response{Results: []*Result{result}})
+			continue
+		}
+		for i, serie := range result.Series {
+			values := serie.Values
+			for first := true; first || len(values) > 0; first = false {
+				n := min(size, len(values))
+				row := &models.Row{Name: serie.Name, Tags: serie.Tags, Columns: serie.Columns, Values: values[:n], Partial: n < len(values)}
+				values = values[n:]
+				chunk := &Result{
+					StatementID: result.StatementID,
+					Series:      models.Rows{row},
+					Partial:     row.Partial || i < len(result.Series)-1 || result.Partial,
+				}
+				if first && i == 0 {
+					chunk.Messages = result.Messages
+				}
+				chunks = append(chunks, &Response{Results: []*Result{chunk}})
+			}
+		}
+	}
+	return chunks
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestChunkResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		rsp  string
+		size int
+		want string
+	}{
+		{
+			name: "series",
+			rsp:  `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["name"],"values":[["a"],["b"],["c"]]},{"name":"mem","columns":["name"],"values":[["d"]]}]}]}`,
+			size: 2,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["name"],"values":[["a"],["b"]],"partial":true}],"partial":true}]}` + "\n" +
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["name"],"values":[["c"]]}],"partial":true}]}` + "\n" +
+				`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["name"],"values":[["d"]]}]}]}` + "\n",
+		},
+		{
+			name: "results",
+			rsp:  `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["name"],"values":[["a"]]}]},{"statement_id":1,"error":"not executed"},{"statement_id":2}]}`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["name"],"values":[["a"]]}]}]}` + "\n" +
+				`{"results":[{"statement_id":1,"error":"not executed"}]}` + "\n" +
+				`{"results":[{"statement_id":2}]}` + "\n",
+		},
+		{
+			name: "empty values",
+			rsp:  `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["name"]}]}]}`,
+			size: 2,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["name"]}]}]}` + "\n",
+		},
+		{
+			name: "error",
+			rsp:  `{"error":"database not found"}`,
+			want: `{"error":"database not found"}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		rsp, err := ResponseFromResponseBytes([]byte(tt.rsp))
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		for _, chunk := range ChunkResponse(rsp, tt.size) {
+			buf.Write(util.MarshalJSON(chunk, false))
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, buf.String(), tt.want)
+		}
+	}
+}
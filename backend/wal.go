@@ -0,0 +1,312 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+/*
+.wal file is composed of records, one record for each point accepted by the backend
+┌─────────────────────────┐ ┌─────────────────────────┐
+│        Record 1         │ │        Record 2         │
+└─────────────────────────┘ └─────────────────────────┘
+┌───────────┐┌────────────┐ ┌───────────┐┌────────────┐
+│Record1 Len││Record1 Body│ │Record2 Len││Record2 Body│
+│  4 bytes  ││  N bytes   │ │  4 bytes  ││  N bytes   │
+└───────────┘└────────────┘ └───────────┘└────────────┘
+
+record body is "<escaped db> <escaped rp> <line>", the same as .dat block without compression
+*/
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	WALFsyncAlways   = "always"
+	WALFsyncInterval = "interval"
+	WALFsyncNone     = "none"
+	WALSegmentSize   = int64(16 * 1024 * 1024)
+)
+
+var ErrInvalidWALFsync = errors.New("invalid wal_fsync, require always, interval or none")
+
+// WAL is a write-ahead log which keeps the points buffered in memory by a backend,
+// the points are removed from the log once they have been written to backend or file.
+type WAL struct {
+	lock     sync.Mutex
+	filename string
+	datadir  string
+	fsync    string
+	segment  int64
+	file     *os.File
+	size     int64
+	dirty    bool
+	refs     map[int64]int
+	closed   chan struct{}
+}
+
+func NewWAL(filename, datadir, fsync string, interval int) (wal *WAL, err error) {
+	wal = &WAL{
+		filename: filename,
+		datadir:  datadir,
+		fsync:    fsync,
+		refs:     make(map[int64]int),
+		closed:   make(chan struct{}),
+	}
+	segments, err := wal.segments()
+	if err != nil {
+		return
+	}
+	if len(segments) > 0 {
+		wal.segment = segments[len(segments)-1]
+	}
+	err = wal.rotate()
+	if err != nil {
+		return
+	}
+	if fsync == WALFsyncInterval {
+		go wal.syncLoop(time.Duration(interval) * time.Second)
+	}
+	return
+}
+
+func (wal *WAL) path(segment int64) string {
+	return filepath.Join(wal.datadir, fmt.Sprintf("%s.%08d.wal", wal.filename, segment))
+}
+
+// segments returns the ids of the segments existing in datadir in ascending order
+func (wal *WAL) segments() (segments []int64, err error) {
+	matches, err := filepath.Glob(filepath.Join(wal.datadir, wal.filename+".*.wal"))
+	if err != nil {
+		return
+	}
+	prefix := filepath.Join(wal.datadir, wal.filename) + "."
+	for _, m := range matches {
+		id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(m, prefix), ".wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, id)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return
+}
+
+func (wal *WAL) rotate() (err error) {
+	if wal.file != nil {
+		if err = wal.file.Sync(); err != nil {
+			log.Printf("sync wal error: %s %s", wal.filename, err)
+		}
+		wal.file.Close()
+		if wal.refs[wal.segment] == 0 {
+			delete(wal.refs, wal.segment)
+			os.Remove(wal.path(wal.segment))
+		}
+	}
+	wal.segment++
+	wal.file, err = os.OpenFile(wal.path(wal.segment), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("open wal error: %s %s", wal.filename, err)
+		return
+	}
+	wal.size = 0
+	return
+}
+
+// Write appends point to the log and returns the segment which point is written to
+func (wal *WAL) Write(point *LinePoint) (segment int64, err error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.size >= WALSegmentSize {
+		if err = wal.rotate(); err != nil {
+			return
+		}
+	}
+	db, rp := url.QueryEscape(point.Db), url.QueryEscape(point.Rp)
+	length := len(db) + len(rp) + len(point.Line) + 2
+	b := make([]byte, 4, length+4)
+	binary.BigEndian.PutUint32(b, uint32(length))
+	b = append(b, db...)
+	b = append(b, ' ')
+	b = append(b, rp...)
+	b = append(b, ' ')
+	b = append(b, point.Line...)
+	_, err = wal.file.Write(b)
+	if err != nil {
+		log.Printf("write wal error: %s %s", wal.filename, err)
+		wal.rollback()
+		return
+	}
+	if wal.fsync == WALFsyncAlways {
+		if err = wal.file.Sync(); err != nil {
+			log.Printf("sync wal error: %s %s", wal.filename, err)
+			wal.rollback()
+			return
+		}
+	} else {
+		wal.dirty = true
+	}
+	wal.size += int64(len(b))
+	wal.refs[wal.segment]++
+	return wal.segment, nil
+}
+
+// rollback removes the record partially written or not synced by truncating the current segment back to
+// the previous size, or rotates to a new segment if the truncation fails, so that the next record is not
+// appended after a torn one.
+func (wal *WAL) rollback() {
+	err := wal.file.Truncate(wal.size)
+	if err == nil {
+		return
+	}
+	log.Printf("truncate wal error: %s %s", wal.filename, err)
+	if err = wal.rotate(); err != nil {
+		log.Printf("rotate wal error: %s %s", wal.filename, err)
+	}
+}
+
+// Release marks the points of segments as persisted, segments holding no more points are removed,
+// and the current segment is truncated.
+func (wal *WAL) Release(segments map[int64]int) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	for segment, n := range segments {
+		wal.refs[segment] -= n
+		if wal.refs[segment] > 0 {
+			continue
+		}
+		delete(wal.refs, segment)
+		if segment != wal.segment {
+			os.Remove(wal.path(segment))
+		} else if wal.size > 0 {
+			if err := wal.file.Truncate(0); err != nil {
+				log.Printf("truncate wal error: %s %s", wal.filename, err)
+				continue
+			}
+			wal.size = 0
+		}
+	}
+}
+
+func (wal *WAL) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wal.lock.Lock()
+			if wal.dirty {
+				if err := wal.file.Sync(); err != nil {
+					log.Printf("sync wal error: %s %s", wal.filename, err)
+				}
+				wal.dirty = false
+			}
+			wal.lock.Unlock()
+		case <-wal.closed:
+			return
+		}
+	}
+}
+
+// Replay writes the points left in the log by previous process into fb, and removes the replayed segments.
+// It must be called before any point is written to the log.
+func (wal *WAL) Replay(fb *FileBackend) (n int, err error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	segments, err := wal.segments()
+	if err != nil {
+		return
+	}
+	for _, segment := range segments {
+		if segment == wal.segment {
+			continue
+		}
+		cnt, err := wal.replay(segment, fb)
+		if err != nil {
+			return n, err
+		}
+		n += cnt
+		os.Remove(wal.path(segment))
+	}
+	return
+}
+
+func (wal *WAL) replay(segment int64, fb *FileBackend) (n int, err error) {
+	f, err := os.Open(wal.path(segment))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	buffers := make(map[string]*bytes.Buffer)
+	r := bufio.NewReader(f)
+	for {
+		var length uint32
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			break
+		}
+		p := make([]byte, length)
+		_, err = io.ReadFull(r, p)
+		if err != nil {
+			// ignore the incomplete record written when crashing
+			break
+		}
+		i := bytes.IndexByte(p, ' ')
+		j := bytes.IndexByte(p[i+1:], ' ') + i + 1
+		if i < 0 || j <= i {
+			continue
+		}
+		key := string(p[:j])
+		if _, ok := buffers[key]; !ok {
+			buffers[key] = &bytes.Buffer{}
+		}
+		buffers[key].Write(p[j+1:])
+		buffers[key].WriteByte('\n')
+		n++
+	}
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return
+	}
+	for key, buf := range buffers {
+		var zbuf bytes.Buffer
+		err = Compress(&zbuf, buf.Bytes())
+		if err != nil {
+			return
+		}
+		err = fb.Write(bytes.Join([][]byte{[]byte(key), zbuf.Bytes()}, []byte{' '}))
+		if err != nil {
+			return
+		}
+	}
+	return n, nil
+}
+
+func (wal *WAL) Close() {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	close(wal.closed)
+	wal.dirty = false
+	wal.file.Sync()
+	wal.file.Close()
+	if wal.refs[wal.segment] == 0 {
+		os.Remove(wal.path(wal.segment))
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWAL("wal", dir, WALFsyncAlways, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := []*LinePoint{
+		{"db1", "", []byte("cpu,host=server01 value=1 1596819659000000000")},
+		{"db1", "", []byte("cpu,host=server02 value=2 1596819659000000000")},
+		{"db 2", "rp", []byte("mem,host=server01 value=3 1596819659000000000")},
+	}
+	segments := make(map[int64]int)
+	for _, point := range points {
+		segment, err := wal.Write(point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments[segment]++
+	}
+	// simulate a crash by leaving the wal without release and close
+	wal.file.Close()
+
+	fb, err := NewFileBackend("wal", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	wal, err = NewWAL("wal", dir, WALFsyncNone, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	n, err := wal.Replay(fb)
+	if err != nil || n != len(points) {
+		t.Fatalf("replay: got %d, %v, want %d", n, err, len(points))
+	}
+	if n, _ = wal.Replay(fb); n != 0 {
+		t.Errorf("replay again: got %d, want 0", n)
+	}
+
+	blocks, err := fb.ReadN(10)
+	if err != nil || len(blocks) != 2 {
+		t.Fatalf("read file: got %d blocks, %v, want 2", len(blocks), err)
+	}
+	got := make(map[string]string)
+	for _, b := range blocks {
+		p := bytes.SplitN(b, []byte{' '}, 3)
+		r, err := gzip.NewReader(bytes.NewReader(p[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		got[string(p[0])+" "+string(p[1])] = string(data)
+	}
+	want := map[string]string{
+		"db1 ":    "cpu,host=server01 value=1 1596819659000000000\ncpu,host=server02 value=2 1596819659000000000\n",
+		"db+2 rp": "mem,host=server01 value=3 1596819659000000000\n",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("block %q: got %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestWALRelease(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWAL("wal", dir, WALFsyncNone, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	point := &LinePoint{"db1", "", []byte("cpu value=1 1596819659000000000")}
+	segment, _ := wal.Write(point)
+	wal.Write(point)
+	wal.Release(map[int64]int{segment: 1})
+	if wal.size == 0 {
+		t.Errorf("release: wal truncated with unreleased point")
+	}
+	wal.Release(map[int64]int{segment: 1})
+	if wal.size != 0 || len(wal.refs) != 0 {
+		t.Errorf("release: got size %d, refs %v, want empty", wal.size, wal.refs)
+	}
+}
+
+func TestWALWriteError(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWAL("wal", dir, WALFsyncNone, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := &LinePoint{"db1", "", []byte("cpu value=1 1596819659000000000")}
+	first, err := wal.Write(point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the failed write can't be truncated on the closed file, then the wal is rotated
+	wal.file.Close()
+	if _, err = wal.Write(point); err == nil {
+		t.Fatal("write closed file: got nil, want error")
+	}
+	if wal.segment != first+1 || wal.size != 0 {
+		t.Errorf("write closed file: got segment %d, size %d, want %d, 0", wal.segment, wal.size, first+1)
+	}
+	second, err := wal.Write(point)
+	if err != nil || second != first+1 {
+		t.Fatalf("write after error: got segment %d, %v, want %d", second, err, first+1)
+	}
+	wal.file.Close()
+
+	fb, err := NewFileBackend("wal", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	wal, err = NewWAL("wal", dir, WALFsyncNone, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if n, err := wal.Replay(fb); err != nil || n != 2 {
+		t.Errorf("replay: got %d, %v, want 2", n, err)
+	}
+}
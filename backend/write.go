@@ -0,0 +1,75 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrLineTooLong is returned when a line of the write exceeds max_line_size.
+var ErrLineTooLong = errors.New("line too long")
+
+// MaxLineErrors is the max number of line errors reported by PartialWriteError.
+var MaxLineErrors = 100
+
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// PartialWriteError is returned when some lines of a write are dropped while the others are written.
+type PartialWriteError struct {
+	Errors  []*LineError
+	Dropped int
+}
+
+func (e *PartialWriteError) Add(line int, err error) {
+	e.Dropped++
+	if len(e.Errors) < MaxLineErrors {
+		e.Errors = append(e.Errors, &LineError{Line: line, Err: err})
+	}
+}
+
+// Error returns the message compatible with influxdb, like "partial write: line 1: unable to parse '...': invalid format dropped=1".
+func (e *PartialWriteError) Error() string {
+	var b strings.Builder
+	b.WriteString("partial write: ")
+	for i, le := range e.Errors {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(le.Error())
+	}
+	if e.Dropped > len(e.Errors) {
+		fmt.Fprintf(&b, "\n... and %d more lines", e.Dropped-len(e.Errors))
+	}
+	fmt.Fprintf(&b, " dropped=%d", e.Dropped)
+	return b.String()
+}
+
+// WriteAbortError is returned when the write stream is aborted at Line, the Written lines before are not rolled back,
+// so the client should retry from Line rather than the whole body.
+type WriteAbortError struct {
+	Line    int
+	Written int
+	Err     error
+}
+
+func (e *WriteAbortError) Error() string {
+	if e.Written == 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s, %d lines before have been written", e.Line, e.Err, e.Written)
+}
+
+func (e *WriteAbortError) Unwrap() error {
+	return e.Err
+}
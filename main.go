@@ -5,12 +5,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
@@ -53,13 +57,21 @@ func main() {
 	cfg.PrintSummary()
 
 	mux := service.NewServeMux()
-	service.NewHttpService(cfg).Register(mux)
+	hs := service.NewHttpService(cfg)
+	hs.Register(mux)
+	if err = hs.OpenListeners(); err != nil {
+		log.Printf("open listeners error: %s", err)
+		return
+	}
 
 	server := &http.Server{
 		Addr:        cfg.ListenAddr,
 		Handler:     mux,
 		IdleTimeout: time.Duration(cfg.IdleTimeout) * time.Second,
 	}
+	done := make(chan struct{})
+	go handleSignal(hs, server, done)
+
 	if cfg.HTTPSEnabled {
 		if cfg.TLS != nil {
 			server.TLSConfig, _ = cfg.TLS.Parse()
@@ -70,8 +82,34 @@ func main() {
 		log.Printf("http service start, listen on %s", server.Addr)
 		err = server.ListenAndServe()
 	}
-	if err != nil {
+	if !errors.Is(err, http.ErrServerClosed) {
 		log.Print(err)
 		return
 	}
+	<-done
+}
+
+func handleSignal(hs *service.HttpService, server *http.Server, done chan struct{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range ch {
+		if sig == syscall.SIGHUP {
+			log.Printf("reload config file: %s", configFile)
+			if err := hs.Reload(); err != nil {
+				log.Printf("reload error: %s", err)
+			}
+			continue
+		}
+
+		timeout := time.Duration(hs.Config().ShutdownTimeout) * time.Second
+		log.Printf("received signal %s, shutdown within %s", sig, timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("http service shutdown error: %s", err)
+		}
+		hs.Shutdown(ctx)
+		cancel()
+		close(done)
+		return
+	}
 }
@@ -0,0 +1,352 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package csv2lp
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+const (
+	typeMeasurement  = "measurement"
+	typeTag          = "tag"
+	typeField        = "field"
+	typeDateTime     = "dateTime"
+	typeDouble       = "double"
+	typeLong         = "long"
+	typeUnsignedLong = "unsignedLong"
+	typeBoolean      = "boolean"
+	typeString       = "string"
+	typeDuration     = "duration"
+	typeIgnored      = "ignored"
+)
+
+var (
+	ErrNoMeasurementColumn = errors.New("no measurement column found")
+	ErrNoMeasurement       = errors.New("no measurement value found")
+	ErrNoField             = errors.New("no field data found")
+)
+
+// RowError is the error of a row which is skipped, the rows after it can still be read.
+type RowError struct {
+	Line int
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+type column struct {
+	label    string
+	datatype string
+	format   string
+	value    string // value of the constant column
+}
+
+func newColumn(label, datatype string) (*column, error) {
+	col := &column{label: label}
+	col.datatype, col.format, _ = strings.Cut(datatype, ":")
+	switch col.datatype {
+	case "":
+		if label != "" {
+			col.datatype = typeField
+		}
+	case "ignore":
+		col.datatype = typeIgnored
+	case typeDateTime:
+	case typeMeasurement, typeTag, typeField, typeDouble, typeLong, typeUnsignedLong, typeBoolean, typeString, typeDuration, typeIgnored:
+		if col.format != "" {
+			return nil, fmt.Errorf("unsupported datatype format: %s", datatype)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported datatype: %s", datatype)
+	}
+	return col, nil
+}
+
+// Reader reads the data rows of annotated csv as points, the annotations #datatype, #constant and #timezone are supported,
+// while the other annotations like #group and #default are ignored.
+// A new table starts when an annotation follows the data rows, whose header is the first row after the annotations.
+type Reader struct {
+	r          *csv.Reader
+	multiplier int64
+	location   *time.Location
+	datatypes  []string
+	constants  []*column
+	columns    []*column
+}
+
+// NewReader returns a reader of annotated csv, the timestamps of number are in the precision.
+func NewReader(r io.Reader, precision string) *Reader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	return &Reader{r: cr, multiplier: models.GetPrecisionMultiplier(precision), location: time.UTC}
+}
+
+// Next returns the point of the next data row and its line number. The error is a *RowError if only the row is invalid,
+// or io.EOF if there are no more rows, otherwise the reader should not be read any more.
+func (r *Reader) Next() (models.Point, int, error) {
+	for {
+		record, err := r.r.Read()
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				return nil, perr.StartLine, &RowError{Line: perr.StartLine, Err: perr.Err}
+			}
+			return nil, 0, err
+		}
+		line, _ := r.r.FieldPos(0)
+		if strings.HasPrefix(record[0], "#") {
+			if err = r.annotate(record); err != nil {
+				return nil, line, fmt.Errorf("line %d: %w", line, err)
+			}
+			continue
+		}
+		if r.columns == nil {
+			if err = r.header(record); err != nil {
+				return nil, line, fmt.Errorf("line %d: %w", line, err)
+			}
+			continue
+		}
+		pt, err := r.point(record)
+		if err != nil {
+			return nil, line, &RowError{Line: line, Err: err}
+		}
+		return pt, line, nil
+	}
+}
+
+// annotate applies the annotation row, whose first column is the annotation name optionally followed by a space and the first value.
+func (r *Reader) annotate(record []string) error {
+	if r.columns != nil {
+		// the annotations after data rows start a new table
+		r.datatypes, r.constants, r.columns = nil, nil, nil
+	}
+	name, first, hasFirst := strings.Cut(record[0], " ")
+	switch name {
+	case "#datatype":
+		r.datatypes = append([]string{strings.TrimSpace(first)}, record[1:]...)
+	case "#constant":
+		var values []string
+		if hasFirst {
+			values = append(values, strings.TrimSpace(first))
+		}
+		values = append(values, record[1:]...)
+		var datatype, label, value string
+		switch len(values) {
+		case 2:
+			datatype, value = values[0], values[1]
+		case 3:
+			datatype, label, value = values[0], values[1], values[2]
+		default:
+			return fmt.Errorf("invalid constant annotation, require datatype, label and value: %s", strings.Join(record, ","))
+		}
+		col, err := newColumn(label, datatype)
+		if err != nil {
+			return err
+		}
+		if col.label == "" {
+			col.label = col.datatype
+		}
+		col.value = value
+		r.constants = append(r.constants, col)
+	case "#timezone":
+		value := strings.TrimSpace(first)
+		if value == "" && len(record) > 1 {
+			value = strings.TrimSpace(record[1])
+		}
+		loc, err := parseTimezone(value)
+		if err != nil {
+			return err
+		}
+		r.location = loc
+	}
+	return nil
+}
+
+func (r *Reader) header(record []string) error {
+	columns := make([]*column, 0, len(record))
+	measurements := 0
+	for i, label := range record {
+		datatype := ""
+		if i < len(r.datatypes) {
+			datatype = strings.TrimSpace(r.datatypes[i])
+		}
+		col, err := newColumn(label, datatype)
+		if err != nil {
+			return fmt.Errorf("column %q: %w", label, err)
+		}
+		if label == "" && col.datatype != "" && col.datatype != typeMeasurement && col.datatype != typeDateTime && col.datatype != typeIgnored {
+			return fmt.Errorf("column %d: missing label of %s", i+1, col.datatype)
+		}
+		if col.datatype == typeMeasurement {
+			measurements++
+		}
+		columns = append(columns, col)
+	}
+	for _, col := range r.constants {
+		if col.datatype == typeMeasurement {
+			measurements++
+		}
+	}
+	if measurements == 0 {
+		return ErrNoMeasurementColumn
+	}
+	r.columns = columns
+	return nil
+}
+
+func (r *Reader) point(record []string) (models.Point, error) {
+	var (
+		measurement string
+		tags        = make(map[string]string)
+		fields      = make(models.Fields)
+		ts          time.Time
+	)
+	apply := func(col *column, value string) error {
+		if value == "" || col.datatype == "" || col.datatype == typeIgnored {
+			return nil
+		}
+		var err error
+		switch col.datatype {
+		case typeMeasurement:
+			measurement = value
+		case typeTag:
+			tags[col.label] = value
+		case typeDateTime:
+			ts, err = r.parseTime(col.format, value)
+		default:
+			fields[col.label], err = parseField(col.datatype, value)
+		}
+		if err != nil {
+			return fmt.Errorf("column %q: %w", col.label, err)
+		}
+		return nil
+	}
+	for _, col := range r.constants {
+		if err := apply(col, col.value); err != nil {
+			return nil, err
+		}
+	}
+	for i, value := range record {
+		if i >= len(r.columns) {
+			break
+		}
+		if err := apply(r.columns[i], value); err != nil {
+			return nil, err
+		}
+	}
+	if measurement == "" {
+		return nil, ErrNoMeasurement
+	}
+	if len(fields) == 0 {
+		return nil, ErrNoField
+	}
+	return models.NewPoint(measurement, models.NewTags(tags), fields, ts)
+}
+
+func (r *Reader) parseTime(format, value string) (time.Time, error) {
+	switch format {
+	case "", "number":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(0, n*r.multiplier), nil
+		} else if format == "number" {
+			return time.Time{}, fmt.Errorf("invalid timestamp: %s", value)
+		}
+		fallthrough
+	case "RFC3339", "RFC3339Nano":
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp: %s", value)
+		}
+		return t, nil
+	default:
+		t, err := time.ParseInLocation(format, value, r.location)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp of layout %s: %s", format, value)
+		}
+		return t, nil
+	}
+}
+
+func parseField(datatype, value string) (interface{}, error) {
+	switch datatype {
+	case typeDouble:
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v, nil
+		}
+	case typeLong:
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return v, nil
+		}
+	case typeUnsignedLong:
+		if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return v, nil
+		}
+	case typeBoolean:
+		if v, ok := parseBool(value); ok {
+			return v, nil
+		}
+	case typeDuration:
+		if v, err := time.ParseDuration(value); err == nil {
+			return int64(v), nil
+		}
+	case typeString:
+		return value, nil
+	case typeField:
+		// the type of field is inferred from the value
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v, nil
+		}
+		if strings.EqualFold(value, "true") || strings.EqualFold(value, "false") {
+			return strings.EqualFold(value, "true"), nil
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("invalid %s value: %s", datatype, value)
+}
+
+func parseBool(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "true", "t", "yes", "y", "1":
+		return true, true
+	case "false", "f", "no", "n", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// parseTimezone parses the timezone like UTC, Local, EST, America/New_York or an offset like -0500.
+func parseTimezone(value string) (*time.Location, error) {
+	if value == "" || value == "UTC" {
+		return time.UTC, nil
+	}
+	if value[0] == '+' || value[0] == '-' {
+		t, err := time.Parse("-0700", value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %s", value)
+		}
+		_, offset := t.Zone()
+		return time.FixedZone(value, offset), nil
+	}
+	loc, err := time.LoadLocation(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %s", value)
+	}
+	return loc, nil
+}
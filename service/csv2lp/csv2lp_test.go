@@ -0,0 +1,182 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package csv2lp
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAll(csv, precision string) (lines []string, rows []int, errs []string, err error) {
+	r := NewReader(strings.NewReader(csv), precision)
+	for {
+		pt, line, err := r.Next()
+		if err == io.EOF {
+			return lines, rows, errs, nil
+		}
+		var rerr *RowError
+		if errors.As(err, &rerr) {
+			errs = append(errs, rerr.Error())
+			continue
+		}
+		if err != nil {
+			return lines, rows, errs, err
+		}
+		lines = append(lines, pt.String())
+		rows = append(rows, line)
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		csv       string
+		precision string
+		lines     []string
+		rows      []int
+		errs      []string
+	}{
+		{
+			name: "datatype",
+			csv: "#datatype measurement,tag,double,long,unsignedLong,boolean,string,ignored,dateTime:number\n" +
+				"m,host,usage,count,total,ok,msg,nothing,time\n" +
+				"cpu,server01,2.5,3,4,true,\"hello, \"\"world\"\"\",x,1600000000000000000\n" +
+				"cpu,,1,,,,,,\n",
+			lines: []string{
+				`cpu,host=server01 count=3i,msg="hello, \"world\"",ok=true,total=4u,usage=2.5 1600000000000000000`,
+				`cpu usage=1`,
+			},
+			rows: []int{3, 4},
+		},
+		{
+			name: "flux annotation column",
+			csv: "#group,false,false,true,false\n" +
+				"#datatype,string,measurement,tag,double\n" +
+				",result,_measurement,host,value\n" +
+				",,cpu,a,1\n",
+			lines: []string{`cpu,host=a value=1`},
+			rows:  []int{4},
+		},
+		{
+			name: "constant",
+			csv: "#constant measurement,cpu\n" +
+				"#constant,tag,region,east\n" +
+				"#constant dateTime:RFC3339,time,2020-01-01T00:00:00Z\n" +
+				"#datatype double\n" +
+				"usage\n" +
+				"0.5\n",
+			lines: []string{`cpu,region=east usage=0.5 1577836800000000000`},
+			rows:  []int{6},
+		},
+		{
+			name: "timezone and layout",
+			csv: "#timezone -0500\n" +
+				"#datatype measurement,dateTime:2006-01-02 15:04,field\n" +
+				"m,time,value\n" +
+				"cpu,2020-01-01 00:00,hello\n",
+			lines: []string{`cpu value="hello" 1577854800000000000`},
+			rows:  []int{4},
+		},
+		{
+			name:      "precision and inferred field",
+			precision: "s",
+			csv: "#datatype measurement,,dateTime\n" +
+				"m,value,time\n" +
+				"cpu,TRUE,1600000000\n" +
+				"cpu,1.5e3,2020-01-01T00:00:00.5Z\n",
+			lines: []string{
+				`cpu value=true 1600000000000000000`,
+				`cpu value=1500 1577836800500000000`,
+			},
+			rows: []int{3, 4},
+		},
+		{
+			name: "row errors",
+			csv: "#datatype measurement,long,dateTime:RFC3339\n" +
+				"m,count,time\n" +
+				"cpu,1.5,\n" +
+				",1,\n" +
+				"cpu,,\n" +
+				"cpu,1,yesterday\n" +
+				"cpu,2,\"bad\"quote\n" +
+				"cpu,3,\n",
+			lines: []string{`cpu count=3i`},
+			rows:  []int{8},
+			errs: []string{
+				`line 3: column "count": invalid long value: 1.5`,
+				`line 4: no measurement value found`,
+				`line 5: no field data found`,
+				`line 6: column "time": invalid timestamp: yesterday`,
+				`line 7: extraneous or missing " in quoted-field`,
+			},
+		},
+		{
+			name: "multiple tables",
+			csv: "#datatype measurement,double\n" +
+				"m,a\n" +
+				"cpu,1\n" +
+				"\n" +
+				"#datatype measurement,tag,long\n" +
+				"m,host,b\n" +
+				"mem,x,2\n",
+			lines: []string{`cpu a=1`, `mem,host=x b=2i`},
+			rows:  []int{3, 7},
+		},
+	}
+	for _, tt := range tests {
+		lines, rows, errs, err := readAll(tt.csv, tt.precision)
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, tt.lines) {
+			t.Errorf("%v: got lines %q, want %q", tt.name, lines, tt.lines)
+		}
+		if !reflect.DeepEqual(rows, tt.rows) {
+			t.Errorf("%v: got rows %v, want %v", tt.name, rows, tt.rows)
+		}
+		if !reflect.DeepEqual(errs, tt.errs) {
+			t.Errorf("%v: got errors %q, want %q", tt.name, errs, tt.errs)
+		}
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		want string
+	}{
+		{
+			name: "no measurement column",
+			csv:  "#datatype tag,double\nhost,value\na,1\n",
+			want: "line 2: no measurement column found",
+		},
+		{
+			name: "unsupported datatype",
+			csv:  "#datatype measurement,decimal\nm,value\ncpu,1\n",
+			want: `line 2: column "value": unsupported datatype: decimal`,
+		},
+		{
+			name: "invalid timezone",
+			csv:  "#timezone Mars/Olympus\n",
+			want: "line 1: invalid timezone: Mars/Olympus",
+		},
+		{
+			name: "invalid constant",
+			csv:  "#constant tag\n",
+			want: "line 1: invalid constant annotation, require datatype, label and value: #constant tag",
+		},
+	}
+	for _, tt := range tests {
+		_, _, _, err := readAll(tt.csv, "")
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%v: got error %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
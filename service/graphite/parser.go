@@ -0,0 +1,255 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+const (
+	// DefaultSeparator is the separator to join the parts of measurement, field and tag values
+	DefaultSeparator = "."
+
+	// DefaultTemplate is the template used if no template matches the metric
+	DefaultTemplate = "measurement*"
+
+	// fieldName is the field which graphite values get written to if no field is specified by template
+	fieldName = "value"
+)
+
+var (
+	// minDate and maxDate are the time range supported by influxdb
+	minDate = time.Unix(0, models.MinNanoTime)
+	maxDate = time.Unix(0, models.MaxNanoTime)
+)
+
+// UnsupportedValueError is returned when the value of a metric is NaN or Inf.
+type UnsupportedValueError struct {
+	Field string
+	Value float64
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return fmt.Sprintf(`field "%s" value: "%v" is unsupported`, e.Field, e.Value)
+}
+
+// template maps the dot separated parts of a metric path to measurement, tags and field.
+type template struct {
+	filter      []string
+	parts       []string
+	defaultTags map[string]string
+	separator   string
+}
+
+// newTemplate parses the template with format [filter] <template> [tag1=value1,tag2=value2].
+func newTemplate(pattern, separator string) (*template, error) {
+	fields := strings.Fields(pattern)
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid template: %q", pattern)
+	}
+	t := &template{defaultTags: make(map[string]string), separator: separator}
+	if strings.Contains(fields[len(fields)-1], "=") {
+		for _, kv := range strings.Split(fields[len(fields)-1], ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || k == "" || v == "" {
+				return nil, fmt.Errorf("invalid template tags: %q", pattern)
+			}
+			t.defaultTags[k] = v
+		}
+		fields = fields[:len(fields)-1]
+	}
+	switch len(fields) {
+	case 1:
+		t.parts = strings.Split(fields[0], ".")
+	case 2:
+		t.filter = strings.Split(fields[0], ".")
+		t.parts = strings.Split(fields[1], ".")
+	default:
+		return nil, fmt.Errorf("invalid template: %q", pattern)
+	}
+	hasMeasurement := false
+	for _, part := range t.parts {
+		if part == "measurement" || part == "measurement*" {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("no measurement specified for template: %q", pattern)
+	}
+	return t, nil
+}
+
+// match returns whether the filter matches the metric path, and the score of matching,
+// which is higher if more parts are matched and the parts are matched exactly earlier.
+func (t *template) match(path []string) (bool, []int) {
+	if len(t.filter) > len(path) {
+		return false, nil
+	}
+	score := []int{len(t.filter)}
+	for i, f := range t.filter {
+		switch f {
+		case "*":
+			score = append(score, 0)
+		case path[i]:
+			score = append(score, 1)
+		default:
+			return false, nil
+		}
+	}
+	return true, score
+}
+
+// apply extracts measurement, tags and field from the metric path.
+func (t *template) apply(path []string) (string, map[string]string, string) {
+	var measurement, field []string
+	tags := make(map[string][]string)
+	for i, part := range t.parts {
+		if i >= len(path) {
+			break
+		}
+		if part == "measurement*" {
+			measurement = append(measurement, path[i:]...)
+			break
+		}
+		if part == "field*" {
+			field = append(field, path[i:]...)
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, path[i])
+		case "field":
+			field = append(field, path[i])
+		default:
+			tags[part] = append(tags[part], path[i])
+		}
+	}
+	out := make(map[string]string, len(tags)+len(t.defaultTags))
+	for k, v := range t.defaultTags {
+		out[k] = v
+	}
+	for k, values := range tags {
+		out[k] = strings.Join(values, t.separator)
+	}
+	return strings.Join(measurement, t.separator), out, strings.Join(field, t.separator)
+}
+
+// Parser converts graphite metrics into points by templates.
+type Parser struct {
+	templates []*template
+	fallback  *template
+}
+
+// NewParser returns a parser with the templates, the most specific filter matching a metric is used.
+func NewParser(templates []string, separator string) (*Parser, error) {
+	if separator == "" {
+		separator = DefaultSeparator
+	}
+	p := &Parser{}
+	for _, pattern := range templates {
+		t, err := newTemplate(pattern, separator)
+		if err != nil {
+			return nil, err
+		}
+		if len(t.filter) == 0 {
+			p.fallback = t
+		} else {
+			p.templates = append(p.templates, t)
+		}
+	}
+	if p.fallback == nil {
+		p.fallback, _ = newTemplate(DefaultTemplate, separator)
+	}
+	return p, nil
+}
+
+func (p *Parser) match(path []string) *template {
+	var best *template
+	var bestScore []int
+	for _, t := range p.templates {
+		ok, score := t.match(path)
+		if ok && (best == nil || compareScore(score, bestScore) > 0) {
+			best, bestScore = t, score
+		}
+	}
+	if best == nil {
+		return p.fallback
+	}
+	return best
+}
+
+func compareScore(a, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] - b[i]
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Parse converts a plaintext line with format <metric path> <value> [timestamp] into a point.
+func (p *Parser) Parse(line string) (models.Point, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("received %q which doesn't have required fields", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf(`field "%s" value: %s`, fields[0], err)
+	}
+	timestamp := time.Now()
+	if len(fields) == 3 {
+		unixTime, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf(`field "%s" time: %s`, fields[0], err)
+		}
+		// -1 is a special value that gets converted to current time
+		if unixTime != -1 {
+			if unixTime < float64(minDate.Unix()) || unixTime > float64(maxDate.Unix()) {
+				return nil, fmt.Errorf(`field "%s" time: timestamp out of range`, fields[0])
+			}
+			timestamp = unixToTime(unixTime)
+		}
+	}
+	return p.ParseMetric(fields[0], value, timestamp)
+}
+
+// ParseMetric converts the metric path with value and timestamp into a point.
+// The graphite tags of the path with format name;tag1=value1;tag2=value2 are kept as tags.
+func (p *Parser) ParseMetric(name string, value float64, timestamp time.Time) (models.Point, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, &UnsupportedValueError{Field: name, Value: value}
+	}
+	if timestamp.Before(minDate) || timestamp.After(maxDate) {
+		return nil, fmt.Errorf(`field "%s" time: timestamp out of range`, name)
+	}
+	parts := strings.Split(name, ";")
+	path := strings.Split(parts[0], ".")
+	measurement, tags, field := p.match(path).apply(path)
+	if measurement == "" {
+		measurement = parts[0]
+	}
+	if field == "" {
+		field = fieldName
+	}
+	for _, kv := range parts[1:] {
+		if k, v, ok := strings.Cut(kv, "="); ok && k != "" && v != "" {
+			tags[k] = v
+		}
+	}
+	return models.NewPoint(measurement, models.NewTags(tags), models.Fields{field: value}, timestamp)
+}
+
+func unixToTime(unixTime float64) time.Time {
+	sec, frac := math.Modf(unixTime)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
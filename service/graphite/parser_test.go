@@ -0,0 +1,196 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package graphite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates []string
+		separator string
+		line      string
+		want      string
+		err       string
+	}{
+		{
+			name: "default template",
+			line: "servers.h1.cpu.idle 1.5 1700000000",
+			want: "servers.h1.cpu.idle value=1.5 1700000000000000000",
+		},
+		{
+			name:      "filter template",
+			templates: []string{"servers.*.cpu.* .host.measurement.field"},
+			line:      "servers.h1.cpu.idle 1.5 1700000000",
+			want:      "cpu,host=h1 idle=1.5 1700000000000000000",
+		},
+		{
+			name:      "most specific filter",
+			templates: []string{"servers.* .host.measurement*", "servers.*.cpu.* .host.measurement.field", "servers.h1.cpu.* .host.measurement.field host_type=special"},
+			line:      "servers.h1.cpu.idle 1.5 1700000000",
+			want:      "cpu,host=h1,host_type=special idle=1.5 1700000000000000000",
+		},
+		{
+			name:      "fallback template with default tags",
+			templates: []string{"servers.*.cpu.* .host.measurement.field", "measurement.field* region=us"},
+			line:      "stats.requests.count 10 1700000000",
+			want:      "stats,region=us requests.count=10 1700000000000000000",
+		},
+		{
+			name:      "greedy measurement with separator",
+			templates: []string{"region.host.measurement*"},
+			separator: "_",
+			line:      "us.h1.disk.sda.used 80 1700000000",
+			want:      "disk_sda_used,host=h1,region=us value=80 1700000000000000000",
+		},
+		{
+			name:      "tag with multiple parts",
+			templates: []string{"host.host.measurement.field"},
+			line:      "web.01.mem.free 1 1700000000",
+			want:      "mem,host=web.01 free=1 1700000000000000000",
+		},
+		{
+			name:      "graphite tags",
+			templates: []string{"measurement.field"},
+			line:      "cpu.idle;host=h1;dc=sh 1.5 1700000000",
+			want:      "cpu,dc=sh,host=h1 idle=1.5 1700000000000000000",
+		},
+		{
+			name: "fractional timestamp",
+			line: "cpu 1 1700000000.5",
+			want: "cpu value=1 1700000000500000000",
+		},
+		{
+			name: "missing value",
+			line: "cpu",
+			err:  `received "cpu" which doesn't have required fields`,
+		},
+		{
+			name: "invalid value",
+			line: "cpu abc 1700000000",
+			err:  `field "cpu" value: strconv.ParseFloat: parsing "abc": invalid syntax`,
+		},
+		{
+			name: "nan value",
+			line: "cpu NaN 1700000000",
+			err:  `field "cpu" value: "NaN" is unsupported`,
+		},
+		{
+			name: "timestamp out of range",
+			line: "cpu 1 1e20",
+			err:  `field "cpu" time: timestamp out of range`,
+		},
+	}
+	for _, tt := range tests {
+		p, err := NewParser(tt.templates, tt.separator)
+		if err != nil {
+			t.Fatalf("%v: new parser error: %s", tt.name, err)
+		}
+		point, err := p.Parse(tt.line)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%v: got error %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: parse error: %s", tt.name, err)
+			continue
+		}
+		if got := point.String(); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParserNow(t *testing.T) {
+	p, _ := NewParser(nil, "")
+	before := time.Now()
+	for _, line := range []string{"cpu 1", "cpu 1 -1"} {
+		point, err := p.Parse(line)
+		if err != nil {
+			t.Fatalf("parse error: %s", err)
+		}
+		if point.Time().Before(before) || point.Time().After(time.Now()) {
+			t.Errorf("%s: got time %s, want now", line, point.Time())
+		}
+	}
+}
+
+func TestNewParserError(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates []string
+	}{
+		{name: "no measurement", templates: []string{"host.field"}},
+		{name: "invalid tags", templates: []string{"measurement.field region"}},
+		{name: "too many parts", templates: []string{"a.* measurement.field region=us extra"}},
+	}
+	for _, tt := range tests {
+		if _, err := NewParser(tt.templates, ""); err == nil {
+			t.Errorf("%v: got nil error", tt.name)
+		}
+	}
+}
+
+func TestParsePickle(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "protocol 0",
+			data: "(lp0\n(Vservers.h1.cpu.idle\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vservers.h1.cpu.user\np4\n(F1700000000.5\nI2\ntp5\ntp6\na.",
+		},
+		{
+			name: "protocol 2",
+			data: "\x80\x02]q\x00(X\x13\x00\x00\x00servers.h1.cpu.idleq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x13\x00\x00\x00servers.h1.cpu.userq\x04GA\xd9T\xfc@ \x00\x00K\x02\x86q\x05\x86q\x06e.",
+		},
+		{
+			name: "protocol 4",
+			data: "\x80\x04\x95R\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x13servers.h1.cpu.idle\x94J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x13servers.h1.cpu.user\x94GA\xd9T\xfc@ \x00\x00K\x02\x86\x94\x86\x94e.",
+		},
+	}
+	want := []*Metric{
+		{Name: "servers.h1.cpu.idle", Value: 1.5, Timestamp: time.Unix(1700000000, 0)},
+		{Name: "servers.h1.cpu.user", Value: 2, Timestamp: time.Unix(1700000000, 500000000)},
+	}
+	for _, tt := range tests {
+		metrics, err := ParsePickle([]byte(tt.data))
+		if err != nil {
+			t.Errorf("%v: parse error: %s", tt.name, err)
+			continue
+		}
+		if len(metrics) != len(want) {
+			t.Errorf("%v: got %d metrics, want %d", tt.name, len(metrics), len(want))
+			continue
+		}
+		for i, m := range metrics {
+			if m.Name != want[i].Name || m.Value != want[i].Value || !m.Timestamp.Equal(want[i].Timestamp) {
+				t.Errorf("%v: got %+v, want %+v", tt.name, m, want[i])
+			}
+		}
+	}
+}
+
+func TestParsePickleError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "truncated", data: "\x80\x02]q\x00(X\x13\x00\x00\x00servers"},
+		{name: "not list", data: "K\x01."},
+		{name: "invalid item", data: "]K\x01a."},
+		{name: "unsupported opcode", data: "}."},
+	}
+	for _, tt := range tests {
+		if _, err := ParsePickle([]byte(tt.data)); err == nil {
+			t.Errorf("%v: got nil error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxPickleSize is the max size of a pickle message, the same as carbon
+const MaxPickleSize = 1 << 20
+
+var (
+	ErrPickleTruncated = errors.New("pickle data truncated")
+	ErrPickleStack     = errors.New("pickle stack underflow")
+	ErrPickleFormat    = errors.New("pickle is not a list of (path, (timestamp, value))")
+)
+
+// Metric is a metric path with value and timestamp received by pickle protocol.
+type Metric struct {
+	Name      string
+	Value     float64
+	Timestamp time.Time
+}
+
+type pickleMark struct{}
+
+// pickleList is a mutable list which may be appended after memoized.
+type pickleList struct {
+	items []interface{}
+}
+
+// unpickler decodes the subset of python pickle protocol 0 to 5 used by graphite clients,
+// which only contains lists, tuples, strings and numbers.
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || u.pos+n > len(u.data) {
+		return nil, ErrPickleTruncated
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.data[u.pos:], '\n')
+	if i < 0 {
+		return "", ErrPickleTruncated
+	}
+	line := string(u.data[u.pos : u.pos+i])
+	u.pos += i + 1
+	return line, nil
+}
+
+func (u *unpickler) readUint(n int) (uint64, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, ErrPickleStack
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, ErrPickleStack
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark pops the items above the topmost mark and the mark.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, ErrPickleStack
+}
+
+func (u *unpickler) popN(n int) ([]interface{}, error) {
+	if len(u.stack) < n {
+		return nil, ErrPickleStack
+	}
+	items := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	return items, nil
+}
+
+func (u *unpickler) appendTo(items ...interface{}) error {
+	top, err := u.pop()
+	if err != nil {
+		return err
+	}
+	list, ok := top.(*pickleList)
+	if !ok {
+		return fmt.Errorf("pickle append to non-list: %T", top)
+	}
+	list.items = append(list.items, items...)
+	u.push(list)
+	return nil
+}
+
+func (u *unpickler) memoize(idx int) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[idx] = v
+	return nil
+}
+
+func (u *unpickler) get(idx int) error {
+	v, ok := u.memo[idx]
+	if !ok {
+		return fmt.Errorf("pickle memo not found: %d", idx)
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		b, err := u.read(1)
+		if err != nil {
+			return nil, err
+		}
+		switch op := b[0]; op {
+		case '.': // STOP
+			return u.pop()
+		case 0x80: // PROTO
+			_, err = u.read(1)
+		case 0x95: // FRAME
+			_, err = u.read(8)
+		case '(': // MARK
+			u.push(pickleMark{})
+		case ']': // EMPTY_LIST
+			u.push(&pickleList{})
+		case ')': // EMPTY_TUPLE
+			u.push([]interface{}{})
+		case 'l': // LIST
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(&pickleList{items: items})
+			}
+		case 't': // TUPLE
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(items)
+			}
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			var items []interface{}
+			if items, err = u.popN(int(op - 0x84)); err == nil {
+				u.push(items)
+			}
+		case 'a': // APPEND
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendTo(v)
+			}
+		case 'e': // APPENDS
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendTo(items...)
+			}
+		case 'N': // NONE
+			u.push(nil)
+		case 0x88: // NEWTRUE
+			u.push(true)
+		case 0x89: // NEWFALSE
+			u.push(false)
+		case 'I', 'L': // INT, LONG
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var v int64
+				if v, err = strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64); err == nil {
+					u.push(v)
+				}
+			}
+		case 'J': // BININT
+			var v uint64
+			if v, err = u.readUint(4); err == nil {
+				u.push(int64(int32(uint32(v))))
+			}
+		case 'K': // BININT1
+			var v uint64
+			if v, err = u.readUint(1); err == nil {
+				u.push(int64(v))
+			}
+		case 'M': // BININT2
+			var v uint64
+			if v, err = u.readUint(2); err == nil {
+				u.push(int64(v))
+			}
+		case 0x8a: // LONG1
+			var n uint64
+			var data []byte
+			if n, err = u.readUint(1); err == nil {
+				if data, err = u.read(int(n)); err == nil {
+					u.push(decodeLong(data))
+				}
+			}
+		case 'F': // FLOAT
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var v float64
+				if v, err = strconv.ParseFloat(line, 64); err == nil {
+					u.push(v)
+				}
+			}
+		case 'G': // BINFLOAT
+			var data []byte
+			if data, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(data)))
+			}
+		case 'S': // STRING
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(unquote(line))
+			}
+		case 'V': // UNICODE
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case 'T', 'X', 'B': // BINSTRING, BINUNICODE, BINBYTES
+			err = u.readString(4)
+		case 'U', 0x8c, 'C': // SHORT_BINSTRING, SHORT_BINUNICODE, SHORT_BINBYTES
+			err = u.readString(1)
+		case 0x8d, 0x8e: // BINUNICODE8, BINBYTES8
+			err = u.readString(8)
+		case 'p': // PUT
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var idx int
+				if idx, err = strconv.Atoi(line); err == nil {
+					err = u.memoize(idx)
+				}
+			}
+		case 'q', 'r': // BINPUT, LONG_BINPUT
+			var idx uint64
+			if idx, err = u.readUint(map[byte]int{'q': 1, 'r': 4}[op]); err == nil {
+				err = u.memoize(int(idx))
+			}
+		case 0x94: // MEMOIZE
+			err = u.memoize(len(u.memo))
+		case 'g': // GET
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var idx int
+				if idx, err = strconv.Atoi(line); err == nil {
+					err = u.get(idx)
+				}
+			}
+		case 'h', 'j': // BINGET, LONG_BINGET
+			var idx uint64
+			if idx, err = u.readUint(map[byte]int{'h': 1, 'j': 4}[op]); err == nil {
+				err = u.get(int(idx))
+			}
+		default:
+			err = fmt.Errorf("pickle opcode unsupported: 0x%02x", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) readString(lenSize int) error {
+	n, err := u.readUint(lenSize)
+	if err != nil {
+		return err
+	}
+	if n > uint64(len(u.data)) {
+		return ErrPickleTruncated
+	}
+	data, err := u.read(int(n))
+	if err != nil {
+		return err
+	}
+	u.push(string(data))
+	return nil
+}
+
+// decodeLong decodes the little endian two's complement integer.
+func decodeLong(data []byte) interface{} {
+	if len(data) == 0 {
+		return int64(0)
+	}
+	be := make([]byte, len(data))
+	for i, b := range data {
+		be[len(data)-1-i] = b
+	}
+	v := new(big.Int).SetBytes(be)
+	if data[len(data)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(len(data)*8)))
+	}
+	if v.IsInt64() {
+		return v.Int64()
+	}
+	f, _ := new(big.Float).SetInt(v).Float64()
+	return f
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// toSlice returns the items of a list or tuple.
+func toSlice(v interface{}) ([]interface{}, bool) {
+	switch s := v.(type) {
+	case *pickleList:
+		return s.items, true
+	case []interface{}:
+		return s, true
+	}
+	return nil, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// ParsePickle decodes a pickle message, which is a list of (path, (timestamp, value)).
+func ParsePickle(data []byte) ([]*Metric, error) {
+	u := &unpickler{data: data, memo: make(map[int]interface{})}
+	v, err := u.load()
+	if err != nil {
+		return nil, err
+	}
+	list, ok := toSlice(v)
+	if !ok {
+		return nil, ErrPickleFormat
+	}
+	metrics := make([]*Metric, 0, len(list))
+	for _, item := range list {
+		pair, ok := toSlice(item)
+		if !ok || len(pair) != 2 {
+			return nil, ErrPickleFormat
+		}
+		name, ok := pair[0].(string)
+		if !ok {
+			return nil, ErrPickleFormat
+		}
+		datapoint, ok := toSlice(pair[1])
+		if !ok || len(datapoint) != 2 {
+			return nil, ErrPickleFormat
+		}
+		ts, ok1 := toFloat(datapoint[0])
+		value, ok2 := toFloat(datapoint[1])
+		if !ok1 || !ok2 {
+			return nil, ErrPickleFormat
+		}
+		timestamp := time.Now()
+		if ts != -1 {
+			if ts < float64(minDate.Unix()) || ts > float64(maxDate.Unix()) {
+				return nil, fmt.Errorf(`field "%s" time: timestamp out of range`, name)
+			}
+			timestamp = unixToTime(ts)
+		}
+		metrics = append(metrics, &Metric{Name: name, Value: value, Timestamp: timestamp})
+	}
+	return metrics, nil
+}
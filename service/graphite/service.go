@@ -0,0 +1,276 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxUDPPayload is the max size of a udp packet payload
+	maxUDPPayload = 64 * 1024
+	// maxBatchSize is the max number of plaintext points written at once
+	maxBatchSize = 5000
+)
+
+var (
+	pointsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "influx_proxy_graphite_points_received_total",
+		Help: "Number of points received by graphite listener.",
+	}, []string{"bind_addr", "protocol"})
+	pointsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "influx_proxy_graphite_points_dropped_total",
+		Help: "Number of points dropped by graphite listener due to parse or write errors.",
+	}, []string{"bind_addr", "protocol"})
+)
+
+// Collectors returns the metrics of graphite listeners, which are registered by the http service.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{pointsReceived, pointsDropped}
+}
+
+// PointsWriter writes the points to database db and retention policy rp.
+type PointsWriter interface {
+	WritePoints(points []models.Point, db, rp string) error
+	IsForbiddenDB(db string) bool
+}
+
+// Service receives graphite metrics by plaintext over tcp or udp, or by pickle over tcp,
+// and writes the points converted by templates to the fixed db and rp.
+type Service struct {
+	cfg      *backend.GraphiteConfig
+	w        PointsWriter
+	parser   *Parser
+	ln       net.Listener
+	conn     net.PacketConn
+	lock     sync.Mutex
+	conns    map[net.Conn]struct{}
+	closing  bool
+	wg       sync.WaitGroup
+	received prometheus.Counter
+	dropped  prometheus.Counter
+}
+
+func NewService(cfg *backend.GraphiteConfig, w PointsWriter) (*Service, error) {
+	parser, err := NewParser(cfg.Templates, cfg.Separator)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		cfg:      cfg,
+		w:        w,
+		parser:   parser,
+		conns:    make(map[net.Conn]struct{}),
+		received: pointsReceived.WithLabelValues(cfg.BindAddr, cfg.Protocol),
+		dropped:  pointsDropped.WithLabelValues(cfg.BindAddr, cfg.Protocol),
+	}, nil
+}
+
+func (s *Service) Open() (err error) {
+	if s.cfg.Protocol == "udp" {
+		var addr *net.UDPAddr
+		var conn *net.UDPConn
+		addr, err = net.ResolveUDPAddr("udp", s.cfg.BindAddr)
+		if err != nil {
+			return
+		}
+		conn, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return
+		}
+		if s.cfg.ReadBuffer > 0 {
+			if err = conn.SetReadBuffer(s.cfg.ReadBuffer); err != nil {
+				conn.Close()
+				return
+			}
+		}
+		s.conn = conn
+		s.wg.Add(1)
+		go s.serveUDP()
+	} else {
+		s.ln, err = net.Listen("tcp", s.cfg.BindAddr)
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.serveTCP()
+	}
+	log.Printf("graphite service start, listen on %s/%s, db: %s, rp: %s", s.cfg.BindAddr, s.cfg.Protocol, s.cfg.Database, s.cfg.RetentionPolicy)
+	return
+}
+
+// Close stops the listener and closes the connections.
+func (s *Service) Close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.lock.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Service) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("graphite accept error: %s, bind_addr: %s", err, s.cfg.BindAddr)
+			continue
+		}
+		s.lock.Lock()
+		if s.closing {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// handleConn reads the metrics from tcp connection until it's closed.
+func (s *Service) handleConn(conn net.Conn) {
+	defer conn.Close()
+	var err error
+	if s.cfg.Protocol == "pickle" {
+		err = s.handlePickle(conn)
+	} else {
+		err = s.handleLines(conn)
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("graphite read error: %s, bind_addr: %s, remote_addr: %s", err, s.cfg.BindAddr, conn.RemoteAddr())
+	}
+}
+
+func (s *Service) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("graphite read error: %s, bind_addr: %s", err, s.cfg.BindAddr)
+			continue
+		}
+		s.handleLines(bytes.NewReader(buf[:n]))
+	}
+}
+
+// handleLines reads the plaintext lines with format <metric path> <value> [timestamp]. The points are written
+// in batch once the data read is consumed, so that the lines of a packet or a read chunk are written at once.
+func (s *Service) handleLines(r io.Reader) error {
+	br := bufio.NewReaderSize(r, bufio.MaxScanTokenSize)
+	var points []models.Point
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			s.writePoints(points)
+			return bufio.ErrTooLong
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			s.received.Inc()
+			point, perr := s.parser.Parse(string(line))
+			if perr != nil {
+				log.Printf("graphite parse error: %s, bind_addr: %s", perr, s.cfg.BindAddr)
+				s.dropped.Inc()
+			} else {
+				points = append(points, point)
+			}
+		}
+		if err != nil || br.Buffered() == 0 || len(points) >= maxBatchSize {
+			s.writePoints(points)
+			points = nil
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// handlePickle reads the pickle messages, each of which is prefixed with 4 bytes of big endian length.
+func (s *Service) handlePickle(r io.Reader) error {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > MaxPickleSize {
+			return fmt.Errorf("pickle message too large: %d", size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		metrics, err := ParsePickle(data)
+		if err != nil {
+			return err
+		}
+		points := make([]models.Point, 0, len(metrics))
+		for _, m := range metrics {
+			s.received.Inc()
+			point, err := s.parser.ParseMetric(m.Name, m.Value, m.Timestamp)
+			if err != nil {
+				log.Printf("graphite parse error: %s, bind_addr: %s", err, s.cfg.BindAddr)
+				s.dropped.Inc()
+				continue
+			}
+			points = append(points, point)
+		}
+		s.writePoints(points)
+	}
+}
+
+func (s *Service) writePoints(points []models.Point) {
+	if len(points) == 0 {
+		return
+	}
+	if s.w.IsForbiddenDB(s.cfg.Database) {
+		log.Printf("graphite write error: database forbidden: %s, bind_addr: %s", s.cfg.Database, s.cfg.BindAddr)
+		s.dropped.Add(float64(len(points)))
+		return
+	}
+	if err := s.w.WritePoints(points, s.cfg.Database, s.cfg.RetentionPolicy); err != nil {
+		log.Printf("graphite write error: %s, bind_addr: %s", err, s.cfg.BindAddr)
+		s.dropped.Add(float64(len(points)))
+	}
+}
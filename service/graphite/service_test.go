@@ -0,0 +1,169 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+type testWriter struct {
+	lock      sync.Mutex
+	db        string
+	rp        string
+	points    []string
+	writes    int
+	forbidden bool
+}
+
+func (tw *testWriter) WritePoints(points []models.Point, db, rp string) error {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	tw.db, tw.rp = db, rp
+	tw.writes++
+	for _, pt := range points {
+		tw.points = append(tw.points, pt.String())
+	}
+	return nil
+}
+
+func (tw *testWriter) IsForbiddenDB(db string) bool {
+	return tw.forbidden
+}
+
+// serve handles the data written to an in-memory connection and returns after the connection is closed.
+func serve(t *testing.T, cfg *backend.GraphiteConfig, tw *testWriter, data []byte) {
+	s, err := NewService(cfg, tw)
+	if err != nil {
+		t.Fatalf("new service error: %s", err)
+	}
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleConn(server)
+		close(done)
+	}()
+	if _, err = client.Write(data); err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+	client.Close()
+	<-done
+}
+
+func TestServicePlaintext(t *testing.T) {
+	cfg := &backend.GraphiteConfig{
+		Protocol:        "tcp",
+		Database:        "graphite",
+		RetentionPolicy: "autogen",
+		Templates:       []string{"servers.*.cpu.* .host.measurement.field"},
+	}
+	tw := &testWriter{}
+	serve(t, cfg, tw, []byte("servers.h1.cpu.idle 1.5 1700000000\n\ninvalid\nservers.h2.cpu.user 2 1700000000"))
+	want := []string{"cpu,host=h1 idle=1.5 1700000000000000000", "cpu,host=h2 user=2 1700000000000000000"}
+	if tw.db != "graphite" || tw.rp != "autogen" {
+		t.Errorf("got db %s, rp %s, want graphite, autogen", tw.db, tw.rp)
+	}
+	if tw.writes != 1 {
+		t.Errorf("got %d writes, want 1 of the read chunk", tw.writes)
+	}
+	if len(tw.points) != len(want) {
+		t.Fatalf("got points %v, want %v", tw.points, want)
+	}
+	for i, pt := range tw.points {
+		if pt != want[i] {
+			t.Errorf("got point %s, want %s", pt, want[i])
+		}
+	}
+}
+
+func TestServicePickle(t *testing.T) {
+	cfg := &backend.GraphiteConfig{
+		Protocol:  "pickle",
+		Database:  "graphite",
+		Templates: []string{"servers.*.cpu.* .host.measurement.field"},
+	}
+	payload := []byte("\x80\x02]q\x00(X\x13\x00\x00\x00servers.h1.cpu.idleq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x13\x00\x00\x00servers.h1.cpu.userq\x04GA\xd9T\xfc@ \x00\x00K\x02\x86q\x05\x86q\x06e.")
+	var data []byte
+	for i := 0; i < 2; i++ {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(payload)))
+		data = append(data, payload...)
+	}
+	tw := &testWriter{}
+	serve(t, cfg, tw, data)
+	want := []string{"cpu,host=h1 idle=1.5 1700000000000000000", "cpu,host=h1 user=2 1700000000500000000"}
+	want = append(want, want...)
+	if len(tw.points) != len(want) {
+		t.Fatalf("got points %v, want %v", tw.points, want)
+	}
+	for i, pt := range tw.points {
+		if pt != want[i] {
+			t.Errorf("got point %s, want %s", pt, want[i])
+		}
+	}
+}
+
+func TestServicePlaintextBatch(t *testing.T) {
+	cfg := &backend.GraphiteConfig{Protocol: "udp", Database: "graphite"}
+	s, err := NewService(cfg, &testWriter{})
+	if err != nil {
+		t.Fatalf("new service error: %s", err)
+	}
+	tests := []struct {
+		name   string
+		lines  int
+		writes int
+	}{
+		{name: "packet", lines: 3, writes: 1},
+		{name: "max batch size", lines: maxBatchSize + 1, writes: 2},
+	}
+	for _, tt := range tests {
+		tw := &testWriter{}
+		s.w = tw
+		// the lines are short enough to be read in one chunk
+		data := bytes.Repeat([]byte("c 1 1\n"), tt.lines)
+		if err = s.handleLines(bytes.NewReader(data)); err != nil {
+			t.Errorf("%v: got error %v", tt.name, err)
+		}
+		if len(tw.points) != tt.lines || tw.writes != tt.writes {
+			t.Errorf("%v: got %d points in %d writes, want %d in %d", tt.name, len(tw.points), tw.writes, tt.lines, tt.writes)
+		}
+	}
+}
+
+func TestServiceForbiddenDB(t *testing.T) {
+	cfg := &backend.GraphiteConfig{Protocol: "tcp", Database: "graphite"}
+	tw := &testWriter{forbidden: true}
+	serve(t, cfg, tw, []byte("cpu 1 1700000000\n"))
+	if len(tw.points) != 0 {
+		t.Errorf("got points %v, want none", tw.points)
+	}
+}
+
+func TestServiceOpenClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+	}{
+		{name: "tcp", protocol: "tcp"},
+		{name: "udp", protocol: "udp"},
+	}
+	for _, tt := range tests {
+		tw := &testWriter{}
+		s, err := NewService(&backend.GraphiteConfig{BindAddr: "127.0.0.1:0", Protocol: tt.protocol, Database: "graphite"}, tw)
+		if err != nil {
+			t.Fatalf("%v: new service error: %s", tt.name, err)
+		}
+		if err = s.Open(); err != nil {
+			t.Fatalf("%v: open error: %s", tt.name, err)
+		}
+		s.Close()
+	}
+}
@@ -7,25 +7,36 @@ package service
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"mime"
 	"net/http"
 	"net/http/pprof"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/service/csv2lp"
+	"github.com/chengshiwen/influx-proxy/service/graphite"
+	"github.com/chengshiwen/influx-proxy/service/opentsdb"
 	"github.com/chengshiwen/influx-proxy/service/prometheus"
 	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
 	"github.com/chengshiwen/influx-proxy/transfer"
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb1-client/models"
+	promclient "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -34,6 +45,15 @@ var (
 	ErrInvalidBatch   = errors.New("invalid batch, require positive integer")
 	ErrInvalidSince   = errors.New("invalid since, require non-negative integer")
 	ErrInvalidHaAddrs = errors.New("invalid ha_addrs, require at least two addresses as <host:port>, comma-separated")
+	ErrNoMatchParam   = errors.New("no match[] parameter provided")
+	ErrPromReadV2     = errors.New("prometheus read and query of metric_version 2 is not supported")
+	ErrShardedByTags  = errors.New("transfer is not supported when shard_key contains %tag(name)")
+	ErrInvalidTags    = errors.New("invalid tags, require comma-separated <key>=<value>")
+)
+
+const (
+	promErrorBadData   = "bad_data"
+	promErrorExecution = "execution"
 )
 
 type ServeMux struct {
@@ -53,37 +73,141 @@ func (mux *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type HttpService struct { //nolint:all
 	ip              *backend.Proxy
 	tx              *transfer.Transfer
+	lock            sync.RWMutex
+	reloadLock      sync.Mutex
 	username        string
 	password        string
 	authEncrypt     bool
-	pingAuthEnabled bool
-	writeTracing    bool
-	queryTracing    bool
+	pingAuthEnabled atomic.Bool
+	writeTracing    atomic.Bool
+	queryTracing    atomic.Bool
 	pprofEnabled    bool
+	listeners       []listener
+	registry        *promclient.Registry
+}
+
+// listener receives points by other protocols than http, such as udp.
+type listener interface {
+	Open() error
+	Close()
 }
 
 func NewHttpService(cfg *backend.ProxyConfig) (hs *HttpService) { //nolint:all
 	ip := backend.NewProxy(cfg)
 	hs = &HttpService{
-		ip:              ip,
-		tx:              transfer.NewTransfer(cfg, ip.Circles, ip.GetKey),
-		username:        cfg.Username,
-		password:        cfg.Password,
-		authEncrypt:     cfg.AuthEncrypt,
-		pingAuthEnabled: cfg.PingAuthEnabled,
-		writeTracing:    cfg.WriteTracing,
-		queryTracing:    cfg.QueryTracing,
-		pprofEnabled:    cfg.PprofEnabled,
-	}
+		ip:           ip,
+		tx:           transfer.NewTransfer(cfg, ip.Circles, ip.GetKey),
+		pprofEnabled: cfg.PprofEnabled,
+	}
+	hs.setConfig(cfg)
+	// register the collectors per service instead of the default registry, which panics if the service is created again
+	hs.registry = promclient.NewRegistry()
+	hs.registry.MustRegister(ip.Cardinality(), ip.QueryCache(), udpPacketsReceived, udpPacketsDropped, udpBytesReceived, udpPointsDropped)
+	hs.registry.MustRegister(graphite.Collectors()...)
+	hs.registry.MustRegister(opentsdb.Collectors()...)
 	return
 }
 
+// OpenListeners starts the listeners of protocols other than http.
+func (hs *HttpService) OpenListeners() error {
+	cfg := hs.ip.Config()
+	var listeners []listener
+	for _, udp := range cfg.UDP {
+		listeners = append(listeners, NewUDPService(udp, hs.ip))
+	}
+	for _, gcfg := range cfg.Graphite {
+		gs, err := graphite.NewService(gcfg, hs.ip)
+		if err != nil {
+			return fmt.Errorf("graphite %s: %w", gcfg.BindAddr, err)
+		}
+		listeners = append(listeners, gs)
+	}
+	if cfg.OpenTSDB != nil && cfg.OpenTSDB.BindAddr != "" {
+		listeners = append(listeners, opentsdb.NewService(cfg.OpenTSDB, hs.ip))
+	}
+	for _, l := range listeners {
+		if err := l.Open(); err != nil {
+			hs.closeListeners()
+			return err
+		}
+		hs.listeners = append(hs.listeners, l)
+	}
+	return nil
+}
+
+func (hs *HttpService) closeListeners() {
+	for _, l := range hs.listeners {
+		l.Close()
+	}
+	hs.listeners = nil
+}
+
+func (hs *HttpService) setConfig(cfg *backend.ProxyConfig) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.username = cfg.Username
+	hs.password = cfg.Password
+	hs.authEncrypt = cfg.AuthEncrypt
+	hs.pingAuthEnabled.Store(cfg.PingAuthEnabled)
+	hs.writeTracing.Store(cfg.WriteTracing)
+	hs.queryTracing.Store(cfg.QueryTracing)
+}
+
+// Reload re-reads the config file and applies it to the running proxy. The reloads are serialized,
+// and no transfer can be started until the reload is done.
+func (hs *HttpService) Reload() error {
+	hs.reloadLock.Lock()
+	defer hs.reloadLock.Unlock()
+	cfg, err := hs.ip.Config().Reload()
+	if err != nil {
+		return err
+	}
+	err = hs.tx.RunIdle(func() error {
+		if err := hs.ip.Reload(cfg); err != nil {
+			return err
+		}
+		for _, cs := range hs.tx.CircleStates {
+			backends := cs.Backends()
+			urls := make([]string, len(backends))
+			for i, be := range backends {
+				urls[i] = be.Url
+			}
+			cs.SyncStats(urls)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	hs.setConfig(cfg)
+	log.Printf("config reloaded")
+	cfg.PrintSummary()
+	return nil
+}
+
+func (hs *HttpService) Config() *backend.ProxyConfig {
+	return hs.ip.Config()
+}
+
+// Shutdown flushes the buffered data of the proxy, it should be called after the http server is shut down.
+func (hs *HttpService) Shutdown(ctx context.Context) {
+	hs.closeListeners()
+	hs.ip.Shutdown(ctx)
+}
+
 func (hs *HttpService) Register(mux *ServeMux) {
 	mux.HandleFunc("/ping", hs.HandlerPing)
 	mux.HandleFunc("/query", hs.HandlerQuery)
 	mux.HandleFunc("/write", hs.HandlerWrite)
 	mux.HandleFunc("/api/v2/query", hs.HandlerQueryV2)
 	mux.HandleFunc("/api/v2/write", hs.HandlerWriteV2)
+	mux.HandleFunc("/api/v2/buckets", hs.HandlerBucketsV2)
+	mux.HandleFunc("/api/v2/buckets/", hs.HandlerBucketsV2)
+	mux.HandleFunc("/api/v2/orgs", hs.HandlerOrgsV2)
+	mux.HandleFunc("/api/v2/orgs/", hs.HandlerOrgsV2)
+	mux.HandleFunc("/api/v2/dbrps", hs.HandlerDBRPsV2)
+	mux.HandleFunc("/api/v2/dbrps/", hs.HandlerDBRPsV2)
+	mux.HandleFunc("/api/v2/delete", hs.HandlerDeleteV2)
 	mux.HandleFunc("/health", hs.HandlerHealth)
 	mux.HandleFunc("/replica", hs.HandlerReplica)
 	mux.HandleFunc("/encrypt", hs.HandlerEncrypt)
@@ -94,8 +218,20 @@ func (hs *HttpService) Register(mux *ServeMux) {
 	mux.HandleFunc("/cleanup", hs.HandlerCleanup)
 	mux.HandleFunc("/transfer/state", hs.HandlerTransferState)
 	mux.HandleFunc("/transfer/stats", hs.HandlerTransferStats)
+	mux.HandleFunc("/reload", hs.HandlerReload)
+	mux.HandleFunc("/cardinality", hs.HandlerCardinality)
+	mux.HandleFunc("/deadletter", hs.HandlerDeadLetter)
+	mux.HandleFunc("/deadletter/download", hs.HandlerDeadLetterDownload)
+	mux.HandleFunc("/deadletter/purge", hs.HandlerDeadLetterPurge)
+	mux.HandleFunc("/deadletter/replay", hs.HandlerDeadLetterReplay)
 	mux.HandleFunc("/api/v1/prom/read", hs.HandlerPromRead)
 	mux.HandleFunc("/api/v1/prom/write", hs.HandlerPromWrite)
+	mux.HandleFunc("/api/v1/query", hs.HandlerPromQuery)
+	mux.HandleFunc("/api/v1/query_range", hs.HandlerPromQueryRange)
+	mux.HandleFunc("/api/v1/series", hs.HandlerPromSeries)
+	mux.HandleFunc("/api/v1/labels", hs.HandlerPromLabels)
+	mux.HandleFunc("/api/put", hs.HandlerOpenTSDBPut)
+	mux.HandleFunc("/v1/metrics", hs.HandlerOTLPMetrics)
 	mux.HandleFunc("/metrics", hs.HandlerMetrics)
 	if hs.pprofEnabled {
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -104,7 +240,7 @@ func (hs *HttpService) Register(mux *ServeMux) {
 }
 
 func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
-	if hs.isAuthEnabled() && hs.pingAuthEnabled && !hs.checkAuth(w, req) {
+	if hs.isAuthEnabled() && hs.pingAuthEnabled.Load() && !hs.checkAuth(w, req) {
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -117,14 +253,20 @@ func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 
 	db := req.FormValue("db")
 	q := req.FormValue("q")
-	body, err := hs.ip.Query(w, req)
+	// the response may be streamed from backend, then neither the body nor the error can be written
+	sw := backend.NewStreamWriter(w)
+	body, err := hs.ip.Query(sw, req)
 	if err != nil {
 		log.Printf("influxql query error: %s, query: %s, db: %s, client: %s", err, q, db, req.RemoteAddr)
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		if !sw.Written() {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		}
 		return
 	}
-	hs.WriteBody(w, body)
-	if hs.queryTracing {
+	if !sw.Written() {
+		hs.WriteBody(w, body)
+	}
+	if hs.queryTracing.Load() {
 		log.Printf("influxql query: %s, db: %s, client: %s", q, db, req.RemoteAddr)
 	}
 }
@@ -171,13 +313,16 @@ func (hs *HttpService) HandlerQueryV2(w http.ResponseWriter, req *http.Request)
 	}
 
 	req.Body = io.NopCloser(bytes.NewBuffer(rbody))
-	err = hs.ip.QueryFlux(w, req, qr)
+	sw := backend.NewStreamWriter(w)
+	err = hs.ip.QueryFlux(sw, req, qr)
 	if err != nil {
 		log.Printf("flux query error: %s, query: %s, spec: %s, client: %s", err, qr.Query, qr.Spec, req.RemoteAddr)
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		if !sw.Written() {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		}
 		return
 	}
-	if hs.queryTracing {
+	if hs.queryTracing.Load() {
 		log.Printf("flux query: %s, spec: %s, client: %s", qr.Query, qr.Spec, req.RemoteAddr)
 	}
 }
@@ -241,29 +386,527 @@ func (hs *HttpService) HandlerWriteV2(w http.ResponseWriter, req *http.Request)
 }
 
 func (hs *HttpService) handlerWrite(db, rp, precision string, w http.ResponseWriter, req *http.Request) {
+	consistency, err := backend.ParseConsistencyLevel(req.URL.Query().Get("consistency"))
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cfg := hs.ip.Config()
 	body := req.Body
+	if cfg.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, body, int64(cfg.MaxBodySize))
+	}
 	if req.Header.Get("Content-Encoding") == "gzip" {
 		b, err := gzip.NewReader(body)
 		if err != nil {
-			hs.WriteError(w, req, http.StatusBadRequest, "unable to decode gzip body")
+			if isBodyTooLarge(err) {
+				hs.WriteError(w, req, http.StatusRequestEntityTooLarge, err.Error())
+			} else {
+				hs.WriteError(w, req, http.StatusBadRequest, "unable to decode gzip body")
+			}
 			return
 		}
 		defer b.Close()
 		body = b
+		if cfg.MaxDecompressSize > 0 {
+			body = http.MaxBytesReader(w, body, int64(cfg.MaxDecompressSize))
+		}
+	}
+	var data bytes.Buffer
+	if hs.writeTracing.Load() {
+		body = io.NopCloser(io.TeeReader(body, &data))
+	}
+
+	format := "line protocol"
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt == "text/csv" {
+		format = "annotated csv"
+		err = hs.writeCSV(body, db, rp, precision, consistency)
+	} else {
+		err = hs.ip.WriteStream(body, db, rp, precision, consistency)
 	}
-	p, err := io.ReadAll(body)
 	if err != nil {
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		hs.writeWriteError(w, req, err)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	if hs.writeTracing.Load() {
+		log.Printf("write %s, db: %s, rp: %s, precision: %s, data: %s, client: %s", format, db, rp, precision, data.Bytes(), req.RemoteAddr)
+	}
+}
+
+// writeCSV converts the rows of annotated csv into line protocol and writes them, the rows failed to convert or write
+// are reported by a partial write error with their line numbers in csv.
+func (hs *HttpService) writeCSV(r io.Reader, db, rp, precision string, consistency backend.ConsistencyLevel) error {
+	reader := csv2lp.NewReader(r, precision)
+	perr := &backend.PartialWriteError{}
+	// the converted points are piped to the write, the line of line protocol where each point starts is mapped to
+	// its row in csv, since a point spans multiple lines if its string fields contain newlines
+	var (
+		starts, rows []int
+		cerr         error
+	)
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lineno := 1
+		for {
+			pt, row, err := reader.Next()
+			if err == io.EOF {
+				pw.Close()
+				return
+			}
+			var rerr *csv2lp.RowError
+			if errors.As(err, &rerr) {
+				perr.Add(rerr.Line, rerr.Err)
+				continue
+			}
+			if err != nil {
+				cerr = err
+				pw.CloseWithError(err)
+				return
+			}
+			line := pt.String() + "\n"
+			starts = append(starts, lineno)
+			rows = append(rows, row)
+			lineno += strings.Count(line, "\n")
+			if _, err = io.WriteString(pw, line); err != nil {
+				return
+			}
+		}
+	}()
+	err := hs.ip.WriteStream(pr, db, rp, "ns", consistency)
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+
+	// row returns the line number in csv of the point starting at line of line protocol
+	row := func(line int) int {
+		if i := sort.SearchInts(starts, line); i < len(starts) && starts[i] == line {
+			return rows[i]
+		}
+		return line
+	}
+	var werr *backend.PartialWriteError
+	var aerr *backend.WriteAbortError
+	switch {
+	case cerr != nil:
+		return cerr
+	case errors.As(err, &werr):
+		for _, le := range werr.Errors {
+			perr.Add(row(le.Line), le.Err)
+		}
+		perr.Dropped += werr.Dropped - len(werr.Errors)
+		sort.SliceStable(perr.Errors, func(i, j int) bool { return perr.Errors[i].Line < perr.Errors[j].Line })
+	case errors.As(err, &aerr):
+		return &backend.WriteAbortError{Line: row(aerr.Line), Written: aerr.Written, Err: aerr.Err}
+	case err != nil:
+		return err
+	}
+	if perr.Dropped > 0 {
+		return perr
+	}
+	return nil
+}
+
+func (hs *HttpService) writeWriteError(w http.ResponseWriter, req *http.Request, err error) {
+	hs.WriteError(w, req, hs.writeErrorStatus(w, err), err.Error())
+}
+
+// writeErrorStatus returns the http status of the write error, and sets Retry-After header if the write can be retried later.
+func (hs *HttpService) writeErrorStatus(w http.ResponseWriter, err error) int {
+	if isBodyTooLarge(err) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, backend.ErrBufferFull) || errors.Is(err, backend.ErrBackendBusy) {
+		// buffered points are expected to be flushed in flush_time seconds
+		w.Header().Set("Retry-After", strconv.Itoa(hs.ip.Config().FlushTime))
+		if errors.Is(err, backend.ErrBufferFull) {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusServiceUnavailable
+	}
+	var cerr *backend.ConsistencyError
+	if errors.As(err, &cerr) {
+		if cerr.Timeout {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusInternalServerError
+	}
+	// valid lines have been written even if some lines are dropped
+	return http.StatusBadRequest
+}
+
+func isBodyTooLarge(err error) bool {
+	var merr *http.MaxBytesError
+	return errors.As(err, &merr) || errors.Is(err, backend.ErrLineTooLong)
+}
+
+// v2OrgName is the name of the virtual organization when no org is specified, the same as influxdb 1.8.
+const v2OrgName = "-"
+
+// v2Bucket is the bucket of influxdb 2.x emulated by the database and retention policy, named as database/retention-policy.
+type v2Bucket struct {
+	ID             string             `json:"id"`
+	OrgID          string             `json:"orgID"`
+	Type           string             `json:"type"`
+	Name           string             `json:"name"`
+	RetentionRules []*v2RetentionRule `json:"retentionRules"`
+	Links          map[string]string  `json:"links,omitempty"`
+
+	database        string
+	retentionPolicy string
+	isDefault       bool
+}
+
+type v2RetentionRule struct {
+	Type                      string `json:"type"`
+	EverySeconds              int64  `json:"everySeconds"`
+	ShardGroupDurationSeconds int64  `json:"shardGroupDurationSeconds,omitempty"`
+}
+
+// v2DBRP is the fixed mapping from the database and retention policy to the bucket of the same name.
+type v2DBRP struct {
+	ID              string `json:"id"`
+	OrgID           string `json:"orgID"`
+	BucketID        string `json:"bucketID"`
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retention_policy"`
+	Default         bool   `json:"default"`
+}
+
+func (hs *HttpService) HandlerBucketsV2(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v2/buckets"), "/")
+	if id == "" && !hs.checkMethodAndAuth(w, req, "GET", "POST") || id != "" && !hs.checkMethodAndAuth(w, req, "GET") {
 		return
 	}
 
-	err = hs.ip.Write(p, db, rp, precision)
-	if err == nil {
-		w.WriteHeader(http.StatusNoContent)
+	q := req.URL.Query()
+	if req.Method == "POST" {
+		hs.createBucketV2(w, req)
+		return
+	}
+	buckets, err := hs.listBucketsV2(v2OrgID(q.Get("orgID"), q.Get("org")))
+	if err != nil {
+		log.Printf("list buckets error: %s, client: %s", err, req.RemoteAddr)
+		hs.writeV2Error(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	if id != "" {
+		for _, b := range buckets {
+			if b.ID == id {
+				hs.writeV2JSON(w, http.StatusOK, b)
+				return
+			}
+		}
+		hs.writeV2Error(w, http.StatusNotFound, "not found", "bucket not found")
+		return
+	}
+	if name := q.Get("name"); name != "" {
+		b := hs.findBucketV2(buckets, name)
+		buckets = nil
+		if b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	if id := q.Get("id"); id != "" {
+		var matched []*v2Bucket
+		for _, b := range buckets {
+			if b.ID == id {
+				matched = append(matched, b)
+			}
+		}
+		buckets = matched
+	}
+	if buckets == nil {
+		buckets = []*v2Bucket{}
+	}
+	hs.writeV2JSON(w, http.StatusOK, map[string]interface{}{"buckets": buckets, "links": map[string]string{"self": "/api/v2/buckets"}})
+}
+
+func (hs *HttpService) createBucketV2(w http.ResponseWriter, req *http.Request) {
+	bucket := &v2Bucket{}
+	if err := json.NewDecoder(req.Body).Decode(bucket); err != nil {
+		hs.writeV2Error(w, http.StatusBadRequest, "invalid", fmt.Sprintf("failed parsing request body as JSON: %s", err))
+		return
+	}
+	db, rp, err := hs.bucket2dbrp(bucket.Name)
+	if err != nil {
+		hs.writeV2Error(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if hs.ip.IsForbiddenDB(db) {
+		hs.writeV2Error(w, http.StatusBadRequest, "invalid", fmt.Sprintf("database forbidden: %s", db))
+		return
+	}
+	orgID := v2OrgID(bucket.OrgID, "")
+	buckets, err := hs.listBucketsV2(orgID)
+	if err != nil {
+		log.Printf("create bucket error: %s, bucket: %s, client: %s", err, bucket.Name, req.RemoteAddr)
+		hs.writeV2Error(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	if hs.findBucketV2(buckets, bucket.Name) != nil {
+		hs.writeV2Error(w, http.StatusUnprocessableEntity, "conflict", fmt.Sprintf("bucket with name %s already exists", bucket.Name))
+		return
 	}
-	if hs.writeTracing {
-		log.Printf("write line protocol, db: %s, rp: %s, precision: %s, data: %s, client: %s", db, rp, precision, p, req.RemoteAddr)
+
+	stmts := v2BucketStmts(db, rp, bucket.RetentionRules)
+	for _, stmt := range stmts {
+		if err = hs.ip.Exec(db, stmt); err != nil {
+			log.Printf("create bucket error: %s, query: %s, client: %s", err, stmt, req.RemoteAddr)
+			hs.writeV2Error(w, http.StatusInternalServerError, "internal error", err.Error())
+			return
+		}
+	}
+	buckets, err = hs.listBucketsV2(orgID)
+	if err != nil {
+		hs.writeV2Error(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	if bucket = hs.findBucketV2(buckets, bucket.Name); bucket == nil {
+		hs.writeV2Error(w, http.StatusInternalServerError, "internal error", "bucket not found after creation")
+		return
+	}
+	hs.writeV2JSON(w, http.StatusCreated, bucket)
+}
+
+// v2BucketStmts returns the statements creating the database and retention policy of the bucket, the duration of
+// retention policy is infinite without the expire rule.
+func v2BucketStmts(db, rp string, rules []*v2RetentionRule) []string {
+	duration, shardDuration := "INF", ""
+	for _, rule := range rules {
+		if rule.Type == "" || rule.Type == "expire" {
+			if rule.EverySeconds > 0 {
+				duration = fmt.Sprintf("%ds", rule.EverySeconds)
+			}
+			if rule.ShardGroupDurationSeconds > 0 {
+				shardDuration = fmt.Sprintf(" shard duration %ds", rule.ShardGroupDurationSeconds)
+			}
+		}
+	}
+	clause := fmt.Sprintf("duration %s replication 1%s", duration, shardDuration)
+	if rp == "" {
+		return []string{fmt.Sprintf("create database \"%s\" with %s", util.EscapeIdentifier(db), clause)}
+	}
+	return []string{
+		fmt.Sprintf("create database \"%s\"", util.EscapeIdentifier(db)),
+		fmt.Sprintf("create retention policy \"%s\" on \"%s\" %s", util.EscapeIdentifier(rp), util.EscapeIdentifier(db), clause),
+	}
+}
+
+func (hs *HttpService) HandlerOrgsV2(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	// there is only one virtual organization whose name is echoed
+	q := req.URL.Query()
+	name := q.Get("org")
+	if name == "" {
+		name = v2OrgName
+	}
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v2/orgs"), "/")
+	if id != "" {
+		hs.writeV2JSON(w, http.StatusOK, map[string]string{"id": id, "name": name})
+		return
+	}
+	org := map[string]string{"id": v2OrgID(q.Get("orgID"), name), "name": name}
+	hs.writeV2JSON(w, http.StatusOK, map[string]interface{}{"orgs": []interface{}{org}, "links": map[string]string{"self": "/api/v2/orgs"}})
+}
+
+func (hs *HttpService) HandlerDBRPsV2(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v2/dbrps"), "/")
+	if id == "" && !hs.checkMethodAndAuth(w, req, "GET", "POST") || id != "" && !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	q := req.URL.Query()
+	dbrp := &v2DBRP{}
+	if req.Method == "POST" {
+		if err := json.NewDecoder(req.Body).Decode(dbrp); err != nil {
+			hs.writeV2Error(w, http.StatusBadRequest, "invalid", fmt.Sprintf("failed parsing request body as JSON: %s", err))
+			return
+		}
+		dbrp.OrgID = v2OrgID(dbrp.OrgID, "")
+	} else {
+		dbrp.OrgID = v2OrgID(q.Get("orgID"), q.Get("org"))
+	}
+	buckets, err := hs.listBucketsV2(dbrp.OrgID)
+	if err != nil {
+		log.Printf("list dbrps error: %s, client: %s", err, req.RemoteAddr)
+		hs.writeV2Error(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	dbrps := make([]*v2DBRP, 0, len(buckets))
+	for _, b := range buckets {
+		dbrps = append(dbrps, &v2DBRP{ID: b.ID, OrgID: b.OrgID, BucketID: b.ID, Database: b.database, RetentionPolicy: b.retentionPolicy, Default: b.isDefault})
+	}
+
+	if req.Method == "POST" {
+		// the mappings are fixed, so the mapping to create must be the existing one
+		for _, m := range dbrps {
+			if m.BucketID == dbrp.BucketID && m.Database == dbrp.Database && m.RetentionPolicy == dbrp.RetentionPolicy {
+				hs.writeV2JSON(w, http.StatusCreated, m)
+				return
+			}
+		}
+		hs.writeV2Error(w, http.StatusBadRequest, "invalid", "dbrp mapping is fixed to the bucket named database/retention-policy")
+		return
+	}
+	if id != "" {
+		for _, m := range dbrps {
+			if m.ID == id {
+				hs.writeV2JSON(w, http.StatusOK, map[string]interface{}{"content": m})
+				return
+			}
+		}
+		hs.writeV2Error(w, http.StatusNotFound, "not found", "unable to find DBRP")
+		return
+	}
+	matched := make([]*v2DBRP, 0, len(dbrps))
+	for _, m := range dbrps {
+		if q.Get("id") != "" && m.ID != q.Get("id") || q.Get("bucketID") != "" && m.BucketID != q.Get("bucketID") ||
+			q.Get("db") != "" && m.Database != q.Get("db") || q.Get("rp") != "" && m.RetentionPolicy != q.Get("rp") ||
+			q.Get("default") != "" && strconv.FormatBool(m.Default) != q.Get("default") {
+			continue
+		}
+		matched = append(matched, m)
+	}
+	hs.writeV2JSON(w, http.StatusOK, map[string]interface{}{"content": matched})
+}
+
+func (hs *HttpService) HandlerDeleteV2(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	q := req.URL.Query()
+	bucket := q.Get("bucket")
+	if bucket == "" && q.Get("bucketID") != "" {
+		buckets, err := hs.listBucketsV2(v2OrgID(q.Get("orgID"), q.Get("org")))
+		if err != nil {
+			hs.writeV2Error(w, http.StatusInternalServerError, "internal error", err.Error())
+			return
+		}
+		for _, b := range buckets {
+			if b.ID == q.Get("bucketID") {
+				bucket = b.Name
+			}
+		}
+		if bucket == "" {
+			hs.writeV2Error(w, http.StatusNotFound, "not found", "bucket not found")
+			return
+		}
+	}
+	db, _, err := hs.bucket2dbrp(bucket)
+	if err != nil {
+		hs.writeV2Error(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if hs.ip.IsForbiddenDB(db) {
+		hs.writeV2Error(w, http.StatusBadRequest, "invalid", fmt.Sprintf("database forbidden: %s", db))
+		return
+	}
+
+	dr := &backend.DeleteRequest{}
+	if err = json.NewDecoder(req.Body).Decode(dr); err != nil {
+		hs.writeV2Error(w, http.StatusBadRequest, "invalid", fmt.Sprintf("failed parsing request body as JSON: %s", err))
+		return
+	}
+	_, stmt, err := backend.DeleteToInfluxQL(dr)
+	if err != nil {
+		hs.writeV2Error(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	// the delete statement of influxql deletes the data in all retention policies of the database
+	if err = hs.ip.Exec(db, stmt); err != nil {
+		log.Printf("delete error: %s, query: %s, db: %s, client: %s", err, stmt, db, req.RemoteAddr)
+		hs.writeV2Error(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	if hs.queryTracing.Load() {
+		log.Printf("delete: %s, db: %s, client: %s", stmt, db, req.RemoteAddr)
+	}
+}
+
+// listBucketsV2 returns the buckets of all retention policies in the databases which are not forbidden.
+func (hs *HttpService) listBucketsV2(orgID string) ([]*v2Bucket, error) {
+	rps, err := hs.ip.ShowRetentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]*v2Bucket, 0, len(rps))
+	for _, rp := range rps {
+		if hs.ip.IsForbiddenDB(rp.Database) {
+			continue
+		}
+		name := rp.Database + "/" + rp.Name
+		bucket := &v2Bucket{
+			ID:              v2ID(name),
+			OrgID:           orgID,
+			Type:            "user",
+			Name:            name,
+			RetentionRules:  []*v2RetentionRule{},
+			database:        rp.Database,
+			retentionPolicy: rp.Name,
+			isDefault:       rp.Default,
+		}
+		bucket.Links = map[string]string{"self": "/api/v2/buckets/" + bucket.ID}
+		if rp.Duration > 0 {
+			bucket.RetentionRules = append(bucket.RetentionRules, &v2RetentionRule{
+				Type:                      "expire",
+				EverySeconds:              int64(rp.Duration / time.Second),
+				ShardGroupDurationSeconds: int64(rp.ShardGroupDuration / time.Second),
+			})
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// findBucketV2 finds the bucket by name, the bucket named database without retention policy is the default retention policy.
+func (hs *HttpService) findBucketV2(buckets []*v2Bucket, name string) *v2Bucket {
+	db, rp, err := hs.bucket2dbrp(name)
+	if err != nil {
+		return nil
 	}
+	for _, b := range buckets {
+		if b.database == db && (rp == "" && b.isDefault || rp != "" && b.retentionPolicy == rp) {
+			nb := *b
+			nb.Name = name
+			return &nb
+		}
+	}
+	return nil
+}
+
+func (hs *HttpService) writeV2JSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(util.MarshalJSON(data, false))
+}
+
+func (hs *HttpService) writeV2Error(w http.ResponseWriter, status int, code, message string) {
+	hs.writeV2JSON(w, status, map[string]string{"code": code, "message": message})
+}
+
+// v2ID returns the id of 16 hex characters hashed from the name.
+func v2ID(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func v2OrgID(orgID, org string) string {
+	if orgID != "" {
+		return orgID
+	}
+	if org == "" {
+		org = v2OrgName
+	}
+	return v2ID(org)
 }
 
 func (hs *HttpService) HandlerHealth(w http.ResponseWriter, req *http.Request) {
@@ -279,6 +922,9 @@ func (hs *HttpService) HandlerHealth(w http.ResponseWriter, req *http.Request) {
 		"circles": hs.ip.GetHealth(stats),
 		"version": backend.Version,
 	}
+	if stats {
+		resp["buffer"] = hs.ip.BufferStats()
+	}
 	hs.Write(w, req, http.StatusOK, resp)
 }
 
@@ -293,7 +939,13 @@ func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request)
 		mm = req.URL.Query().Get("meas") // compatible with version <= 2.5.11
 	}
 	if db != "" && mm != "" {
-		key := hs.ip.GetKey(db, mm)
+		// the tags are only used if the shard key contains %tag(name)
+		tags, err := formTags(req.URL.Query().Get("tags"))
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		key := hs.ip.GetKeyWithTags(db, mm, tags)
 		backends := hs.ip.GetBackends(key)
 		data := make([]map[string]interface{}, len(backends))
 		for i, b := range backends {
@@ -309,6 +961,22 @@ func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+// formTags parses the tags in the form of comma-separated <key>=<value>.
+func formTags(s string) (models.Tags, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, ErrInvalidTags
+		}
+		m[k] = v
+	}
+	return models.NewTags(m), nil
+}
+
 func (hs *HttpService) HandlerEncrypt(w http.ResponseWriter, req *http.Request) {
 	if !hs.checkMethod(w, req, "GET") {
 		return
@@ -336,6 +1004,10 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 	if !hs.checkMethodAndAuth(w, req, "POST") {
 		return
 	}
+	if hs.ip.IsShardedByTags() {
+		hs.WriteError(w, req, http.StatusBadRequest, ErrShardedByTags.Error())
+		return
+	}
 
 	circleId, err := hs.formCircleId(req, "circle_id") //nolint:all
 	if err != nil {
@@ -361,25 +1033,20 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 		}
 		for _, bkcfg := range body.Backends {
 			backends = append(backends, backend.NewSimpleBackend(bkcfg))
-			hs.tx.CircleStates[circleId].Stats[bkcfg.Url] = &transfer.Stats{}
+			hs.tx.CircleStates[circleId].GetStats(bkcfg.Url)
 		}
 	}
-	backends = append(backends, hs.ip.Circles[circleId].Backends...)
-
-	if hs.tx.CircleStates[circleId].Transferring {
-		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", circleId))
-		return
-	}
-	if hs.tx.Resyncing {
-		hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
-		return
-	}
+	backends = append(backends, hs.ip.Circles[circleId].Backends()...)
 
 	err = hs.setParam(req)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err = hs.tx.Reserve(circleId); err != nil {
+		hs.WriteText(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	dbs := hs.formValues(req, "dbs")
 	go hs.tx.Rebalance(circleId, backends, dbs)
@@ -390,6 +1057,10 @@ func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request)
 	if !hs.checkMethodAndAuth(w, req, "POST") {
 		return
 	}
+	if hs.ip.IsShardedByTags() {
+		hs.WriteError(w, req, http.StatusBadRequest, ErrShardedByTags.Error())
+		return
+	}
 
 	fromCircleId, err := hs.formCircleId(req, "from_circle_id") //nolint:all
 	if err != nil {
@@ -406,20 +1077,15 @@ func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	if hs.tx.CircleStates[fromCircleId].Transferring || hs.tx.CircleStates[toCircleId].Transferring {
-		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d or %d is transferring", fromCircleId, toCircleId))
-		return
-	}
-	if hs.tx.Resyncing {
-		hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
-		return
-	}
-
 	err = hs.setParam(req)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err = hs.tx.Reserve(toCircleId, fromCircleId); err != nil {
+		hs.WriteText(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	backendUrls := hs.formValues(req, "backend_urls")
 	dbs := hs.formValues(req, "dbs")
@@ -431,15 +1097,8 @@ func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
 	if !hs.checkMethodAndAuth(w, req, "POST") {
 		return
 	}
-
-	for _, cs := range hs.tx.CircleStates {
-		if cs.Transferring {
-			hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", cs.CircleId))
-			return
-		}
-	}
-	if hs.tx.Resyncing {
-		hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
+	if hs.ip.IsShardedByTags() {
+		hs.WriteError(w, req, http.StatusBadRequest, ErrShardedByTags.Error())
 		return
 	}
 
@@ -448,6 +1107,10 @@ func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err = hs.tx.ReserveResync(); err != nil {
+		hs.WriteText(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	dbs := hs.formValues(req, "dbs")
 	go hs.tx.Resync(dbs)
@@ -458,6 +1121,10 @@ func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request)
 	if !hs.checkMethodAndAuth(w, req, "POST") {
 		return
 	}
+	if hs.ip.IsShardedByTags() {
+		hs.WriteError(w, req, http.StatusBadRequest, ErrShardedByTags.Error())
+		return
+	}
 
 	circleId, err := hs.formCircleId(req, "circle_id") //nolint:all
 	if err != nil {
@@ -465,20 +1132,15 @@ func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	if hs.tx.CircleStates[circleId].Transferring {
-		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", circleId))
-		return
-	}
-	if hs.tx.Resyncing {
-		hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
-		return
-	}
-
 	err = hs.setParam(req)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err = hs.tx.Reserve(circleId); err != nil {
+		hs.WriteText(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	go hs.tx.Cleanup(circleId)
 	hs.WriteText(w, http.StatusAccepted, "accepted")
@@ -490,15 +1152,16 @@ func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Req
 	}
 
 	if req.Method == "GET" {
+		resyncing, transferring := hs.tx.State()
 		data := make([]map[string]interface{}, len(hs.tx.CircleStates))
 		for k, cs := range hs.tx.CircleStates {
 			data[k] = map[string]interface{}{
 				"id":           cs.CircleId,
 				"name":         cs.Name,
-				"transferring": cs.Transferring,
+				"transferring": transferring[k],
 			}
 		}
-		state := map[string]interface{}{"resyncing": hs.tx.Resyncing, "circles": data}
+		state := map[string]interface{}{"resyncing": resyncing, "circles": data}
 		hs.Write(w, req, http.StatusOK, state)
 		return
 	} else if req.Method == "POST" {
@@ -509,7 +1172,7 @@ func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Req
 				hs.WriteError(w, req, http.StatusBadRequest, "illegal resyncing")
 				return
 			}
-			hs.tx.Resyncing = resyncing
+			hs.tx.SetResyncing(resyncing)
 			state["resyncing"] = resyncing
 		}
 		if req.FormValue("circle_id") != "" || req.FormValue("transferring") != "" {
@@ -524,12 +1187,11 @@ func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Req
 				return
 			}
 			cs := hs.tx.CircleStates[circleId]
-			cs.Transferring = transferring
-			cs.SetTransferIn(transferring)
+			hs.tx.SetTransferring(cs, transferring)
 			state["circle"] = map[string]interface{}{
 				"id":           cs.CircleId,
 				"name":         cs.Name,
-				"transferring": cs.Transferring,
+				"transferring": transferring,
 			}
 		}
 		if len(state) == 0 {
@@ -554,18 +1216,154 @@ func (hs *HttpService) HandlerTransferStats(w http.ResponseWriter, req *http.Req
 
 	statsType := req.FormValue("type")
 	if statsType == "rebalance" || statsType == "recovery" || statsType == "resync" || statsType == "cleanup" {
-		hs.Write(w, req, http.StatusOK, hs.tx.CircleStates[circleId].Stats)
+		hs.Write(w, req, http.StatusOK, hs.tx.CircleStates[circleId].CopyStats())
 	} else {
 		hs.WriteError(w, req, http.StatusBadRequest, "invalid stats type")
 	}
 }
 
+func (hs *HttpService) HandlerReload(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	err := hs.Reload()
+	if err != nil {
+		log.Printf("reload error: %s, client: %s", err, req.RemoteAddr)
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	hs.WriteText(w, http.StatusOK, "reloaded")
+}
+
+func (hs *HttpService) HandlerCardinality(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	hs.Write(w, req, http.StatusOK, hs.ip.Cardinality().Stats(req.FormValue("db")))
+}
+
+func (hs *HttpService) HandlerDeadLetter(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	backends, err := hs.deadLetterBackends(req)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	data := make([]map[string]interface{}, 0, len(backends))
+	for _, be := range backends {
+		entries, size := be.DeadLetter().Stats()
+		data = append(data, map[string]interface{}{
+			"name":    be.Name,
+			"url":     be.Url,
+			"entries": entries,
+			"size":    size,
+		})
+	}
+	hs.Write(w, req, http.StatusOK, data)
+}
+
+func (hs *HttpService) HandlerDeadLetterDownload(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	if req.FormValue("backend") == "" {
+		hs.WriteError(w, req, http.StatusBadRequest, "backend not specified")
+		return
+	}
+	backends, err := hs.deadLetterBackends(req)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	be := backends[0]
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", be.Name+".dlq"))
+	err = be.DeadLetter().Download(w)
+	if err != nil {
+		log.Printf("download dead letter error: %s, backend: %s", err, be.Name)
+	}
+}
+
+func (hs *HttpService) HandlerDeadLetterPurge(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	backends, err := hs.deadLetterBackends(req)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, be := range backends {
+		err = be.DeadLetter().Purge()
+		if err != nil {
+			hs.WriteError(w, req, http.StatusInternalServerError, fmt.Sprintf("backend %s: %s", be.Name, err))
+			return
+		}
+		log.Printf("dead letter of backend %s purged, client: %s", be.Name, req.RemoteAddr)
+	}
+	hs.WriteText(w, http.StatusOK, "purged")
+}
+
+func (hs *HttpService) HandlerDeadLetterReplay(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	backends, err := hs.deadLetterBackends(req)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	data := make([]map[string]interface{}, 0, len(backends))
+	for _, be := range backends {
+		written, dead, err := be.ReplayDeadLetter()
+		stats := map[string]interface{}{
+			"name":    be.Name,
+			"written": written,
+			"dead":    dead,
+		}
+		if err != nil {
+			stats["error"] = err.Error()
+		}
+		log.Printf("dead letter of backend %s replayed: %d written, %d dead, error: %v, client: %s", be.Name, written, dead, err, req.RemoteAddr)
+		data = append(data, stats)
+	}
+	hs.Write(w, req, http.StatusOK, data)
+}
+
+// deadLetterBackends returns the backend specified by form value backend, or all backends if not specified.
+func (hs *HttpService) deadLetterBackends(req *http.Request) ([]*backend.Backend, error) {
+	if !hs.ip.Config().DeadLetterEnabled {
+		return nil, backend.ErrDeadLetterDisabled
+	}
+	name := req.FormValue("backend")
+	var backends []*backend.Backend
+	for _, circle := range hs.ip.Circles {
+		for _, be := range circle.Backends() {
+			if name == "" || be.Name == name {
+				backends = append(backends, be)
+			}
+		}
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("backend not found: %s", name)
+	}
+	return backends, nil
+}
+
 func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request) {
 	if !hs.checkMethodAndAuth(w, req, "POST") {
 		return
 	}
 
-	db, err := hs.queryDB(req, true)
+	db, err := hs.promReadDB(req)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
@@ -588,35 +1386,359 @@ func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request)
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-	if len(readReq.Queries) != 1 {
-		err = errors.New("prometheus read endpoint currently only supports one query at a time")
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+
+	// each query is resolved to its metrics
+	metrics := make([][]string, len(readReq.Queries))
+	for i, q := range readReq.Queries {
+		metrics[i], err = hs.promReadMetrics(db, q)
+		if err != nil {
+			log.Printf("prometheus read error: %s, query: %s %s %v, client: %s", err, req.Method, db, q, req.RemoteAddr)
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// the response of a single query of a single metric is streamed from its backend as is
+	if len(readReq.Queries) == 1 && len(metrics[0]) == 1 && !hs.ip.Config().NativePromRead {
+		q, metric := readReq.Queries[0], metrics[0][0]
+		sw := backend.NewStreamWriter(w)
+		err = hs.ip.ReadPromStream(sw, req, db, metric, prometheus.QueryWithMetric(q, metric))
+		if err != nil {
+			log.Printf("prometheus read error: %s, query: %s %s %v, client: %s", err, req.Method, db, q, req.RemoteAddr)
+			if !sw.Written() {
+				hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			}
+			return
+		}
+		if hs.queryTracing.Load() {
+			log.Printf("prometheus read: %s %s %v, client: %s", req.Method, db, readReq.Queries, req.RemoteAddr)
+		}
 		return
 	}
 
-	var metric string
-	q := readReq.Queries[0]
-	for _, m := range q.Matchers {
-		if m.Name == "__name__" {
-			metric = m.Value
+	// the metrics are read from their backends concurrently, each into its own slot so that
+	// the timeseries are returned in metric order
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, hs.ip.Config().ConnPoolSize)
+	results := make([][]*remote.QueryResult, len(readReq.Queries))
+	errs := make([][]error, len(readReq.Queries))
+	for i, q := range readReq.Queries {
+		results[i] = make([]*remote.QueryResult, len(metrics[i]))
+		errs[i] = make([]error, len(metrics[i]))
+		for j, metric := range metrics[i] {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i, j int, metric string, q *remote.Query) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				results[i][j], errs[i][j] = hs.ip.ReadProm(req, db, metric, prometheus.QueryWithMetric(q, metric))
+			}(i, j, metric, q)
 		}
 	}
-	if metric == "" {
-		log.Printf("prometheus query: %v", q)
-		err = errors.New("prometheus metric not found")
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+	wg.Wait()
+	readRsp := &remote.ReadResponse{Results: make([]*remote.QueryResult, len(readReq.Queries))}
+	for i := range readReq.Queries {
+		readRsp.Results[i] = &remote.QueryResult{}
+		for j, err := range errs[i] {
+			if err != nil {
+				log.Printf("prometheus read error: %s, query: %s %s %v, client: %s", err, req.Method, db, readReq.Queries[i], req.RemoteAddr)
+				hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+				return
+			}
+			readRsp.Results[i].Timeseries = append(readRsp.Results[i].Timeseries, results[i][j].Timeseries...)
+		}
+	}
+
+	sw := backend.NewStreamWriter(w)
+	if err = backend.WritePromReadResponse(sw, readRsp); err != nil {
+		if !sw.Written() {
+			hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	if hs.queryTracing.Load() {
+		log.Printf("prometheus read: %s %s %v, client: %s", req.Method, db, readReq.Queries, req.RemoteAddr)
+	}
+}
+
+// promReadMetrics returns the metrics matched by the query, the measurements are shown from all backends
+// if the query has no equality matcher of __name__.
+func (hs *HttpService) promReadMetrics(db string, q *remote.Query) ([]string, error) {
+	var names []string
+	if metric := prometheus.MetricName(q); metric != "" {
+		names = []string{metric}
+	} else {
+		var err error
+		names, err = hs.ip.ShowMeasurements(db, prometheus.MeasurementRegex(q))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return prometheus.MatchMetrics(q, names)
+}
+
+func (hs *HttpService) HandlerPromQuery(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+		return
 	}
 
-	req.Body = io.NopCloser(bytes.NewBuffer(compressed))
-	err = hs.ip.ReadProm(w, req, db, metric)
+	db, err := hs.promReadDB(req)
 	if err != nil {
-		log.Printf("prometheus read error: %s, query: %s %s %v, client: %s", err, req.Method, db, q, req.RemoteAddr)
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	expr, err := prometheus.ParseExpr(req.FormValue("query"))
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	ts, err := hs.promTime(req, "time", time.Now())
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
 		return
 	}
-	if hs.queryTracing {
-		log.Printf("prometheus read: %s %s %v, client: %s", req.Method, db, q, req.RemoteAddr)
+
+	querier := &promQuerier{hs: hs, db: db, rp: req.FormValue("rp")}
+	result, err := prometheus.Query(querier, expr, ts)
+	if err != nil {
+		log.Printf("prometheus query error: %s, query: %s %s %s, client: %s", err, req.Method, db, expr, req.RemoteAddr)
+		hs.writePromError(w, http.StatusUnprocessableEntity, promErrorExecution, err)
+		return
+	}
+	hs.writePromData(w, result)
+	if hs.queryTracing.Load() {
+		log.Printf("prometheus query: %s %s %s, client: %s", req.Method, db, expr, req.RemoteAddr)
+	}
+}
+
+func (hs *HttpService) HandlerPromQueryRange(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+		return
+	}
+
+	db, err := hs.promReadDB(req)
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	expr, err := prometheus.ParseExpr(req.FormValue("query"))
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	start, err := hs.promTime(req, "start", time.Time{})
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	end, err := hs.promTime(req, "end", time.Time{})
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	step, err := prometheus.ParseDuration(req.FormValue("step"))
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	if err = prometheus.CheckRange(expr, start, end, step); err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+
+	querier := &promQuerier{hs: hs, db: db, rp: req.FormValue("rp")}
+	result, err := prometheus.QueryRange(querier, expr, start, end, step)
+	if err != nil {
+		log.Printf("prometheus query range error: %s, query: %s %s %s, client: %s", err, req.Method, db, expr, req.RemoteAddr)
+		hs.writePromError(w, http.StatusUnprocessableEntity, promErrorExecution, err)
+		return
+	}
+	hs.writePromData(w, result)
+	if hs.queryTracing.Load() {
+		log.Printf("prometheus query range: %s %s %s, client: %s", req.Method, db, expr, req.RemoteAddr)
+	}
+}
+
+func (hs *HttpService) HandlerPromSeries(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+		return
+	}
+
+	db, err := hs.promReadDB(req)
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	if len(req.Form["match[]"]) == 0 {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, ErrNoMatchParam)
+		return
+	}
+	series, err := hs.promSeries(req, db)
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
 	}
+	hs.writePromData(w, series)
+}
+
+func (hs *HttpService) HandlerPromLabels(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+		return
+	}
+
+	db, err := hs.promReadDB(req)
+	if err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+		return
+	}
+
+	set := util.NewSet("__name__")
+	if len(req.Form["match[]"]) == 0 {
+		keys, err := hs.ip.ShowTagKeys(db)
+		if err != nil {
+			hs.writePromError(w, http.StatusUnprocessableEntity, promErrorExecution, err)
+			return
+		}
+		for _, key := range keys {
+			set.Add(key)
+		}
+	} else {
+		series, err := hs.promSeries(req, db)
+		if err != nil {
+			hs.writePromError(w, http.StatusBadRequest, promErrorBadData, err)
+			return
+		}
+		for _, s := range series {
+			for name := range s {
+				set.Add(name)
+			}
+		}
+	}
+	labels := make([]string, 0, len(set))
+	for name := range set {
+		labels = append(labels, name)
+	}
+	sort.Strings(labels)
+	hs.writePromData(w, labels)
+}
+
+// promSeries returns the label sets of the distinct time series matched by the selectors of match[] in the time range.
+func (hs *HttpService) promSeries(req *http.Request, db string) ([]map[string]string, error) {
+	start, err := hs.promTime(req, "start", time.Unix(0, 0))
+	if err != nil {
+		return nil, err
+	}
+	end, err := hs.promTime(req, "end", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	querier := &promQuerier{hs: hs, db: db, rp: req.FormValue("rp"), last: true}
+	series := make([]map[string]string, 0)
+	keys := util.NewSet()
+	for _, match := range req.Form["match[]"] {
+		expr, err := prometheus.ParseExpr(match)
+		if err != nil {
+			return nil, err
+		}
+		vs, ok := expr.(*prometheus.VectorSelector)
+		if !ok || vs.Range > 0 {
+			return nil, fmt.Errorf("invalid match[] parameter %q, must be an instant vector selector", match)
+		}
+		tss, err := querier.Select(&remote.Query{StartTimestampMs: start.UnixMilli(), EndTimestampMs: end.UnixMilli(), Matchers: vs.Matchers})
+		if err != nil {
+			return nil, err
+		}
+		for _, ts := range tss {
+			var sb strings.Builder
+			metric := make(map[string]string, len(ts.Labels))
+			for _, l := range ts.Labels {
+				metric[l.Name] = l.Value
+				sb.WriteString(l.Name + "\xff" + l.Value + "\xff")
+			}
+			if key := sb.String(); !keys[key] {
+				keys.Add(key)
+				series = append(series, metric)
+			}
+		}
+	}
+	return series, nil
+}
+
+func (hs *HttpService) promTime(req *http.Request, key string, defaultTime time.Time) (time.Time, error) {
+	value := req.FormValue(key)
+	if value == "" {
+		if defaultTime.IsZero() {
+			return defaultTime, fmt.Errorf("invalid parameter %q: missing", key)
+		}
+		return defaultTime, nil
+	}
+	t, err := prometheus.ParseTime(value)
+	if err != nil {
+		return t, fmt.Errorf("invalid parameter %q: %w", key, err)
+	}
+	return t, nil
+}
+
+func (hs *HttpService) writePromData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(util.MarshalJSON(map[string]interface{}{"status": "success", "data": data}, false))
+}
+
+func (hs *HttpService) writePromError(w http.ResponseWriter, status int, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(util.MarshalJSON(map[string]interface{}{"status": "error", "errorType": errorType, "error": err.Error()}, false))
+}
+
+// promQuerier selects the time series of prometheus by influxql from the backends of the metrics matched.
+type promQuerier struct {
+	hs   *HttpService
+	db   string
+	rp   string
+	last bool
+}
+
+func (pq *promQuerier) Select(q *remote.Query) ([]*remote.TimeSeries, error) {
+	metrics, err := pq.hs.promReadMetrics(pq.db, q)
+	if err != nil {
+		return nil, err
+	}
+	var tss []*remote.TimeSeries
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var qerr error
+	sem := make(chan struct{}, pq.hs.ip.Config().ConnPoolSize)
+	for _, metric := range metrics {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(metric string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			qr, err := pq.hs.ip.QueryProm(pq.db, pq.rp, metric, prometheus.QueryWithMetric(q, metric), pq.last)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				qerr = err
+				return
+			}
+			tss = append(tss, qr.Timeseries...)
+		}(metric)
+	}
+	wg.Wait()
+	return tss, qerr
 }
 
 func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request) {
@@ -630,6 +1752,11 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 		return
 	}
 	rp := req.URL.Query().Get("rp")
+	opts, err := hs.promWriteOptions(req, db)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	body := req.Body
 	var bs []byte
@@ -642,7 +1769,7 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 
 	_, err = buf.ReadFrom(body)
 	if err != nil {
-		if hs.writeTracing {
+		if hs.writeTracing.Load() {
 			log.Printf("prom write handler unable to read bytes from request body")
 		}
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
@@ -651,7 +1778,7 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 
 	reqBuf, err := snappy.Decode(nil, buf.Bytes())
 	if err != nil {
-		if hs.writeTracing {
+		if hs.writeTracing.Load() {
 			log.Printf("prom write handler unable to snappy decode from request body, error: %s", err)
 		}
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
@@ -661,16 +1788,16 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 	// Convert the Prometheus remote write request to Influx Points
 	var writeReq remote.WriteRequest
 	if err = proto.Unmarshal(reqBuf, &writeReq); err != nil {
-		if hs.writeTracing {
+		if hs.writeTracing.Load() {
 			log.Printf("prom write handler unable to unmarshal from snappy decoded bytes, error: %s", err)
 		}
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	points, err := prometheus.WriteRequestToPoints(&writeReq)
+	points, err := prometheus.WriteRequestToPointsWithOptions(&writeReq, opts)
 	if err != nil {
-		if hs.writeTracing {
+		if hs.writeTracing.Load() {
 			log.Printf("prom write handler, error: %s", err)
 		}
 		// Check if the error was from something other than dropping invalid values.
@@ -682,16 +1809,275 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 
 	// Write points.
 	err = hs.ip.WritePoints(points, db, rp)
-	if err == nil {
+	if err != nil {
+		hs.writeWriteError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// promWriteConfig returns the prometheus remote write config of db, or the config of all databases if db is not configured.
+func (hs *HttpService) promWriteConfig(db string) *backend.PromWriteConfig {
+	var pwcfg *backend.PromWriteConfig
+	for _, pw := range hs.ip.Config().PromWrite {
+		if pw.Database == db {
+			return pw
+		}
+		if pw.Database == "" {
+			pwcfg = pw
+		}
+	}
+	return pwcfg
+}
+
+// promReadDB returns the database of prometheus read and query, which only understand the layout of metric_version 1,
+// so the database written with metric_version 2 is rejected.
+func (hs *HttpService) promReadDB(req *http.Request) (string, error) {
+	db, err := hs.queryDB(req, true)
+	if err != nil {
+		return "", err
+	}
+	if pwcfg := hs.promWriteConfig(db); pwcfg != nil && pwcfg.MetricVersion == 2 {
+		return "", ErrPromReadV2
+	}
+	return db, nil
+}
+
+// promWriteOptions returns the schema options of prometheus remote write for db, the options of db or
+// all databases in config are overridden by the query parameters metric_version, keep_stale and metadata.
+func (hs *HttpService) promWriteOptions(req *http.Request, db string) (*prometheus.WriteOptions, error) {
+	opts := &prometheus.WriteOptions{MetricVersion: 1}
+	if pwcfg := hs.promWriteConfig(db); pwcfg != nil {
+		opts.MetricVersion, opts.KeepStale, opts.Metadata = pwcfg.MetricVersion, pwcfg.KeepStale, pwcfg.Metadata
+	}
+
+	q := req.URL.Query()
+	var err error
+	if v := q.Get("metric_version"); v != "" {
+		if opts.MetricVersion, err = strconv.Atoi(v); err != nil || (opts.MetricVersion != 1 && opts.MetricVersion != 2) {
+			return nil, backend.ErrInvalidMetricVersion
+		}
+	}
+	if v := q.Get("keep_stale"); v != "" {
+		if opts.KeepStale, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid keep_stale: %s", v)
+		}
+	}
+	if v := q.Get("metadata"); v != "" {
+		if opts.Metadata, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid metadata: %s", v)
+		}
+	}
+	return opts, nil
+}
+
+func (hs *HttpService) HandlerOpenTSDBPut(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		hs.writeOpenTSDB(w, req, http.StatusMethodNotAllowed, opentsdb.NewErrorResponse(http.StatusMethodNotAllowed, "Method not allowed", fmt.Sprintf("The HTTP method [%s] is not permitted for this endpoint", req.Method)))
+		return
+	}
+	if !hs.checkAuth(w, req) {
+		return
+	}
+	cfg := hs.ip.Config()
+	if cfg.OpenTSDB == nil || cfg.OpenTSDB.Database == "" {
+		hs.writeOpenTSDB(w, req, http.StatusNotFound, opentsdb.NewErrorResponse(http.StatusNotFound, "Endpoint not found", "opentsdb database is not configured"))
+		return
+	}
+
+	body := req.Body
+	if cfg.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, body, int64(cfg.MaxBodySize))
+	}
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		b, err := gzip.NewReader(body)
+		if err != nil {
+			hs.writeOpenTSDB(w, req, http.StatusBadRequest, opentsdb.NewErrorResponse(http.StatusBadRequest, "Unable to decompress the request body", err.Error()))
+			return
+		}
+		defer b.Close()
+		body = b
+		if cfg.MaxDecompressSize > 0 {
+			body = http.MaxBytesReader(w, body, int64(cfg.MaxDecompressSize))
+		}
+	}
+	dps, err := opentsdb.ReadDataPoints(body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			hs.writeOpenTSDB(w, req, http.StatusRequestEntityTooLarge, opentsdb.NewErrorResponse(http.StatusRequestEntityTooLarge, "Request Entity Too Large", err.Error()))
+		} else {
+			hs.writeOpenTSDB(w, req, http.StatusBadRequest, opentsdb.NewErrorResponse(http.StatusBadRequest, "Unable to parse the given JSON", err.Error()))
+		}
+		return
+	}
+
+	result := opentsdb.Put(hs.ip, dps, cfg.OpenTSDB.Database, cfg.OpenTSDB.RetentionPolicy)
+	if hs.writeTracing.Load() {
+		log.Printf("opentsdb put, db: %s, rp: %s, success: %d, failed: %d, client: %s", cfg.OpenTSDB.Database, cfg.OpenTSDB.RetentionPolicy, result.Success, result.Failed, req.RemoteAddr)
+	}
+	status := http.StatusOK
+	if result.Failed > 0 {
+		status = http.StatusBadRequest
+	}
+	q := req.URL.Query()
+	if _, ok := q["details"]; ok {
+		if result.Errors == nil {
+			result.Errors = []*opentsdb.PutError{}
+		}
+		hs.writeOpenTSDB(w, req, status, result)
+	} else if _, ok := q["summary"]; ok {
+		result.Errors = nil
+		hs.writeOpenTSDB(w, req, status, result)
+	} else if result.Failed > 0 {
+		hs.writeOpenTSDB(w, req, status, opentsdb.NewErrorResponse(status, "One or more data points had errors", "Please see the TSD logs or append \"details\" to the put request"))
+	} else {
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
+func (hs *HttpService) writeOpenTSDB(w http.ResponseWriter, req *http.Request, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	pretty := req.URL.Query().Get("pretty") == "true"
+	w.Write(util.MarshalJSON(data, pretty))
+}
+
+func (hs *HttpService) HandlerOTLPMetrics(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mt != "application/x-protobuf" && mt != "application/json" {
+		hs.WriteError(w, req, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type: %s", req.Header.Get("Content-Type")))
+		return
+	}
+	protobuf := mt == "application/x-protobuf"
+
+	cfg := hs.ip.Config()
+	q := req.URL.Query()
+	db, rp := q.Get("db"), q.Get("rp")
+	if cfg.OTLP != nil {
+		if db == "" {
+			db = cfg.OTLP.Database
+		}
+		if rp == "" {
+			rp = cfg.OTLP.RetentionPolicy
+		}
+	}
+	if db == "" {
+		hs.writeOTLPStatus(w, protobuf, http.StatusBadRequest, "database not found")
+		return
+	}
+	if hs.ip.IsForbiddenDB(db) {
+		hs.writeOTLPStatus(w, protobuf, http.StatusBadRequest, fmt.Sprintf("database forbidden: %s", db))
+		return
+	}
+
+	body := req.Body
+	if cfg.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, body, int64(cfg.MaxBodySize))
+	}
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		b, err := gzip.NewReader(body)
+		if err != nil {
+			hs.writeOTLPStatus(w, protobuf, http.StatusBadRequest, "unable to decode gzip body")
+			return
+		}
+		defer b.Close()
+		body = b
+		if cfg.MaxDecompressSize > 0 {
+			body = http.MaxBytesReader(w, body, int64(cfg.MaxDecompressSize))
+		}
+	}
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			hs.writeOTLPStatus(w, protobuf, http.StatusRequestEntityTooLarge, err.Error())
+		} else {
+			hs.writeOTLPStatus(w, protobuf, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	var metricsReq *prometheus.OTLPMetricsRequest
+	if protobuf {
+		metricsReq, err = prometheus.UnmarshalOTLPMetrics(buf)
+	} else {
+		metricsReq, err = prometheus.UnmarshalOTLPMetricsJSON(buf)
+	}
+	if err != nil {
+		if hs.writeTracing.Load() {
+			log.Printf("otlp metrics handler unable to unmarshal request body, error: %s", err)
+		}
+		hs.writeOTLPStatus(w, protobuf, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	points, err := prometheus.OTLPMetricsToPoints(metricsReq)
+	var perr *prometheus.OTLPPartialError
+	if err != nil && !errors.As(err, &perr) {
+		hs.writeOTLPStatus(w, protobuf, http.StatusBadRequest, err.Error())
+		return
+	}
+	if perr != nil && hs.writeTracing.Load() {
+		log.Printf("otlp metrics handler, error: %s", perr)
+	}
+	if len(points) > 0 {
+		if err = hs.ip.WritePoints(points, db, rp); err != nil {
+			hs.writeOTLPStatus(w, protobuf, hs.writeErrorStatus(w, err), err.Error())
+			return
+		}
+	}
+
+	// the response is an ExportMetricsServiceResponse with partial success if some data points are rejected
+	if protobuf {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		if perr != nil {
+			w.Write(prometheus.MarshalOTLPPartialSuccess(perr.Rejected, perr.Message))
+		}
+		return
+	}
+	rsp := map[string]interface{}{}
+	if perr != nil {
+		rsp["partialSuccess"] = map[string]interface{}{
+			"rejectedDataPoints": strconv.FormatInt(perr.Rejected, 10),
+			"errorMessage":       perr.Message,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(util.MarshalJSON(rsp, false))
+}
+
+// writeOTLPStatus writes the error response of otlp with a google.rpc.Status in protobuf or json.
+func (hs *HttpService) writeOTLPStatus(w http.ResponseWriter, protobuf bool, status int, message string) {
+	code := int32(3) // INVALID_ARGUMENT
+	switch status {
+	case http.StatusTooManyRequests:
+		code = 8 // RESOURCE_EXHAUSTED
+	case http.StatusServiceUnavailable:
+		code = 14 // UNAVAILABLE
+	case http.StatusInternalServerError:
+		code = 13 // INTERNAL
+	}
+	if protobuf {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(status)
+		w.Write(prometheus.MarshalOTLPStatus(code, message))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(util.MarshalJSON(map[string]interface{}{"code": code, "message": message}, false))
+}
+
 func (hs *HttpService) HandlerMetrics(w http.ResponseWriter, req *http.Request) {
-	if hs.isAuthEnabled() && hs.pingAuthEnabled && !hs.checkAuth(w, req) {
+	if hs.isAuthEnabled() && hs.pingAuthEnabled.Load() && !hs.checkAuth(w, req) {
 		return
 	}
-	promhttp.Handler().ServeHTTP(w, req)
+	promhttp.HandlerFor(promclient.Gatherers{promclient.DefaultGatherer, hs.registry}, promhttp.HandlerOpts{}).ServeHTTP(w, req)
 }
 
 func (hs *HttpService) Write(w http.ResponseWriter, req *http.Request, status int, data interface{}) {
@@ -771,10 +2157,14 @@ func (hs *HttpService) parseAuth(req *http.Request) (string, string, bool) {
 }
 
 func (hs *HttpService) isAuthEnabled() bool {
+	hs.lock.RLock()
+	defer hs.lock.RUnlock()
 	return hs.username != "" || hs.password != ""
 }
 
 func (hs *HttpService) compareAuth(u, p string) bool {
+	hs.lock.RLock()
+	defer hs.lock.RUnlock()
 	return hs.transAuth(u) == hs.username && hs.transAuth(p) == hs.password
 }
 
@@ -0,0 +1,337 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+	"github.com/chengshiwen/influx-proxy/transfer"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+)
+
+// newTestService creates a service with one circle whose backend is served by handler,
+// the settings are merged into the config, and the requests are served by the returned server.
+func newTestService(t *testing.T, handler http.HandlerFunc, settings map[string]interface{}) (*HttpService, *httptest.Server) {
+	influx := httptest.NewServer(handler)
+	t.Cleanup(influx.Close)
+	dir := t.TempDir()
+	cfg := map[string]interface{}{
+		"circles":  []interface{}{map[string]interface{}{"name": "circle-1", "backends": []interface{}{map[string]interface{}{"name": "influxdb-1-1", "url": influx.URL}}}},
+		"data_dir": filepath.Join(dir, "data"),
+	}
+	for k, v := range settings {
+		cfg[k] = v
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "proxy.json")
+	if err = os.WriteFile(file, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pxcfg, err := backend.NewFileConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := NewHttpService(pxcfg)
+	mux := NewServeMux()
+	hs.Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		server.Close()
+		hs.Shutdown(context.Background())
+	})
+	return hs, server
+}
+
+func TestHttpServiceMetrics(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	// the collectors must not be registered twice in the same registry
+	newTestService(t, ok, nil)
+	_, server := newTestService(t, ok, nil)
+	rsp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	b, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"influx_proxy_query_cache_entries", "influx_proxy_opentsdb_points_received_total", "go_goroutines"} {
+		if !strings.Contains(string(b), name) {
+			t.Errorf("got metrics without %s", name)
+		}
+	}
+}
+
+func TestHttpServicePromReadMetricVersion2(t *testing.T) {
+	_, server := newTestService(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, map[string]interface{}{"prom_write": []interface{}{map[string]interface{}{"database": "prom2", "metric_version": 2}}})
+	for _, path := range []string{"/api/v1/query?db=prom2&query=up", "/api/v1/labels?db=prom2", "/api/v1/prom/read?db=prom2"} {
+		method := http.MethodGet
+		if strings.HasPrefix(path, "/api/v1/prom/read") {
+			method = http.MethodPost
+		}
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), ErrPromReadV2.Error()) {
+			t.Errorf("%s: got %d %s, want 400 %s", path, rsp.StatusCode, b, ErrPromReadV2)
+		}
+	}
+}
+
+func TestHttpServicePromReadOrder(t *testing.T) {
+	// the first metric is answered last, the response must still be in metric order
+	metrics := []string{"cpu", "disk", "mem"}
+	_, server := newTestService(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"],["mem"]]}]}]}`)
+			return
+		}
+		compressed, _ := io.ReadAll(req.Body)
+		buf, _ := snappy.Decode(nil, compressed)
+		var readReq remote.ReadRequest
+		if err := proto.Unmarshal(buf, &readReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name := readReq.Queries[0].Matchers[0].Value
+		if name == metrics[0] {
+			time.Sleep(100 * time.Millisecond)
+		}
+		backend.WritePromReadResponse(w, &remote.ReadResponse{Results: []*remote.QueryResult{{
+			Timeseries: []*remote.TimeSeries{{Labels: []*remote.LabelPair{{Name: "__name__", Value: name}}}},
+		}}})
+	}, nil)
+
+	data, err := proto.Marshal(&remote.ReadRequest{Queries: []*remote.Query{{
+		Matchers: []*remote.LabelMatcher{{Type: remote.MatchType_REGEX_MATCH, Name: "__name__", Value: ".+"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.Post(server.URL+"/api/v1/prom/read?db=prom", "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	compressed, _ := io.ReadAll(rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d %s, want 200", rsp.StatusCode, compressed)
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readRsp remote.ReadResponse
+	if err = proto.Unmarshal(buf, &readRsp); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ts := range readRsp.Results[0].Timeseries {
+		got = append(got, ts.Labels[0].Value)
+	}
+	if strings.Join(got, ",") != strings.Join(metrics, ",") {
+		t.Errorf("got metrics %v, want %v", got, metrics)
+	}
+}
+
+func TestHttpServiceWriteCSV(t *testing.T) {
+	_, server := newTestService(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, map[string]interface{}{"cardinality_measurement_limit": 1})
+	tests := []struct {
+		name   string
+		csv    string
+		status int
+		errs   []string
+	}{
+		{
+			name:   "valid",
+			csv:    "#datatype measurement,tag,string,long\nm,host,msg,v\ncpu,a,\"multiple\nlines\",1\ncpu,a,,2\n",
+			status: http.StatusNoContent,
+		},
+		{
+			// the string field with newline spans two lines of line protocol
+			name:   "partial",
+			csv:    "#datatype measurement,tag,string,long\nm,host,msg,v\ncpu,a,\"multiple\nlines\",1\ncpu,a,x,bad\ncpu,b,x,2\ncpu,a,\"more\nlines\",3\ncpu,c,x,4\n",
+			status: http.StatusBadRequest,
+			errs:   []string{"line 5: ", "line 6: max series per measurement limit exceeded", "line 9: max series per measurement limit exceeded", "dropped=3"},
+		},
+	}
+	for _, tt := range tests {
+		rsp, err := http.Post(server.URL+"/write?db=db1", "text/csv", strings.NewReader(tt.csv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != tt.status {
+			t.Errorf("%v: got %d %s, want %d", tt.name, rsp.StatusCode, b, tt.status)
+			continue
+		}
+		for _, e := range tt.errs {
+			if !strings.Contains(string(b), e) {
+				t.Errorf("%v: got %s, want %q", tt.name, b, e)
+			}
+		}
+	}
+}
+
+func TestHttpServiceShardedByTags(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	_, server := newTestService(t, ok, map[string]interface{}{"shard_key": "%db,%mm,%tag(host)"})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		want   string
+	}{
+		{name: "replica", method: "GET", path: "/replica?db=db1&mm=cpu&tags=host%3Da,region%3Deast", status: http.StatusOK, want: "influxdb-1-1"},
+		{name: "invalid tags", method: "GET", path: "/replica?db=db1&mm=cpu&tags=host", status: http.StatusBadRequest, want: "invalid tags"},
+		{name: "rebalance", method: "POST", path: "/rebalance?circle_id=0&operation=add", status: http.StatusBadRequest, want: ErrShardedByTags.Error()},
+		{name: "recovery", method: "POST", path: "/recovery?from_circle_id=0&to_circle_id=1", status: http.StatusBadRequest, want: ErrShardedByTags.Error()},
+		{name: "resync", method: "POST", path: "/resync", status: http.StatusBadRequest, want: ErrShardedByTags.Error()},
+		{name: "cleanup", method: "POST", path: "/cleanup?circle_id=0", status: http.StatusBadRequest, want: ErrShardedByTags.Error()},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != tt.status || !strings.Contains(string(b), tt.want) {
+			t.Errorf("%v: got %d %s, want %d %s", tt.name, rsp.StatusCode, b, tt.status, tt.want)
+		}
+	}
+}
+
+func TestHttpServiceReload(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	hs, server := newTestService(t, ok, map[string]interface{}{"query_tracing": true})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := hs.Reload(); err != nil {
+				t.Errorf("concurrent reload: got %v, want nil", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			rsp, err := http.Get(server.URL + "/query?q=show+databases")
+			if err == nil {
+				rsp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := hs.tx.Reserve(0); err != nil {
+		t.Fatalf("reserve: got %v, want nil", err)
+	}
+	if err := hs.Reload(); !errors.Is(err, transfer.ErrTransferring) {
+		t.Errorf("reload while transferring: got %v, want %v", err, transfer.ErrTransferring)
+	}
+	rsp, err := http.Post(server.URL+"/cleanup?circle_id=0", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), "circle 0 is transferring") {
+		t.Errorf("cleanup while transferring: got %d %s, want %d circle 0 is transferring", rsp.StatusCode, b, http.StatusBadRequest)
+	}
+	hs.tx.SetTransferring(hs.tx.CircleStates[0], false)
+	if err := hs.Reload(); err != nil {
+		t.Errorf("reload after transfer: got %v, want nil", err)
+	}
+}
+
+func TestV2BucketStmts(t *testing.T) {
+	tests := []struct {
+		name  string
+		db    string
+		rp    string
+		rules []*v2RetentionRule
+		want  []string
+	}{
+		{
+			name: "database without rule",
+			db:   "db1",
+			want: []string{`create database "db1" with duration INF replication 1`},
+		},
+		{
+			name:  "database with rule",
+			db:    "db1",
+			rules: []*v2RetentionRule{{Type: "expire", EverySeconds: 86400, ShardGroupDurationSeconds: 3600}},
+			want:  []string{`create database "db1" with duration 86400s replication 1 shard duration 3600s`},
+		},
+		{
+			name: "retention policy without rule",
+			db:   "db1",
+			rp:   "rp1",
+			want: []string{`create database "db1"`, `create retention policy "rp1" on "db1" duration INF replication 1`},
+		},
+		{
+			name:  "retention policy with shard duration only",
+			db:    "db1",
+			rp:    "rp1",
+			rules: []*v2RetentionRule{{ShardGroupDurationSeconds: 3600}},
+			want:  []string{`create database "db1"`, `create retention policy "rp1" on "db1" duration INF replication 1 shard duration 3600s`},
+		},
+		{
+			name:  "retention policy with rule",
+			db:    "db1",
+			rp:    "rp1",
+			rules: []*v2RetentionRule{{Type: "expire", EverySeconds: 604800, ShardGroupDurationSeconds: 86400}},
+			want:  []string{`create database "db1"`, `create retention policy "rp1" on "db1" duration 604800s replication 1 shard duration 86400s`},
+		},
+	}
+	for _, tt := range tests {
+		got := v2BucketStmts(tt.db, tt.rp, tt.rules)
+		if strings.Join(got, ";") != strings.Join(tt.want, ";") {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+// fieldName is the field which opentsdb values get written to
+const fieldName = "value"
+
+var (
+	ErrMissingMetric    = errors.New("metric name was empty")
+	ErrMissingTimestamp = errors.New("missing timestamp")
+	ErrMissingValue     = errors.New("missing value")
+)
+
+// DataPoint is a data point of opentsdb, the timestamp and value are json.Number or string.
+type DataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp interface{}       `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// Point converts the data point into a point with the metric as measurement and the value in field value.
+// The timestamp is in seconds, or in milliseconds if it has 13 digits.
+func (dp *DataPoint) Point() (models.Point, error) {
+	if dp.Metric == "" {
+		return nil, ErrMissingMetric
+	}
+	if dp.Timestamp == nil {
+		return nil, ErrMissingTimestamp
+	}
+	ts, err := strconv.ParseInt(fmt.Sprint(dp.Timestamp), 10, 64)
+	if err != nil || ts <= 0 || ts > 9999999999999 {
+		return nil, fmt.Errorf("invalid timestamp: %v", dp.Timestamp)
+	}
+	if dp.Value == nil {
+		return nil, ErrMissingValue
+	}
+	value, err := strconv.ParseFloat(fmt.Sprint(dp.Value), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("unable to parse value to a number: %v", dp.Value)
+	}
+	for k, v := range dp.Tags {
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("invalid tag: %s=%s", k, v)
+		}
+	}
+	var t time.Time
+	if ts > 9999999999 {
+		t = time.Unix(0, ts*int64(time.Millisecond))
+	} else {
+		t = time.Unix(ts, 0)
+	}
+	return models.NewPoint(dp.Metric, models.NewTags(dp.Tags), models.Fields{fieldName: value}, t)
+}
+
+// ParsePut parses the arguments of telnet put command with format <metric> <timestamp> <value> <tagk1=tagv1 ...>.
+func ParsePut(args []string) (*DataPoint, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("not enough arguments (need least 3, got %d)", len(args))
+	}
+	dp := &DataPoint{Metric: args[0], Timestamp: args[1], Value: args[2], Tags: make(map[string]string, len(args)-3)}
+	for _, tag := range args[3:] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid tag: %s", tag)
+		}
+		dp.Tags[k] = v
+	}
+	return dp, nil
+}
+
+// ReadDataPoints decodes a single data point or an array of data points in json.
+func ReadDataPoints(r io.Reader) ([]*DataPoint, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSpace(body)
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var dps []*DataPoint
+	if len(body) > 0 && body[0] == '[' {
+		err = dec.Decode(&dps)
+	} else {
+		dp := &DataPoint{}
+		err = dec.Decode(dp)
+		dps = append(dps, dp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dps, nil
+}
+
+// PutError is the error of a data point in the response of /api/put with details.
+type PutError struct {
+	DataPoint *DataPoint `json:"datapoint"`
+	Error     string     `json:"error"`
+}
+
+// PutResult is the response of /api/put with summary or details.
+type PutResult struct {
+	Success int         `json:"success"`
+	Failed  int         `json:"failed"`
+	Errors  []*PutError `json:"errors,omitempty"`
+}
+
+// ErrorResponse is the error response of opentsdb http api.
+type ErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Details string `json:"details,omitempty"`
+	} `json:"error"`
+}
+
+func NewErrorResponse(code int, message, details string) *ErrorResponse {
+	rsp := &ErrorResponse{}
+	rsp.Error.Code = code
+	rsp.Error.Message = message
+	rsp.Error.Details = details
+	return rsp
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opentsdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePut(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+		err  string
+	}{
+		{
+			name: "seconds",
+			line: "sys.cpu.user 1700000000 42.5 host=web01 cpu=0",
+			want: "sys.cpu.user,cpu=0,host=web01 value=42.5 1700000000000000000",
+		},
+		{
+			name: "milliseconds",
+			line: "sys.cpu.user 1700000000123 42 host=web01",
+			want: "sys.cpu.user,host=web01 value=42 1700000000123000000",
+		},
+		{
+			name: "no tags",
+			line: "sys.cpu.user 1700000000 1",
+			want: "sys.cpu.user value=1 1700000000000000000",
+		},
+		{
+			name: "not enough arguments",
+			line: "sys.cpu.user 1700000000",
+			err:  "not enough arguments (need least 3, got 2)",
+		},
+		{
+			name: "invalid tag",
+			line: "sys.cpu.user 1700000000 1 host",
+			err:  "invalid tag: host",
+		},
+		{
+			name: "invalid timestamp",
+			line: "sys.cpu.user 17000000001234 1 host=web01",
+			err:  "invalid timestamp: 17000000001234",
+		},
+		{
+			name: "invalid value",
+			line: "sys.cpu.user 1700000000 abc host=web01",
+			err:  "unable to parse value to a number: abc",
+		},
+	}
+	for _, tt := range tests {
+		dp, err := ParsePut(strings.Fields(tt.line))
+		if err == nil {
+			point, perr := dp.Point()
+			if perr == nil {
+				if got := point.String(); got != tt.want {
+					t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+				}
+			}
+			err = perr
+		}
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%v: got error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReadDataPoints(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+		errs []string
+		err  bool
+	}{
+		{
+			name: "single",
+			body: `{"metric":"sys.cpu.nice","timestamp":1700000000,"value":18,"tags":{"host":"web01","dc":"lga"}}`,
+			want: []string{"sys.cpu.nice,dc=lga,host=web01 value=18 1700000000000000000"},
+			errs: []string{""},
+		},
+		{
+			name: "array",
+			body: ` [{"metric":"sys.cpu.nice","timestamp":1700000000123,"value":"9.5","tags":{"host":"web01"}},{"metric":"","timestamp":1700000000,"value":1},{"metric":"sys.cpu.nice","value":1}]`,
+			want: []string{"sys.cpu.nice,host=web01 value=9.5 1700000000123000000", "", ""},
+			errs: []string{"", "metric name was empty", "missing timestamp"},
+		},
+		{
+			name: "invalid json",
+			body: `{"metric":`,
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		dps, err := ReadDataPoints(strings.NewReader(tt.body))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: got nil error", tt.name)
+			}
+			continue
+		}
+		if err != nil || len(dps) != len(tt.want) {
+			t.Errorf("%v: got %d data points, error %v, want %d", tt.name, len(dps), err, len(tt.want))
+			continue
+		}
+		for i, dp := range dps {
+			point, err := dp.Point()
+			if tt.errs[i] != "" {
+				if err == nil || err.Error() != tt.errs[i] {
+					t.Errorf("%v: got error %v, want %s", tt.name, err, tt.errs[i])
+				}
+				continue
+			}
+			if err != nil || point.String() != tt.want[i] {
+				t.Errorf("%v: got %v, error %v, want %s", tt.name, point, err, tt.want[i])
+			}
+		}
+	}
+}
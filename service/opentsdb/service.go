@@ -0,0 +1,202 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opentsdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pointsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "influx_proxy_opentsdb_points_received_total",
+		Help: "Number of points received by opentsdb telnet listener and /api/put.",
+	})
+	pointsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "influx_proxy_opentsdb_points_dropped_total",
+		Help: "Number of points dropped by opentsdb telnet listener and /api/put due to parse or write errors.",
+	})
+)
+
+// Collectors returns the metrics of opentsdb listener and /api/put, which are registered by the http service.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{pointsReceived, pointsDropped}
+}
+
+// PointsWriter writes the points to database db and retention policy rp.
+type PointsWriter interface {
+	WritePoints(points []models.Point, db, rp string) error
+	IsForbiddenDB(db string) bool
+}
+
+// Service receives the put commands of opentsdb telnet protocol and writes the points to the fixed db and rp.
+type Service struct {
+	cfg     *backend.OpenTSDBConfig
+	w       PointsWriter
+	ln      net.Listener
+	lock    sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func NewService(cfg *backend.OpenTSDBConfig, w PointsWriter) *Service {
+	return &Service{cfg: cfg, w: w, conns: make(map[net.Conn]struct{})}
+}
+
+func (s *Service) Open() (err error) {
+	s.ln, err = net.Listen("tcp", s.cfg.BindAddr)
+	if err != nil {
+		return
+	}
+	log.Printf("opentsdb service start, listen on %s, db: %s, rp: %s", s.cfg.BindAddr, s.cfg.Database, s.cfg.RetentionPolicy)
+	s.wg.Add(1)
+	go s.serve()
+	return
+}
+
+// Close stops the listener and closes the connections.
+func (s *Service) Close() {
+	s.ln.Close()
+	s.lock.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Service) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("opentsdb accept error: %s, bind_addr: %s", err, s.cfg.BindAddr)
+			continue
+		}
+		s.lock.Lock()
+		if s.closing {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// handleConn executes the telnet commands until the connection is closed or exit is received,
+// only the errors are responded to put command like opentsdb.
+func (s *Service) handleConn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		var rsp string
+		switch args[0] {
+		case "put":
+			if err := s.put(args[1:]); err != nil {
+				rsp = fmt.Sprintf("put: %s\n", err)
+			}
+		case "version":
+			rsp = fmt.Sprintf("influx-proxy version %s, opentsdb compatible\n", backend.Version)
+		case "exit":
+			return
+		default:
+			rsp = fmt.Sprintf("unknown command: %s.  Try `help'.\n", args[0])
+		}
+		if rsp != "" {
+			if _, err := conn.Write([]byte(rsp)); err != nil {
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("opentsdb read error: %s, bind_addr: %s, remote_addr: %s", err, s.cfg.BindAddr, conn.RemoteAddr())
+	}
+}
+
+func (s *Service) put(args []string) error {
+	pointsReceived.Inc()
+	dp, err := ParsePut(args)
+	if err == nil {
+		var point models.Point
+		if point, err = dp.Point(); err == nil {
+			return writePoints(s.w, []models.Point{point}, s.cfg.Database, s.cfg.RetentionPolicy)
+		}
+	}
+	pointsDropped.Inc()
+	return fmt.Errorf("illegal argument: %w", err)
+}
+
+// writePoints writes the points received by telnet or http to db and rp, the points are counted as dropped on error.
+func writePoints(w PointsWriter, points []models.Point, db, rp string) error {
+	if len(points) == 0 {
+		return nil
+	}
+	var err error
+	if w.IsForbiddenDB(db) {
+		err = fmt.Errorf("database forbidden: %s", db)
+	} else {
+		err = w.WritePoints(points, db, rp)
+	}
+	if err != nil {
+		log.Printf("opentsdb write error: %s, db: %s, rp: %s", err, db, rp)
+		pointsDropped.Add(float64(len(points)))
+	}
+	return err
+}
+
+// Put converts the data points received by /api/put and writes them to db and rp, the result contains the errors of failed data points.
+func Put(w PointsWriter, dps []*DataPoint, db, rp string) *PutResult {
+	pointsReceived.Add(float64(len(dps)))
+	result := &PutResult{}
+	points := make([]models.Point, 0, len(dps))
+	valid := make([]*DataPoint, 0, len(dps))
+	for _, dp := range dps {
+		point, err := dp.Point()
+		if err != nil {
+			pointsDropped.Inc()
+			result.Failed++
+			result.Errors = append(result.Errors, &PutError{DataPoint: dp, Error: err.Error()})
+			continue
+		}
+		points = append(points, point)
+		valid = append(valid, dp)
+	}
+	if err := writePoints(w, points, db, rp); err != nil {
+		result.Failed += len(valid)
+		for _, dp := range valid {
+			result.Errors = append(result.Errors, &PutError{DataPoint: dp, Error: err.Error()})
+		}
+		return result
+	}
+	result.Success = len(valid)
+	return result
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package opentsdb
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+type testWriter struct {
+	lock      sync.Mutex
+	points    []string
+	forbidden bool
+	err       error
+}
+
+func (tw *testWriter) WritePoints(points []models.Point, db, rp string) error {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.err != nil {
+		return tw.err
+	}
+	for _, pt := range points {
+		tw.points = append(tw.points, db+" "+rp+" "+pt.String())
+	}
+	return nil
+}
+
+func (tw *testWriter) IsForbiddenDB(db string) bool {
+	return tw.forbidden
+}
+
+func TestServiceTelnet(t *testing.T) {
+	tw := &testWriter{}
+	s := NewService(&backend.OpenTSDBConfig{Database: "opentsdb", RetentionPolicy: "autogen"}, tw)
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handleConn(server)
+		close(done)
+	}()
+
+	r := bufio.NewReader(client)
+	tests := []struct {
+		name    string
+		command string
+		rsp     string
+	}{
+		{name: "put", command: "put sys.cpu.user 1700000000 42.5 host=web01"},
+		{name: "put error", command: "put sys.cpu.user 1700000000", rsp: "put: illegal argument: not enough arguments (need least 3, got 2)"},
+		{name: "version", command: "version", rsp: "influx-proxy version " + backend.Version + ", opentsdb compatible"},
+		{name: "unknown", command: "get sys.cpu.user", rsp: "unknown command: get.  Try `help'."},
+	}
+	for _, tt := range tests {
+		if _, err := client.Write([]byte(tt.command + "\n")); err != nil {
+			t.Fatalf("%v: write error: %s", tt.name, err)
+		}
+		if tt.rsp == "" {
+			continue
+		}
+		line, err := r.ReadString('\n')
+		if err != nil || strings.TrimSuffix(line, "\n") != tt.rsp {
+			t.Errorf("%v: got %q, error %v, want %q", tt.name, line, err, tt.rsp)
+		}
+	}
+	client.Write([]byte("exit\n"))
+	<-done
+	client.Close()
+
+	want := []string{"opentsdb autogen sys.cpu.user,host=web01 value=42.5 1700000000000000000"}
+	if len(tw.points) != len(want) || tw.points[0] != want[0] {
+		t.Errorf("got points %v, want %v", tw.points, want)
+	}
+}
+
+func TestPut(t *testing.T) {
+	dps := []*DataPoint{
+		{Metric: "sys.cpu.user", Timestamp: "1700000000", Value: "1", Tags: map[string]string{"host": "web01"}},
+		{Metric: "sys.cpu.user", Value: "1"},
+	}
+	tests := []struct {
+		name    string
+		tw      *testWriter
+		success int
+		failed  int
+		errs    []string
+	}{
+		{name: "partial", tw: &testWriter{}, success: 1, failed: 1, errs: []string{"missing timestamp"}},
+		{name: "forbidden", tw: &testWriter{forbidden: true}, success: 0, failed: 2, errs: []string{"missing timestamp", "database forbidden: opentsdb"}},
+		{name: "write error", tw: &testWriter{err: errors.New("can't get backends")}, success: 0, failed: 2, errs: []string{"missing timestamp", "can't get backends"}},
+	}
+	for _, tt := range tests {
+		result := Put(tt.tw, dps, "opentsdb", "")
+		if result.Success != tt.success || result.Failed != tt.failed || len(result.Errors) != len(tt.errs) {
+			t.Errorf("%v: got %+v, want success %d, failed %d", tt.name, result, tt.success, tt.failed)
+			continue
+		}
+		for i, e := range result.Errors {
+			if e.Error != tt.errs[i] {
+				t.Errorf("%v: got error %s, want %s", tt.name, e.Error, tt.errs[i])
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package prometheus
 import (
 	"fmt"
 	"math"
+	"strings"
 	"time"
 
 	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
@@ -18,8 +19,34 @@ const (
 
 	// prometheusNameTag is the tag key that Prometheus uses for metric names
 	prometheusNameTag = "__name__"
+
+	// measurementNameV2 is the measurement all prometheus values get written to with metric version 2
+	measurementNameV2 = "prometheus"
+
+	// staleFieldName is the flag field the stale markers get written to with metric version 1
+	staleFieldName = "stale"
+
+	// staleFieldSuffix is appended to the metric name as the flag field of stale markers with metric version 2
+	staleFieldSuffix = "_stale"
+
+	// metadataMeasurement is the measurement the metric metadata get written to
+	metadataMeasurement = "prometheus_metadata"
+
+	// staleNaN is the bits of the NaN value that Prometheus uses as the stale marker
+	staleNaN uint64 = 0x7ff0000000000002
 )
 
+// WriteOptions is the schema options of converting a Prometheus remote write request into points.
+type WriteOptions struct {
+	// MetricVersion 1 writes the samples into a measurement named after the metric with a value field,
+	// and 2 writes the samples into the prometheus measurement with a field named after the metric.
+	MetricVersion int
+	// KeepStale writes the stale markers as a boolean flag field instead of dropping them.
+	KeepStale bool
+	// Metadata writes the metric metadata into the prometheus_metadata measurement.
+	Metadata bool
+}
+
 // A DroppedValuesError is returned when the prometheus write request contains
 // unsupported float64 values.
 type DroppedValuesError struct {
@@ -36,28 +63,47 @@ func (e DroppedValuesError) Error() string {
 // WriteRequestToPoints converts a Prometheus remote write request of time series and their
 // samples into Points that can be written into Influx
 func WriteRequestToPoints(req *remote.WriteRequest) ([]models.Point, error) {
+	return WriteRequestToPointsWithOptions(req, &WriteOptions{MetricVersion: 1})
+}
+
+// WriteRequestToPointsWithOptions converts a Prometheus remote write request into Points with the schema options
+func WriteRequestToPointsWithOptions(req *remote.WriteRequest, opts *WriteOptions) ([]models.Point, error) {
 	var maxPoints int
 	for _, ts := range req.Timeseries {
 		maxPoints += len(ts.Samples)
 	}
+	if opts.Metadata {
+		maxPoints += len(req.Metadata)
+	}
 	points := make([]models.Point, 0, maxPoints)
 
 	// Track any dropped values.
 	var nan, inf, ninf uint64
 
 	for _, ts := range req.Timeseries {
-		measurement := measurementName
+		name := measurementName
 
 		tags := make(map[string]string, len(ts.Labels))
 		for _, l := range ts.Labels {
-			tags[l.Name] = l.Value
 			if l.Name == prometheusNameTag {
-				measurement = l.Value
+				name = l.Value
+				if opts.MetricVersion == 2 {
+					continue
+				}
 			}
+			tags[l.Name] = l.Value
+		}
+
+		measurement, field, staleField := name, fieldName, staleFieldName
+		if opts.MetricVersion == 2 {
+			measurement, field, staleField = measurementNameV2, name, name+staleFieldSuffix
 		}
 
 		for _, s := range ts.Samples {
-			if v := s.Value; math.IsNaN(v) {
+			var fields map[string]interface{}
+			if v := s.Value; opts.KeepStale && math.Float64bits(v) == staleNaN {
+				fields = map[string]interface{}{staleField: true}
+			} else if math.IsNaN(v) {
 				nan++
 				continue
 			} else if math.IsInf(v, -1) {
@@ -66,11 +112,12 @@ func WriteRequestToPoints(req *remote.WriteRequest) ([]models.Point, error) {
 			} else if math.IsInf(v, 1) {
 				inf++
 				continue
+			} else {
+				fields = map[string]interface{}{field: v}
 			}
 
 			// convert and append
 			t := time.Unix(0, s.TimestampMs*int64(time.Millisecond))
-			fields := map[string]interface{}{fieldName: s.Value}
 			p, err := models.NewPoint(measurement, models.NewTags(tags), fields, t)
 			if err != nil {
 				return nil, err
@@ -79,6 +126,28 @@ func WriteRequestToPoints(req *remote.WriteRequest) ([]models.Point, error) {
 		}
 	}
 
+	if opts.Metadata {
+		now := time.Now()
+		for _, md := range req.Metadata {
+			if md.MetricFamilyName == "" {
+				continue
+			}
+			fields := map[string]interface{}{"type": strings.ToLower(md.Type.String())}
+			if md.Help != "" {
+				fields["help"] = md.Help
+			}
+			if md.Unit != "" {
+				fields["unit"] = md.Unit
+			}
+			tags := models.NewTags(map[string]string{"metric_family_name": md.MetricFamilyName})
+			p, err := models.NewPoint(metadataMeasurement, tags, fields, now)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, p)
+		}
+	}
+
 	if nan+inf+ninf > 0 {
 		return points, DroppedValuesError{nan: nan, inf: inf, ninf: ninf}
 	}
@@ -0,0 +1,89 @@
+package prometheus
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+)
+
+func newTestWriteRequest() *remote.WriteRequest {
+	return &remote.WriteRequest{
+		Timeseries: []*remote.TimeSeries{
+			{
+				Labels: []*remote.LabelPair{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+				Samples: []*remote.Sample{
+					{Value: 1, TimestampMs: 1000},
+					{Value: math.Float64frombits(staleNaN), TimestampMs: 2000},
+					{Value: math.NaN(), TimestampMs: 3000},
+					{Value: math.Inf(1), TimestampMs: 4000},
+				},
+			},
+		},
+		Metadata: []*remote.MetricMetadata{
+			{Type: remote.MetricMetadata_GAUGE, MetricFamilyName: "up", Help: "target is up"},
+			{Type: remote.MetricMetadata_COUNTER},
+		},
+	}
+}
+
+func TestWriteRequestToPointsWithOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *WriteOptions
+		want    []string
+		dropped string
+	}{
+		{
+			name:    "v1",
+			opts:    &WriteOptions{MetricVersion: 1},
+			want:    []string{"up,__name__=up,job=node value=1 1000000000"},
+			dropped: "[NaN = 2, +Inf = 1, -Inf = 0]",
+		},
+		{
+			name:    "v2",
+			opts:    &WriteOptions{MetricVersion: 2},
+			want:    []string{"prometheus,job=node up=1 1000000000"},
+			dropped: "[NaN = 2, +Inf = 1, -Inf = 0]",
+		},
+		{
+			name:    "v1 keep stale",
+			opts:    &WriteOptions{MetricVersion: 1, KeepStale: true},
+			want:    []string{"up,__name__=up,job=node value=1 1000000000", "up,__name__=up,job=node stale=true 2000000000"},
+			dropped: "[NaN = 1, +Inf = 1, -Inf = 0]",
+		},
+		{
+			name:    "v2 keep stale",
+			opts:    &WriteOptions{MetricVersion: 2, KeepStale: true},
+			want:    []string{"prometheus,job=node up=1 1000000000", "prometheus,job=node up_stale=true 2000000000"},
+			dropped: "[NaN = 1, +Inf = 1, -Inf = 0]",
+		},
+		{
+			name:    "v2 metadata",
+			opts:    &WriteOptions{MetricVersion: 2, Metadata: true},
+			want:    []string{"prometheus,job=node up=1 1000000000", `prometheus_metadata,metric_family_name=up help="target is up",type="gauge"`},
+			dropped: "[NaN = 2, +Inf = 1, -Inf = 0]",
+		},
+	}
+	for _, tt := range tests {
+		points, err := WriteRequestToPointsWithOptions(newTestWriteRequest(), tt.opts)
+		if _, ok := err.(DroppedValuesError); !ok || !strings.HasSuffix(err.Error(), tt.dropped) {
+			t.Errorf("%v: got error %v, want dropped values %s", tt.name, err, tt.dropped)
+		}
+		if len(points) != len(tt.want) {
+			t.Errorf("%v: got %d points, want %d", tt.name, len(points), len(tt.want))
+			continue
+		}
+		for i, p := range points {
+			got := p.String()
+			if string(p.Name()) == metadataMeasurement {
+				// the metadata points are written at the current time
+				got = got[:strings.LastIndexByte(got, ' ')]
+			}
+			if got != tt.want[i] {
+				t.Errorf("%v: got point %s, want %s", tt.name, got, tt.want[i])
+			}
+		}
+	}
+}
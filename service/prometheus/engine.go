@@ -0,0 +1,518 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+)
+
+const (
+	// LookbackDelta is the maximum duration an instant vector selector looks back for the latest sample
+	LookbackDelta = 5 * time.Minute
+	// MaxPoints is the maximum number of points per time series resulted from a range query
+	MaxPoints = 11000
+)
+
+const (
+	ValueTypeScalar = "scalar"
+	ValueTypeVector = "vector"
+	ValueTypeMatrix = "matrix"
+)
+
+var (
+	ErrRangeVector      = errors.New("range vector is only allowed in the call to function rate or increase")
+	ErrRangeVectorQuery = errors.New("invalid expression type range vector for range query, must be scalar or instant vector")
+	ErrInvalidStep      = errors.New("zero or negative query resolution step widths are not accepted, try a positive integer")
+	ErrInvalidRange     = errors.New("end timestamp must not be before start time")
+	ErrTooManyPoints    = fmt.Errorf("exceeded maximum resolution of %d points per timeseries, try decreasing the query resolution (?step=XX)", MaxPoints)
+)
+
+// Querier selects the time series matching the label matchers in the time range of the query.
+type Querier interface {
+	Select(q *remote.Query) ([]*remote.TimeSeries, error)
+}
+
+// Point is a sample of a time series.
+type Point struct {
+	T int64
+	V float64
+}
+
+// MarshalJSON encodes the point as [<unix seconds>, "<value>"] like prometheus.
+func (p Point) MarshalJSON() ([]byte, error) {
+	t := strconv.FormatFloat(float64(p.T)/1000, 'f', -1, 64)
+	return []byte("[" + t + ",\"" + strconv.FormatFloat(p.V, 'f', -1, 64) + "\"]"), nil
+}
+
+// Series is a time series with labels of metric and points in time order.
+type Series struct {
+	Metric map[string]string
+	Points []Point
+}
+
+// Result is the result of a query, which is a scalar, a vector or a matrix.
+type Result struct {
+	Type   string
+	Scalar Point
+	Series []*Series
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  Point             `json:"value"`
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values []Point           `json:"values"`
+}
+
+// MarshalJSON encodes the result as the data of prometheus query api.
+func (r *Result) MarshalJSON() ([]byte, error) {
+	var result interface{}
+	switch r.Type {
+	case ValueTypeScalar:
+		result = r.Scalar
+	case ValueTypeVector:
+		vector := make([]vectorSample, 0, len(r.Series))
+		for _, s := range r.Series {
+			vector = append(vector, vectorSample{Metric: s.Metric, Value: s.Points[0]})
+		}
+		result = vector
+	default:
+		matrix := make([]matrixSeries, 0, len(r.Series))
+		for _, s := range r.Series {
+			matrix = append(matrix, matrixSeries{Metric: s.Metric, Values: s.Points})
+		}
+		result = matrix
+	}
+	return json.Marshal(struct {
+		ResultType string      `json:"resultType"`
+		Result     interface{} `json:"result"`
+	}{r.Type, result})
+}
+
+type sample struct {
+	metric map[string]string
+	v      float64
+}
+
+type vector []sample
+
+type evaluator struct {
+	querier Querier
+	series  map[*VectorSelector][]*Series
+}
+
+// Query evaluates the expression at the time ts.
+func Query(querier Querier, expr Expr, ts time.Time) (*Result, error) {
+	t := timestamp(ts)
+	ev := &evaluator{querier: querier, series: make(map[*VectorSelector][]*Series)}
+	if err := ev.prepare(expr, t, t); err != nil {
+		return nil, err
+	}
+	if vs, ok := expr.(*VectorSelector); ok && vs.Range > 0 {
+		r := &Result{Type: ValueTypeMatrix}
+		for _, s := range ev.series[vs] {
+			if points := rangePoints(s.Points, t-vs.Range.Milliseconds(), t); len(points) > 0 {
+				r.Series = append(r.Series, &Series{Metric: s.Metric, Points: points})
+			}
+		}
+		return r, nil
+	}
+	v, err := ev.eval(expr, t)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case float64:
+		return &Result{Type: ValueTypeScalar, Scalar: Point{T: t, V: v}}, nil
+	default:
+		r := &Result{Type: ValueTypeVector}
+		for _, s := range v.(vector) {
+			r.Series = append(r.Series, &Series{Metric: s.metric, Points: []Point{{T: t, V: s.v}}})
+		}
+		sortSeries(r.Series)
+		return r, nil
+	}
+}
+
+// CheckRange checks the time range and the step of a range query of the expression.
+func CheckRange(expr Expr, start, end time.Time, step time.Duration) error {
+	if vs, ok := expr.(*VectorSelector); ok && vs.Range > 0 {
+		return ErrRangeVectorQuery
+	}
+	if step < time.Millisecond {
+		return ErrInvalidStep
+	}
+	if end.Before(start) {
+		return ErrInvalidRange
+	}
+	if end.Sub(start)/step >= MaxPoints {
+		return ErrTooManyPoints
+	}
+	return nil
+}
+
+// QueryRange evaluates the expression at each step in the time range from start to end,
+// which should be checked by CheckRange before.
+func QueryRange(querier Querier, expr Expr, start, end time.Time, step time.Duration) (*Result, error) {
+	if err := CheckRange(expr, start, end, step); err != nil {
+		return nil, err
+	}
+	st, et, interval := timestamp(start), timestamp(end), step.Milliseconds()
+	ev := &evaluator{querier: querier, series: make(map[*VectorSelector][]*Series)}
+	if err := ev.prepare(expr, st, et); err != nil {
+		return nil, err
+	}
+	r := &Result{Type: ValueTypeMatrix}
+	series := make(map[string]*Series)
+	for t := st; t <= et; t += interval {
+		v, err := ev.eval(expr, t)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case float64:
+			if len(r.Series) == 0 {
+				r.Series = append(r.Series, &Series{Metric: map[string]string{}})
+			}
+			r.Series[0].Points = append(r.Series[0].Points, Point{T: t, V: v})
+		case vector:
+			for _, smpl := range v {
+				key := labelsKey(smpl.metric)
+				s, ok := series[key]
+				if !ok {
+					s = &Series{Metric: smpl.metric}
+					series[key] = s
+					r.Series = append(r.Series, s)
+				}
+				s.Points = append(s.Points, Point{T: t, V: smpl.v})
+			}
+		}
+	}
+	sortSeries(r.Series)
+	return r, nil
+}
+
+// prepare selects the time series of all vector selectors in the expression once for the whole time range.
+func (ev *evaluator) prepare(expr Expr, start, end int64) error {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		lookback := LookbackDelta
+		if e.Range > 0 {
+			lookback = e.Range
+		}
+		q := &remote.Query{StartTimestampMs: start - lookback.Milliseconds(), EndTimestampMs: end, Matchers: e.Matchers}
+		tss, err := ev.querier.Select(q)
+		if err != nil {
+			return err
+		}
+		series := make([]*Series, 0, len(tss))
+		for _, ts := range tss {
+			s := &Series{Metric: make(map[string]string, len(ts.Labels)), Points: make([]Point, 0, len(ts.Samples))}
+			for _, l := range ts.Labels {
+				s.Metric[l.Name] = l.Value
+			}
+			for _, smpl := range ts.Samples {
+				s.Points = append(s.Points, Point{T: smpl.TimestampMs, V: smpl.Value})
+			}
+			sort.SliceStable(s.Points, func(i, j int) bool { return s.Points[i].T < s.Points[j].T })
+			series = append(series, s)
+		}
+		ev.series[e] = series
+	case *Call:
+		return ev.prepare(e.Arg, start, end)
+	case *AggregateExpr:
+		return ev.prepare(e.Expr, start, end)
+	case *BinaryExpr:
+		if err := ev.prepare(e.LHS, start, end); err != nil {
+			return err
+		}
+		return ev.prepare(e.RHS, start, end)
+	}
+	return nil
+}
+
+// eval evaluates the expression at the time t, and returns a scalar of float64 or a vector.
+func (ev *evaluator) eval(expr Expr, t int64) (interface{}, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return e.Val, nil
+	case *VectorSelector:
+		if e.Range > 0 {
+			return nil, ErrRangeVector
+		}
+		var v vector
+		for _, s := range ev.series[e] {
+			i := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > t }) - 1
+			if i >= 0 && s.Points[i].T > t-LookbackDelta.Milliseconds() {
+				v = append(v, sample{metric: s.Metric, v: s.Points[i].V})
+			}
+		}
+		return v, nil
+	case *Call:
+		var v vector
+		for _, s := range ev.series[e.Arg] {
+			points := rangePoints(s.Points, t-e.Arg.Range.Milliseconds(), t)
+			if value, ok := extrapolatedRate(points, t-e.Arg.Range.Milliseconds(), t, e.Func == "rate"); ok {
+				v = append(v, sample{metric: dropMetricName(s.Metric), v: value})
+			}
+		}
+		return v, nil
+	case *AggregateExpr:
+		v, err := ev.eval(e.Expr, t)
+		if err != nil {
+			return nil, err
+		}
+		vec, ok := v.(vector)
+		if !ok {
+			return nil, fmt.Errorf("expected instant vector in aggregation %s, got scalar", e.Op)
+		}
+		return aggregate(e, vec), nil
+	case *BinaryExpr:
+		lhs, err := ev.eval(e.LHS, t)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.eval(e.RHS, t)
+		if err != nil {
+			return nil, err
+		}
+		return binaryOp(e.Op, lhs, rhs)
+	}
+	return nil, fmt.Errorf("unknown expression %s", expr)
+}
+
+// rangePoints returns the points in the left-open time range (start, end].
+func rangePoints(points []Point, start, end int64) []Point {
+	i := sort.Search(len(points), func(i int) bool { return points[i].T > start })
+	j := sort.Search(len(points), func(i int) bool { return points[i].T > end })
+	return points[i:j]
+}
+
+// extrapolatedRate calculates the increase of the counter in the time range with counter resets and extrapolation,
+// and the per-second rate if isRate is true, like prometheus.
+func extrapolatedRate(points []Point, start, end int64, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	first, last := points[0], points[len(points)-1]
+	result := last.V - first.V
+	prev := first.V
+	for _, p := range points[1:] {
+		if p.V < prev {
+			result += prev
+		}
+		prev = p.V
+	}
+
+	durationToStart := float64(first.T-start) / 1000
+	durationToEnd := float64(end-last.T) / 1000
+	sampledInterval := float64(last.T-first.T) / 1000
+	averageDurationBetweenSamples := sampledInterval / float64(len(points)-1)
+	if result > 0 && first.V >= 0 {
+		// counters cannot be negative, so don't extrapolate below zero
+		durationToZero := sampledInterval * (first.V / result)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+	extrapolateToInterval := sampledInterval
+	if durationToStart < extrapolationThreshold {
+		extrapolateToInterval += durationToStart
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+	if durationToEnd < extrapolationThreshold {
+		extrapolateToInterval += durationToEnd
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+	result *= extrapolateToInterval / sampledInterval
+	if isRate {
+		result /= float64(end-start) / 1000
+	}
+	return result, true
+}
+
+type group struct {
+	metric map[string]string
+	value  float64
+	count  int
+}
+
+func aggregate(e *AggregateExpr, v vector) vector {
+	groups := make(map[string]*group)
+	var keys []string
+	for _, s := range v {
+		metric := groupingMetric(s.metric, e.Grouping, e.Without)
+		key := labelsKey(metric)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{metric: metric, value: s.v}
+			groups[key] = g
+			keys = append(keys, key)
+		} else {
+			switch e.Op {
+			case "sum", "avg":
+				g.value += s.v
+			case "min":
+				if s.v < g.value || math.IsNaN(g.value) {
+					g.value = s.v
+				}
+			case "max":
+				if s.v > g.value || math.IsNaN(g.value) {
+					g.value = s.v
+				}
+			}
+		}
+		g.count++
+	}
+	result := make(vector, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+		switch e.Op {
+		case "avg":
+			g.value /= float64(g.count)
+		case "count":
+			g.value = float64(g.count)
+		}
+		result = append(result, sample{metric: g.metric, v: g.value})
+	}
+	return result
+}
+
+func binaryOp(op string, lhs, rhs interface{}) (interface{}, error) {
+	switch l := lhs.(type) {
+	case float64:
+		switch r := rhs.(type) {
+		case float64:
+			return arithmetic(op, l, r), nil
+		case vector:
+			result := make(vector, 0, len(r))
+			for _, s := range r {
+				result = append(result, sample{metric: dropMetricName(s.metric), v: arithmetic(op, l, s.v)})
+			}
+			return result, nil
+		}
+	case vector:
+		switch r := rhs.(type) {
+		case float64:
+			result := make(vector, 0, len(l))
+			for _, s := range l {
+				result = append(result, sample{metric: dropMetricName(s.metric), v: arithmetic(op, s.v, r)})
+			}
+			return result, nil
+		case vector:
+			// one-to-one matching on all labels except the metric name
+			rs := make(map[string]sample, len(r))
+			for _, s := range r {
+				key := labelsKey(dropMetricName(s.metric))
+				if _, ok := rs[key]; ok {
+					return nil, errors.New("found duplicate series for the match group on the right hand-side of the operation, many-to-many matching not allowed")
+				}
+				rs[key] = s
+			}
+			matched := make(map[string]bool, len(l))
+			result := make(vector, 0, len(l))
+			for _, s := range l {
+				key := labelsKey(dropMetricName(s.metric))
+				rsmpl, ok := rs[key]
+				if !ok {
+					continue
+				}
+				if matched[key] {
+					return nil, errors.New("found duplicate series for the match group on the left hand-side of the operation, many-to-many matching not allowed")
+				}
+				matched[key] = true
+				result = append(result, sample{metric: dropMetricName(s.metric), v: arithmetic(op, s.v, rsmpl.v)})
+			}
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported operand types of operator %s", op)
+}
+
+func arithmetic(op string, l, r float64) float64 {
+	switch op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	default:
+		return l / r
+	}
+}
+
+// labelsKey returns the key identifying the labels of metric.
+func labelsKey(m map[string]string) string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteByte(0xff)
+		sb.WriteString(m[name])
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
+
+// groupingMetric returns only the labels of metric grouped by,
+// or all the labels except the metric name and the labels grouped without.
+func groupingMetric(metric map[string]string, grouping []string, without bool) map[string]string {
+	m := make(map[string]string)
+	if without {
+		for name, value := range metric {
+			m[name] = value
+		}
+		delete(m, prometheusNameTag)
+		for _, name := range grouping {
+			delete(m, name)
+		}
+		return m
+	}
+	for _, name := range grouping {
+		if value, ok := metric[name]; ok {
+			m[name] = value
+		}
+	}
+	return m
+}
+
+func dropMetricName(metric map[string]string) map[string]string {
+	if _, ok := metric[prometheusNameTag]; !ok {
+		return metric
+	}
+	m := make(map[string]string, len(metric)-1)
+	for name, value := range metric {
+		if name != prometheusNameTag {
+			m[name] = value
+		}
+	}
+	return m
+}
+
+func sortSeries(series []*Series) {
+	sort.SliceStable(series, func(i, j int) bool {
+		return labelsKey(series[i].Metric) < labelsKey(series[j].Metric)
+	})
+}
+
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,720 @@
+package prometheus
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// otlpLibraryNameTag and otlpLibraryVersionTag are the tag keys of the instrumentation scope
+	otlpLibraryNameTag    = "otel.library.name"
+	otlpLibraryVersionTag = "otel.library.version"
+
+	// otlpGaugeField and otlpCounterField are the fields which the values of gauges and monotonic sums get written to
+	otlpGaugeField   = "gauge"
+	otlpCounterField = "counter"
+)
+
+// OTLPPartialError is returned when some data points of the OTLP export request are rejected,
+// which should be reported as partial success.
+type OTLPPartialError struct {
+	Rejected int64
+	Message  string
+}
+
+func (e *OTLPPartialError) Error() string {
+	return fmt.Sprintf("%d data points rejected: %s", e.Rejected, e.Message)
+}
+
+// OTLPMetricsRequest is the ExportMetricsServiceRequest of OTLP, only the parts needed for conversion are decoded.
+type OTLPMetricsRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource        `json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+	LibMetrics   []*otlpScopeMetrics `json:"instrumentationLibraryMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Library otlpScope     `json:"instrumentationLibrary"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpMetric struct {
+	Name                 string            `json:"name"`
+	Gauge                *otlpNumbers      `json:"gauge"`
+	Sum                  *otlpNumbers      `json:"sum"`
+	Histogram            *otlpHistogram    `json:"histogram"`
+	ExponentialHistogram *otlpExpHistogram `json:"exponentialHistogram"`
+	Summary              *otlpSummary      `json:"summary"`
+}
+
+type otlpNumbers struct {
+	DataPoints  []*otlpNumberDataPoint `json:"dataPoints"`
+	IsMonotonic bool                   `json:"isMonotonic"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []*otlpKeyValue `json:"attributes"`
+	TimeUnixNano otlpUint64      `json:"timeUnixNano"`
+	AsDouble     *otlpFloat64    `json:"asDouble"`
+	AsInt        *otlpInt64      `json:"asInt"`
+}
+
+type otlpHistogram struct {
+	DataPoints []*otlpHistogramDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes     []*otlpKeyValue `json:"attributes"`
+	TimeUnixNano   otlpUint64      `json:"timeUnixNano"`
+	Count          otlpUint64      `json:"count"`
+	Sum            *otlpFloat64    `json:"sum"`
+	BucketCounts   []otlpUint64    `json:"bucketCounts"`
+	ExplicitBounds []otlpFloat64   `json:"explicitBounds"`
+}
+
+// otlpExpHistogram is unsupported, only the data points are counted to be rejected.
+type otlpExpHistogram struct {
+	DataPoints []json.RawMessage `json:"dataPoints"`
+}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes     []*otlpKeyValue `json:"attributes"`
+	TimeUnixNano   otlpUint64      `json:"timeUnixNano"`
+	Count          otlpUint64      `json:"count"`
+	Sum            otlpFloat64     `json:"sum"`
+	QuantileValues []*otlpQuantile `json:"quantileValues"`
+}
+
+type otlpQuantile struct {
+	Quantile otlpFloat64 `json:"quantile"`
+	Value    otlpFloat64 `json:"value"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string           `json:"stringValue"`
+	BoolValue   *bool             `json:"boolValue"`
+	IntValue    *otlpInt64        `json:"intValue"`
+	DoubleValue *otlpFloat64      `json:"doubleValue"`
+	ArrayValue  *otlpArrayValue   `json:"arrayValue"`
+	KvlistValue *otlpKeyValueList `json:"kvlistValue"`
+	BytesValue  []byte            `json:"bytesValue"`
+}
+
+type otlpArrayValue struct {
+	Values []*otlpAnyValue `json:"values"`
+}
+
+type otlpKeyValueList struct {
+	Values []*otlpKeyValue `json:"values"`
+}
+
+// otlpUint64 and otlpInt64 are 64-bit integers encoded as strings or numbers in OTLP/JSON.
+type otlpUint64 uint64
+
+func (v *otlpUint64) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseUint(string(bytes.Trim(b, `"`)), 10, 64)
+	*v = otlpUint64(n)
+	return err
+}
+
+type otlpInt64 int64
+
+func (v *otlpInt64) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseInt(string(bytes.Trim(b, `"`)), 10, 64)
+	*v = otlpInt64(n)
+	return err
+}
+
+// otlpFloat64 is a double encoded as a number, or "NaN", "Infinity" and "-Infinity" in OTLP/JSON.
+type otlpFloat64 float64
+
+func (v *otlpFloat64) UnmarshalJSON(b []byte) error {
+	s := string(bytes.Trim(b, `"`))
+	switch s {
+	case "NaN":
+		*v = otlpFloat64(math.NaN())
+	case "Infinity":
+		*v = otlpFloat64(math.Inf(1))
+	case "-Infinity":
+		*v = otlpFloat64(math.Inf(-1))
+	default:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*v = otlpFloat64(f)
+	}
+	return nil
+}
+
+// String returns the attribute value as a tag value, the arrays and key value lists are encoded in json.
+func (v *otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'g', -1, 64)
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case v.ArrayValue != nil, v.KvlistValue != nil:
+		b, _ := json.Marshal(v.value())
+		return string(b)
+	}
+	return ""
+}
+
+func (v *otlpAnyValue) value() interface{} {
+	switch {
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, av := range v.ArrayValue.Values {
+			values = append(values, av.value())
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.value()
+		}
+		return values
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return float64(*v.DoubleValue)
+	}
+	return v.String()
+}
+
+// UnmarshalOTLPMetricsJSON decodes the ExportMetricsServiceRequest in OTLP/JSON.
+func UnmarshalOTLPMetricsJSON(b []byte) (*OTLPMetricsRequest, error) {
+	req := &OTLPMetricsRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// UnmarshalOTLPMetrics decodes the ExportMetricsServiceRequest in protobuf.
+func UnmarshalOTLPMetrics(b []byte) (*OTLPMetricsRequest, error) {
+	req := &OTLPMetricsRequest{}
+	err := decodeProto(b, func(f protoField) error {
+		if f.num == 1 && f.typ == protowire.BytesType {
+			rm := &otlpResourceMetrics{}
+			req.ResourceMetrics = append(req.ResourceMetrics, rm)
+			return rm.decode(f.bytes())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// protoField is a field of protobuf message with the raw value including length prefix if any.
+type protoField struct {
+	num protowire.Number
+	typ protowire.Type
+	raw []byte
+}
+
+func (f protoField) bytes() []byte {
+	v, _ := protowire.ConsumeBytes(f.raw)
+	return v
+}
+
+func (f protoField) varint() uint64 {
+	v, _ := protowire.ConsumeVarint(f.raw)
+	return v
+}
+
+func (f protoField) fixed64() uint64 {
+	v, _ := protowire.ConsumeFixed64(f.raw)
+	return v
+}
+
+func (f protoField) double() float64 {
+	return math.Float64frombits(f.fixed64())
+}
+
+// repeatedFixed64 returns the values of repeated fixed64 or double field, which is packed or not.
+func (f protoField) repeatedFixed64() ([]uint64, error) {
+	switch f.typ {
+	case protowire.Fixed64Type:
+		return []uint64{f.fixed64()}, nil
+	case protowire.BytesType:
+		b := f.bytes()
+		values := make([]uint64, 0, len(b)/8)
+		for len(b) > 0 {
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			values = append(values, v)
+			b = b[n:]
+		}
+		return values, nil
+	}
+	return nil, nil
+}
+
+// decodeProto calls fn with each field of the protobuf message b, the unknown fields should be ignored by fn.
+func decodeProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		if err := fn(protoField{num: num, typ: typ, raw: b[:m]}); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+func (rm *otlpResourceMetrics) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			return decodeProto(f.bytes(), func(f protoField) error {
+				if f.num == 1 && f.typ == protowire.BytesType {
+					return decodeKeyValue(f.bytes(), &rm.Resource.Attributes)
+				}
+				return nil
+			})
+		case 2, 1000:
+			sm := &otlpScopeMetrics{}
+			rm.ScopeMetrics = append(rm.ScopeMetrics, sm)
+			return sm.decode(f.bytes())
+		}
+		return nil
+	})
+}
+
+func (sm *otlpScopeMetrics) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			return decodeProto(f.bytes(), func(f protoField) error {
+				switch {
+				case f.num == 1 && f.typ == protowire.BytesType:
+					sm.Scope.Name = string(f.bytes())
+				case f.num == 2 && f.typ == protowire.BytesType:
+					sm.Scope.Version = string(f.bytes())
+				}
+				return nil
+			})
+		case 2:
+			m := &otlpMetric{}
+			sm.Metrics = append(sm.Metrics, m)
+			return m.decode(f.bytes())
+		}
+		return nil
+	})
+}
+
+func (m *otlpMetric) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			m.Name = string(f.bytes())
+		case 5:
+			m.Gauge = &otlpNumbers{}
+			return m.Gauge.decode(f.bytes())
+		case 7:
+			m.Sum = &otlpNumbers{}
+			return m.Sum.decode(f.bytes())
+		case 9:
+			m.Histogram = &otlpHistogram{}
+			return m.Histogram.decode(f.bytes())
+		case 10:
+			m.ExponentialHistogram = &otlpExpHistogram{}
+			return decodeProto(f.bytes(), func(f protoField) error {
+				if f.num == 1 && f.typ == protowire.BytesType {
+					m.ExponentialHistogram.DataPoints = append(m.ExponentialHistogram.DataPoints, nil)
+				}
+				return nil
+			})
+		case 11:
+			m.Summary = &otlpSummary{}
+			return m.Summary.decode(f.bytes())
+		}
+		return nil
+	})
+}
+
+func (ns *otlpNumbers) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			dp := &otlpNumberDataPoint{}
+			ns.DataPoints = append(ns.DataPoints, dp)
+			return dp.decode(f.bytes())
+		case f.num == 3 && f.typ == protowire.VarintType:
+			ns.IsMonotonic = f.varint() != 0
+		}
+		return nil
+	})
+}
+
+func (dp *otlpNumberDataPoint) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		switch {
+		case f.num == 7 && f.typ == protowire.BytesType:
+			return decodeKeyValue(f.bytes(), &dp.Attributes)
+		case f.num == 3 && f.typ == protowire.Fixed64Type:
+			dp.TimeUnixNano = otlpUint64(f.fixed64())
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			v := otlpFloat64(f.double())
+			dp.AsDouble = &v
+		case f.num == 6 && f.typ == protowire.Fixed64Type:
+			v := otlpInt64(f.fixed64())
+			dp.AsInt = &v
+		}
+		return nil
+	})
+}
+
+func (h *otlpHistogram) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		if f.num == 1 && f.typ == protowire.BytesType {
+			dp := &otlpHistogramDataPoint{}
+			h.DataPoints = append(h.DataPoints, dp)
+			return dp.decode(f.bytes())
+		}
+		return nil
+	})
+}
+
+func (dp *otlpHistogramDataPoint) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		switch {
+		case f.num == 9 && f.typ == protowire.BytesType:
+			return decodeKeyValue(f.bytes(), &dp.Attributes)
+		case f.num == 3 && f.typ == protowire.Fixed64Type:
+			dp.TimeUnixNano = otlpUint64(f.fixed64())
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			dp.Count = otlpUint64(f.fixed64())
+		case f.num == 5 && f.typ == protowire.Fixed64Type:
+			v := otlpFloat64(f.double())
+			dp.Sum = &v
+		case f.num == 6:
+			values, err := f.repeatedFixed64()
+			for _, v := range values {
+				dp.BucketCounts = append(dp.BucketCounts, otlpUint64(v))
+			}
+			return err
+		case f.num == 7:
+			values, err := f.repeatedFixed64()
+			for _, v := range values {
+				dp.ExplicitBounds = append(dp.ExplicitBounds, otlpFloat64(math.Float64frombits(v)))
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *otlpSummary) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		if f.num == 1 && f.typ == protowire.BytesType {
+			dp := &otlpSummaryDataPoint{}
+			s.DataPoints = append(s.DataPoints, dp)
+			return dp.decode(f.bytes())
+		}
+		return nil
+	})
+}
+
+func (dp *otlpSummaryDataPoint) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		switch {
+		case f.num == 7 && f.typ == protowire.BytesType:
+			return decodeKeyValue(f.bytes(), &dp.Attributes)
+		case f.num == 3 && f.typ == protowire.Fixed64Type:
+			dp.TimeUnixNano = otlpUint64(f.fixed64())
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			dp.Count = otlpUint64(f.fixed64())
+		case f.num == 5 && f.typ == protowire.Fixed64Type:
+			dp.Sum = otlpFloat64(f.double())
+		case f.num == 6 && f.typ == protowire.BytesType:
+			q := &otlpQuantile{}
+			dp.QuantileValues = append(dp.QuantileValues, q)
+			return decodeProto(f.bytes(), func(f protoField) error {
+				switch {
+				case f.num == 1 && f.typ == protowire.Fixed64Type:
+					q.Quantile = otlpFloat64(f.double())
+				case f.num == 2 && f.typ == protowire.Fixed64Type:
+					q.Value = otlpFloat64(f.double())
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func decodeKeyValue(b []byte, kvs *[]*otlpKeyValue) error {
+	kv := &otlpKeyValue{}
+	*kvs = append(*kvs, kv)
+	return decodeProto(b, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			kv.Key = string(f.bytes())
+		case f.num == 2 && f.typ == protowire.BytesType:
+			return kv.Value.decode(f.bytes())
+		}
+		return nil
+	})
+}
+
+func (v *otlpAnyValue) decode(b []byte) error {
+	return decodeProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			s := string(f.bytes())
+			v.StringValue = &s
+		case 2:
+			bv := f.varint() != 0
+			v.BoolValue = &bv
+		case 3:
+			iv := otlpInt64(f.varint())
+			v.IntValue = &iv
+		case 4:
+			dv := otlpFloat64(f.double())
+			v.DoubleValue = &dv
+		case 5:
+			v.ArrayValue = &otlpArrayValue{}
+			return decodeProto(f.bytes(), func(f protoField) error {
+				if f.num == 1 && f.typ == protowire.BytesType {
+					av := &otlpAnyValue{}
+					v.ArrayValue.Values = append(v.ArrayValue.Values, av)
+					return av.decode(f.bytes())
+				}
+				return nil
+			})
+		case 6:
+			v.KvlistValue = &otlpKeyValueList{}
+			return decodeProto(f.bytes(), func(f protoField) error {
+				if f.num == 1 && f.typ == protowire.BytesType {
+					return decodeKeyValue(f.bytes(), &v.KvlistValue.Values)
+				}
+				return nil
+			})
+		case 7:
+			v.BytesValue = append([]byte{}, f.bytes()...)
+		}
+		return nil
+	})
+}
+
+// MarshalOTLPPartialSuccess encodes the ExportMetricsServiceResponse with partial success in protobuf.
+func MarshalOTLPPartialSuccess(rejected int64, message string) []byte {
+	var ps []byte
+	ps = protowire.AppendTag(ps, 1, protowire.VarintType)
+	ps = protowire.AppendVarint(ps, uint64(rejected))
+	ps = protowire.AppendTag(ps, 2, protowire.BytesType)
+	ps = protowire.AppendString(ps, message)
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, ps)
+}
+
+// MarshalOTLPStatus encodes the google.rpc.Status of an error response in protobuf.
+func MarshalOTLPStatus(code int32, message string) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(code))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendString(b, message)
+}
+
+// OTLPMetricsToPoints converts the OTLP metrics into points with a schema similar to the prometheus-v1 schema of
+// telegraf opentelemetry input. The measurement is the metric name, and the tags are the resource attributes,
+// the instrumentation scope and the data point attributes. The fields are:
+//   - gauge: gauge
+//   - sum: counter if monotonic, otherwise gauge
+//   - histogram: count, sum and the cumulative count of each bucket keyed by its upper bound, such as 0.5 and +Inf
+//   - summary: count, sum and the value of each quantile keyed by the quantile, such as 0.5 and 0.99
+//
+// The data points with NaN or Inf value only and exponential histograms are rejected with OTLPPartialError.
+func OTLPMetricsToPoints(req *OTLPMetricsRequest) ([]models.Point, error) {
+	var points []models.Point
+	var rejected int64
+	var message string
+	reject := func(n int, msg string) {
+		rejected += int64(n)
+		if message == "" {
+			message = msg
+		}
+	}
+	for _, rm := range req.ResourceMetrics {
+		resourceTags := make(map[string]string, len(rm.Resource.Attributes))
+		for _, kv := range rm.Resource.Attributes {
+			resourceTags[kv.Key] = kv.Value.String()
+		}
+		for _, sm := range append(rm.ScopeMetrics, rm.LibMetrics...) {
+			scope := sm.Scope
+			if scope.Name == "" {
+				scope = sm.Library
+			}
+			scopeTags := make(map[string]string, len(resourceTags)+2)
+			for k, v := range resourceTags {
+				scopeTags[k] = v
+			}
+			if scope.Name != "" {
+				scopeTags[otlpLibraryNameTag] = scope.Name
+			}
+			if scope.Version != "" {
+				scopeTags[otlpLibraryVersionTag] = scope.Version
+			}
+			for _, m := range sm.Metrics {
+				measurement := m.Name
+				if measurement == "" {
+					measurement = measurementName
+				}
+				add := func(attributes []*otlpKeyValue, ts otlpUint64, fields models.Fields) error {
+					if len(fields) == 0 {
+						reject(1, "unsupported NaN or Inf value")
+						return nil
+					}
+					tags := make(map[string]string, len(scopeTags)+len(attributes))
+					for k, v := range scopeTags {
+						tags[k] = v
+					}
+					for _, kv := range attributes {
+						tags[kv.Key] = kv.Value.String()
+					}
+					t := time.Now()
+					if ts > 0 {
+						t = time.Unix(0, int64(ts))
+					}
+					p, err := models.NewPoint(measurement, models.NewTags(tags), fields, t)
+					if err != nil {
+						return err
+					}
+					points = append(points, p)
+					return nil
+				}
+				switch {
+				case m.Gauge != nil || m.Sum != nil:
+					numbers, field := m.Gauge, otlpGaugeField
+					if numbers == nil {
+						numbers = m.Sum
+						if numbers.IsMonotonic {
+							field = otlpCounterField
+						}
+					}
+					for _, dp := range numbers.DataPoints {
+						fields := models.Fields{}
+						if dp.AsInt != nil {
+							fields[field] = float64(*dp.AsInt)
+						} else if dp.AsDouble != nil {
+							setFinite(fields, field, float64(*dp.AsDouble))
+						}
+						if err := add(dp.Attributes, dp.TimeUnixNano, fields); err != nil {
+							return nil, err
+						}
+					}
+				case m.Histogram != nil:
+					for _, dp := range m.Histogram.DataPoints {
+						fields := models.Fields{"count": float64(dp.Count)}
+						if dp.Sum != nil {
+							setFinite(fields, "sum", float64(*dp.Sum))
+						}
+						var cumulative uint64
+						for i, count := range dp.BucketCounts {
+							cumulative += uint64(count)
+							bound := "+Inf"
+							if i < len(dp.ExplicitBounds) {
+								bound = strconv.FormatFloat(float64(dp.ExplicitBounds[i]), 'g', -1, 64)
+							}
+							fields[bound] = float64(cumulative)
+						}
+						if err := add(dp.Attributes, dp.TimeUnixNano, fields); err != nil {
+							return nil, err
+						}
+					}
+				case m.Summary != nil:
+					for _, dp := range m.Summary.DataPoints {
+						fields := models.Fields{"count": float64(dp.Count)}
+						setFinite(fields, "sum", float64(dp.Sum))
+						sort.Slice(dp.QuantileValues, func(i, j int) bool { return dp.QuantileValues[i].Quantile < dp.QuantileValues[j].Quantile })
+						for _, q := range dp.QuantileValues {
+							setFinite(fields, strconv.FormatFloat(float64(q.Quantile), 'g', -1, 64), float64(q.Value))
+						}
+						if err := add(dp.Attributes, dp.TimeUnixNano, fields); err != nil {
+							return nil, err
+						}
+					}
+				case m.ExponentialHistogram != nil:
+					reject(len(m.ExponentialHistogram.DataPoints), "unsupported exponential histogram")
+				}
+			}
+		}
+	}
+	if rejected > 0 {
+		return points, &OTLPPartialError{Rejected: rejected, Message: message}
+	}
+	return points, nil
+}
+
+// setFinite sets the field only if the value is neither NaN nor Inf which are unsupported by influxdb.
+func setFinite(fields models.Fields, key string, value float64) {
+	if !math.IsNaN(value) && !math.IsInf(value, 0) {
+		fields[key] = value
+	}
+}
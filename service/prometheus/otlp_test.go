@@ -0,0 +1,170 @@
+package prometheus
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const otlpTestJSON = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}]},
+    "scopeMetrics": [{
+      "scope": {"name": "meter", "version": "1.0"},
+      "metrics": [
+        {"name": "temperature", "gauge": {"dataPoints": [
+          {"attributes": [{"key": "room", "value": {"stringValue": "a"}}], "timeUnixNano": "1700000000000000000", "asDouble": 21.5},
+          {"attributes": [{"key": "room", "value": {"stringValue": "b"}}], "timeUnixNano": "1700000000000000000", "asDouble": "NaN"}
+        ]}},
+        {"name": "requests", "sum": {"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": [
+          {"attributes": [{"key": "code", "value": {"intValue": "200"}}], "timeUnixNano": "1700000000000000000", "asInt": "10"}
+        ]}},
+        {"name": "queue", "sum": {"aggregationTemporality": "AGGREGATION_TEMPORALITY_CUMULATIVE", "dataPoints": [
+          {"timeUnixNano": 1700000000000000000, "asInt": 3}
+        ]}},
+        {"name": "latency", "histogram": {"aggregationTemporality": 2, "dataPoints": [
+          {"timeUnixNano": "1700000000000000000", "count": "6", "sum": 2.5, "bucketCounts": ["1", "2", "3"], "explicitBounds": [0.1, 0.5]}
+        ]}},
+        {"name": "duration", "summary": {"dataPoints": [
+          {"timeUnixNano": "1700000000000000000", "count": "4", "sum": 8, "quantileValues": [{"quantile": 0.99, "value": 3}, {"quantile": 0.5, "value": 2}]}
+        ]}},
+        {"name": "size", "exponentialHistogram": {"dataPoints": [{"timeUnixNano": "1700000000000000000", "count": "1"}]}}
+      ]
+    }]
+  }]
+}`
+
+var otlpTestPoints = []string{
+	`duration,otel.library.name=meter,otel.library.version=1.0,service.name=api 0.5=2,0.99=3,count=4,sum=8 1700000000000000000`,
+	`latency,otel.library.name=meter,otel.library.version=1.0,service.name=api +Inf=6,0.1=1,0.5=3,count=6,sum=2.5 1700000000000000000`,
+	`queue,otel.library.name=meter,otel.library.version=1.0,service.name=api gauge=3 1700000000000000000`,
+	`requests,code=200,otel.library.name=meter,otel.library.version=1.0,service.name=api counter=10 1700000000000000000`,
+	`temperature,otel.library.name=meter,otel.library.version=1.0,room=a,service.name=api gauge=21.5 1700000000000000000`,
+}
+
+func checkOTLPPoints(t *testing.T, name string, points []models.Point, err error) {
+	var perr *OTLPPartialError
+	if !errors.As(err, &perr) || perr.Rejected != 2 {
+		t.Errorf("%s: got error %v, want 2 data points rejected", name, err)
+	}
+	got := make([]string, 0, len(points))
+	for _, p := range points {
+		got = append(got, p.String())
+	}
+	sort.Strings(got)
+	if len(got) != len(otlpTestPoints) {
+		t.Fatalf("%s: got points %v, want %v", name, got, otlpTestPoints)
+	}
+	for i := range got {
+		if got[i] != otlpTestPoints[i] {
+			t.Errorf("%s: got point %s, want %s", name, got[i], otlpTestPoints[i])
+		}
+	}
+}
+
+func TestOTLPMetricsToPointsJSON(t *testing.T) {
+	req, err := UnmarshalOTLPMetricsJSON([]byte(otlpTestJSON))
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	points, err := OTLPMetricsToPoints(req)
+	checkOTLPPoints(t, "json", points, err)
+}
+
+func pbMessage(num protowire.Number, fields ...[]byte) []byte {
+	var msg []byte
+	for _, f := range fields {
+		msg = append(msg, f...)
+	}
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func pbString(num protowire.Number, s string) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func pbVarint(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbFixed64(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func pbDouble(num protowire.Number, v float64) []byte {
+	return pbFixed64(num, math.Float64bits(v))
+}
+
+func pbPacked(num protowire.Number, values ...uint64) []byte {
+	var packed []byte
+	for _, v := range values {
+		packed = protowire.AppendFixed64(packed, v)
+	}
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+func pbAttribute(num protowire.Number, key string, value []byte) []byte {
+	return pbMessage(num, pbString(1, key), pbMessage(2, value))
+}
+
+func TestOTLPMetricsToPointsProtobuf(t *testing.T) {
+	ts := uint64(1700000000000000000)
+	metrics := [][]byte{
+		pbMessage(2, pbString(1, "temperature"), pbMessage(5,
+			pbMessage(1, pbAttribute(7, "room", pbString(1, "a")), pbFixed64(3, ts), pbDouble(4, 21.5)),
+			pbMessage(1, pbAttribute(7, "room", pbString(1, "b")), pbFixed64(3, ts), pbDouble(4, math.NaN())),
+		)),
+		pbMessage(2, pbString(1, "requests"), pbMessage(7,
+			pbMessage(1, pbAttribute(7, "code", pbVarint(3, 200)), pbFixed64(3, ts), pbFixed64(6, 10)),
+			pbVarint(2, 2), pbVarint(3, 1),
+		)),
+		pbMessage(2, pbString(1, "queue"), pbMessage(7,
+			pbMessage(1, pbFixed64(3, ts), pbFixed64(6, 3)),
+			pbVarint(2, 2),
+		)),
+		pbMessage(2, pbString(1, "latency"), pbMessage(9,
+			pbMessage(1, pbFixed64(3, ts), pbFixed64(4, 6), pbDouble(5, 2.5), pbPacked(6, 1, 2, 3), pbPacked(7, math.Float64bits(0.1), math.Float64bits(0.5))),
+		)),
+		pbMessage(2, pbString(1, "duration"), pbMessage(11,
+			pbMessage(1, pbFixed64(3, ts), pbFixed64(4, 4), pbDouble(5, 8),
+				pbMessage(6, pbDouble(1, 0.99), pbDouble(2, 3)), pbMessage(6, pbDouble(1, 0.5), pbDouble(2, 2))),
+		)),
+		pbMessage(2, pbString(1, "size"), pbMessage(10, pbMessage(1, pbFixed64(3, ts)))),
+	}
+	scope := append([][]byte{pbMessage(1, pbString(1, "meter"), pbString(2, "1.0"))}, metrics...)
+	data := pbMessage(1,
+		pbMessage(1, pbAttribute(1, "service.name", pbString(1, "api"))),
+		pbMessage(2, scope...),
+	)
+
+	req, err := UnmarshalOTLPMetrics(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	points, err := OTLPMetricsToPoints(req)
+	checkOTLPPoints(t, "protobuf", points, err)
+}
+
+func TestUnmarshalOTLPMetricsError(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "truncated", data: pbMessage(1, pbString(1, "x"))[:3]},
+		{name: "invalid tag", data: []byte{0xff}},
+	}
+	for _, tt := range tests {
+		if _, err := UnmarshalOTLPMetrics(tt.data); err == nil {
+			t.Errorf("%v: got nil error", tt.name)
+		}
+	}
+}
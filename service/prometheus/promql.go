@@ -0,0 +1,643 @@
+package prometheus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+)
+
+// The PromQL subset supported includes:
+//   - instant and range vector selectors: metric{label="value", label!="value", label=~"regex", label!~"regex"}[5m]
+//   - functions of range vectors: rate and increase
+//   - aggregations with optional by or without clause: sum, avg, min, max and count
+//   - arithmetic operators between scalars and vectors: +, -, * and /
+//   - number literals, parentheses and unary minus
+
+// Expr is the node of a PromQL expression.
+type Expr interface {
+	String() string
+}
+
+// NumberLiteral is a scalar number.
+type NumberLiteral struct {
+	Val float64
+}
+
+// VectorSelector selects the time series by matchers, and is a range vector selector if Range is not zero.
+type VectorSelector struct {
+	Name     string
+	Matchers []*remote.LabelMatcher
+	Range    time.Duration
+}
+
+// Call is a function call of a range vector.
+type Call struct {
+	Func string
+	Arg  *VectorSelector
+}
+
+// AggregateExpr is an aggregation of the vector by grouping labels.
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Grouping []string
+	Without  bool
+}
+
+// BinaryExpr is an arithmetic operation between scalars and vectors.
+type BinaryExpr struct {
+	Op  string
+	LHS Expr
+	RHS Expr
+}
+
+var (
+	promFunctions   = map[string]bool{"rate": true, "increase": true}
+	promAggregators = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+	matchTypes      = map[string]remote.MatchType{
+		"=":  remote.MatchType_EQUAL,
+		"!=": remote.MatchType_NOT_EQUAL,
+		"=~": remote.MatchType_REGEX_MATCH,
+		"!~": remote.MatchType_REGEX_NO_MATCH,
+	}
+	promOps = map[string]bool{
+		"(": true, ")": true, "{": true, "}": true, "[": true, "]": true, ",": true,
+		"+": true, "-": true, "*": true, "/": true, "=": true, "!=": true, "=~": true, "!~": true,
+	}
+	matchOps = map[remote.MatchType]string{
+		remote.MatchType_EQUAL:          "=",
+		remote.MatchType_NOT_EQUAL:      "!=",
+		remote.MatchType_REGEX_MATCH:    "=~",
+		remote.MatchType_REGEX_NO_MATCH: "!~",
+	}
+)
+
+func (e *NumberLiteral) String() string {
+	return strconv.FormatFloat(e.Val, 'f', -1, 64)
+}
+
+func (e *VectorSelector) String() string {
+	var matchers []string
+	for _, m := range e.Matchers {
+		if m.Name == prometheusNameTag && m.Type == remote.MatchType_EQUAL && m.Value == e.Name {
+			continue
+		}
+		matchers = append(matchers, fmt.Sprintf("%s%s%q", m.Name, matchOps[m.Type], m.Value))
+	}
+	s := e.Name
+	if len(matchers) > 0 {
+		s += "{" + strings.Join(matchers, ",") + "}"
+	}
+	if e.Range > 0 {
+		s += "[" + formatDuration(e.Range) + "]"
+	}
+	return s
+}
+
+func (e *Call) String() string {
+	return fmt.Sprintf("%s(%s)", e.Func, e.Arg)
+}
+
+func (e *AggregateExpr) String() string {
+	s := e.Op
+	if len(e.Grouping) > 0 || e.Without {
+		if e.Without {
+			s += " without"
+		} else {
+			s += " by"
+		}
+		s += " (" + strings.Join(e.Grouping, ", ") + ")"
+	}
+	return fmt.Sprintf("%s (%s)", s, e.Expr)
+}
+
+func (e *BinaryExpr) String() string {
+	lhs, rhs := e.LHS.String(), e.RHS.String()
+	if b, ok := e.LHS.(*BinaryExpr); ok && precedence(b.Op) < precedence(e.Op) {
+		lhs = "(" + lhs + ")"
+	}
+	if b, ok := e.RHS.(*BinaryExpr); ok && precedence(b.Op) <= precedence(e.Op) {
+		rhs = "(" + rhs + ")"
+	}
+	return fmt.Sprintf("%s %s %s", lhs, e.Op, rhs)
+}
+
+func precedence(op string) int {
+	if op == "*" || op == "/" {
+		return 2
+	}
+	return 1
+}
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenDuration
+	tokenOp
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+// lex splits the PromQL expression into tokens.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	inBrackets := false
+	for pos := 0; pos < len(input); {
+		c := input[pos]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			pos++
+		case c == '"' || c == '\'' || c == '`':
+			end := pos + 1
+			for end < len(input) && input[end] != c {
+				if input[end] == '\\' && c != '`' {
+					end++
+				}
+				end++
+			}
+			if end >= len(input) {
+				return nil, fmt.Errorf("unterminated quoted string at position %d", pos)
+			}
+			val := input[pos+1 : end]
+			if c != '`' {
+				var err error
+				if val, err = strconv.Unquote("\"" + strings.ReplaceAll(val, `\'`, `'`) + "\""); err != nil {
+					return nil, fmt.Errorf("invalid quoted string at position %d", pos)
+				}
+			}
+			tokens = append(tokens, token{tokenString, val, pos})
+			pos = end + 1
+		case inBrackets && isDigit(c):
+			end := pos
+			for end < len(input) && (isDigit(input[end]) || isLetter(input[end])) {
+				end++
+			}
+			tokens = append(tokens, token{tokenDuration, input[pos:end], pos})
+			pos = end
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			end := pos
+			for end < len(input) && (isDigit(input[end]) || input[end] == '.' || input[end] == 'e' || input[end] == 'E' ||
+				((input[end] == '+' || input[end] == '-') && (input[end-1] == 'e' || input[end-1] == 'E'))) {
+				end++
+			}
+			tokens = append(tokens, token{tokenNumber, input[pos:end], pos})
+			pos = end
+		case isLetter(c) || c == '_' || c == ':':
+			end := pos
+			for end < len(input) && (isLetter(input[end]) || isDigit(input[end]) || input[end] == '_' || input[end] == ':') {
+				end++
+			}
+			tokens = append(tokens, token{tokenIdent, input[pos:end], pos})
+			pos = end
+		default:
+			op := string(c)
+			if pos+1 < len(input) {
+				if two := input[pos : pos+2]; two == "!=" || two == "=~" || two == "!~" {
+					op = two
+				}
+			}
+			if !promOps[op] {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, pos)
+			}
+			if op == "[" {
+				inBrackets = true
+			} else if op == "]" {
+				inBrackets = false
+			}
+			tokens = append(tokens, token{tokenOp, op, pos})
+			pos += len(op)
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(input)}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// ParseExpr parses the PromQL expression of the supported subset.
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+	if err = checkRangeVector(expr, true); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// checkRangeVector checks that the range vectors are only the arguments of functions or the whole expression.
+func checkRangeVector(expr Expr, top bool) error {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		if e.Range > 0 && !top {
+			return ErrRangeVector
+		}
+	case *AggregateExpr:
+		return checkRangeVector(e.Expr, false)
+	case *BinaryExpr:
+		if err := checkRangeVector(e.LHS, false); err != nil {
+			return err
+		}
+		return checkRangeVector(e.RHS, false)
+	}
+	return nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.typ == tokenEOF {
+		return errors.New("unexpected end of input")
+	}
+	return fmt.Errorf("unexpected %q at position %d", t.val, t.pos)
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.typ != tokenOp || t.val != op {
+		return p.unexpected(t)
+	}
+	return nil
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.typ != tokenOp {
+		return false
+	}
+	for _, op := range ops {
+		if t.val == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseAdditive() (Expr, error) {
+	lhs, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+", "-") {
+		op := p.next().val
+		rhs, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseMultiplicative() (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*", "/") {
+		op := p.next().val
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.isOp("+", "-") {
+		op := p.next().val
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			return expr, nil
+		}
+		if n, ok := expr.(*NumberLiteral); ok {
+			return &NumberLiteral{Val: -n.Val}, nil
+		}
+		return &BinaryExpr{Op: "*", LHS: &NumberLiteral{Val: -1}, RHS: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+	switch t.typ {
+	case tokenNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.val, t.pos)
+		}
+		return &NumberLiteral{Val: v}, nil
+	case tokenIdent:
+		nt := p.tokens[p.pos+1]
+		if promAggregators[t.val] && (nt.typ == tokenOp && nt.val == "(" || nt.typ == tokenIdent && (nt.val == "by" || nt.val == "without")) {
+			return p.parseAggregate()
+		}
+		if promFunctions[t.val] && nt.typ == tokenOp && nt.val == "(" {
+			return p.parseCall()
+		}
+		if strings.ToLower(t.val) == "inf" || strings.ToLower(t.val) == "nan" {
+			p.next()
+			v, _ := strconv.ParseFloat(t.val, 64)
+			return &NumberLiteral{Val: v}, nil
+		}
+		return p.parseSelector()
+	case tokenOp:
+		if t.val == "(" {
+			p.next()
+			expr, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		}
+		if t.val == "{" {
+			return p.parseSelector()
+		}
+	}
+	return nil, p.unexpected(t)
+}
+
+func (p *parser) parseAggregate() (Expr, error) {
+	agg := &AggregateExpr{Op: p.next().val}
+	parsed := false
+	if p.peek().typ == tokenIdent {
+		if err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+		parsed = true
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(")"); err != nil {
+		return nil, err
+	}
+	agg.Expr = expr
+	if !parsed && p.peek().typ == tokenIdent && (p.peek().val == "by" || p.peek().val == "without") {
+		if err = p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+func (p *parser) parseGrouping(agg *AggregateExpr) error {
+	switch t := p.next(); t.val {
+	case "by":
+	case "without":
+		agg.Without = true
+	default:
+		return p.unexpected(t)
+	}
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	agg.Grouping = []string{}
+	for !p.isOp(")") {
+		t := p.next()
+		if t.typ != tokenIdent {
+			return p.unexpected(t)
+		}
+		agg.Grouping = append(agg.Grouping, t.val)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	return p.expect(")")
+}
+
+func (p *parser) parseCall() (Expr, error) {
+	call := &Call{Func: p.next().val}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	expr, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := expr.(*VectorSelector)
+	if !ok || vs.Range == 0 {
+		return nil, fmt.Errorf("expected range vector in call to function %q at position %d", call.Func, t.pos)
+	}
+	call.Arg = vs
+	if err = p.expect(")"); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+func (p *parser) parseSelector() (Expr, error) {
+	vs := &VectorSelector{}
+	if t := p.peek(); t.typ == tokenIdent {
+		p.next()
+		vs.Name = t.val
+		vs.Matchers = append(vs.Matchers, &remote.LabelMatcher{Type: remote.MatchType_EQUAL, Name: prometheusNameTag, Value: t.val})
+	}
+	if p.isOp("{") {
+		p.next()
+		for !p.isOp("}") {
+			name := p.next()
+			if name.typ != tokenIdent {
+				return nil, p.unexpected(name)
+			}
+			op := p.next()
+			mt, ok := matchTypes[op.val]
+			if op.typ != tokenOp || !ok {
+				return nil, p.unexpected(op)
+			}
+			value := p.next()
+			if value.typ != tokenString {
+				return nil, p.unexpected(value)
+			}
+			if mt == remote.MatchType_REGEX_MATCH || mt == remote.MatchType_REGEX_NO_MATCH {
+				if _, err := regexp.Compile(anchorRegex(value.val)); err != nil {
+					return nil, fmt.Errorf("invalid regex of %s: %w", name.val, err)
+				}
+			}
+			vs.Matchers = append(vs.Matchers, &remote.LabelMatcher{Type: mt, Name: name.val, Value: value.val})
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	}
+	if len(vs.Matchers) == 0 {
+		return nil, p.unexpected(p.peek())
+	}
+	if !selectsNonEmpty(vs.Matchers) {
+		return nil, errors.New("vector selector must contain at least one non-empty matcher")
+	}
+	if p.isOp("[") {
+		p.next()
+		t := p.next()
+		if t.typ != tokenDuration {
+			return nil, p.unexpected(t)
+		}
+		d, err := ParseDuration(t.val)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid range %q at position %d", t.val, t.pos)
+		}
+		vs.Range = d
+		if err = p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	return vs, nil
+}
+
+// selectsNonEmpty reports whether any matcher does not match the empty string, like prometheus.
+func selectsNonEmpty(matchers []*remote.LabelMatcher) bool {
+	for _, m := range matchers {
+		q := &remote.Query{Matchers: []*remote.LabelMatcher{{Type: m.Type, Name: prometheusNameTag, Value: m.Value}}}
+		if metrics, err := MatchMetrics(q, []string{""}); err == nil && len(metrics) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+var durationUnits = []struct {
+	unit string
+	d    time.Duration
+}{
+	{"ms", time.Millisecond},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// ParseDuration parses the duration of prometheus like 1h30m, or the float number of seconds.
+func ParseDuration(s string) (time.Duration, error) {
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v*float64(time.Second) > math.MaxInt64 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(v * float64(time.Second)), nil
+	}
+	var d time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && isDigit(rest[i]) {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[i:]
+		found := false
+		for _, u := range durationUnits {
+			if strings.HasPrefix(rest, u.unit) && !(u.unit == "m" && strings.HasPrefix(rest, "ms")) {
+				d += time.Duration(n) * u.d
+				rest = rest[len(u.unit):]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func formatDuration(d time.Duration) string {
+	if d%time.Second != 0 {
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	}
+	var sb strings.Builder
+	for i := len(durationUnits) - 1; i >= 1; i-- {
+		u := durationUnits[i]
+		if d >= u.d {
+			sb.WriteString(strconv.FormatInt(int64(d/u.d), 10) + u.unit)
+			d %= u.d
+		}
+	}
+	if sb.Len() == 0 {
+		return "0s"
+	}
+	return sb.String()
+}
+
+// ParseTime parses the time of prometheus api in rfc3339 or the float number of unix seconds.
+func ParseTime(s string) (time.Time, error) {
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e3))*int64(time.Millisecond)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
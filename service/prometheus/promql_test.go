@@ -0,0 +1,331 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+)
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		name string
+		have string
+		want string
+	}{
+		{
+			name: "selector",
+			have: `up`,
+			want: `up`,
+		},
+		{
+			name: "selector with matchers",
+			have: `http_requests_total{job="api", code!='500',path=~"/api/.+", instance!~"local.*",}`,
+			want: `http_requests_total{job="api",code!="500",path=~"/api/.+",instance!~"local.*"}`,
+		},
+		{
+			name: "selector of name matcher",
+			have: `{__name__=~"go_.*"}`,
+			want: `{__name__=~"go_.*"}`,
+		},
+		{
+			name: "range selector",
+			have: `up[1h30m]`,
+			want: `up[1h30m]`,
+		},
+		{
+			name: "rate",
+			have: `rate(http_requests_total{job="api"}[5m])`,
+			want: `rate(http_requests_total{job="api"}[5m])`,
+		},
+		{
+			name: "sum by",
+			have: `sum by (job) (rate(http_requests_total[5m]))`,
+			want: `sum by (job) (rate(http_requests_total[5m]))`,
+		},
+		{
+			name: "sum by after",
+			have: `sum(rate(http_requests_total[5m])) by (job, code)`,
+			want: `sum by (job, code) (rate(http_requests_total[5m]))`,
+		},
+		{
+			name: "avg without",
+			have: `avg without (instance) (up)`,
+			want: `avg without (instance) (up)`,
+		},
+		{
+			name: "arithmetic precedence",
+			have: `1 + 2 * up - -3 / 4`,
+			want: `1 + 2 * up - -3 / 4`,
+		},
+		{
+			name: "parentheses",
+			have: `(1 + 2) * sum(up)`,
+			want: `(1 + 2) * sum (up)`,
+		},
+		{
+			name: "right associative parentheses",
+			have: `up - (1 - 2) / (3 / 4)`,
+			want: `up - (1 - 2) / (3 / 4)`,
+		},
+		{
+			name: "unary minus",
+			have: `-up`,
+			want: `-1 * up`,
+		},
+		{
+			name: "metric named like aggregator",
+			have: `count{job="api"}`,
+			want: `count{job="api"}`,
+		},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpr(tt.have)
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		if got := expr.String(); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseExprError(t *testing.T) {
+	tests := []struct {
+		name string
+		have string
+	}{
+		{name: "empty", have: ``},
+		{name: "unclosed brace", have: `up{job="api"`},
+		{name: "unquoted value", have: `up{job=api}`},
+		{name: "empty matchers", have: `{job=""}`},
+		{name: "invalid regex", have: `up{job=~"("}`},
+		{name: "invalid range", have: `up[5x]`},
+		{name: "rate of instant vector", have: `rate(up)`},
+		{name: "range vector in arithmetic", have: `up[5m] * 2`},
+		{name: "range vector in aggregation", have: `sum(up[5m])`},
+		{name: "unsupported operator", have: `up % 2`},
+		{name: "trailing tokens", have: `up up`},
+	}
+	for _, tt := range tests {
+		if _, err := ParseExpr(tt.have); err == nil {
+			t.Errorf("%v: got nil error", tt.name)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		have string
+		want time.Duration
+	}{
+		{name: "seconds", have: "15s", want: 15 * time.Second},
+		{name: "milliseconds", have: "500ms", want: 500 * time.Millisecond},
+		{name: "compound", have: "1h30m", want: 90 * time.Minute},
+		{name: "days", have: "1d", want: 24 * time.Hour},
+		{name: "float seconds", have: "1.5", want: 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.have)
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	for _, s := range []string{"", "m", "5x", "1h5"} {
+		if _, err := ParseDuration(s); err == nil {
+			t.Errorf("%q: got nil error", s)
+		}
+	}
+}
+
+type fakeQuerier struct {
+	series []*remote.TimeSeries
+}
+
+func (fq *fakeQuerier) Select(q *remote.Query) ([]*remote.TimeSeries, error) {
+	var tss []*remote.TimeSeries
+	for _, ts := range fq.series {
+		metric := make(map[string]string)
+		for _, l := range ts.Labels {
+			metric[l.Name] = l.Value
+		}
+		matched := true
+		for _, m := range q.Matchers {
+			if m.Type == remote.MatchType_EQUAL && metric[m.Name] != m.Value {
+				matched = false
+			}
+		}
+		if !matched {
+			continue
+		}
+		nts := &remote.TimeSeries{Labels: ts.Labels}
+		for _, s := range ts.Samples {
+			if s.TimestampMs >= q.StartTimestampMs && s.TimestampMs <= q.EndTimestampMs {
+				nts.Samples = append(nts.Samples, s)
+			}
+		}
+		tss = append(tss, nts)
+	}
+	return tss, nil
+}
+
+func newFakeSeries(name, job, instance string, values ...float64) *remote.TimeSeries {
+	ts := &remote.TimeSeries{Labels: []*remote.LabelPair{
+		{Name: "__name__", Value: name},
+		{Name: "instance", Value: instance},
+		{Name: "job", Value: job},
+	}}
+	for i, v := range values {
+		ts.Samples = append(ts.Samples, &remote.Sample{Value: v, TimestampMs: int64(i) * 60000})
+	}
+	return ts
+}
+
+func TestQuery(t *testing.T) {
+	fq := &fakeQuerier{series: []*remote.TimeSeries{
+		newFakeSeries("requests", "api", "a", 0, 60, 120, 180, 240, 300),
+		newFakeSeries("requests", "api", "b", 0, 120, 240, 360, 480, 600),
+		newFakeSeries("requests", "web", "c", 100, 160, 10, 70, 130, 190),
+		newFakeSeries("limit", "api", "a", 10, 10, 10, 10, 10, 10),
+		newFakeSeries("limit", "api", "b", 20, 20, 20, 20, 20, 20),
+	}}
+	ts := time.Unix(300, 0)
+	tests := []struct {
+		name string
+		have string
+		want string
+	}{
+		{
+			name: "scalar",
+			have: `1 + 2 * 3`,
+			want: `{"resultType":"scalar","result":[300,"7"]}`,
+		},
+		{
+			name: "selector",
+			have: `requests{job="api"}`,
+			want: `{"resultType":"vector","result":[` +
+				`{"metric":{"__name__":"requests","instance":"a","job":"api"},"value":[300,"300"]},` +
+				`{"metric":{"__name__":"requests","instance":"b","job":"api"},"value":[300,"600"]}]}`,
+		},
+		{
+			name: "range selector",
+			have: `requests{instance="a"}[2m]`,
+			want: `{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"requests","instance":"a","job":"api"},"values":[[240,"240"],[300,"300"]]}]}`,
+		},
+		{
+			name: "rate",
+			have: `rate(requests{job="api"}[5m])`,
+			want: `{"resultType":"vector","result":[` +
+				`{"metric":{"instance":"a","job":"api"},"value":[300,"1"]},` +
+				`{"metric":{"instance":"b","job":"api"},"value":[300,"2"]}]}`,
+		},
+		{
+			name: "increase with counter reset",
+			have: `increase(requests{job="web"}[5m])`,
+			want: `{"resultType":"vector","result":[` +
+				`{"metric":{"instance":"c","job":"web"},"value":[300,"237.5"]}]}`,
+		},
+		{
+			name: "sum by",
+			have: `sum by (job) (increase(requests[5m]))`,
+			want: `{"resultType":"vector","result":[` +
+				`{"metric":{"job":"api"},"value":[300,"900"]},` +
+				`{"metric":{"job":"web"},"value":[300,"237.5"]}]}`,
+		},
+		{
+			name: "avg",
+			have: `avg(requests{job="api"})`,
+			want: `{"resultType":"vector","result":[{"metric":{},"value":[300,"450"]}]}`,
+		},
+		{
+			name: "min max count without",
+			have: `max without (instance) (requests) - min without (instance) (requests) + count without (instance) (requests)`,
+			want: `{"resultType":"vector","result":[` +
+				`{"metric":{"job":"api"},"value":[300,"302"]},` +
+				`{"metric":{"job":"web"},"value":[300,"1"]}]}`,
+		},
+		{
+			name: "vector and scalar",
+			have: `limit{instance="a"} * 2 + 1`,
+			want: `{"resultType":"vector","result":[{"metric":{"instance":"a","job":"api"},"value":[300,"21"]}]}`,
+		},
+		{
+			name: "vector and vector",
+			have: `requests / limit`,
+			want: `{"resultType":"vector","result":[` +
+				`{"metric":{"instance":"a","job":"api"},"value":[300,"30"]},` +
+				`{"metric":{"instance":"b","job":"api"},"value":[300,"30"]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpr(tt.have)
+		if err != nil {
+			t.Errorf("%v: got parse error %s", tt.name, err)
+			continue
+		}
+		result, err := Query(fq, expr, ts)
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+			continue
+		}
+		got, _ := json.Marshal(result)
+		if string(got) != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	fq := &fakeQuerier{series: []*remote.TimeSeries{
+		newFakeSeries("requests", "api", "a", 0, 60, 120, 180, 240, 300),
+		newFakeSeries("requests", "api", "b", 0, 120),
+	}}
+	expr, err := ParseExpr(`sum by (job) (requests) / 60`)
+	if err != nil {
+		t.Fatalf("got parse error %s", err)
+	}
+	result, err := QueryRange(fq, expr, time.Unix(0, 0), time.Unix(600, 0), 2*time.Minute)
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	want := &Result{Type: ValueTypeMatrix, Series: []*Series{{
+		Metric: map[string]string{"job": "api"},
+		Points: []Point{{0, 0}, {120000, 4}, {240000, 6}, {360000, 5}, {480000, 5}},
+	}}}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("got %v, want %v", result, want)
+	}
+
+	if err = CheckRange(expr, time.Unix(0, 0), time.Unix(MaxPoints, 0), time.Second); err != ErrTooManyPoints {
+		t.Errorf("got error %v, want %s", err, ErrTooManyPoints)
+	}
+	if err = CheckRange(expr, time.Unix(600, 0), time.Unix(0, 0), time.Second); err != ErrInvalidRange {
+		t.Errorf("got error %v, want %s", err, ErrInvalidRange)
+	}
+}
+
+func TestPointMarshalJSON(t *testing.T) {
+	tests := []struct {
+		have Point
+		want string
+	}{
+		{have: Point{T: 1700000000123, V: 1.5}, want: `[1700000000.123,"1.5"]`},
+		{have: Point{T: 1000, V: math.NaN()}, want: `[1,"NaN"]`},
+		{have: Point{T: 1000, V: math.Inf(1)}, want: `[1,"+Inf"]`},
+	}
+	for _, tt := range tests {
+		got, _ := json.Marshal(tt.have)
+		if string(got) != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package prometheus
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+)
+
+// MetricName returns the metric name of the equality matcher of __name__ in the query, or empty if there is none.
+func MetricName(q *remote.Query) string {
+	for _, m := range q.Matchers {
+		if m.Name == prometheusNameTag && m.Type == remote.MatchType_EQUAL {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+// MeasurementRegex returns the regex of the measurements which might be matched by the query,
+// or empty which means all measurements if there is no regex matcher of __name__.
+func MeasurementRegex(q *remote.Query) string {
+	for _, m := range q.Matchers {
+		if m.Name == prometheusNameTag && m.Type == remote.MatchType_REGEX_MATCH {
+			return anchorRegex(m.Value)
+		}
+	}
+	return ""
+}
+
+// MatchMetrics returns the metric names matching all the matchers of __name__ in the query.
+func MatchMetrics(q *remote.Query, names []string) ([]string, error) {
+	var matches []func(string) bool
+	for _, m := range q.Matchers {
+		if m.Name != prometheusNameTag {
+			continue
+		}
+		value := m.Value
+		switch m.Type {
+		case remote.MatchType_EQUAL:
+			matches = append(matches, func(s string) bool { return s == value })
+		case remote.MatchType_NOT_EQUAL:
+			matches = append(matches, func(s string) bool { return s != value })
+		case remote.MatchType_REGEX_MATCH, remote.MatchType_REGEX_NO_MATCH:
+			re, err := regexp.Compile(anchorRegex(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex of %s: %w", prometheusNameTag, err)
+			}
+			negative := m.Type == remote.MatchType_REGEX_NO_MATCH
+			matches = append(matches, func(s string) bool { return re.MatchString(s) != negative })
+		default:
+			return nil, fmt.Errorf("unknown match type %v", m.Type)
+		}
+	}
+
+	var metrics []string
+NAMES:
+	for _, name := range names {
+		for _, match := range matches {
+			if !match(name) {
+				continue NAMES
+			}
+		}
+		metrics = append(metrics, name)
+	}
+	return metrics, nil
+}
+
+// QueryWithMetric returns a copy of the query with the matchers of __name__ replaced by an equality matcher of name,
+// since the backends only support the query of a single metric.
+func QueryWithMetric(q *remote.Query, name string) *remote.Query {
+	nq := &remote.Query{
+		StartTimestampMs: q.StartTimestampMs,
+		EndTimestampMs:   q.EndTimestampMs,
+		Matchers:         []*remote.LabelMatcher{{Type: remote.MatchType_EQUAL, Name: prometheusNameTag, Value: name}},
+	}
+	for _, m := range q.Matchers {
+		if m.Name != prometheusNameTag {
+			nq.Matchers = append(nq.Matchers, m)
+		}
+	}
+	return nq
+}
+
+// anchorRegex anchors the regex on both ends like prometheus.
+func anchorRegex(re string) string {
+	return "^(?:" + re + ")$"
+}
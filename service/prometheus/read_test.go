@@ -0,0 +1,100 @@
+package prometheus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+)
+
+func TestMatchMetrics(t *testing.T) {
+	names := []string{"go_gc_duration_seconds", "go_goroutines", "http_requests_total", "up"}
+	tests := []struct {
+		name     string
+		matchers []*remote.LabelMatcher
+		regex    string
+		want     []string
+	}{
+		{
+			name:     "equal",
+			matchers: []*remote.LabelMatcher{{Type: remote.MatchType_EQUAL, Name: "__name__", Value: "up"}},
+			want:     []string{"up"},
+		},
+		{
+			name:     "not equal",
+			matchers: []*remote.LabelMatcher{{Type: remote.MatchType_NOT_EQUAL, Name: "__name__", Value: "up"}},
+			want:     []string{"go_gc_duration_seconds", "go_goroutines", "http_requests_total"},
+		},
+		{
+			name:     "regex",
+			matchers: []*remote.LabelMatcher{{Type: remote.MatchType_REGEX_MATCH, Name: "__name__", Value: "go_.*"}},
+			regex:    "^(?:go_.*)$",
+			want:     []string{"go_gc_duration_seconds", "go_goroutines"},
+		},
+		{
+			name:     "regex anchored",
+			matchers: []*remote.LabelMatcher{{Type: remote.MatchType_REGEX_MATCH, Name: "__name__", Value: "go"}},
+			regex:    "^(?:go)$",
+		},
+		{
+			name: "regex and negative regex",
+			matchers: []*remote.LabelMatcher{
+				{Type: remote.MatchType_REGEX_MATCH, Name: "__name__", Value: "go_.+|up"},
+				{Type: remote.MatchType_REGEX_NO_MATCH, Name: "__name__", Value: ".*seconds"},
+				{Type: remote.MatchType_EQUAL, Name: "job", Value: "node"},
+			},
+			regex: "^(?:go_.+|up)$",
+			want:  []string{"go_goroutines", "up"},
+		},
+		{
+			name:     "no metric matcher",
+			matchers: []*remote.LabelMatcher{{Type: remote.MatchType_EQUAL, Name: "job", Value: "node"}},
+			want:     names,
+		},
+	}
+	for _, tt := range tests {
+		q := &remote.Query{Matchers: tt.matchers}
+		if got := MeasurementRegex(q); got != tt.regex {
+			t.Errorf("%v: got regex %s, want %s", tt.name, got, tt.regex)
+		}
+		got, err := MatchMetrics(q, names)
+		if err != nil {
+			t.Errorf("%v: got error %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got metrics %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchMetricsError(t *testing.T) {
+	q := &remote.Query{Matchers: []*remote.LabelMatcher{{Type: remote.MatchType_REGEX_MATCH, Name: "__name__", Value: "go_("}}}
+	if _, err := MatchMetrics(q, []string{"go_goroutines"}); err == nil {
+		t.Error("got nil error, want invalid regex error")
+	}
+}
+
+func TestQueryWithMetric(t *testing.T) {
+	q := &remote.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*remote.LabelMatcher{
+			{Type: remote.MatchType_REGEX_MATCH, Name: "__name__", Value: "go_.*"},
+			{Type: remote.MatchType_EQUAL, Name: "job", Value: "node"},
+		},
+	}
+	want := &remote.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*remote.LabelMatcher{
+			{Type: remote.MatchType_EQUAL, Name: "__name__", Value: "go_goroutines"},
+			{Type: remote.MatchType_EQUAL, Name: "job", Value: "node"},
+		},
+	}
+	if got := QueryWithMetric(q, "go_goroutines"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got query %v, want %v", got, want)
+	}
+	if MetricName(want) != "go_goroutines" {
+		t.Errorf("got metric name %s, want go_goroutines", MetricName(want))
+	}
+}
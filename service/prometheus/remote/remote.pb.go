@@ -55,6 +55,49 @@ func (MatchType) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_eefc82927d57d89b, []int{0}
 }
 
+type MetricMetadata_MetricType int32
+
+const (
+	MetricMetadata_UNKNOWN        MetricMetadata_MetricType = 0
+	MetricMetadata_COUNTER        MetricMetadata_MetricType = 1
+	MetricMetadata_GAUGE          MetricMetadata_MetricType = 2
+	MetricMetadata_HISTOGRAM      MetricMetadata_MetricType = 3
+	MetricMetadata_GAUGEHISTOGRAM MetricMetadata_MetricType = 4
+	MetricMetadata_SUMMARY        MetricMetadata_MetricType = 5
+	MetricMetadata_INFO           MetricMetadata_MetricType = 6
+	MetricMetadata_STATESET       MetricMetadata_MetricType = 7
+)
+
+var MetricMetadata_MetricType_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "COUNTER",
+	2: "GAUGE",
+	3: "HISTOGRAM",
+	4: "GAUGEHISTOGRAM",
+	5: "SUMMARY",
+	6: "INFO",
+	7: "STATESET",
+}
+
+var MetricMetadata_MetricType_value = map[string]int32{
+	"UNKNOWN":        0,
+	"COUNTER":        1,
+	"GAUGE":          2,
+	"HISTOGRAM":      3,
+	"GAUGEHISTOGRAM": 4,
+	"SUMMARY":        5,
+	"INFO":           6,
+	"STATESET":       7,
+}
+
+func (x MetricMetadata_MetricType) String() string {
+	return proto.EnumName(MetricMetadata_MetricType_name, int32(x))
+}
+
+func (MetricMetadata_MetricType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_eefc82927d57d89b, []int{9, 0}
+}
+
 type Sample struct {
 	Value       float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
 	TimestampMs int64   `protobuf:"varint,2,opt,name=timestamp_ms,json=timestampMs,proto3" json:"timestamp_ms,omitempty"`
@@ -213,7 +256,8 @@ func (m *TimeSeries) GetSamples() []*Sample {
 }
 
 type WriteRequest struct {
-	Timeseries []*TimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries,omitempty"`
+	Timeseries []*TimeSeries     `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries,omitempty"`
+	Metadata   []*MetricMetadata `protobuf:"bytes,3,rep,name=metadata,proto3" json:"metadata,omitempty"`
 }
 
 func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
@@ -256,6 +300,13 @@ func (m *WriteRequest) GetTimeseries() []*TimeSeries {
 	return nil
 }
 
+func (m *WriteRequest) GetMetadata() []*MetricMetadata {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 type ReadRequest struct {
 	Queries []*Query `protobuf:"bytes,1,rep,name=queries,proto3" json:"queries,omitempty"`
 }
@@ -509,8 +560,79 @@ func (m *QueryResult) GetTimeseries() []*TimeSeries {
 	return nil
 }
 
+type MetricMetadata struct {
+	// Represents the metric type, these match the set from Prometheus.
+	// Refer to github.com/prometheus/common/model/metric_type.go for details.
+	Type             MetricMetadata_MetricType `protobuf:"varint,1,opt,name=type,proto3,enum=remote.MetricMetadata_MetricType" json:"type,omitempty"`
+	MetricFamilyName string                    `protobuf:"bytes,2,opt,name=metric_family_name,json=metricFamilyName,proto3" json:"metric_family_name,omitempty"`
+	Help             string                    `protobuf:"bytes,4,opt,name=help,proto3" json:"help,omitempty"`
+	Unit             string                    `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+}
+
+func (m *MetricMetadata) Reset()         { *m = MetricMetadata{} }
+func (m *MetricMetadata) String() string { return proto.CompactTextString(m) }
+func (*MetricMetadata) ProtoMessage()    {}
+func (*MetricMetadata) Descriptor() ([]byte, []int) {
+	return fileDescriptor_eefc82927d57d89b, []int{9}
+}
+func (m *MetricMetadata) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *MetricMetadata) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_MetricMetadata.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *MetricMetadata) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MetricMetadata.Merge(m, src)
+}
+func (m *MetricMetadata) XXX_Size() int {
+	return m.Size()
+}
+func (m *MetricMetadata) XXX_DiscardUnknown() {
+	xxx_messageInfo_MetricMetadata.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MetricMetadata proto.InternalMessageInfo
+
+func (m *MetricMetadata) GetType() MetricMetadata_MetricType {
+	if m != nil {
+		return m.Type
+	}
+	return MetricMetadata_UNKNOWN
+}
+
+func (m *MetricMetadata) GetMetricFamilyName() string {
+	if m != nil {
+		return m.MetricFamilyName
+	}
+	return ""
+}
+
+func (m *MetricMetadata) GetHelp() string {
+	if m != nil {
+		return m.Help
+	}
+	return ""
+}
+
+func (m *MetricMetadata) GetUnit() string {
+	if m != nil {
+		return m.Unit
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterEnum("remote.MatchType", MatchType_name, MatchType_value)
+	proto.RegisterEnum("remote.MetricMetadata_MetricType", MetricMetadata_MetricType_name, MetricMetadata_MetricType_value)
 	proto.RegisterType((*Sample)(nil), "remote.Sample")
 	proto.RegisterType((*LabelPair)(nil), "remote.LabelPair")
 	proto.RegisterType((*TimeSeries)(nil), "remote.TimeSeries")
@@ -520,41 +642,52 @@ func init() {
 	proto.RegisterType((*Query)(nil), "remote.Query")
 	proto.RegisterType((*LabelMatcher)(nil), "remote.LabelMatcher")
 	proto.RegisterType((*QueryResult)(nil), "remote.QueryResult")
+	proto.RegisterType((*MetricMetadata)(nil), "remote.MetricMetadata")
 }
 
 func init() { proto.RegisterFile("remote.proto", fileDescriptor_eefc82927d57d89b) }
 
 var fileDescriptor_eefc82927d57d89b = []byte{
-	// 457 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x53, 0xc1, 0x6e, 0xd3, 0x40,
-	0x10, 0xcd, 0x26, 0x4d, 0x82, 0xc7, 0x6e, 0x08, 0x43, 0x0f, 0x3e, 0x59, 0xc1, 0x12, 0xc2, 0x20,
-	0xa8, 0x50, 0x11, 0xdc, 0x38, 0xa4, 0x28, 0x02, 0xa1, 0xa6, 0xa5, 0x5b, 0x23, 0xb8, 0x59, 0x5b,
-	0x32, 0x12, 0x96, 0xec, 0xc4, 0xdd, 0x5d, 0x23, 0xe5, 0x2f, 0xe0, 0xaf, 0x38, 0xf6, 0xc8, 0x11,
-	0x25, 0x3f, 0x82, 0xb2, 0x1b, 0x3b, 0x8e, 0xd4, 0x13, 0xb7, 0xcc, 0xbc, 0xf7, 0x66, 0x5e, 0xf6,
-	0x8d, 0xc1, 0x93, 0x94, 0x2f, 0x34, 0x1d, 0x17, 0x72, 0xa1, 0x17, 0xd8, 0xb3, 0x55, 0x38, 0x86,
-	0xde, 0x95, 0xc8, 0x8b, 0x8c, 0xf0, 0x08, 0xba, 0x3f, 0x44, 0x56, 0x92, 0xcf, 0x46, 0x2c, 0x62,
-	0xdc, 0x16, 0xf8, 0x08, 0x3c, 0x9d, 0xe6, 0xa4, 0xb4, 0xc8, 0x8b, 0x24, 0x57, 0x7e, 0x7b, 0xc4,
-	0xa2, 0x0e, 0x77, 0xeb, 0xde, 0x54, 0x85, 0xaf, 0xc1, 0x39, 0x13, 0xd7, 0x94, 0x7d, 0x12, 0xa9,
-	0x44, 0x84, 0x83, 0xb9, 0xc8, 0xed, 0x10, 0x87, 0x9b, 0xdf, 0xbb, 0xc9, 0x6d, 0xd3, 0xb4, 0x45,
-	0x28, 0x00, 0xe2, 0x34, 0xa7, 0x2b, 0x92, 0x29, 0x29, 0x7c, 0x0a, 0xbd, 0x6c, 0x33, 0x44, 0xf9,
-	0x6c, 0xd4, 0x89, 0xdc, 0x93, 0x07, 0xc7, 0x5b, 0xbb, 0xf5, 0x68, 0xbe, 0x25, 0x60, 0x04, 0x7d,
-	0x65, 0x2c, 0x6f, 0xdc, 0x6c, 0xb8, 0x83, 0x8a, 0x6b, 0xff, 0x09, 0xaf, 0xe0, 0xf0, 0x14, 0xbc,
-	0x2f, 0x32, 0xd5, 0xc4, 0xe9, 0xa6, 0x24, 0xa5, 0xf1, 0x04, 0xc0, 0x18, 0x37, 0x2b, 0xb7, 0x8b,
-	0xb0, 0x12, 0xef, 0xcc, 0xf0, 0x06, 0x2b, 0x7c, 0x03, 0x2e, 0x27, 0x31, 0xab, 0x46, 0x3c, 0x81,
-	0xfe, 0x4d, 0xd9, 0xd4, 0x1f, 0x56, 0xfa, 0xcb, 0x92, 0xe4, 0x92, 0x57, 0x68, 0xf8, 0x16, 0x3c,
-	0xab, 0x53, 0xc5, 0x62, 0xae, 0x08, 0x5f, 0x40, 0x5f, 0x92, 0x2a, 0x33, 0x5d, 0x09, 0x1f, 0xee,
-	0x0b, 0x0d, 0xc6, 0x2b, 0x4e, 0xf8, 0x8b, 0x41, 0xd7, 0x00, 0xf8, 0x1c, 0x50, 0x69, 0x21, 0x75,
-	0xb2, 0x97, 0x03, 0x33, 0x39, 0x0c, 0x0d, 0x12, 0xef, 0xc2, 0xc0, 0x08, 0x86, 0x34, 0x9f, 0x25,
-	0x77, 0x64, 0x36, 0xa0, 0xf9, 0xac, 0xc9, 0x7c, 0x09, 0xf7, 0x72, 0xa1, 0xbf, 0x7d, 0x27, 0xa9,
-	0xfc, 0x8e, 0x71, 0x74, 0xb4, 0xf7, 0xe6, 0x53, 0x0b, 0xf2, 0x9a, 0x15, 0x26, 0xe0, 0x35, 0x11,
-	0x7c, 0x0c, 0x07, 0x7a, 0x59, 0xd8, 0xac, 0x07, 0xbb, 0xc4, 0x0c, 0x1c, 0x2f, 0x0b, 0xe2, 0x06,
-	0xae, 0x4f, 0xa2, 0x7d, 0xd7, 0x49, 0x74, 0x9a, 0x27, 0x31, 0x06, 0xb7, 0xf1, 0x18, 0xff, 0x13,
-	0xd7, 0xb3, 0x8f, 0xe0, 0xd4, 0xfb, 0xd1, 0x81, 0xee, 0xe4, 0xf2, 0xf3, 0xf8, 0x6c, 0xd8, 0xc2,
-	0x43, 0x70, 0xce, 0x2f, 0xe2, 0xc4, 0x96, 0x0c, 0xef, 0x83, 0xcb, 0x27, 0xef, 0x27, 0x5f, 0x93,
-	0xe9, 0x38, 0x7e, 0xf7, 0x61, 0xd8, 0x46, 0x84, 0x81, 0x6d, 0x9c, 0x5f, 0x6c, 0x7b, 0x9d, 0x53,
-	0xff, 0xf7, 0x2a, 0x60, 0xb7, 0xab, 0x80, 0xfd, 0x5d, 0x05, 0xec, 0xe7, 0x3a, 0x68, 0xdd, 0xae,
-	0x83, 0xd6, 0x9f, 0x75, 0xd0, 0xba, 0xee, 0x99, 0x8f, 0xe8, 0xd5, 0xbf, 0x00, 0x00, 0x00, 0xff,
-	0xff, 0x2a, 0xc9, 0xc7, 0x07, 0x54, 0x03, 0x00, 0x00,
+	// 622 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0xcd, 0x6e, 0xd3, 0x4c,
+	0x14, 0x8d, 0x7f, 0xf2, 0x77, 0x93, 0xe6, 0xf3, 0x77, 0xa9, 0x90, 0x57, 0x51, 0x6b, 0x09, 0x11,
+	0x50, 0xa9, 0x50, 0x51, 0xd9, 0xb1, 0x30, 0x95, 0x9b, 0xb6, 0xd4, 0x0e, 0x9d, 0x38, 0x2a, 0xac,
+	0xac, 0x69, 0x33, 0xa8, 0x96, 0xec, 0xc4, 0xb5, 0x27, 0x48, 0x91, 0x78, 0x08, 0xd8, 0xf1, 0x48,
+	0x2c, 0xbb, 0x64, 0x89, 0xda, 0x17, 0x41, 0x9e, 0xb1, 0x13, 0x47, 0xea, 0x8a, 0xdd, 0xdc, 0x73,
+	0xce, 0xfd, 0xf3, 0xb9, 0x32, 0x74, 0x53, 0x16, 0xcf, 0x39, 0xdb, 0x4f, 0xd2, 0x39, 0x9f, 0x63,
+	0x43, 0x46, 0x96, 0x0d, 0x8d, 0x31, 0x8d, 0x93, 0x88, 0xe1, 0x36, 0xd4, 0xbf, 0xd2, 0x68, 0xc1,
+	0x4c, 0x65, 0x47, 0x19, 0x28, 0x44, 0x06, 0xb8, 0x0b, 0x5d, 0x1e, 0xc6, 0x2c, 0xe3, 0x34, 0x4e,
+	0x82, 0x38, 0x33, 0xd5, 0x1d, 0x65, 0xa0, 0x91, 0xce, 0x0a, 0x73, 0x33, 0xeb, 0x10, 0xda, 0xe7,
+	0xf4, 0x8a, 0x45, 0x1f, 0x69, 0x98, 0x22, 0x82, 0x3e, 0xa3, 0xb1, 0x2c, 0xd2, 0x26, 0xe2, 0xbd,
+	0xae, 0xac, 0x0a, 0x50, 0x06, 0x16, 0x05, 0xf0, 0xc3, 0x98, 0x8d, 0x59, 0x1a, 0xb2, 0x0c, 0x5f,
+	0x40, 0x23, 0xca, 0x8b, 0x64, 0xa6, 0xb2, 0xa3, 0x0d, 0x3a, 0x07, 0xff, 0xef, 0x17, 0xe3, 0xae,
+	0x4a, 0x93, 0x42, 0x80, 0x03, 0x68, 0x66, 0x62, 0xe4, 0x7c, 0x9a, 0x5c, 0xdb, 0x2b, 0xb5, 0x72,
+	0x13, 0x52, 0xd2, 0xd6, 0x37, 0xe8, 0x5e, 0xa6, 0x21, 0x67, 0x84, 0xdd, 0x2e, 0x58, 0xc6, 0xf1,
+	0x00, 0x40, 0x0c, 0x2e, 0x5a, 0x16, 0x8d, 0xb0, 0x4c, 0x5e, 0x0f, 0x43, 0x2a, 0x2a, 0x3c, 0x80,
+	0x56, 0xcc, 0x38, 0x9d, 0x52, 0x4e, 0x4d, 0x4d, 0x64, 0x3c, 0x2d, 0x33, 0x5c, 0xc6, 0xd3, 0xf0,
+	0xda, 0x2d, 0x58, 0xb2, 0xd2, 0x9d, 0xe9, 0x2d, 0xd5, 0xd0, 0xac, 0xb7, 0xd0, 0x21, 0x8c, 0x4e,
+	0xcb, 0xe6, 0xcf, 0xa1, 0x79, 0xbb, 0xa8, 0x76, 0xde, 0x2a, 0xeb, 0x5c, 0x2c, 0x58, 0xba, 0x24,
+	0x25, 0x6b, 0xbd, 0x83, 0xae, 0xcc, 0xcb, 0x92, 0xf9, 0x2c, 0x63, 0xf8, 0x0a, 0x9a, 0x29, 0xcb,
+	0x16, 0x11, 0x2f, 0x13, 0x9f, 0x6c, 0x26, 0x0a, 0x8e, 0x94, 0x1a, 0xeb, 0x87, 0x02, 0x75, 0x41,
+	0xe0, 0x1e, 0x60, 0xc6, 0x69, 0xca, 0x83, 0x0d, 0x07, 0x15, 0xe1, 0xa0, 0x21, 0x18, 0x7f, 0x6d,
+	0x23, 0x0e, 0xc0, 0x60, 0xb3, 0x69, 0xf0, 0x88, 0xdb, 0x3d, 0x36, 0x9b, 0x56, 0x95, 0xaf, 0xa1,
+	0x15, 0x53, 0x7e, 0x7d, 0xc3, 0xd2, 0xac, 0xf8, 0x24, 0xdb, 0x1b, 0x6e, 0xb9, 0x92, 0x24, 0x2b,
+	0x95, 0x15, 0x40, 0xb7, 0xca, 0xe0, 0x33, 0xd0, 0xf9, 0x32, 0x91, 0x57, 0xd2, 0x5b, 0x7b, 0x2d,
+	0x68, 0x7f, 0x99, 0x30, 0x22, 0xe8, 0xd5, 0x31, 0xa9, 0x8f, 0x1d, 0x93, 0x56, 0x3d, 0x26, 0x1b,
+	0x3a, 0x95, 0x8f, 0xf1, 0x2f, 0x46, 0x5b, 0x3f, 0x55, 0xe8, 0x6d, 0x3a, 0x8a, 0x87, 0x1b, 0x63,
+	0xee, 0x3e, 0xee, 0x7b, 0x11, 0x56, 0xc6, 0xde, 0x03, 0x8c, 0x05, 0x16, 0x7c, 0xa1, 0x71, 0x18,
+	0x2d, 0x83, 0xca, 0x12, 0x86, 0x64, 0x8e, 0x05, 0xe1, 0xe5, 0x0b, 0x21, 0xe8, 0x37, 0x2c, 0x4a,
+	0x4c, 0x5d, 0x2e, 0x99, 0xbf, 0x73, 0x6c, 0x31, 0x0b, 0xb9, 0x59, 0x97, 0x58, 0xfe, 0xb6, 0x96,
+	0x00, 0xeb, 0x4e, 0xd8, 0x81, 0xe6, 0xc4, 0xfb, 0xe0, 0x8d, 0x2e, 0x3d, 0xa3, 0x96, 0x07, 0x47,
+	0xa3, 0x89, 0xe7, 0x3b, 0xc4, 0x50, 0xb0, 0x0d, 0xf5, 0xa1, 0x3d, 0x19, 0x3a, 0x86, 0x8a, 0x5b,
+	0xd0, 0x3e, 0x39, 0x1d, 0xfb, 0xa3, 0x21, 0xb1, 0x5d, 0x43, 0x43, 0x84, 0x9e, 0x60, 0xd6, 0x98,
+	0x9e, 0xa7, 0x8e, 0x27, 0xae, 0x6b, 0x93, 0xcf, 0x46, 0x1d, 0x5b, 0xa0, 0x9f, 0x7a, 0xc7, 0x23,
+	0xa3, 0x81, 0x5d, 0x68, 0x8d, 0x7d, 0xdb, 0x77, 0xc6, 0x8e, 0x6f, 0x34, 0x5f, 0x9e, 0x41, 0x7b,
+	0x65, 0x4d, 0x5e, 0xdf, 0xb9, 0x98, 0xd8, 0xe7, 0x46, 0x2d, 0xaf, 0xef, 0x8d, 0xfc, 0x40, 0x86,
+	0x0a, 0xfe, 0x07, 0x1d, 0xe2, 0x0c, 0x9d, 0x4f, 0x81, 0x6b, 0xfb, 0x47, 0x27, 0x86, 0x9a, 0x37,
+	0x94, 0x80, 0x37, 0x2a, 0x30, 0xed, 0xbd, 0xf9, 0xeb, 0xbe, 0xaf, 0xdc, 0xdd, 0xf7, 0x95, 0x3f,
+	0xf7, 0x7d, 0xe5, 0xfb, 0x43, 0xbf, 0x76, 0xf7, 0xd0, 0xaf, 0xfd, 0x7e, 0xe8, 0xd7, 0xae, 0x1a,
+	0xe2, 0xcf, 0xf4, 0xe6, 0xef, 0x00, 0x5c, 0x42, 0xe5, 0x67, 0xa9, 0x04, 0x00, 0x00,
 }
 
 func (m *Sample) Marshal() (dAtA []byte, err error) {
@@ -699,6 +832,20 @@ func (m *WriteRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Metadata) > 0 {
+		for iNdEx := len(m.Metadata) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Metadata[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRemote(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x1a
+		}
+	}
 	if len(m.Timeseries) > 0 {
 		for iNdEx := len(m.Timeseries) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -916,6 +1063,55 @@ func (m *QueryResult) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *MetricMetadata) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *MetricMetadata) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *MetricMetadata) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Unit) > 0 {
+		i -= len(m.Unit)
+		copy(dAtA[i:], m.Unit)
+		i = encodeVarintRemote(dAtA, i, uint64(len(m.Unit)))
+		i--
+		dAtA[i] = 0x2a
+	}
+	if len(m.Help) > 0 {
+		i -= len(m.Help)
+		copy(dAtA[i:], m.Help)
+		i = encodeVarintRemote(dAtA, i, uint64(len(m.Help)))
+		i--
+		dAtA[i] = 0x22
+	}
+	if len(m.MetricFamilyName) > 0 {
+		i -= len(m.MetricFamilyName)
+		copy(dAtA[i:], m.MetricFamilyName)
+		i = encodeVarintRemote(dAtA, i, uint64(len(m.MetricFamilyName)))
+		i--
+		dAtA[i] = 0x12
+	}
+	if m.Type != 0 {
+		i = encodeVarintRemote(dAtA, i, uint64(m.Type))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintRemote(dAtA []byte, offset int, v uint64) int {
 	offset -= sovRemote(v)
 	base := offset
@@ -992,6 +1188,12 @@ func (m *WriteRequest) Size() (n int) {
 			n += 1 + l + sovRemote(uint64(l))
 		}
 	}
+	if len(m.Metadata) > 0 {
+		for _, e := range m.Metadata {
+			l = e.Size()
+			n += 1 + l + sovRemote(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1081,6 +1283,30 @@ func (m *QueryResult) Size() (n int) {
 	return n
 }
 
+func (m *MetricMetadata) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Type != 0 {
+		n += 1 + sovRemote(uint64(m.Type))
+	}
+	l = len(m.MetricFamilyName)
+	if l > 0 {
+		n += 1 + l + sovRemote(uint64(l))
+	}
+	l = len(m.Help)
+	if l > 0 {
+		n += 1 + l + sovRemote(uint64(l))
+	}
+	l = len(m.Unit)
+	if l > 0 {
+		n += 1 + l + sovRemote(uint64(l))
+	}
+	return n
+}
+
 func sovRemote(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -1462,6 +1688,40 @@ func (m *WriteRequest) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metadata", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Metadata = append(m.Metadata, &MetricMetadata{})
+			if err := m.Metadata[len(m.Metadata)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRemote(dAtA[iNdEx:])
@@ -1990,6 +2250,171 @@ func (m *QueryResult) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *MetricMetadata) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRemote
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: MetricMetadata: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: MetricMetadata: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+			}
+			m.Type = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Type |= MetricMetadata_MetricType(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MetricFamilyName", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.MetricFamilyName = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Help", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Help = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Unit", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Unit = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRemote(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipRemote(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -0,0 +1,177 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+// maxUDPPayload is the max size of a udp packet payload
+const maxUDPPayload = 64 * 1024
+
+var (
+	udpPacketsReceived = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "influx_proxy_udp_packets_received_total",
+		Help: "Number of packets received by udp listener.",
+	}, []string{"bind_addr"})
+	udpPacketsDropped = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "influx_proxy_udp_packets_dropped_total",
+		Help: "Number of packets dropped by udp listener since too many packets are pending.",
+	}, []string{"bind_addr"})
+	udpBytesReceived = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "influx_proxy_udp_bytes_received_total",
+		Help: "Number of bytes received by udp listener.",
+	}, []string{"bind_addr"})
+	udpPointsDropped = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "influx_proxy_udp_points_dropped_total",
+		Help: "Number of points dropped by udp listener due to write errors.",
+	}, []string{"bind_addr"})
+)
+
+// LinesWriter writes the line protocol p to database db and retention policy rp.
+type LinesWriter interface {
+	Write(p []byte, db, rp, precision string) error
+	IsForbiddenDB(db string) bool
+}
+
+// UDPService receives line protocol from udp packets and writes them in batches to the proxy with fixed db, rp and precision.
+type UDPService struct {
+	cfg     *backend.UDPConfig
+	w       LinesWriter
+	conn    *net.UDPConn
+	packets chan []byte
+	wg      sync.WaitGroup
+}
+
+func NewUDPService(cfg *backend.UDPConfig, w LinesWriter) *UDPService {
+	return &UDPService{
+		cfg:     cfg,
+		w:       w,
+		packets: make(chan []byte, cfg.BatchPending),
+	}
+}
+
+func (us *UDPService) Open() (err error) {
+	addr, err := net.ResolveUDPAddr("udp", us.cfg.BindAddr)
+	if err != nil {
+		return
+	}
+	us.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return
+	}
+	if us.cfg.ReadBuffer > 0 {
+		err = us.conn.SetReadBuffer(us.cfg.ReadBuffer)
+		if err != nil {
+			us.conn.Close()
+			return
+		}
+	}
+	log.Printf("udp service start, listen on %s, db: %s, rp: %s, precision: %s", us.cfg.BindAddr, us.cfg.Database, us.cfg.RetentionPolicy, us.cfg.Precision)
+	us.wg.Add(2)
+	go us.serve()
+	go us.process()
+	return
+}
+
+// Close stops receiving packets, and writes the pending packets to the proxy.
+func (us *UDPService) Close() {
+	if us.conn == nil {
+		return
+	}
+	us.conn.Close()
+	us.wg.Wait()
+}
+
+func (us *UDPService) serve() {
+	defer us.wg.Done()
+	defer close(us.packets)
+	received := udpPacketsReceived.WithLabelValues(us.cfg.BindAddr)
+	dropped := udpPacketsDropped.WithLabelValues(us.cfg.BindAddr)
+	bytesReceived := udpBytesReceived.WithLabelValues(us.cfg.BindAddr)
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, _, err := us.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("udp read error: %s, bind_addr: %s", err, us.cfg.BindAddr)
+			continue
+		}
+		received.Inc()
+		bytesReceived.Add(float64(n))
+		if n == 0 {
+			continue
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		select {
+		case us.packets <- packet:
+		default:
+			dropped.Inc()
+		}
+	}
+}
+
+func (us *UDPService) process() {
+	defer us.wg.Done()
+	var batch bytes.Buffer
+	lines := 0
+	ticker := time.NewTicker(time.Duration(us.cfg.BatchTimeout) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case packet, ok := <-us.packets:
+			if !ok {
+				us.write(&batch)
+				return
+			}
+			batch.Write(packet)
+			if packet[len(packet)-1] != '\n' {
+				batch.WriteByte('\n')
+			}
+			lines += bytes.Count(packet, []byte{'\n'}) + 1
+			if lines >= us.cfg.BatchSize {
+				us.write(&batch)
+				lines = 0
+			}
+		case <-ticker.C:
+			us.write(&batch)
+			lines = 0
+		}
+	}
+}
+
+func (us *UDPService) write(batch *bytes.Buffer) {
+	if batch.Len() == 0 {
+		return
+	}
+	defer batch.Reset()
+	dropped := udpPointsDropped.WithLabelValues(us.cfg.BindAddr)
+	if us.w.IsForbiddenDB(us.cfg.Database) {
+		log.Printf("udp write error: database forbidden: %s, bind_addr: %s", us.cfg.Database, us.cfg.BindAddr)
+		dropped.Add(float64(len(backend.SplitLines(batch.Bytes()))))
+		return
+	}
+	err := us.w.Write(batch.Bytes(), us.cfg.Database, us.cfg.RetentionPolicy, us.cfg.Precision)
+	if err != nil {
+		log.Printf("udp write error: %s, bind_addr: %s", err, us.cfg.BindAddr)
+		var perr *backend.PartialWriteError
+		if errors.As(err, &perr) {
+			dropped.Add(float64(perr.Dropped))
+		} else {
+			dropped.Add(float64(len(backend.SplitLines(batch.Bytes()))))
+		}
+	}
+}
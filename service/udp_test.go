@@ -0,0 +1,144 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type testLinesWriter struct {
+	lock    sync.Mutex
+	batches []string
+	err     error
+	block   chan struct{}
+	blocked chan struct{}
+	written chan struct{}
+}
+
+func newTestLinesWriter() *testLinesWriter {
+	return &testLinesWriter{written: make(chan struct{}, 100)}
+}
+
+func (tw *testLinesWriter) Write(p []byte, db, rp, precision string) error {
+	if tw.block != nil {
+		tw.blocked <- struct{}{}
+		<-tw.block
+	}
+	tw.lock.Lock()
+	tw.batches = append(tw.batches, string(p))
+	tw.lock.Unlock()
+	tw.written <- struct{}{}
+	return tw.err
+}
+
+func (tw *testLinesWriter) IsForbiddenDB(db string) bool {
+	return false
+}
+
+func (tw *testLinesWriter) Batches() []string {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	return append([]string(nil), tw.batches...)
+}
+
+// openTestUDP opens the udp service on a loopback port, and returns the connection sending packets to it.
+func openTestUDP(t *testing.T, cfg *backend.UDPConfig, tw *testLinesWriter) (*UDPService, *net.UDPConn) {
+	us := NewUDPService(cfg, tw)
+	if err := us.Open(); err != nil {
+		t.Fatalf("open error: %s", err)
+	}
+	conn, err := net.DialUDP("udp", nil, us.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return us, conn
+}
+
+func waitWritten(t *testing.T, tw *testLinesWriter) {
+	select {
+	case <-tw.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for write")
+	}
+}
+
+func waitCounter(t *testing.T, c prometheus.Counter, want float64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(c) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for counter %v", want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPServiceBatch(t *testing.T) {
+	cfg := &backend.UDPConfig{BindAddr: "127.0.0.1:0", Database: "udp", Precision: "s", BatchSize: 3, BatchPending: 10, BatchTimeout: 60}
+	received := udpPacketsReceived.WithLabelValues(cfg.BindAddr)
+	base := testutil.ToFloat64(received)
+	tw := newTestLinesWriter()
+	us, conn := openTestUDP(t, cfg, tw)
+	for _, packet := range []string{"cpu value=1", "cpu value=2\ncpu value=3\n", "cpu value=4"} {
+		if _, err := conn.Write([]byte(packet)); err != nil {
+			t.Fatalf("write error: %s", err)
+		}
+	}
+	// the first batch is written once the batch size is reached, the rest is written on close
+	waitWritten(t, tw)
+	waitCounter(t, received, base+3)
+	us.Close()
+	want := []string{"cpu value=1\ncpu value=2\ncpu value=3\n", "cpu value=4\n"}
+	got := tw.Batches()
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got batches %q, want %q", got, want)
+	}
+}
+
+func TestUDPServiceDropped(t *testing.T) {
+	cfg := &backend.UDPConfig{BindAddr: "127.0.0.1:0", Database: "udp", BatchSize: 1, BatchPending: 1, BatchTimeout: 60}
+	received := udpPacketsReceived.WithLabelValues(cfg.BindAddr)
+	packetsDropped := udpPacketsDropped.WithLabelValues(cfg.BindAddr)
+	pointsDropped := udpPointsDropped.WithLabelValues(cfg.BindAddr)
+	base := []float64{testutil.ToFloat64(received), testutil.ToFloat64(packetsDropped), testutil.ToFloat64(pointsDropped)}
+	tw := newTestLinesWriter()
+	tw.block = make(chan struct{})
+	tw.blocked = make(chan struct{}, 2)
+	tw.err = errors.New("backend unavailable")
+	us, conn := openTestUDP(t, cfg, tw)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write([]byte("cpu value=1\ncpu value=2")); err != nil {
+			t.Fatalf("write error: %s", err)
+		}
+		if i == 0 {
+			<-tw.blocked
+		}
+	}
+	// the writer is blocked by the first packet and the second one is pending, the others are dropped
+	waitCounter(t, received, base[0]+5)
+	close(tw.block)
+	us.Close()
+	if got := testutil.ToFloat64(packetsDropped) - base[1]; got != 3 {
+		t.Errorf("got %v packets dropped, want 3", got)
+	}
+	// the points of the written packets are dropped by the write error
+	if got := testutil.ToFloat64(pointsDropped) - base[2]; got != 4 {
+		t.Errorf("got %v points dropped, want 4", got)
+	}
+}
+
+func TestUDPServiceCloseUnopened(t *testing.T) {
+	us := NewUDPService(&backend.UDPConfig{BindAddr: "127.0.0.1:0", BatchPending: 1}, newTestLinesWriter())
+	us.Close()
+}
@@ -6,6 +6,7 @@ package transfer
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/chengshiwen/influx-proxy/backend"
 )
@@ -21,30 +22,77 @@ type Stats struct {
 
 type CircleState struct {
 	*backend.Circle
-	Stats        map[string]*Stats
-	Transferring bool
+	lock         sync.RWMutex
+	stats        map[string]*Stats
+	transferring bool
 	wg           sync.WaitGroup
 }
 
 func NewCircleState(cfg *backend.CircleConfig, circle *backend.Circle) (cs *CircleState) {
 	cs = &CircleState{
-		Circle:       circle,
-		Stats:        make(map[string]*Stats),
-		Transferring: false,
+		Circle: circle,
+		stats:  make(map[string]*Stats),
 	}
 	for _, bkcfg := range cfg.Backends {
-		cs.Stats[bkcfg.Url] = &Stats{}
+		cs.stats[bkcfg.Url] = &Stats{}
 	}
 	return
 }
 
+// GetStats returns the stats of backend url, which is created if not exists.
+func (cs *CircleState) GetStats(url string) *Stats {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	stats, ok := cs.stats[url]
+	if !ok {
+		stats = &Stats{}
+		cs.stats[url] = stats
+	}
+	return stats
+}
+
+// SyncStats keeps the stats of backend urls only, the missing ones are created.
+func (cs *CircleState) SyncStats(urls []string) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	stats := make(map[string]*Stats, len(urls))
+	for _, url := range urls {
+		if s, ok := cs.stats[url]; ok {
+			stats[url] = s
+		} else {
+			stats[url] = &Stats{}
+		}
+	}
+	cs.stats = stats
+}
+
+// CopyStats returns a copy of the stats of all backends.
+func (cs *CircleState) CopyStats() map[string]*Stats {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	stats := make(map[string]*Stats, len(cs.stats))
+	for url, s := range cs.stats {
+		stats[url] = &Stats{
+			DatabaseTotal:    atomic.LoadInt32(&s.DatabaseTotal),
+			DatabaseDone:     atomic.LoadInt32(&s.DatabaseDone),
+			MeasurementTotal: atomic.LoadInt32(&s.MeasurementTotal),
+			MeasurementDone:  atomic.LoadInt32(&s.MeasurementDone),
+			TransferCount:    atomic.LoadInt32(&s.TransferCount),
+			InPlaceCount:     atomic.LoadInt32(&s.InPlaceCount),
+		}
+	}
+	return stats
+}
+
 func (cs *CircleState) ResetStates() {
-	for _, s := range cs.Stats {
-		s.DatabaseTotal = 0
-		s.DatabaseDone = 0
-		s.MeasurementTotal = 0
-		s.MeasurementDone = 0
-		s.TransferCount = 0
-		s.InPlaceCount = 0
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	for _, s := range cs.stats {
+		atomic.StoreInt32(&s.DatabaseTotal, 0)
+		atomic.StoreInt32(&s.DatabaseDone, 0)
+		atomic.StoreInt32(&s.MeasurementTotal, 0)
+		atomic.StoreInt32(&s.MeasurementDone, 0)
+		atomic.StoreInt32(&s.TransferCount, 0)
+		atomic.StoreInt32(&s.InPlaceCount, 0)
 	}
 }
@@ -33,6 +33,9 @@ var (
 	DefaultBatch  = 20000
 	DefaultSince  = int64(0)
 	tlog          = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	ErrResyncing    = errors.New("proxy is resyncing")
+	ErrTransferring = errors.New("proxy is transferring or resyncing")
 )
 
 type QueryResult struct {
@@ -53,8 +56,11 @@ type Transfer struct {
 	Worker       int
 	Batch        int
 	Since        int64
-	Resyncing    bool
 	HaAddrs      []string
+
+	// lock guards the resyncing and transferring states, so that they are checked and set at once
+	lock      sync.RWMutex
+	resyncing bool
 }
 
 func NewTransfer(cfg *backend.ProxyConfig, circles []*backend.Circle, getKeyFn func(string, string) string) (tx *Transfer) {
@@ -72,6 +78,80 @@ func NewTransfer(cfg *backend.ProxyConfig, circles []*backend.Circle, getKeyFn f
 	return
 }
 
+// State returns whether the proxy is resyncing and whether each circle is transferring.
+func (tx *Transfer) State() (resyncing bool, transferring []bool) {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	transferring = make([]bool, len(tx.CircleStates))
+	for i, cs := range tx.CircleStates {
+		transferring[i] = cs.transferring
+	}
+	return tx.resyncing, transferring
+}
+
+func (tx *Transfer) SetResyncing(resyncing bool) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.resyncing = resyncing
+}
+
+func (tx *Transfer) SetTransferring(cs *CircleState, transferring bool) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	cs.transferring = transferring
+	cs.SetTransferIn(transferring)
+}
+
+// Reserve marks the circle of circleId as transferring, it returns an error instead if the proxy is resyncing,
+// or the circle or any circle of checkIds is transferring.
+func (tx *Transfer) Reserve(circleId int, checkIds ...int) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.resyncing {
+		return ErrResyncing
+	}
+	for _, id := range append([]int{circleId}, checkIds...) {
+		if tx.CircleStates[id].transferring {
+			return fmt.Errorf("circle %d is transferring", id)
+		}
+	}
+	cs := tx.CircleStates[circleId]
+	cs.transferring = true
+	cs.SetTransferIn(true)
+	return nil
+}
+
+// ReserveResync marks the proxy as resyncing, it returns an error instead if the proxy is resyncing or any circle is transferring.
+func (tx *Transfer) ReserveResync() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.resyncing {
+		return ErrResyncing
+	}
+	for _, cs := range tx.CircleStates {
+		if cs.transferring {
+			return fmt.Errorf("circle %d is transferring", cs.CircleId)
+		}
+	}
+	tx.resyncing = true
+	return nil
+}
+
+// RunIdle runs fn if the proxy is neither transferring nor resyncing, and no transfer can be reserved until fn returns.
+func (tx *Transfer) RunIdle(fn func() error) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.resyncing {
+		return ErrTransferring
+	}
+	for _, cs := range tx.CircleStates {
+		if cs.transferring {
+			return ErrTransferring
+		}
+	}
+	return fn()
+}
+
 func (tx *Transfer) resetCircleStates() {
 	for _, cs := range tx.CircleStates {
 		cs.ResetStates()
@@ -103,7 +183,7 @@ func (tx *Transfer) getRetentionPolicies(db string) []string {
 	rps := make([]string, 0)
 	rpm := make(map[string]bool)
 	for _, cs := range tx.CircleStates {
-		for _, be := range cs.Backends {
+		for _, be := range cs.Backends() {
 			if be.IsActive() {
 				for _, rp := range be.GetRetentionPolicies(db) {
 					if _, ok := rpm[rp]; !ok {
@@ -121,7 +201,7 @@ func (tx *Transfer) getDatabases() []string {
 	dbs := make([]string, 0)
 	dbm := make(map[string]bool)
 	for _, cs := range tx.CircleStates {
-		for _, be := range cs.Backends {
+		for _, be := range cs.Backends() {
 			if be.IsActive() {
 				for _, db := range be.GetDatabases() {
 					if _, ok := dbm[db]; !ok {
@@ -142,7 +222,7 @@ func (tx *Transfer) createDatabases(dbs []string) ([]string, error) {
 	if len(dbs) > 0 {
 		backends := make([]*backend.Backend, 0)
 		for _, cs := range tx.CircleStates {
-			backends = append(backends, cs.Backends...)
+			backends = append(backends, cs.Backends()...)
 		}
 		// create database
 		for _, db := range dbs {
@@ -387,8 +467,8 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 		return
 	}
 
-	stats := cs.Stats[be.Url]
-	stats.DatabaseTotal = int32(len(dbs))
+	stats := cs.GetStats(be.Url)
+	atomic.StoreInt32(&stats.DatabaseTotal, int32(len(dbs)))
 	mms := make([][]string, len(dbs))
 	var wg sync.WaitGroup
 	for i, db := range dbs {
@@ -400,7 +480,7 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 	}
 	wg.Wait()
 	for i := range mms {
-		stats.MeasurementTotal += int32(len(mms[i]))
+		atomic.AddInt32(&stats.MeasurementTotal, int32(len(mms[i])))
 	}
 
 	for i, db := range dbs {
@@ -417,7 +497,12 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 	}
 }
 
+// Rebalance transfers the measurements of backends to the right backends of the circle of circleId,
+// the circle should be reserved by Reserve in advance and is released once done.
 func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []string) { //nolint:all
+	cs := tx.CircleStates[circleId]
+	tx.broadcastTransferring(cs, true)
+	defer tx.broadcastTransferring(cs, false)
 	tx.setLogOutput("rebalance.log")
 	dbs, err := tx.createDatabases(dbs)
 	if err != nil || len(dbs) == 0 {
@@ -430,10 +515,7 @@ func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []s
 	}
 	defer tx.pool.Release()
 	tlog.Printf("rebalance start: circle %d", circleId)
-	cs := tx.CircleStates[circleId]
 	tx.resetCircleStates()
-	tx.broadcastTransferring(cs, true)
-	defer tx.broadcastTransferring(cs, false)
 
 	for _, be := range backends {
 		cs.wg.Add(1)
@@ -454,7 +536,13 @@ func (tx *Transfer) runRebalance(cs *CircleState, be *backend.Backend, db string
 	return
 }
 
+// Recovery transfers the measurements from the circle of fromCircleId to backendUrls of the circle of toCircleId,
+// the circle of toCircleId should be reserved by Reserve in advance and is released once done.
 func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string, dbs []string) { //nolint:all
+	fcs := tx.CircleStates[fromCircleId]
+	tcs := tx.CircleStates[toCircleId]
+	tx.broadcastTransferring(tcs, true)
+	defer tx.broadcastTransferring(tcs, false)
 	tx.setLogOutput("recovery.log")
 	dbs, err := tx.createDatabases(dbs)
 	if err != nil || len(dbs) == 0 {
@@ -467,11 +555,7 @@ func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string,
 	}
 	defer tx.pool.Release()
 	tlog.Printf("recovery start: circle from %d to %d", fromCircleId, toCircleId)
-	fcs := tx.CircleStates[fromCircleId]
-	tcs := tx.CircleStates[toCircleId]
 	tx.resetCircleStates()
-	tx.broadcastTransferring(tcs, true)
-	defer tx.broadcastTransferring(tcs, false)
 
 	backendUrlSet := util.NewSet() //nolint:all
 	if len(backendUrls) != 0 {
@@ -479,11 +563,11 @@ func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string,
 			backendUrlSet.Add(u)
 		}
 	} else {
-		for _, b := range tcs.Backends {
+		for _, b := range tcs.Backends() {
 			backendUrlSet.Add(b.Url)
 		}
 	}
-	for _, be := range fcs.Backends {
+	for _, be := range fcs.Backends() {
 		fcs.wg.Add(1)
 		go tx.runTransfer(fcs, be, dbs, tx.runRecovery, tcs, backendUrlSet)
 	}
@@ -504,7 +588,11 @@ func (tx *Transfer) runRecovery(fcs *CircleState, be *backend.Backend, db string
 	return
 }
 
+// Resync transfers the measurements between all circles, the proxy should be reserved by ReserveResync
+// in advance and is released once done.
 func (tx *Transfer) Resync(dbs []string) {
+	tx.broadcastResyncing(true)
+	defer tx.broadcastResyncing(false)
 	tx.setLogOutput("resync.log")
 	dbs, err := tx.createDatabases(dbs)
 	if err != nil || len(dbs) == 0 {
@@ -518,12 +606,10 @@ func (tx *Transfer) Resync(dbs []string) {
 	defer tx.pool.Release()
 	tlog.Printf("resync start")
 	tx.resetCircleStates()
-	tx.broadcastResyncing(true)
-	defer tx.broadcastResyncing(false)
 
 	for _, cs := range tx.CircleStates {
 		tlog.Printf("resync start: circle %d", cs.CircleId)
-		for _, be := range cs.Backends {
+		for _, be := range cs.Backends() {
 			cs.wg.Add(1)
 			go tx.runTransfer(cs, be, dbs, tx.runResync)
 		}
@@ -550,7 +636,12 @@ func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, m
 	return
 }
 
+// Cleanup drops the measurements which don't belong to the backends of the circle of circleId,
+// the circle should be reserved by Reserve in advance and is released once done.
 func (tx *Transfer) Cleanup(circleId int) { //nolint:all
+	cs := tx.CircleStates[circleId]
+	tx.broadcastTransferring(cs, true)
+	defer tx.broadcastTransferring(cs, false)
 	tx.setLogOutput("cleanup.log")
 	var err error
 	tx.pool, err = ants.NewPool(tx.Worker)
@@ -560,12 +651,9 @@ func (tx *Transfer) Cleanup(circleId int) { //nolint:all
 	}
 	defer tx.pool.Release()
 	tlog.Printf("cleanup start: circle %d", circleId)
-	cs := tx.CircleStates[circleId]
 	tx.resetCircleStates()
-	tx.broadcastTransferring(cs, true)
-	defer tx.broadcastTransferring(cs, false)
 
-	for _, be := range cs.Backends {
+	for _, be := range cs.Backends() {
 		dbs := be.GetDatabases()
 		if len(dbs) > 0 {
 			cs.wg.Add(1)
@@ -591,7 +679,7 @@ func (tx *Transfer) runCleanup(cs *CircleState, be *backend.Backend, db string,
 }
 
 func (tx *Transfer) broadcastResyncing(resyncing bool) {
-	tx.Resyncing = resyncing
+	tx.SetResyncing(resyncing)
 	client := backend.NewClient(tx.httpsEnabled, 10)
 	for _, addr := range tx.HaAddrs {
 		url := fmt.Sprintf("http://%s/transfer/state?resyncing=%t", addr, resyncing)
@@ -600,8 +688,7 @@ func (tx *Transfer) broadcastResyncing(resyncing bool) {
 }
 
 func (tx *Transfer) broadcastTransferring(cs *CircleState, transferring bool) {
-	cs.Transferring = transferring
-	cs.SetTransferIn(transferring)
+	tx.SetTransferring(cs, transferring)
 	client := backend.NewClient(tx.httpsEnabled, 10)
 	for _, addr := range tx.HaAddrs {
 		url := fmt.Sprintf("http://%s/transfer/state?circle_id=%d&transferring=%t", addr, cs.CircleId, transferring)
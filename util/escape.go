@@ -13,6 +13,7 @@ var (
 	measurementUnescaper = strings.NewReplacer(`\,`, `,`, `\ `, ` `)
 	tagEscaper           = strings.NewReplacer(`,`, `\,`, ` `, `\ `, `=`, `\=`)
 	tagUnescaper         = strings.NewReplacer(`\,`, `,`, `\ `, ` `, `\=`, `=`)
+	stringEscaper        = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
 )
 
 func EscapeIdentifier(in string) string {
@@ -47,3 +48,25 @@ func UnescapeTag(in string) string {
 	}
 	return tagUnescaper.Replace(in)
 }
+
+func EscapeString(in string) string {
+	return stringEscaper.Replace(in)
+}
+
+// EscapeRegex escapes the slashes of regex in to be quoted by slashes, the slashes escaped already are kept as is.
+func EscapeRegex(in string) string {
+	if strings.IndexByte(in, '/') == -1 {
+		return in
+	}
+	var b strings.Builder
+	b.Grow(len(in) + 2)
+	escaped := false
+	for i := 0; i < len(in); i++ {
+		if in[i] == '/' && !escaped {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(in[i])
+		escaped = in[i] == '\\' && !escaped
+	}
+	return b.String()
+}